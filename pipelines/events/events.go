@@ -0,0 +1,138 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package events parses the events reported by the pipelines API into
+// structured values.
+//
+// The human readable event descriptions may change at any time, so programs
+// should rely on the parsed details instead of matching description strings.
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	genomics "google.golang.org/api/genomics/v2alpha1"
+)
+
+// Event is a pipeline event with its details decoded.
+type Event struct {
+	Timestamp   time.Time
+	Description string
+
+	// Details holds a pointer to one of the genomics event types (such as
+	// *genomics.ContainerStoppedEvent) or nil if the event type is not known.
+	Details interface{}
+
+	// Raw holds the undecoded event details.
+	Raw json.RawMessage
+}
+
+// ActionID returns the (1-based) index of the action the event refers to, or
+// zero if the event does not refer to an action.
+func (e *Event) ActionID() int64 {
+	switch details := e.Details.(type) {
+	case *genomics.ContainerStartedEvent:
+		return details.ActionId
+	case *genomics.ContainerStoppedEvent:
+		return details.ActionId
+	case *genomics.ContainerKilledEvent:
+		return details.ActionId
+	case *genomics.UnexpectedExitStatusEvent:
+		return details.ActionId
+	}
+	return 0
+}
+
+// IsFailure returns true if the event reports a warning or failure (as
+// opposed to routine progress).
+func (e *Event) IsFailure() bool {
+	switch details := e.Details.(type) {
+	case *genomics.FailedEvent, *genomics.UnexpectedExitStatusEvent, *genomics.ContainerKilledEvent, *genomics.DelayedEvent:
+		return true
+	case *genomics.ContainerStoppedEvent:
+		return details.ExitStatus != 0
+	}
+	return false
+}
+
+// Parse decodes a single event.  Events with unknown detail types are
+// returned with nil details.
+func Parse(event *genomics.Event) (*Event, error) {
+	timestamp, err := time.Parse(time.RFC3339Nano, event.Timestamp)
+	if err != nil {
+		return nil, fmt.Errorf("parsing timestamp: %v", err)
+	}
+
+	e := &Event{
+		Timestamp:   timestamp,
+		Description: event.Description,
+		Raw:         json.RawMessage(event.Details),
+	}
+	if len(event.Details) == 0 {
+		return e, nil
+	}
+
+	var header struct {
+		Type string `json:"@type"`
+	}
+	if err := json.Unmarshal(event.Details, &header); err != nil {
+		return nil, fmt.Errorf("parsing details: %v", err)
+	}
+
+	switch header.Type[strings.LastIndex(header.Type, ".")+1:] {
+	case "WorkerAssignedEvent":
+		e.Details = &genomics.WorkerAssignedEvent{}
+	case "WorkerReleasedEvent":
+		e.Details = &genomics.WorkerReleasedEvent{}
+	case "PullStartedEvent":
+		e.Details = &genomics.PullStartedEvent{}
+	case "PullStoppedEvent":
+		e.Details = &genomics.PullStoppedEvent{}
+	case "ContainerStartedEvent":
+		e.Details = &genomics.ContainerStartedEvent{}
+	case "ContainerStoppedEvent":
+		e.Details = &genomics.ContainerStoppedEvent{}
+	case "ContainerKilledEvent":
+		e.Details = &genomics.ContainerKilledEvent{}
+	case "UnexpectedExitStatusEvent":
+		e.Details = &genomics.UnexpectedExitStatusEvent{}
+	case "DelayedEvent":
+		e.Details = &genomics.DelayedEvent{}
+	case "FailedEvent":
+		e.Details = &genomics.FailedEvent{}
+	default:
+		return e, nil
+	}
+
+	if err := json.Unmarshal(event.Details, e.Details); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", header.Type, err)
+	}
+	return e, nil
+}
+
+// ParseAll decodes the events from an operation's metadata.  The API returns
+// events in reverse chronological order: the returned events are sorted from
+// oldest to newest.  Events that cannot be parsed are skipped.
+func ParseAll(events []*genomics.Event) []*Event {
+	var parsed []*Event
+	for i := len(events) - 1; i >= 0; i-- {
+		if e, err := Parse(events[i]); err == nil {
+			parsed = append(parsed, e)
+		}
+	}
+	return parsed
+}
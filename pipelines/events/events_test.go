@@ -0,0 +1,49 @@
+package events
+
+import (
+	"testing"
+
+	genomics "google.golang.org/api/genomics/v2alpha1"
+)
+
+func TestParse(t *testing.T) {
+	event := &genomics.Event{
+		Timestamp:   "2018-10-01T12:00:00.5Z",
+		Description: "Stopped running \"bash\"",
+		Details:     []byte(`{"@type": "type.googleapis.com/google.genomics.v2alpha1.ContainerStoppedEvent", "actionId": 2, "exitStatus": 1, "stderr": "oops"}`),
+	}
+
+	e, err := Parse(event)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	details, ok := e.Details.(*genomics.ContainerStoppedEvent)
+	if !ok {
+		t.Fatalf("Unexpected details type: %T", e.Details)
+	}
+	if details.ExitStatus != 1 || details.Stderr != "oops" {
+		t.Fatalf("Unexpected details: %+v", details)
+	}
+	if got, want := e.ActionID(), int64(2); got != want {
+		t.Fatalf("Unexpected action ID: got %d, want %d", got, want)
+	}
+	if !e.IsFailure() {
+		t.Fatalf("Expected a non-zero exit status to be a failure")
+	}
+}
+
+func TestParseUnknown(t *testing.T) {
+	event := &genomics.Event{
+		Timestamp: "2018-10-01T12:00:00Z",
+		Details:   []byte(`{"@type": "type.googleapis.com/google.genomics.v2alpha1.SomethingNewEvent"}`),
+	}
+
+	e, err := Parse(event)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if e.Details != nil {
+		t.Fatalf("Unexpected details: %+v", e.Details)
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package bundle provides a sub-tool for exporting everything needed to
+// reproduce a pipeline run into a single archive.
+//
+// The archive contains:
+//
+//	request.json     the pipeline request, with images pinned to digests
+//	script.sh        the script the pipeline was created from (if known)
+//	parameters.json  the environment variables and labels of the pipeline
+//	manifest.json    the operation status, images, outputs and log locations
+//	events.json      the events reported for the operation
+//
+// The pipeline can be run again using 'pipelines run request.json'.
+package bundle
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/common"
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/selector"
+	genomics "google.golang.org/api/genomics/v2alpha1"
+)
+
+var (
+	flags  = flag.NewFlagSet("", flag.ExitOnError)
+	target = selector.New(flags)
+)
+
+type manifest struct {
+	Operation  string
+	CreateTime string
+	StartTime  string `json:",omitempty"`
+	EndTime    string `json:",omitempty"`
+	Done       bool
+	Error      *genomics.Status `json:",omitempty"`
+
+	// Images maps the image names used by the pipeline to the pinned names
+	// used in request.json.
+	Images map[string]string
+
+	Outputs []string `json:",omitempty"`
+	Logs    []string `json:",omitempty"`
+}
+
+type parameters struct {
+	Environment map[string]string
+	Labels      map[string]string
+}
+
+func Invoke(ctx context.Context, service *genomics.Service, project string, arguments []string) error {
+	name, arguments, err := target.Take(ctx, service, project, common.ParseFlags(flags, arguments))
+	if err != nil {
+		return err
+	}
+	if len(arguments) != 1 {
+		return errors.New("expecting an operation name and an output filename")
+	}
+	lro, metadata, err := common.GetOperation(ctx, service, name)
+	if err != nil {
+		return err
+	}
+	pipeline := metadata.Pipeline
+	if pipeline == nil {
+		return fmt.Errorf("operation %q has no pipeline", name)
+	}
+
+	m := manifest{
+		Operation:  lro.Name,
+		CreateTime: metadata.CreateTime,
+		StartTime:  metadata.StartTime,
+		EndTime:    metadata.EndTime,
+		Done:       lro.Done,
+		Error:      lro.Error,
+		Images:     make(map[string]string),
+		Outputs:    common.Outputs(pipeline),
+		Logs:       logLocations(pipeline),
+	}
+
+	for _, action := range pipeline.Actions {
+		pinned, ok := m.Images[action.ImageUri]
+		if !ok {
+			pinned, err = common.PinImage(ctx, action.ImageUri)
+			if err != nil {
+				fmt.Printf("Failed to pin %q (leaving it unchanged): %v\n", action.ImageUri, err)
+				pinned = action.ImageUri
+			}
+			m.Images[action.ImageUri] = pinned
+		}
+		action.ImageUri = pinned
+	}
+
+	files := make(map[string]interface{})
+	files["request.json"] = &genomics.RunPipelineRequest{Pipeline: pipeline, Labels: metadata.Labels}
+	files["parameters.json"] = parameters{Environment: pipeline.Environment, Labels: metadata.Labels}
+	files["manifest.json"] = m
+	files["events.json"] = metadata.Events
+
+	f, err := os.Create(arguments[1])
+	if err != nil {
+		return fmt.Errorf("creating bundle: %v", err)
+	}
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+
+	for _, filename := range []string{"request.json", "parameters.json", "manifest.json", "events.json"} {
+		encoded, err := json.MarshalIndent(files[filename], "", "  ")
+		if err != nil {
+			return fmt.Errorf("encoding %s: %v", filename, err)
+		}
+		if err := writeFile(tw, filename, append(encoded, '\n')); err != nil {
+			return err
+		}
+	}
+	if script := common.Script(pipeline); script != "" {
+		if err := writeFile(tw, "script.sh", []byte(script)); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("writing bundle: %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("writing bundle: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("writing bundle: %v", err)
+	}
+
+	fmt.Printf("Bundle written to %q\n", arguments[1])
+	return nil
+}
+
+func writeFile(tw *tar.Writer, filename string, data []byte) error {
+	header := &tar.Header{
+		Name:    filename,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return fmt.Errorf("writing %s: %v", filename, err)
+	}
+	if _, err := tw.Write(data); err != nil {
+		return fmt.Errorf("writing %s: %v", filename, err)
+	}
+	return nil
+}
+
+// logLocations returns the GCS paths that the pipeline log is copied to.
+func logLocations(pipeline *genomics.Pipeline) []string {
+	var locations []string
+	for _, action := range pipeline.Actions {
+		var copiesLog bool
+		for _, argument := range action.Commands {
+			if strings.Contains(argument, "/google/logs") {
+				copiesLog = true
+			}
+		}
+		if !copiesLog {
+			continue
+		}
+		for _, argument := range action.Commands {
+			for _, field := range strings.Fields(argument) {
+				if strings.HasPrefix(field, "gs://") {
+					locations = append(locations, field)
+				}
+			}
+		}
+	}
+	return locations
+}
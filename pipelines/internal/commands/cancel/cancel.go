@@ -13,25 +13,118 @@
 // limitations under the License.
 
 // Package cancel provides a sub-tool for cancelling running pipelines.
+//
+// Either a single operation name may be given, or the --older-than flag may be
+// used to cancel every running operation that was created more than the given
+// duration ago (optionally restricted to operations with the labels given by
+// --label).  This protects against pipelines that were started without
+// waiting for them and then forgotten.
 package cancel
 
 import (
 	"context"
 	"errors"
+	"flag"
 	"fmt"
 	"net/http"
+	"os"
+	"time"
 
 	"github.com/googlegenomics/pipelines-tools/pipelines/internal/common"
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/printer"
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/selector"
 	genomics "google.golang.org/api/genomics/v2alpha1"
 	"google.golang.org/api/googleapi"
 )
 
+var (
+	labels = make(map[string]string)
+
+	flags  = flag.NewFlagSet("", flag.ExitOnError)
+	target = selector.New(flags)
+	out    = printer.New(flags, nil)
+
+	olderThan = flags.String("older-than", "", "cancel all running operations created before this long ago (e.g. 12h)")
+	dryRun    = flags.Bool("dry-run", false, "show the operations that would be cancelled without cancelling them")
+)
+
+func init() {
+	flags.Var(&common.MapFlagValue{Values: labels}, "label", "only cancel operations with this label when using --older-than")
+}
+
 func Invoke(ctx context.Context, service *genomics.Service, project string, arguments []string) error {
-	if len(arguments) < 1 {
-		return errors.New("missing operation name")
+	names := common.ParseFlags(flags, arguments)
+	if err := out.Validate(); err != nil {
+		return err
+	}
+
+	if *olderThan != "" {
+		if len(names) > 0 {
+			return errors.New("operation names cannot be combined with --older-than")
+		}
+		return sweep(ctx, service, project)
+	}
+
+	names, err := target.All(ctx, service, project, names)
+	if err != nil {
+		return err
+	}
+	var records []printer.Record
+	for _, name := range names {
+		if err := cancel(ctx, service, name); err != nil {
+			return err
+		}
+		if out.Default() {
+			fmt.Printf("Operation %q cancelled\n", name)
+		}
+		records = append(records, printer.Record{"name": name, "result": "cancelled"})
 	}
+	if out.Default() {
+		return nil
+	}
+	return out.Print(os.Stdout, []string{"name", "result"}, records)
+}
+
+// sweep cancels the running operations that match the age and label filters.
+func sweep(ctx context.Context, service *genomics.Service, project string) error {
+	age, err := common.ParseDuration(*olderThan)
+	if err != nil {
+		return fmt.Errorf("parsing --older-than: %v", err)
+	}
+	cutoff := time.Now().Add(-age).UTC().Format(time.RFC3339)
+
+	filter := common.AndFilters(common.LabelFilter(labels), fmt.Sprintf("metadata.createTime < %q", cutoff), "done = false")
 
-	name := common.ExpandOperationName(project, arguments[0])
+	result := "cancelled"
+	if *dryRun {
+		result = "would be cancelled"
+	}
+
+	var records []printer.Record
+	err = common.ListOperations(ctx, service, project, filter, func(operation *genomics.Operation, metadata *genomics.Metadata) error {
+		if out.Default() {
+			fmt.Printf("%s (created %s)\n", operation.Name, metadata.CreateTime)
+		}
+		if !*dryRun {
+			if err := cancel(ctx, service, operation.Name); err != nil {
+				return err
+			}
+		}
+		records = append(records, printer.Record{"name": operation.Name, "created": metadata.CreateTime, "result": result})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if !out.Default() {
+		return out.Print(os.Stdout, []string{"name", "created", "result"}, records)
+	}
+	fmt.Printf("%d operations %s\n", len(records), result)
+	return nil
+}
+
+func cancel(ctx context.Context, service *genomics.Service, name string) error {
 	req := &genomics.CancelOperationRequest{}
 	if _, err := service.Projects.Operations.Cancel(name, req).Context(ctx).Do(); err != nil {
 		if err, ok := err.(*googleapi.Error); ok && err.Code == http.StatusNotFound {
@@ -39,7 +132,5 @@ func Invoke(ctx context.Context, service *genomics.Service, project string, argu
 		}
 		return err
 	}
-
-	fmt.Println("Operation cancelled")
 	return nil
 }
@@ -0,0 +1,168 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cleanup provides a sub-tool for deleting the outputs of old
+// pipelines.
+package cleanup
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/common"
+	genomics "google.golang.org/api/genomics/v2alpha1"
+	"google.golang.org/api/googleapi"
+	storage "google.golang.org/api/storage/v1"
+)
+
+var (
+	labels = make(map[string]string)
+
+	flags = flag.NewFlagSet("", flag.ExitOnError)
+
+	olderThan = flags.String("older-than", "", "only clean up operations created before this long ago (e.g. 30d)")
+	dryRun    = flags.Bool("dry-run", false, "show the objects that would be deleted without deleting them")
+)
+
+func init() {
+	flags.Var(&common.MapFlagValue{Values: labels}, "label", "only clean up operations with this label (e.g. name=nightly)")
+}
+
+// Invoke deletes the GCS outputs (including logs) recorded in the output
+// manifest of completed operations that match the label and age filters.
+func Invoke(ctx context.Context, service *genomics.Service, project string, arguments []string) error {
+	flags.Parse(arguments)
+
+	if *olderThan == "" {
+		return errors.New("--older-than is required")
+	}
+	age, err := common.ParseDuration(*olderThan)
+	if err != nil {
+		return fmt.Errorf("parsing --older-than: %v", err)
+	}
+	cutoff := time.Now().Add(-age).UTC().Format(time.RFC3339)
+
+	storageService, err := common.NewStorageService(ctx)
+	if err != nil {
+		return err
+	}
+
+	filter := common.AndFilters(common.LabelFilter(labels), fmt.Sprintf("metadata.createTime < %q", cutoff), "done = true")
+
+	var count int
+	err = common.ListOperations(ctx, service, project, filter, func(operation *genomics.Operation, metadata *genomics.Metadata) error {
+		end, err := time.Parse(time.RFC3339Nano, metadata.EndTime)
+		if err != nil {
+			fmt.Printf("Skipping %q: no end time\n", operation.Name)
+			return nil
+		}
+		for _, output := range common.Outputs(metadata.Pipeline) {
+			n, err := deleteOutput(ctx, storageService, output, end)
+			if err != nil {
+				return fmt.Errorf("cleaning up %q: %v", operation.Name, err)
+			}
+			count += n
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if *dryRun {
+		fmt.Printf("%d objects would be deleted\n", count)
+	} else {
+		fmt.Printf("%d objects deleted\n", count)
+	}
+	return nil
+}
+
+// deleteOutput deletes the objects written to a single output destination,
+// which may be a directory ('/*') or a tree ('/**').  Objects that were updated
+// after the operation ended (for example, by a later run writing to the same
+// path) are kept.
+func deleteOutput(ctx context.Context, service *storage.Service, output string, end time.Time) (int, error) {
+	bucket, object, err := common.ParseGCSPath(strings.TrimRight(output, "*"))
+	if err != nil {
+		return 0, err
+	}
+
+	var objects []*storage.Object
+	if !strings.HasSuffix(output, "*") {
+		item, err := service.Objects.Get(bucket, object).Context(ctx).Do()
+		if err != nil {
+			if err, ok := err.(*googleapi.Error); ok && err.Code == http.StatusNotFound {
+				return 0, nil
+			}
+			return 0, fmt.Errorf("getting %q: %v", output, err)
+		}
+		objects = append(objects, item)
+	} else {
+		call := service.Objects.List(bucket).Prefix(object)
+		if !strings.HasSuffix(output, "**") {
+			call = call.Delimiter("/")
+		}
+		err = call.Pages(ctx, func(resp *storage.Objects) error {
+			objects = append(objects, resp.Items...)
+			return nil
+		})
+		if err != nil {
+			return 0, fmt.Errorf("listing %q: %v", output, err)
+		}
+	}
+
+	var count int
+	for _, object := range objects {
+		if !writtenBefore(object, end) {
+			fmt.Printf("Keeping gs://%s/%s: updated after the operation ended\n", bucket, object.Name)
+			continue
+		}
+		n, err := deleteObject(ctx, service, object)
+		if err != nil {
+			return count, err
+		}
+		count += n
+	}
+	return count, nil
+}
+
+// writtenBefore returns true if the object was last updated at or before end.
+func writtenBefore(object *storage.Object, end time.Time) bool {
+	updated, err := time.Parse(time.RFC3339Nano, object.Updated)
+	return err == nil && !updated.After(end)
+}
+
+// deleteObject deletes the generation of the object that was examined, so that
+// an object that is rewritten in the meantime is kept.
+func deleteObject(ctx context.Context, service *storage.Service, object *storage.Object) (int, error) {
+	path := fmt.Sprintf("gs://%s/%s", object.Bucket, object.Name)
+	if *dryRun {
+		fmt.Println(path)
+		return 1, nil
+	}
+	call := service.Objects.Delete(object.Bucket, object.Name).IfGenerationMatch(object.Generation)
+	if err := call.Context(ctx).Do(); err != nil {
+		if err, ok := err.(*googleapi.Error); ok && (err.Code == http.StatusNotFound || err.Code == http.StatusPreconditionFailed) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("deleting %q: %v", path, err)
+	}
+	fmt.Println("Deleted", path)
+	return 1, nil
+}
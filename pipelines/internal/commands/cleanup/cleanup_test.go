@@ -0,0 +1,27 @@
+package cleanup
+
+import (
+	"testing"
+	"time"
+
+	storage "google.golang.org/api/storage/v1"
+)
+
+func TestWrittenBefore(t *testing.T) {
+	end := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		updated string
+		want    bool
+	}{
+		{"2018-06-01T11:59:59.5Z", true},
+		{"2018-06-01T12:00:00Z", true},
+		{"2018-06-01T12:00:00.001Z", false},
+		{"2018-07-01T00:00:00Z", false},
+		{"", false},
+	}
+	for _, tc := range testCases {
+		if got := writtenBefore(&storage.Object{Updated: tc.updated}, end); got != tc.want {
+			t.Errorf("writtenBefore(%q): got %t, want %t", tc.updated, got, tc.want)
+		}
+	}
+}
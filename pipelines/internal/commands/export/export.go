@@ -21,11 +21,15 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"strings"
 	"time"
 
 	"cloud.google.com/go/bigquery"
 	"cloud.google.com/go/civil"
+	"github.com/googlegenomics/pipelines-tools/pipelines/events"
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/common"
 	genomics "google.golang.org/api/genomics/v2alpha1"
+	"google.golang.org/api/iterator"
 )
 
 var (
@@ -34,7 +38,11 @@ var (
 	filter      = flags.String("filter", "", "the export filter")
 	datasetName = flags.String("dataset", "", "the dataset to export to which must already exist")
 	tableName   = flags.String("table", "", "the table to export to")
-	update      = flags.Bool("update", true, "only export operations newer than those already exported")
+	update      = flags.Bool("update", true, "skip operations that are already in the table (see --lookback)")
+	lookback    = flags.String("lookback", "7d", "with --update and without --since, how long before the newest exported operation to look for operations that finished since the last export")
+	bqTable     = flags.String("bigquery", "", "the table ([PROJECT.]DATASET.TABLE) to export to, instead of --dataset and --table")
+	since       = flags.String("since", "", "only export operations created after this time (RFC3339) or this long ago (e.g. 30d)")
+	running     = flags.Bool("running", false, "also export operations that have not finished (their rows are not updated when they do)")
 )
 
 type row struct {
@@ -56,6 +64,12 @@ type row struct {
 	Zones       []string
 	MachineType string
 	Preemptible bool
+
+	// Zone is the zone the worker was assigned in and ExitStatus is the exit
+	// status of the action that failed (or zero if the operation succeeded).
+	// Both are nullable so that they can be added to existing tables.
+	Zone       string `bigquery:",nullable"`
+	ExitStatus bigquery.NullInt64
 }
 
 type status struct {
@@ -75,21 +89,34 @@ type label struct {
 func Invoke(ctx context.Context, service *genomics.Service, project string, arguments []string) error {
 	flags.Parse(arguments)
 
-	if *datasetName == "" || *tableName == "" {
-		return errors.New("dataset and table are required")
+	bqProject, dataset, tableID, err := destination(project)
+	if err != nil {
+		return err
+	}
+
+	filters := []string{*filter}
+	if !*running {
+		filters = append(filters, "done = true")
+	}
+	var sinceTime time.Time
+	if *since != "" {
+		sinceTime, err = common.ParseTime(*since, time.Now())
+		if err != nil {
+			return fmt.Errorf("parsing --since: %v", err)
+		}
+		filters = append(filters, fmt.Sprintf("metadata.createTime > %q", sinceTime.UTC().Format(time.RFC3339)))
 	}
 
 	path := fmt.Sprintf("projects/%s/operations", project)
 	call := service.Projects.Operations.List(path).Context(ctx)
 	call.PageSize(256)
 
-	bq, err := bigquery.NewClient(ctx, project)
+	bq, err := bigquery.NewClient(ctx, bqProject)
 	if err != nil {
 		return fmt.Errorf("creating BigQuery client: %v", err)
 	}
 
-	dataset := bq.Dataset(*datasetName)
-	if _, err := dataset.Metadata(ctx); err != nil {
+	if _, err := bq.Dataset(dataset).Metadata(ctx); err != nil {
 		return fmt.Errorf("looking up dataset: %v", err)
 	}
 
@@ -98,27 +125,42 @@ func Invoke(ctx context.Context, service *genomics.Service, project string, argu
 		return fmt.Errorf("inferring schema: %v", err)
 	}
 
-	f := *filter
-	table := dataset.Table(*tableName)
-	if _, err := table.Metadata(ctx); err != nil {
+	table := bq.Dataset(dataset).Table(tableID)
+	exported := make(map[string]bool)
+	if metadata, err := table.Metadata(ctx); err != nil {
 		if err := table.Create(ctx, &bigquery.TableMetadata{Schema: schema}); err != nil {
 			return fmt.Errorf("creating table: %v", err)
 		}
-	} else if *update {
-		timestamp, err := latestTimestamp(ctx, bq, project)
-		if err != nil {
-			return fmt.Errorf("retrieving latest timestamp: %v", err)
+	} else {
+		if err := addMissingColumns(ctx, table, metadata, schema); err != nil {
+			return err
 		}
-		if timestamp != "" {
-			expr := fmt.Sprintf(`metadata.createTime > %q`, timestamp)
-			if f != "" {
-				f = fmt.Sprintf("(%s) AND %s", f, expr)
-			} else {
-				f = expr
+		if *update {
+			// Operations that finish after newer ones were exported
+			// would be missed by comparing creation times, so the
+			// operations in a window are compared by name instead.
+			start := sinceTime
+			if *since == "" {
+				window, err := common.ParseDuration(*lookback)
+				if err != nil {
+					return fmt.Errorf("parsing --lookback: %v", err)
+				}
+				latest, err := latestTimestamp(ctx, bq, table)
+				if err != nil {
+					return fmt.Errorf("retrieving latest timestamp: %v", err)
+				}
+				if !latest.IsZero() {
+					start = latest.Add(-window)
+					filters = append(filters, fmt.Sprintf("metadata.createTime > %q", start.Format(time.RFC3339)))
+				}
+			}
+			exported, err = exportedNames(ctx, bq, table, start)
+			if err != nil {
+				return fmt.Errorf("retrieving exported operations: %v", err)
 			}
 		}
 	}
-	call.Filter(f)
+	call.Filter(common.AndFilters(filters...))
 
 	uploader := table.Uploader()
 
@@ -136,48 +178,19 @@ func Invoke(ctx context.Context, service *genomics.Service, project string, argu
 
 		var savers []*bigquery.StructSaver
 		for _, operation := range resp.Operations {
+			if exported[operation.Name] {
+				continue
+			}
+
 			var metadata genomics.Metadata
 			if err := json.Unmarshal(operation.Metadata, &metadata); err != nil {
 				return fmt.Errorf("unmarshalling operation (after %d operations): %v", count, err)
 				return err
 			}
 
-			pipeline, err := json.Marshal(metadata.Pipeline)
+			r, err := newRow(operation, &metadata)
 			if err != nil {
-				return fmt.Errorf("marshalling pipeline (after %d operations): %v", count, err)
-			}
-			resources := metadata.Pipeline.Resources
-
-			r := row{
-				Name:       operation.Name,
-				Done:       operation.Done,
-				CreateTime: parseTimestamp(metadata.CreateTime).DateTime,
-				StartTime:  parseTimestamp(metadata.StartTime),
-				EndTime:    parseTimestamp(metadata.EndTime),
-
-				Pipeline:    string(pipeline),
-				Regions:     resources.Regions,
-				Zones:       resources.Zones,
-				MachineType: resources.VirtualMachine.MachineType,
-				Preemptible: resources.VirtualMachine.Preemptible,
-			}
-
-			if operation.Error != nil {
-				r.Error = &status{
-					Message: operation.Error.Message,
-					Code:    operation.Error.Code,
-				}
-			}
-
-			for k, v := range metadata.Labels {
-				r.Labels = append(r.Labels, label{Key: k, Value: v})
-			}
-
-			for _, e := range metadata.Events {
-				r.Events = append(r.Events, event{
-					Timestamp:   parseTimestamp(e.Timestamp).DateTime,
-					Description: e.Description,
-				})
+				return fmt.Errorf("creating row (after %d operations): %v", count, err)
 			}
 
 			savers = append(savers, &bigquery.StructSaver{
@@ -201,6 +214,131 @@ func Invoke(ctx context.Context, service *genomics.Service, project string, argu
 	}
 }
 
+// newRow returns the row describing an operation.
+func newRow(operation *genomics.Operation, metadata *genomics.Metadata) (row, error) {
+	pipeline, err := json.Marshal(metadata.Pipeline)
+	if err != nil {
+		return row{}, fmt.Errorf("marshalling pipeline: %v", err)
+	}
+	resources := metadata.Pipeline.Resources
+
+	r := row{
+		Name:       operation.Name,
+		Done:       operation.Done,
+		CreateTime: parseTimestamp(metadata.CreateTime).DateTime,
+		StartTime:  parseTimestamp(metadata.StartTime),
+		EndTime:    parseTimestamp(metadata.EndTime),
+
+		Pipeline:    string(pipeline),
+		Regions:     resources.Regions,
+		Zones:       resources.Zones,
+		MachineType: resources.VirtualMachine.MachineType,
+		Preemptible: resources.VirtualMachine.Preemptible,
+	}
+
+	if operation.Error != nil {
+		r.Error = &status{
+			Message: operation.Error.Message,
+			Code:    operation.Error.Code,
+		}
+		if err := common.NewPipelineExecutionError(operation.Error, metadata); err.ActionID > 0 {
+			r.ExitStatus = bigquery.NullInt64{Int64: err.ExitStatus, Valid: true}
+		}
+	} else if operation.Done {
+		r.ExitStatus = bigquery.NullInt64{Valid: true}
+	}
+
+	for k, v := range metadata.Labels {
+		r.Labels = append(r.Labels, label{Key: k, Value: v})
+	}
+
+	for _, e := range metadata.Events {
+		r.Events = append(r.Events, event{
+			Timestamp:   parseTimestamp(e.Timestamp).DateTime,
+			Description: e.Description,
+		})
+	}
+	for _, e := range events.ParseAll(metadata.Events) {
+		if details, ok := e.Details.(*genomics.WorkerAssignedEvent); ok {
+			r.Zone = details.Zone
+		}
+	}
+	return r, nil
+}
+
+// destination returns the project, dataset and table to export to, from either
+// the --bigquery flag or the --dataset and --table flags.
+func destination(project string) (string, string, string, error) {
+	if *bqTable == "" {
+		if *datasetName == "" || *tableName == "" {
+			return "", "", "", errors.New("--bigquery (or --dataset and --table) is required")
+		}
+		return project, *datasetName, *tableName, nil
+	}
+	if *datasetName != "" || *tableName != "" {
+		return "", "", "", errors.New("--bigquery cannot be used with --dataset or --table")
+	}
+
+	parts := strings.Split(*bqTable, ".")
+	switch len(parts) {
+	case 2:
+		parts = append([]string{project}, parts...)
+	case 3:
+	default:
+		return "", "", "", fmt.Errorf("invalid table %q: expecting [PROJECT.]DATASET.TABLE", *bqTable)
+	}
+	return parts[0], parts[1], parts[2], nil
+}
+
+// addMissingColumns adds the columns of schema that an existing table does
+// not have yet (for example, because it was created by an older version of
+// the tool).
+func addMissingColumns(ctx context.Context, table *bigquery.Table, metadata *bigquery.TableMetadata, schema bigquery.Schema) error {
+	existing := make(map[string]bool)
+	for _, field := range metadata.Schema {
+		existing[strings.ToLower(field.Name)] = true
+	}
+	var missing bigquery.Schema
+	for _, field := range schema {
+		if !existing[strings.ToLower(field.Name)] {
+			missing = append(missing, field)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	update := bigquery.TableMetadataToUpdate{Schema: append(metadata.Schema, missing...)}
+	if _, err := table.Update(ctx, update, metadata.ETag); err != nil {
+		return fmt.Errorf("adding columns to table: %v", err)
+	}
+	return nil
+}
+
+// exportedNames returns the names of the operations in the table that were
+// created after since.
+func exportedNames(ctx context.Context, bq *bigquery.Client, table *bigquery.Table, since time.Time) (map[string]bool, error) {
+	q := bq.Query(fmt.Sprintf("SELECT Name FROM `%s.%s.%s` WHERE CreateTime > @since", table.ProjectID, table.DatasetID, table.TableID))
+	q.Parameters = []bigquery.QueryParameter{{Name: "since", Value: civil.DateTimeOf(since.UTC())}}
+	it, err := q.Read(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("running query: %v", err)
+	}
+
+	names := make(map[string]bool)
+	for {
+		var v []bigquery.Value
+		err := it.Next(&v)
+		if err == iterator.Done {
+			return names, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading query results: %v", err)
+		}
+		names[fmt.Sprintf("%s", v[0])] = true
+	}
+}
+
 func parseTimestamp(ts string) bigquery.NullDateTime {
 	t, err := time.Parse(time.RFC3339, ts)
 	if err != nil {
@@ -212,30 +350,33 @@ func parseTimestamp(ts string) bigquery.NullDateTime {
 	}
 }
 
-func latestTimestamp(ctx context.Context, bq *bigquery.Client, project string) (string, error) {
-	q := bq.Query(fmt.Sprintf("SELECT MAX(CreateTime) FROM `%s.%s.%s`", project, *datasetName, *tableName))
+// latestTimestamp returns the creation time (in UTC) of the newest operation in
+// the table, or the zero time if the table is empty.
+func latestTimestamp(ctx context.Context, bq *bigquery.Client, table *bigquery.Table) (time.Time, error) {
+	q := bq.Query(fmt.Sprintf("SELECT MAX(CreateTime) FROM `%s.%s.%s`", table.ProjectID, table.DatasetID, table.TableID))
 	job, err := q.Run(ctx)
 	if err != nil {
-		return "", fmt.Errorf("running query: %v", err)
+		return time.Time{}, fmt.Errorf("running query: %v", err)
 	}
 	status, err := job.Wait(ctx)
 	if err != nil {
-		return "", fmt.Errorf("waiting for query: %v", err)
+		return time.Time{}, fmt.Errorf("waiting for query: %v", err)
 	}
 	if err := status.Err(); err != nil {
-		return "", fmt.Errorf("query status: %v", err)
+		return time.Time{}, fmt.Errorf("query status: %v", err)
 	}
 	it, err := job.Read(ctx)
 	if err != nil {
-		return "", fmt.Errorf("reading query: %v", err)
+		return time.Time{}, fmt.Errorf("reading query: %v", err)
 	}
 
 	var v []bigquery.Value
 	if err := it.Next(&v); err != nil {
-		return "", fmt.Errorf("getting query data: %v", err)
+		return time.Time{}, fmt.Errorf("getting query data: %v", err)
 	}
-	if v[0] == nil {
-		return "", nil
+	latest, ok := v[0].(civil.DateTime)
+	if !ok {
+		return time.Time{}, nil
 	}
-	return fmt.Sprintf("%s", v[0]), nil
+	return latest.In(time.UTC), nil
 }
@@ -0,0 +1,49 @@
+package export
+
+import (
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+	genomics "google.golang.org/api/genomics/v2alpha1"
+)
+
+func TestNewRow(t *testing.T) {
+	pipeline := &genomics.Pipeline{
+		Actions:   []*genomics.Action{{ImageUri: "bash"}},
+		Resources: &genomics.Resources{VirtualMachine: &genomics.VirtualMachine{MachineType: "n1-standard-1"}},
+	}
+	assigned := &genomics.Event{
+		Timestamp: "2018-01-01T10:00:00Z",
+		Details:   []byte(`{"@type": "type.googleapis.com/google.genomics.v2alpha1.WorkerAssignedEvent", "zone": "us-east1-b", "instance": "worker"}`),
+	}
+	stopped := &genomics.Event{
+		Timestamp: "2018-01-01T10:05:00Z",
+		Details:   []byte(`{"@type": "type.googleapis.com/google.genomics.v2alpha1.ContainerStoppedEvent", "actionId": 1, "exitStatus": 3}`),
+	}
+
+	tests := []struct {
+		operation      *genomics.Operation
+		wantExitStatus bigquery.NullInt64
+	}{
+		{&genomics.Operation{Name: "running"}, bigquery.NullInt64{}},
+		{&genomics.Operation{Name: "succeeded", Done: true}, bigquery.NullInt64{Valid: true}},
+		{&genomics.Operation{Name: "failed", Done: true, Error: &genomics.Status{Code: 9}}, bigquery.NullInt64{Int64: 3, Valid: true}},
+	}
+	for _, test := range tests {
+		metadata := &genomics.Metadata{
+			Pipeline:   pipeline,
+			CreateTime: "2018-01-01T09:59:00Z",
+			Events:     []*genomics.Event{stopped, assigned},
+		}
+		r, err := newRow(test.operation, metadata)
+		if err != nil {
+			t.Fatalf("newRow(%q): unexpected error: %v", test.operation.Name, err)
+		}
+		if r.Zone != "us-east1-b" || r.MachineType != "n1-standard-1" {
+			t.Errorf("newRow(%q): unexpected zone or machine type: %+v", test.operation.Name, r)
+		}
+		if r.ExitStatus != test.wantExitStatus {
+			t.Errorf("newRow(%q): got exit status %v, want %v", test.operation.Name, r.ExitStatus, test.wantExitStatus)
+		}
+	}
+}
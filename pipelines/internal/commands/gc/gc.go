@@ -0,0 +1,208 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package gc provides a sub-tool for deleting VMs and disks that were left
+// behind by pipelines that terminated abnormally.
+package gc
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/googlegenomics/pipelines-tools/pipelines/events"
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/common"
+	compute "google.golang.org/api/compute/v1"
+	genomics "google.golang.org/api/genomics/v2alpha1"
+)
+
+var (
+	flags = flag.NewFlagSet("", flag.ExitOnError)
+
+	yes    = flags.Bool("yes", false, "delete the resources without asking for confirmation")
+	minAge = flags.String("min-age", "6h", "only delete resources created at least this long ago (e.g. 6h or 2d)")
+
+	// The pipelines API applies this label to the VMs it creates.
+	workerLabel = flags.String("worker-label", "goog-pipelines-worker", "the label that identifies pipeline worker VMs and disks")
+)
+
+// resource is a leaked VM or disk.
+type resource struct {
+	kind, zone, name string
+}
+
+// Invoke finds worker VMs and unattached disks that belong to operations that
+// have finished and deletes them (after confirmation).  Resources whose
+// operation cannot be found (for example, because they were created by another
+// tool) and resources younger than --min-age are never deleted.
+func Invoke(ctx context.Context, service *genomics.Service, project string, arguments []string) error {
+	flags.Parse(arguments)
+
+	age, err := common.ParseDuration(*minAge)
+	if err != nil {
+		return fmt.Errorf("parsing --min-age: %v", err)
+	}
+	now := time.Now()
+
+	computeService, err := common.NewComputeService(ctx)
+	if err != nil {
+		return err
+	}
+
+	filter := fmt.Sprintf("labels.%s:*", *workerLabel)
+	var instances []*compute.Instance
+	err = computeService.Instances.AggregatedList(project).Filter(filter).Pages(ctx, func(list *compute.InstanceAggregatedList) error {
+		for _, scoped := range list.Items {
+			instances = append(instances, scoped.Instances...)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("listing instances: %v", err)
+	}
+
+	var disks []*compute.Disk
+	err = computeService.Disks.AggregatedList(project).Filter(filter).Pages(ctx, func(list *compute.DiskAggregatedList) error {
+		for _, scoped := range list.Items {
+			disks = append(disks, scoped.Disks...)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("listing disks: %v", err)
+	}
+
+	// An operation is created before its worker, so only the operations
+	// created before the oldest candidate (with a day of margin for queued
+	// operations) need to be examined.  Workers whose operation is older are
+	// kept, since their owner is unknown.
+	oldest := now.Add(-age)
+	for _, created := range creationTimes(instances, disks) {
+		if created.Before(oldest) {
+			oldest = created
+		}
+	}
+	owners := make(map[string]bool)
+	opFilter := fmt.Sprintf("metadata.createTime > %q", oldest.Add(-24*time.Hour).UTC().Format(time.RFC3339))
+	err = common.ListOperations(ctx, service, project, opFilter, func(operation *genomics.Operation, metadata *genomics.Metadata) error {
+		for _, event := range events.ParseAll(metadata.Events) {
+			if details, ok := event.Details.(*genomics.WorkerAssignedEvent); ok {
+				done, seen := owners[details.Instance]
+				owners[details.Instance] = operation.Done && (done || !seen)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	leaked := leakedResources(owners, instances, disks, now.Add(-age))
+	if len(leaked) == 0 {
+		fmt.Println("No leaked resources found")
+		return nil
+	}
+
+	for _, r := range leaked {
+		fmt.Printf("%s %s (zone %s)\n", r.kind, r.name, r.zone)
+	}
+	if !*yes && !confirm(fmt.Sprintf("Delete %d resources?", len(leaked))) {
+		return nil
+	}
+
+	var failures int
+	for _, r := range leaked {
+		var err error
+		if r.kind == "instance" {
+			_, err = computeService.Instances.Delete(project, r.zone, r.name).Context(ctx).Do()
+		} else {
+			_, err = computeService.Disks.Delete(project, r.zone, r.name).Context(ctx).Do()
+		}
+		if err != nil {
+			fmt.Printf("Failed to delete %s %s: %v\n", r.kind, r.name, err)
+			failures++
+			continue
+		}
+		fmt.Printf("Deleting %s %s\n", r.kind, r.name)
+	}
+	if failures > 0 {
+		return fmt.Errorf("failed to delete %d resources", failures)
+	}
+	return nil
+}
+
+// leakedResources returns the instances and unattached disks that were created
+// before cutoff and belong to a worker whose operation is done.  The owners map
+// holds the name of each known worker and whether its operation is done.
+// Disks belong to the worker whose name they start with.
+func leakedResources(owners map[string]bool, instances []*compute.Instance, disks []*compute.Disk, cutoff time.Time) []resource {
+	old := func(timestamp string) bool {
+		created, err := time.Parse(time.RFC3339, timestamp)
+		return err == nil && created.Before(cutoff)
+	}
+
+	var leaked []resource
+	for _, instance := range instances {
+		if owners[instance.Name] && old(instance.CreationTimestamp) {
+			leaked = append(leaked, resource{"instance", path.Base(instance.Zone), instance.Name})
+		}
+	}
+	for _, disk := range disks {
+		if len(disk.Users) == 0 && diskOwnerDone(owners, disk.Name) && old(disk.CreationTimestamp) {
+			leaked = append(leaked, resource{"disk", path.Base(disk.Zone), disk.Name})
+		}
+	}
+	return leaked
+}
+
+// diskOwnerDone returns true if the disk is named after a known worker (either
+// its boot disk or one of its attached disks) whose operation is done.
+func diskOwnerDone(owners map[string]bool, disk string) bool {
+	for instance, done := range owners {
+		if disk == instance || strings.HasPrefix(disk, instance+"-") {
+			return done
+		}
+	}
+	return false
+}
+
+// creationTimes returns the creation times of the resources.
+func creationTimes(instances []*compute.Instance, disks []*compute.Disk) []time.Time {
+	var timestamps []string
+	for _, instance := range instances {
+		timestamps = append(timestamps, instance.CreationTimestamp)
+	}
+	for _, disk := range disks {
+		timestamps = append(timestamps, disk.CreationTimestamp)
+	}
+	var times []time.Time
+	for _, timestamp := range timestamps {
+		if t, err := time.Parse(time.RFC3339, timestamp); err == nil {
+			times = append(times, t)
+		}
+	}
+	return times
+}
+
+func confirm(prompt string) bool {
+	fmt.Printf("%s [y/N] ", prompt)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
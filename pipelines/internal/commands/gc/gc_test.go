@@ -0,0 +1,41 @@
+package gc
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	compute "google.golang.org/api/compute/v1"
+)
+
+func TestLeakedResources(t *testing.T) {
+	cutoff := time.Date(2018, 6, 1, 6, 0, 0, 0, time.UTC)
+	const old, fresh = "2018-06-01T00:00:00Z", "2018-06-01T11:00:00Z"
+
+	owners := map[string]bool{
+		"worker-done":    true,
+		"worker-running": false,
+	}
+	instances := []*compute.Instance{
+		{Name: "worker-done", Zone: "zones/us-east1-b", CreationTimestamp: old},
+		{Name: "worker-running", Zone: "zones/us-east1-b", CreationTimestamp: old},
+		{Name: "worker-unknown", Zone: "zones/us-east1-b", CreationTimestamp: old},
+	}
+	disks := []*compute.Disk{
+		{Name: "worker-done-google", Zone: "zones/us-east1-b", CreationTimestamp: old},
+		{Name: "worker-done-attached", Zone: "zones/us-east1-b", CreationTimestamp: old, Users: []string{"worker-done"}},
+		{Name: "worker-running-google", Zone: "zones/us-east1-b", CreationTimestamp: old},
+		{Name: "worker-unknown", Zone: "zones/us-east1-b", CreationTimestamp: old},
+		{Name: "worker-fresh", Zone: "zones/us-east1-b", CreationTimestamp: fresh},
+		{Name: "worker-done-fresh", Zone: "zones/us-east1-b", CreationTimestamp: fresh},
+	}
+
+	got := leakedResources(owners, instances, disks, cutoff)
+	want := []resource{
+		{"instance", "us-east1-b", "worker-done"},
+		{"disk", "us-east1-b", "worker-done-google"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Unexpected resources: got %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,247 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package graph provides a sub-tool for rendering the actions of a pipeline as
+// a graph, so that complex scripts can be reviewed before they are run.
+//
+// The arguments are the same as those of the run command, and any options for
+// the graph command itself must come first (use '--' to separate them from
+// run flags if the run arguments start with a flag):
+//
+//	pipelines graph --format mermaid -- --inputs gs://bucket/input job.script
+//
+// Each action is a node, with foreground actions connected in the order they
+// run.  Background actions are connected to the action they start after by a
+// dashed edge, actions that always run (even after a failure) have edges
+// labelled 'always', and the GCS objects copied by the localization and
+// delocalization actions are shown as separate nodes.
+package graph
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/commands/run"
+	genomics "google.golang.org/api/genomics/v2alpha1"
+)
+
+var (
+	flags = flag.NewFlagSet("", flag.ExitOnError)
+
+	format = flags.String("format", "dot", "the output format (dot or mermaid)")
+)
+
+// maxLabelLength is the length beyond which action commands are truncated.
+const maxLabelLength = 40
+
+// copyPattern matches the gsutil commands used to copy inputs and outputs.
+var copyPattern = regexp.MustCompile(`gsutil(?: -\w+)* (?:cp|rsync)(?: -\w+)* (\S+) (\S+)`)
+
+// node is an action (or a GCS object copied by an action) in the graph.
+type node struct {
+	id, label  string
+	background bool
+	storage    bool
+}
+
+// edge connects two nodes, optionally with a label.
+type edge struct {
+	from, to, label string
+	dashed          bool
+}
+
+// graph is the graph of the actions of a pipeline.
+type graph struct {
+	nodes []node
+	edges []edge
+}
+
+func Invoke(ctx context.Context, service *genomics.Service, project string, arguments []string) error {
+	flags.Parse(arguments)
+	if *format != "dot" && *format != "mermaid" {
+		return fmt.Errorf("unknown format %q (expecting dot or mermaid)", *format)
+	}
+	if flags.NArg() == 0 {
+		return errors.New("missing pipeline (the arguments of the run command)")
+	}
+
+	req, err := run.BuildRequest(project, flags.Args())
+	if err != nil {
+		return fmt.Errorf("building request: %v", err)
+	}
+	if req.Pipeline == nil {
+		return errors.New("the request has no pipeline")
+	}
+
+	g := newGraph(req.Pipeline.Actions)
+	if *format == "mermaid" {
+		return g.writeMermaid(os.Stdout)
+	}
+	return g.writeDOT(os.Stdout)
+}
+
+// newGraph builds the graph of actions.
+func newGraph(actions []*genomics.Action) *graph {
+	var g graph
+	objects := make(map[string]string)
+	object := func(path string) string {
+		id, ok := objects[path]
+		if !ok {
+			id = fmt.Sprintf("gcs%d", len(objects)+1)
+			objects[path] = id
+			g.nodes = append(g.nodes, node{id: id, label: path, storage: true})
+		}
+		return id
+	}
+
+	var previous string
+	for i, action := range actions {
+		id := fmt.Sprintf("action%d", i+1)
+		background := hasFlag(action, "RUN_IN_BACKGROUND")
+		g.nodes = append(g.nodes, node{id: id, label: fmt.Sprintf("%d: %s", i+1, describe(action)), background: background})
+
+		if previous != "" {
+			e := edge{from: previous, to: id}
+			switch {
+			case background:
+				e.label, e.dashed = "background", true
+			case hasFlag(action, "ALWAYS_RUN"):
+				e.label = "always"
+			}
+			g.edges = append(g.edges, e)
+		}
+		if !background {
+			previous = id
+		}
+
+		if m := copyPattern.FindStringSubmatch(strings.Join(action.Commands, " ")); m != nil {
+			switch from, to := m[1], m[2]; {
+			case strings.HasPrefix(from, "gs://"):
+				g.edges = append(g.edges, edge{from: object(from), to: id, label: "localize"})
+			case strings.HasPrefix(to, "gs://"):
+				g.edges = append(g.edges, edge{from: id, to: object(to), label: "delocalize"})
+			}
+		}
+	}
+	return &g
+}
+
+// describe returns a short description of what an action runs.
+func describe(action *genomics.Action) string {
+	if action.Name != "" {
+		return action.Name
+	}
+	command := strings.Join(action.Commands, " ")
+	if len(action.Commands) == 2 && action.Commands[0] == "-c" {
+		command = action.Commands[1]
+	}
+	if m := copyPattern.FindStringSubmatch(command); m != nil {
+		command = fmt.Sprintf("copy %s to %s", m[1], m[2])
+	}
+	if i := strings.Index(command, "\n"); i >= 0 {
+		command = command[:i] + "..."
+	}
+	if len(command) > maxLabelLength {
+		command = command[:maxLabelLength] + "..."
+	}
+	if command == "" {
+		return action.ImageUri
+	}
+	return fmt.Sprintf("%s\n%s", action.ImageUri, command)
+}
+
+func hasFlag(action *genomics.Action, flag string) bool {
+	for _, f := range action.Flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *graph) writeDOT(w io.Writer) error {
+	quote := func(s string) string {
+		s = strings.Replace(s, `\`, `\\`, -1)
+		s = strings.Replace(s, `"`, `\"`, -1)
+		return `"` + strings.Replace(s, "\n", `\n`, -1) + `"`
+	}
+
+	lines := []string{"digraph pipeline {", "  node [shape=box];"}
+	for _, n := range g.nodes {
+		attributes := "label=" + quote(n.label)
+		switch {
+		case n.storage:
+			attributes += ", shape=cylinder"
+		case n.background:
+			attributes += ", style=dashed"
+		}
+		lines = append(lines, fmt.Sprintf("  %s [%s];", n.id, attributes))
+	}
+	for _, e := range g.edges {
+		var attributes []string
+		if e.label != "" {
+			attributes = append(attributes, "label="+quote(e.label))
+		}
+		if e.dashed {
+			attributes = append(attributes, "style=dashed")
+		}
+		line := fmt.Sprintf("  %s -> %s", e.from, e.to)
+		if len(attributes) > 0 {
+			line += " [" + strings.Join(attributes, ", ") + "]"
+		}
+		lines = append(lines, line+";")
+	}
+	lines = append(lines, "}")
+
+	_, err := fmt.Fprintln(w, strings.Join(lines, "\n"))
+	return err
+}
+
+func (g *graph) writeMermaid(w io.Writer) error {
+	quote := func(s string) string {
+		s = strings.Replace(s, `"`, "#quot;", -1)
+		return `"` + strings.Replace(s, "\n", "<br>", -1) + `"`
+	}
+
+	lines := []string{"flowchart TD"}
+	for _, n := range g.nodes {
+		switch {
+		case n.storage:
+			lines = append(lines, fmt.Sprintf("  %s[(%s)]", n.id, quote(n.label)))
+		case n.background:
+			lines = append(lines, fmt.Sprintf("  %s([%s])", n.id, quote(n.label)))
+		default:
+			lines = append(lines, fmt.Sprintf("  %s[%s]", n.id, quote(n.label)))
+		}
+	}
+	for _, e := range g.edges {
+		arrow := "-->"
+		if e.dashed {
+			arrow = "-.->"
+		}
+		if e.label != "" {
+			arrow += "|" + quote(e.label) + "|"
+		}
+		lines = append(lines, fmt.Sprintf("  %s %s %s", e.from, arrow, e.to))
+	}
+
+	_, err := fmt.Fprintln(w, strings.Join(lines, "\n"))
+	return err
+}
@@ -0,0 +1,32 @@
+package graph
+
+import (
+	"reflect"
+	"testing"
+
+	genomics "google.golang.org/api/genomics/v2alpha1"
+)
+
+func TestNewGraph(t *testing.T) {
+	actions := []*genomics.Action{
+		{ImageUri: "io", Commands: []string{"-c", "gsutil cp gs://bucket/input /mnt/input"}},
+		{ImageUri: "tools", Flags: []string{"RUN_IN_BACKGROUND"}},
+		{ImageUri: "bash", Commands: []string{"-c", "sort /mnt/input > /mnt/output"}},
+		{ImageUri: "io", Commands: []string{"-c", "gsutil -q cp /mnt/output gs://bucket/output"}, Flags: []string{"ALWAYS_RUN"}},
+	}
+	want := []edge{
+		{from: "gcs1", to: "action1", label: "localize"},
+		{from: "action1", to: "action2", label: "background", dashed: true},
+		{from: "action1", to: "action3"},
+		{from: "action3", to: "action4", label: "always"},
+		{from: "action4", to: "gcs2", label: "delocalize"},
+	}
+
+	g := newGraph(actions)
+	if !reflect.DeepEqual(g.edges, want) {
+		t.Fatalf("Unexpected edges: got %+v, want %+v", g.edges, want)
+	}
+	if len(g.nodes) != 6 {
+		t.Fatalf("Unexpected number of nodes: got %d, want 6", len(g.nodes))
+	}
+}
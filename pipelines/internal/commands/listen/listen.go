@@ -0,0 +1,215 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package listen provides a sub-tool that submits a pipeline for every GCS
+// object notification received from a Pub/Sub subscription.
+//
+// The arguments following the listen flags are passed to the run command for
+// each new object.  The placeholders {object}, {bucket} and {name} in those
+// arguments are replaced by the GCS path of the object, its bucket and its
+// name respectively.  If no placeholder is used, the object is passed to the
+// pipeline with --inputs (and so is available as ${INPUT0}).  Pipelines are
+// submitted without waiting for them to finish unless --wait is given
+// explicitly.
+//
+// For example, to align every new FASTQ file:
+//
+//	gsutil notification create -t new-fastq -f json -e OBJECT_FINALIZE gs://bucket
+//	gcloud pubsub subscriptions create new-fastq-pipelines --topic new-fastq
+//	pipelines listen --subscription new-fastq-pipelines --suffix .fastq.gz \
+//	  align.pipeline --outputs gs://results/{name}.bam
+//
+// Messages are acknowledged once the pipeline has been submitted, so a message
+// whose submission fails is delivered again later.  After --max-failures failed
+// attempts, the message is published to --dead-letter-topic (if given) and
+// acknowledged, so that a notification that can never be processed is not
+// retried forever.
+package listen
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/commands/run"
+	"golang.org/x/oauth2/google"
+	genomics "google.golang.org/api/genomics/v2alpha1"
+	pubsub "google.golang.org/api/pubsub/v1"
+)
+
+var (
+	flags = flag.NewFlagSet("", flag.ExitOnError)
+
+	subscription = flags.String("subscription", "", "the Pub/Sub subscription that receives GCS notifications")
+	eventType    = flags.String("event-type", "OBJECT_FINALIZE", "only submit pipelines for notifications of this type (or all types if empty)")
+	suffix       = flags.String("suffix", "", "only submit pipelines for objects whose names end with this suffix")
+	maxMessages  = flags.Int64("max-messages", 10, "the maximum number of messages to process at a time")
+	maxFailures  = flags.Int("max-failures", 5, "the number of times a message may fail before it is given up on (0 to retry forever)")
+	deadLetter   = flags.String("dead-letter-topic", "", "if set, the Pub/Sub topic that messages are published to when they are given up on")
+)
+
+// notification holds the fields of a GCS object notification that are used
+// to submit pipelines.
+type notification struct {
+	Bucket, Name string
+}
+
+func Invoke(ctx context.Context, service *genomics.Service, project string, arguments []string) error {
+	flags.Parse(arguments)
+	template := flags.Args()
+	if *subscription == "" {
+		return errors.New("--subscription is required")
+	}
+	if len(template) == 0 {
+		return errors.New("missing pipeline arguments")
+	}
+
+	name := *subscription
+	if !strings.HasPrefix(name, "projects/") {
+		name = fmt.Sprintf("projects/%s/subscriptions/%s", project, name)
+	}
+
+	client, err := google.DefaultClient(ctx, pubsub.PubsubScope)
+	if err != nil {
+		return fmt.Errorf("creating Pub/Sub client: %v", err)
+	}
+	ps, err := pubsub.New(client)
+	if err != nil {
+		return fmt.Errorf("creating Pub/Sub service: %v", err)
+	}
+
+	topic := *deadLetter
+	if topic != "" && !strings.HasPrefix(topic, "projects/") {
+		topic = fmt.Sprintf("projects/%s/topics/%s", project, topic)
+	}
+
+	// failures counts the failed attempts to process each message (by ID),
+	// since redelivered messages only carry a delivery attempt count when the
+	// subscription has a dead letter policy.
+	failures := make(map[string]int)
+
+	fmt.Printf("Listening for notifications on %q\n", name)
+	for {
+		req := &pubsub.PullRequest{MaxMessages: *maxMessages}
+		resp, err := ps.Projects.Subscriptions.Pull(name, req).Context(ctx).Do()
+		if err != nil {
+			return fmt.Errorf("pulling messages: %v", err)
+		}
+
+		var ackIDs []string
+		for _, received := range resp.ReceivedMessages {
+			id := received.Message.MessageId
+			if err := process(ctx, service, project, received.Message, template); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to process message %s: %v\n", id, err)
+				failures[id]++
+				if int64(failures[id]) < received.DeliveryAttempt {
+					failures[id] = int(received.DeliveryAttempt)
+				}
+				if !givenUp(failures[id], *maxFailures) {
+					continue
+				}
+				if topic != "" {
+					if err := publish(ctx, ps, topic, received.Message); err != nil {
+						fmt.Fprintf(os.Stderr, "Failed to dead-letter message %s: %v\n", id, err)
+						continue
+					}
+				}
+				fmt.Fprintf(os.Stderr, "Giving up on message %s after %d failures\n", id, failures[id])
+			}
+			delete(failures, id)
+			ackIDs = append(ackIDs, received.AckId)
+		}
+
+		if len(ackIDs) > 0 {
+			req := &pubsub.AcknowledgeRequest{AckIds: ackIDs}
+			if _, err := ps.Projects.Subscriptions.Acknowledge(name, req).Context(ctx).Do(); err != nil {
+				return fmt.Errorf("acknowledging messages: %v", err)
+			}
+		}
+	}
+}
+
+// givenUp returns true if a message that has failed the given number of times
+// should no longer be retried.
+func givenUp(failures, max int) bool {
+	return max > 0 && failures >= max
+}
+
+// publish sends a copy of message to topic.
+func publish(ctx context.Context, ps *pubsub.Service, topic string, message *pubsub.PubsubMessage) error {
+	req := &pubsub.PublishRequest{
+		Messages: []*pubsub.PubsubMessage{{Data: message.Data, Attributes: message.Attributes}},
+	}
+	if _, err := ps.Projects.Topics.Publish(topic, req).Context(ctx).Do(); err != nil {
+		return fmt.Errorf("publishing to %q: %v", topic, err)
+	}
+	return nil
+}
+
+// process submits a pipeline for a single notification.  Notifications that
+// do not match the filters are ignored (and so are acknowledged).
+func process(ctx context.Context, service *genomics.Service, project string, message *pubsub.PubsubMessage, template []string) error {
+	if *eventType != "" && message.Attributes["eventType"] != *eventType {
+		return nil
+	}
+
+	n := notification{
+		Bucket: message.Attributes["bucketId"],
+		Name:   message.Attributes["objectId"],
+	}
+	if n.Bucket == "" || n.Name == "" {
+		data, err := base64.StdEncoding.DecodeString(message.Data)
+		if err != nil {
+			return fmt.Errorf("decoding message: %v", err)
+		}
+		if err := json.Unmarshal(data, &n); err != nil {
+			return fmt.Errorf("parsing notification: %v", err)
+		}
+	}
+	if n.Bucket == "" || n.Name == "" {
+		return errors.New("the message is not a GCS object notification")
+	}
+	if !strings.HasSuffix(n.Name, *suffix) {
+		return nil
+	}
+
+	object := fmt.Sprintf("gs://%s/%s", n.Bucket, n.Name)
+	fmt.Printf("Submitting pipeline for %q\n", object)
+	return run.Invoke(ctx, service, project, expand(template, n))
+}
+
+// expand returns the run arguments for the notification.
+func expand(template []string, n notification) []string {
+	object := fmt.Sprintf("gs://%s/%s", n.Bucket, n.Name)
+	replacer := strings.NewReplacer("{object}", object, "{bucket}", n.Bucket, "{name}", n.Name)
+
+	arguments := []string{"--wait=false"}
+	var substituted bool
+	for _, argument := range template {
+		expanded := replacer.Replace(argument)
+		if expanded != argument {
+			substituted = true
+		}
+		arguments = append(arguments, expanded)
+	}
+	if !substituted {
+		arguments = append(arguments, "--inputs", object)
+	}
+	return arguments
+}
@@ -0,0 +1,45 @@
+package listen
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExpand(t *testing.T) {
+	n := notification{Bucket: "bucket", Name: "dir/sample.fastq"}
+
+	testCases := []struct {
+		name     string
+		template []string
+		want     []string
+	}{
+		{"no placeholders", []string{"script"}, []string{"--wait=false", "script", "--inputs", "gs://bucket/dir/sample.fastq"}},
+		{"object", []string{"--inputs={object}", "script"}, []string{"--wait=false", "--inputs=gs://bucket/dir/sample.fastq", "script"}},
+		{"name", []string{"--outputs", "gs://out/{name}.bam", "script"}, []string{"--wait=false", "--outputs", "gs://out/dir/sample.fastq.bam", "script"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := expand(tc.template, n); !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("Unexpected result: got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestGivenUp(t *testing.T) {
+	testCases := []struct {
+		failures, max int
+		want          bool
+	}{
+		{1, 5, false},
+		{4, 5, false},
+		{5, 5, true},
+		{7, 5, true},
+		{100, 0, false},
+	}
+	for _, tc := range testCases {
+		if got := givenUp(tc.failures, tc.max); got != tc.want {
+			t.Errorf("givenUp(%d, %d): got %t, want %t", tc.failures, tc.max, got, tc.want)
+		}
+	}
+}
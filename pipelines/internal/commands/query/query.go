@@ -17,59 +17,132 @@ package query
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"os"
 	"strings"
+	"time"
 
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/common"
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/printer"
 	genomics "google.golang.org/api/genomics/v2alpha1"
 )
 
 var (
+	labels = make(map[string]string)
+
 	flags = flag.NewFlagSet("", flag.ExitOnError)
 
-	filter = flags.String("filter", "", "the query filter")
-	limit  = flags.Uint("limit", 32, "the maximum number of operations to list")
-	all    = flags.Bool("all", false, "show all operations (when false, show only running operations)")
+	filter        = flags.String("filter", "", "the query filter")
+	limit         = flags.Uint("limit", 32, "the maximum number of operations to list (0 for no limit)")
+	all           = flags.Bool("all", false, "show all operations (when false, show only running operations)")
+	state         = flags.String("state", "", "if set, a comma separated list of the states to show (running, succeeded, failed or cancelled)")
+	createdAfter  = flags.String("created-after", "", "only show operations created after this time (RFC3339) or this long ago (e.g. 12h)")
+	createdBefore = flags.String("created-before", "", "only show operations created before this time (RFC3339) or this long ago (e.g. 7d)")
+	out           = printer.New(flags, nil)
 )
 
-func Invoke(ctx context.Context, service *genomics.Service, project string, arguments []string) error {
-	flags.Parse(arguments)
+func init() {
+	flags.Var(&common.MapFlagValue{Values: labels}, "label", "only show operations with this label (may be repeated)")
+}
 
-	path := fmt.Sprintf("projects/%s/operations", project)
-	call := service.Projects.Operations.List(path).Context(ctx)
+// errLimitReached stops listing once --limit operations have been found.
+var errLimitReached = errors.New("limit reached")
 
-	if !*all {
-		*filter = strings.Join([]string{*filter, "done=false"}, " ")
+func Invoke(ctx context.Context, service *genomics.Service, project string, arguments []string) error {
+	flags.Parse(arguments)
+	if err := out.Validate(); err != nil {
+		return err
 	}
 
-	if *filter != "" {
-		call = call.Filter(*filter)
+	states, err := parseStates(*state)
+	if err != nil {
+		return err
 	}
-
-	if *limit == 0 {
-		return nil
+	if states == nil && !*all {
+		states = map[string]bool{"running": true}
 	}
 
-	var pageToken string
-	var count uint
-	for {
-		resp, err := call.PageToken(pageToken).Do()
+	var timeFilters []string
+	for _, bound := range []struct {
+		name, value, operator string
+	}{
+		{"created-after", *createdAfter, ">"},
+		{"created-before", *createdBefore, "<"},
+	} {
+		if bound.value == "" {
+			continue
+		}
+		t, err := common.ParseTime(bound.value, time.Now())
 		if err != nil {
-			return err
+			return fmt.Errorf("parsing --%s: %v", bound.name, err)
 		}
+		timeFilters = append(timeFilters, fmt.Sprintf("metadata.createTime %s %q", bound.operator, t.UTC().Format(time.RFC3339)))
+	}
 
-		for _, operation := range resp.Operations {
-			fmt.Println(operation.Name)
-			count++
-			if count == *limit {
-				return nil
-			}
-		}
+	filters := append([]string{*filter, common.LabelFilter(labels), doneFilter(states)}, timeFilters...)
 
-		if resp.NextPageToken == "" {
+	var records []printer.Record
+	err = common.ListOperations(ctx, service, project, common.AndFilters(filters...), func(operation *genomics.Operation, metadata *genomics.Metadata) error {
+		status := common.OperationStatus(operation)
+		if states != nil && !states[status] {
 			return nil
 		}
+		records = append(records, printer.Record{
+			"name":    operation.Name,
+			"status":  status,
+			"created": metadata.CreateTime,
+			"ended":   metadata.EndTime,
+			"labels":  metadata.Labels,
+		})
+		if uint(len(records)) == *limit {
+			return errLimitReached
+		}
+		return nil
+	})
+	if err != nil && err != errLimitReached {
+		return err
+	}
+	if out.Default() {
+		for _, record := range records {
+			fmt.Println(record["name"])
+		}
+		return nil
+	}
+	return out.Print(os.Stdout, []string{"name", "status", "created"}, records)
+}
+
+// parseStates returns the set of states named in input, or nil if input is
+// empty.
+func parseStates(input string) (map[string]bool, error) {
+	if input == "" {
+		return nil, nil
+	}
+	states := make(map[string]bool)
+	for _, name := range strings.Split(input, ",") {
+		switch name {
+		case "running", "succeeded", "failed", "cancelled":
+			states[name] = true
+		default:
+			return nil, fmt.Errorf("unknown state %q (must be running, succeeded, failed or cancelled)", name)
+		}
+	}
+	return states, nil
+}
 
-		pageToken = resp.NextPageToken
+// doneFilter returns the filter expression that selects the operations that
+// could be in one of states.  The API can only filter on whether an operation
+// is done, so finished operations are further filtered by their result after
+// they are listed.
+func doneFilter(states map[string]bool) string {
+	switch {
+	case states == nil:
+		return ""
+	case len(states) == 1 && states["running"]:
+		return "done = false"
+	case !states["running"]:
+		return "done = true"
 	}
+	return ""
 }
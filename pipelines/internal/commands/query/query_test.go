@@ -0,0 +1,30 @@
+package query
+
+import "testing"
+
+func TestDoneFilter(t *testing.T) {
+	testCases := []struct {
+		input string
+		want  string
+	}{
+		{"", ""},
+		{"running", "done = false"},
+		{"failed,cancelled", "done = true"},
+		{"running,failed", ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.input, func(t *testing.T) {
+			states, err := parseStates(tc.input)
+			if err != nil {
+				t.Fatalf("Failed to parse states: %v", err)
+			}
+			if got := doneFilter(states); got != tc.want {
+				t.Fatalf("Unexpected filter: got %q, want %q", got, tc.want)
+			}
+		})
+	}
+
+	if _, err := parseStates("pending"); err == nil {
+		t.Fatal("Expected an error for an unknown state")
+	}
+}
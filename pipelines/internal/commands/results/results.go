@@ -0,0 +1,82 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package results provides a sub-tool for listing and downloading the outputs
+// of a pipeline.
+package results
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/common"
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/selector"
+	genomics "google.golang.org/api/genomics/v2alpha1"
+)
+
+var (
+	flags  = flag.NewFlagSet("", flag.ExitOnError)
+	target = selector.New(flags)
+
+	download = flags.String("download", "", "if set, a local directory to download the outputs to")
+)
+
+// Invoke lists the objects written to the output destinations recorded in the
+// output manifest of an operation (see the run command), together with their
+// sizes and checksums, and optionally downloads them.
+func Invoke(ctx context.Context, service *genomics.Service, project string, arguments []string) error {
+	name, arguments, err := target.Take(ctx, service, project, common.ParseFlags(flags, arguments))
+	if err != nil {
+		return err
+	}
+	if len(arguments) != 0 {
+		return errors.New("expecting a single operation name")
+	}
+	_, metadata, err := common.GetOperation(ctx, service, name)
+	if err != nil {
+		return err
+	}
+	outputs := common.Outputs(metadata.Pipeline)
+	if len(outputs) == 0 {
+		return fmt.Errorf("operation %q has no recorded outputs", name)
+	}
+
+	storageService, err := common.NewStorageService(ctx)
+	if err != nil {
+		return err
+	}
+
+	written := make(map[string]string)
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "OBJECT\tSIZE\tMD5\tCRC32C")
+	for _, output := range outputs {
+		objects, err := common.ListOutput(ctx, storageService, output)
+		if err != nil {
+			return err
+		}
+		for _, object := range objects {
+			fmt.Fprintf(w, "gs://%s/%s\t%d\t%s\t%s\n", object.Bucket, object.Name, object.Size, object.Md5Hash, object.Crc32c)
+			if *download != "" {
+				if _, err := common.DownloadOutput(ctx, storageService, output, object, *download, written); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return w.Flush()
+}
@@ -0,0 +1,85 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package run
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	genomics "google.golang.org/api/genomics/v2alpha1"
+)
+
+// stepAccelerators holds the accelerators requested by the "# gpus=" and
+// "# gpu-type=" options of each script line.
+var stepAccelerators = make(map[*genomics.Action]*genomics.Accelerator)
+
+// parseAccelerator returns the accelerator requested by the options of a
+// script line, or nil if none is requested.  A type without a count requests
+// a single GPU, and a count without a type accepts any type of GPU.
+func parseAccelerator(options map[string]string) (*genomics.Accelerator, error) {
+	count, hasCount := options["gpus"]
+	kind, hasType := options["gpu-type"]
+	if !hasCount && !hasType {
+		return nil, nil
+	}
+
+	accelerator := &genomics.Accelerator{Type: kind, Count: 1}
+	if hasCount {
+		n, err := strconv.ParseInt(count, 10, 64)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid GPU count %q", count)
+		}
+		accelerator.Count = n
+	}
+	return accelerator, nil
+}
+
+// vmAccelerators returns the accelerators to attach to the VM, which must
+// satisfy both the --gpus flag and every step that requests GPUs: the VM gets
+// the largest number of GPUs requested.  Only one type of GPU can be attached
+// (the --gpu-type flag if it was given, otherwise the first type requested by
+// a step) so a warning is shown for steps that request a different type.
+func vmAccelerators(actions []*genomics.Action) []*genomics.Accelerator {
+	var kind string
+	if *gpus > 0 || isFlagSet("gpu-type") {
+		kind = *gpuType
+	}
+	count := int64(*gpus)
+	for i, action := range actions {
+		requested, ok := stepAccelerators[action]
+		if !ok {
+			continue
+		}
+		if requested.Count > count {
+			count = requested.Count
+		}
+		if requested.Type == "" {
+			continue
+		}
+		if kind == "" {
+			kind = requested.Type
+		} else if requested.Type != kind {
+			fmt.Fprintf(os.Stderr, "Warning: step %d requests %s GPUs but %s GPUs are attached to the VM\n", i+1, requested.Type, kind)
+		}
+	}
+	if count == 0 {
+		return nil
+	}
+	if kind == "" {
+		kind = *gpuType
+	}
+	return []*genomics.Accelerator{{Type: kind, Count: count}}
+}
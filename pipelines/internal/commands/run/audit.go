@@ -0,0 +1,145 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package run
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/common"
+	"golang.org/x/oauth2/google"
+	genomics "google.golang.org/api/genomics/v2alpha1"
+)
+
+// auditRecord describes a single pipeline submission.
+type auditRecord struct {
+	Timestamp time.Time
+	Operation string
+	Principal string
+	Arguments []string
+
+	// The submitted request as JSON.
+	Request string
+}
+
+// writeAuditRecord records the submission of req (as operation) to the
+// destination, which is either a GCS path prefix or a BigQuery table given as
+// DATASET.TABLE.  Records written to GCS are never overwritten: each one is
+// stored as a new object below the prefix.
+func writeAuditRecord(ctx context.Context, destination, project, operation string, req *genomics.RunPipelineRequest) error {
+	encoded, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("encoding request: %v", err)
+	}
+
+	record := auditRecord{
+		Timestamp: time.Now().UTC(),
+		Operation: operation,
+		Principal: principal(ctx),
+		Arguments: os.Args,
+		Request:   string(encoded),
+	}
+
+	if strings.HasPrefix(destination, "gs://") {
+		storage, err := common.NewStorageService(ctx)
+		if err != nil {
+			return err
+		}
+		encoded, err := json.Marshal(record)
+		if err != nil {
+			return fmt.Errorf("encoding audit record: %v", err)
+		}
+		name := fmt.Sprintf("%s-%s.json", record.Timestamp.Format("20060102T150405.000000000Z"), operation[strings.LastIndex(operation, "/")+1:])
+		return common.WriteObject(ctx, storage, gcsJoin(destination, name), encoded)
+	}
+
+	parts := strings.Split(destination, ".")
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid audit log %q: expecting a GCS path or DATASET.TABLE", destination)
+	}
+	bq, err := bigquery.NewClient(ctx, project)
+	if err != nil {
+		return fmt.Errorf("creating BigQuery client: %v", err)
+	}
+	defer bq.Close()
+
+	schema, err := bigquery.InferSchema(record)
+	if err != nil {
+		return fmt.Errorf("inferring schema: %v", err)
+	}
+	table := bq.Dataset(parts[0]).Table(parts[1])
+	if _, err := table.Metadata(ctx); err != nil {
+		if err := table.Create(ctx, &bigquery.TableMetadata{Schema: schema}); err != nil {
+			return fmt.Errorf("creating table: %v", err)
+		}
+	}
+	saver := &bigquery.StructSaver{Struct: record, InsertID: operation, Schema: schema}
+	if err := table.Uploader().Put(ctx, saver); err != nil {
+		return fmt.Errorf("inserting audit record: %v", err)
+	}
+	return nil
+}
+
+// principal returns the email address of the account used to submit
+// pipelines (or "unknown" if it cannot be determined).
+func principal(ctx context.Context) string {
+	creds, err := google.FindDefaultCredentials(ctx, "https://www.googleapis.com/auth/userinfo.email")
+	if err != nil {
+		return "unknown"
+	}
+
+	var key struct {
+		ClientEmail string `json:"client_email"`
+	}
+	if err := json.Unmarshal(creds.JSON, &key); err == nil && key.ClientEmail != "" {
+		return key.ClientEmail
+	}
+
+	token, err := creds.TokenSource.Token()
+	if err != nil {
+		return "unknown"
+	}
+	// The token is sent in the body rather than the URL so that it is not
+	// recorded in request logs.
+	form := url.Values{"access_token": {token.AccessToken}}
+	req, err := http.NewRequest(http.MethodPost, "https://oauth2.googleapis.com/tokeninfo", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "unknown"
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "unknown"
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "unknown"
+	}
+
+	var info struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil || info.Email == "" {
+		return "unknown"
+	}
+	return info.Email
+}
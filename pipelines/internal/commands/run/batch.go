@@ -0,0 +1,166 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package run
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/common"
+	genomics "google.golang.org/api/genomics/v2alpha1"
+)
+
+// parseBatch returns the requests in filename if it contains a JSON encoded
+// array of raw API requests, or nil if it contains anything else (including
+// an array of actions).
+func parseBatch(filename string) ([]*genomics.RunPipelineRequest, error) {
+	if filename == "" || filename == "-" {
+		return nil, nil
+	}
+
+	var objects []map[string]json.RawMessage
+	if err := parseJSON(filename, &objects); err != nil || len(objects) == 0 {
+		return nil, nil
+	}
+	for _, object := range objects {
+		if _, ok := object["pipeline"]; !ok {
+			return nil, nil
+		}
+	}
+
+	var requests []*genomics.RunPipelineRequest
+	if err := parseJSON(filename, &requests); err != nil {
+		return nil, fmt.Errorf("parsing requests: %v", err)
+	}
+	for i, req := range requests {
+		if req.Pipeline == nil {
+			return nil, fmt.Errorf("request %d has no pipeline", i+1)
+		}
+	}
+	return requests, nil
+}
+
+// prepareBatch prepares each of the raw requests as if it had been given as
+// the input file.  Requests that do not name a project are submitted to
+// project.
+func prepareBatch(project string, requests []*genomics.RunPipelineRequest) ([]string, error) {
+	var err error
+	if config, err = common.LoadConfig(); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, len(requests))
+	for i, req := range requests {
+		names[i] = strconv.Itoa(i + 1)
+		fmt.Printf("=== request %s ===\n", names[i])
+		if req.Pipeline.Resources == nil {
+			req.Pipeline.Resources = &genomics.Resources{}
+		}
+		if req.Pipeline.Resources.ProjectId == "" {
+			req.Pipeline.Resources.ProjectId = project
+		}
+		if err := applyMutators(req); err != nil {
+			return nil, fmt.Errorf("request %s: %v", names[i], err)
+		}
+		if err := finishRequest(req); err != nil {
+			return nil, fmt.Errorf("request %s: %v", names[i], err)
+		}
+	}
+	return names, nil
+}
+
+// runBatch submits each of the prepared requests (with no more than
+// --max-parallel running at once) and then watches each of them (retrying as
+// usual) in turn.  Requests whose outputs already exist are skipped (see
+// --skip-if-outputs-exist).  The requests are identified by the names in the
+// named column of the summary.
+func runBatch(ctx context.Context, service *genomics.Service, column string, names []string, requests []*genomics.RunPipelineRequest) error {
+	if *dryRun || (*attempts == 0 && *pvmAttempts == 0) {
+		return nil
+	}
+
+	results, err := skipRequests(ctx, requests)
+	if err != nil {
+		return err
+	}
+
+	states := make([]*retryState, len(requests))
+	for i, req := range requests {
+		states[i] = newRetryState(req)
+		if results[i] != nil {
+			fmt.Printf("Skipping %s %s: %v\n", column, names[i], results[i])
+		}
+	}
+
+	if err := stageInputs(ctx); err != nil {
+		return err
+	}
+	defer removeStagedInputs(ctx)
+
+	// Each pipeline keeps its slot until it has been watched to completion
+	// (including any retries), at which point the next request is submitted.
+	limit := len(states)
+	if *maxParallel > 0 && *maxParallel < limit {
+		limit = *maxParallel
+	}
+	submit := func(i int) {
+		if results[i] != nil {
+			return
+		}
+		if err := states[i].submit(ctx, service, ""); err != nil {
+			results[i] = fmt.Errorf("submitting %s %s: %v", column, names[i], err)
+			fmt.Println(results[i])
+		}
+	}
+	for i := 0; i < limit; i++ {
+		submit(i)
+	}
+
+	for i, state := range states {
+		if results[i] == nil {
+			fmt.Printf("=== %s %s ===\n", column, names[i])
+			results[i] = runPipeline(ctx, service, state)
+		}
+		if next := i + limit; next < len(states) {
+			submit(next)
+		}
+	}
+
+	if !*wait {
+		return nil
+	}
+	return printResults(column, names, states, results)
+}
+
+// checkBatch returns an error if flags that cannot be used with a batch of
+// pipelines are set.
+func checkBatch() error {
+	switch {
+	case *projects != "":
+		return errors.New("--projects cannot be used with a batch of pipelines")
+	case len(syncDirs) > 0 || *ephemeral:
+		return errors.New("--sync-dir and --ephemeral-service-account cannot be used with a batch of pipelines")
+	case *retryStatePath != "":
+		return errors.New("--retry-state cannot be used with a batch of pipelines")
+	case *local:
+		return errors.New("--local cannot be used with a batch of pipelines")
+	case *maxParallel > 0 && !*wait:
+		return errors.New("--max-parallel requires waiting for the pipelines to finish")
+	}
+	return nil
+}
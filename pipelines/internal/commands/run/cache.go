@@ -0,0 +1,170 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package run
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/common"
+	genomics "google.golang.org/api/genomics/v2alpha1"
+	storage "google.golang.org/api/storage/v1"
+)
+
+const (
+	// hashVariable is the name of the pipeline environment variable that
+	// holds the hash of the pipeline when --skip-if-outputs-exist is set.
+	hashVariable = "PIPELINES_TOOLS_HASH"
+
+	// hashMetadata is the custom metadata key under which the hash is
+	// recorded on each object written to the --outputs destinations.
+	hashMetadata = "pipelines-tools-hash"
+)
+
+// errSkipped is the result of a pipeline that was not run because all of its
+// outputs already exist.
+var errSkipped = errors.New("all of the outputs already exist")
+
+// hashOptions returns the gsutil options that record the pipeline hash in the
+// metadata of the objects it writes (if --skip-if-outputs-exist is set).
+func hashOptions() []string {
+	if !*skipExisting {
+		return nil
+	}
+	return []string{"-h", fmt.Sprintf("x-goog-meta-%s:${%s}", hashMetadata, hashVariable)}
+}
+
+// setHash records the hash of pipeline in its environment.
+func setHash(pipeline *genomics.Pipeline) {
+	if pipeline.Environment == nil {
+		pipeline.Environment = make(map[string]string)
+	}
+	pipeline.Environment[hashVariable] = pipelineHash(pipeline)
+}
+
+// pipelineHash returns a hash of the parts of pipeline that determine its
+// outputs: the environment and the image, entrypoint, commands and
+// environment of each action.  Resources, timeouts and labels are ignored so
+// that, for example, a retry on a larger machine has the same hash.
+//
+// The paths of staged local inputs include a staging ID that is different for
+// every run, so they are replaced by a hash of the contents of the local file.
+// The contents of GCS inputs are not hashed, so changes to them (as opposed to
+// their paths) are not detected.
+func pipelineHash(pipeline *genomics.Pipeline) string {
+	var b bytes.Buffer
+	encoder := json.NewEncoder(&b)
+
+	environment := copyMap(pipeline.Environment)
+	delete(environment, hashVariable)
+	encoder.Encode(environment)
+	for _, action := range pipeline.Actions {
+		encoder.Encode([]interface{}{action.ImageUri, action.Entrypoint, action.Commands, action.Environment})
+	}
+
+	var replacements []string
+	for local, remote := range staged {
+		replacements = append(replacements, remote, "staged:"+fileHash(local))
+	}
+	h := sha256.New()
+	strings.NewReplacer(replacements...).WriteString(h, b.String())
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// fileHash returns a hash of the contents of the named file, or its name if it
+// cannot be read.
+func fileHash(filename string) string {
+	f, err := os.Open(filename)
+	if err != nil {
+		return filename
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return filename
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// skipRequests returns the result of each of requests that does not need to
+// be run (errSkipped, when all of its outputs already exist and were written
+// by the same pipeline) or nil for those that do.
+func skipRequests(ctx context.Context, requests []*genomics.RunPipelineRequest) ([]error, error) {
+	results := make([]error, len(requests))
+	if !*skipExisting || *force {
+		return results, nil
+	}
+
+	service, err := common.NewStorageService(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i, req := range requests {
+		exist, err := outputsExist(ctx, service, req.Pipeline)
+		if err != nil {
+			return nil, fmt.Errorf("checking outputs: %v", err)
+		}
+		if exist {
+			results[i] = errSkipped
+		}
+	}
+	return results, nil
+}
+
+// outputsExist returns true if pipeline has outputs and every one of them
+// already exists and records the hash of pipeline.  Objects recording a
+// different hash (because the script, settings, input paths or staged local
+// inputs have changed since they were written) or no hash at all (because
+// they were written some other way) do not count.
+func outputsExist(ctx context.Context, service *storage.Service, pipeline *genomics.Pipeline) (bool, error) {
+	// The output manifest also includes the --output log file, which is not
+	// a result of the pipeline.
+	var destinations []string
+	for _, destination := range common.Outputs(pipeline) {
+		if destination != *output {
+			destinations = append(destinations, destination)
+		}
+	}
+	if len(destinations) == 0 {
+		return false, nil
+	}
+
+	hash := pipeline.Environment[hashVariable]
+	for _, destination := range destinations {
+		objects, err := common.ListOutput(ctx, service, destination)
+		if err != nil {
+			return false, err
+		}
+		if len(objects) == 0 {
+			return false, nil
+		}
+		for _, object := range objects {
+			if recorded := object.Metadata[hashMetadata]; recorded != hash {
+				fmt.Printf("Output gs://%s/%s was not written by the same pipeline\n", object.Bucket, object.Name)
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
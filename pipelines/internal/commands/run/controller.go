@@ -0,0 +1,255 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package run
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/common"
+	genomics "google.golang.org/api/genomics/v2alpha1"
+	storage "google.golang.org/api/storage/v1"
+)
+
+var (
+	controllerFlags = flag.NewFlagSet("", flag.ExitOnError)
+
+	controllerPrefix   = controllerFlags.String("prefix", "", "the GCS path prefix below which retry state objects are saved")
+	controllerListen   = controllerFlags.String("listen", "", "the address to listen on (defaults to :$PORT, or :8080)")
+	controllerOnce     = controllerFlags.Bool("once", false, "process the retry state objects once and exit instead of listening")
+	controllerGenerate = controllerFlags.String("generate", "", "if set, a directory where Terraform files that deploy the controller to Cloud Run are written")
+	controllerImage    = controllerFlags.String("image", "", "the container image of this tool (with --generate)")
+	controllerRegion   = controllerFlags.String("region", "us-central1", "the Cloud Run region (with --generate)")
+	controllerSchedule = controllerFlags.String("schedule", "*/5 * * * *", "how often the controller checks operations (with --generate)")
+	controllerAccount  = controllerFlags.String("controller-service-account", "", "the service account that runs the controller (with --generate)")
+)
+
+var terraform = template.Must(template.New("terraform").Parse(`# Deploys the pipelines retry controller to Cloud Run, and a Cloud Scheduler
+# job that invokes it periodically.  Pipelines started with
+#
+#   pipelines run --wait=false --retry-state {{.Prefix}}NAME.json ...
+#
+# are then retried by the controller.  The service account must be able to
+# run pipelines, act as the pipeline service account and read and write the
+# retry state objects.
+
+provider "google" {
+  project = "{{.Project}}"
+  region  = "{{.Region}}"
+}
+
+resource "google_cloud_run_service" "retry_controller" {
+  name     = "pipelines-retry-controller"
+  location = "{{.Region}}"
+
+  template {
+    spec {
+      service_account_name = "{{.ServiceAccount}}"
+      container_concurrency = 1
+      containers {
+        image = "{{.Image}}"
+        args  = ["--project", "{{.Project}}", "retry-controller", "--prefix", "{{.Prefix}}"]
+      }
+    }
+  }
+}
+
+resource "google_cloud_run_service_iam_member" "invoker" {
+  service  = google_cloud_run_service.retry_controller.name
+  location = google_cloud_run_service.retry_controller.location
+  role     = "roles/run.invoker"
+  member   = "serviceAccount:{{.ServiceAccount}}"
+}
+
+resource "google_cloud_scheduler_job" "retry_controller" {
+  name     = "pipelines-retry-controller"
+  schedule = "{{.Schedule}}"
+
+  http_target {
+    http_method = "POST"
+    uri         = google_cloud_run_service.retry_controller.status[0].url
+
+    oidc_token {
+      service_account_email = "{{.ServiceAccount}}"
+    }
+  }
+}
+`))
+
+// Controller runs the retry loop for pipelines on behalf of users who are no
+// longer running the tool.  Each time it is triggered (by an HTTP request or
+// with --once), it examines every retry state object below --prefix: finished
+// operations are retried (following the options saved with the state) or
+// their state is removed, and attempts whose backoff delay has passed are
+// submitted.  Since the controller does not wait for operations to finish, it
+// is suitable for running on Cloud Run.
+func Controller(ctx context.Context, service *genomics.Service, project string, arguments []string) error {
+	controllerFlags.Parse(arguments)
+	if *controllerPrefix == "" {
+		return errors.New("--prefix is required")
+	}
+	if !strings.HasSuffix(*controllerPrefix, "/") {
+		*controllerPrefix += "/"
+	}
+
+	if *controllerGenerate != "" {
+		return generateController(project)
+	}
+
+	storageService, err := common.NewStorageService(ctx)
+	if err != nil {
+		return err
+	}
+
+	if *controllerOnce {
+		return processRetryStates(ctx, service, storageService, os.Stdout)
+	}
+
+	address := *controllerListen
+	if address == "" {
+		port := os.Getenv("PORT")
+		if port == "" {
+			port = "8080"
+		}
+		address = ":" + port
+	}
+
+	var mu sync.Mutex
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err := processRetryStates(r.Context(), service, storageService, w); err != nil {
+			fmt.Fprintf(os.Stderr, "Processing retry states: %v\n", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+	fmt.Printf("Listening on %s\n", address)
+	return http.ListenAndServe(address, nil)
+}
+
+// processRetryStates advances every retry loop below the prefix, writing a
+// line per loop to w.
+func processRetryStates(ctx context.Context, service *genomics.Service, storageService *storage.Service, w io.Writer) error {
+	bucket, prefix, err := common.ParseGCSPath(*controllerPrefix)
+	if err != nil {
+		return err
+	}
+
+	var paths []string
+	err = storageService.Objects.List(bucket).Prefix(prefix).Pages(ctx, func(objects *storage.Objects) error {
+		for _, object := range objects.Items {
+			paths = append(paths, fmt.Sprintf("gs://%s/%s", bucket, object.Name))
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("listing retry states: %v", err)
+	}
+
+	for _, path := range paths {
+		status, err := advance(ctx, service, path)
+		if err != nil {
+			status = fmt.Sprintf("error: %v", err)
+		}
+		fmt.Fprintf(w, "%s: %s\n", path, status)
+	}
+	return nil
+}
+
+// advance moves the retry loop saved at path forward without waiting and
+// returns a description of its status.
+func advance(ctx context.Context, service *genomics.Service, path string) (string, error) {
+	state, err := loadRetryState(ctx, path)
+	if err != nil {
+		return "", err
+	}
+
+	if state.Operation != "" {
+		lro, metadata, err := common.GetOperation(ctx, service, state.Operation)
+		if err != nil {
+			return "", err
+		}
+		if !lro.Done {
+			return fmt.Sprintf("attempt %d running as %s", state.Attempt, state.Operation), nil
+		}
+		if lro.Error == nil {
+			state.remove(ctx, path)
+			return fmt.Sprintf("attempt %d succeeded", state.Attempt), nil
+		}
+
+		policy, err := parseRetryPolicy(state.Options.ExitCodes, state.Options.Patterns)
+		if err != nil {
+			return "", fmt.Errorf("parsing retry policy: %v", err)
+		}
+		failure := common.NewPipelineExecutionError(lro.Error, metadata)
+		delay, ok := state.retry(failure, policy)
+		if !ok {
+			state.remove(ctx, path)
+			return fmt.Sprintf("attempt %d failed: %v", state.Attempt, failure), nil
+		}
+		state.NotBefore = time.Now().Add(delay)
+		if err := state.save(ctx, path); err != nil {
+			return "", err
+		}
+	}
+
+	if time.Now().Before(state.NotBefore) {
+		return fmt.Sprintf("attempt %d waiting until %s", state.Attempt, state.NotBefore.Format(time.RFC3339)), nil
+	}
+	if err := state.submit(ctx, service, path); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("attempt %d submitted as %s", state.Attempt, state.Operation), nil
+}
+
+func generateController(project string) error {
+	if *controllerImage == "" || *controllerAccount == "" {
+		return errors.New("--image and --controller-service-account are required with --generate")
+	}
+
+	var config strings.Builder
+	err := terraform.Execute(&config, map[string]string{
+		"Project":        project,
+		"Region":         *controllerRegion,
+		"Image":          *controllerImage,
+		"Prefix":         *controllerPrefix,
+		"Schedule":       *controllerSchedule,
+		"ServiceAccount": *controllerAccount,
+	})
+	if err != nil {
+		return fmt.Errorf("generating configuration: %v", err)
+	}
+
+	if err := os.MkdirAll(*controllerGenerate, 0755); err != nil {
+		return fmt.Errorf("creating directory: %v", err)
+	}
+	filename := filepath.Join(*controllerGenerate, "main.tf")
+	if err := ioutil.WriteFile(filename, []byte(config.String()), 0644); err != nil {
+		return fmt.Errorf("writing configuration: %v", err)
+	}
+	fmt.Printf("Terraform configuration written to %q\n", filename)
+	return nil
+}
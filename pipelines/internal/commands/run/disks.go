@@ -0,0 +1,158 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package run
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/common"
+	genomics "google.golang.org/api/genomics/v2alpha1"
+)
+
+const (
+	// localSSD is the disk type of NVMe local SSDs, which come in units of
+	// localSSDSizeGb.
+	localSSD       = "local-ssd"
+	localSSDSizeGb = 375
+)
+
+var (
+	// diskSpecs holds the values of the --disk flag.
+	diskSpecs common.ListFlagValue
+
+	// dataDisks maps the name of each disk given with --disk to its settings.
+	dataDisks map[string]*genomics.Disk
+
+	diskNamePattern = regexp.MustCompile(`^[a-z]([-a-z0-9]*[a-z0-9])?$`)
+)
+
+// parseDisks parses the --disk flags (each of the form
+// name=NAME,size=GB,type=TYPE,image=IMAGE, where only the name is required).
+func parseDisks(specs []string) (map[string]*genomics.Disk, error) {
+	disks := make(map[string]*genomics.Disk)
+	for _, spec := range specs {
+		disk, err := parseDisk(spec)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := disks[disk.Name]; ok {
+			return nil, fmt.Errorf("disk %q is specified more than once", disk.Name)
+		}
+		disks[disk.Name] = disk
+	}
+	return disks, nil
+}
+
+func parseDisk(spec string) (*genomics.Disk, error) {
+	disk := &genomics.Disk{}
+	for _, field := range strings.Split(spec, ",") {
+		n := strings.Index(field, "=")
+		if n < 0 {
+			return nil, fmt.Errorf("invalid disk setting %q (expected KEY=VALUE)", field)
+		}
+		switch key, value := field[:n], field[n+1:]; key {
+		case "name":
+			disk.Name = value
+		case "size":
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || size <= 0 {
+				return nil, fmt.Errorf("invalid disk size %q", value)
+			}
+			disk.SizeGb = size
+		case "type":
+			disk.Type = value
+		case "image":
+			disk.SourceImage = value
+		default:
+			return nil, fmt.Errorf("unknown disk setting %q (must be name, size, type or image)", key)
+		}
+	}
+
+	if err := checkDiskName(disk.Name); err != nil {
+		return nil, err
+	}
+	if disk.Type == localSSD {
+		if disk.SourceImage != "" {
+			return nil, fmt.Errorf("disk %q: local SSDs cannot be created from an image", disk.Name)
+		}
+		if disk.SizeGb == 0 {
+			disk.SizeGb = localSSDSizeGb
+		}
+		if size := roundLocalSSD(disk.SizeGb); size != disk.SizeGb {
+			fmt.Printf("Warning: local SSDs come in units of %dGB, so disk %q will be %dGB\n", localSSDSizeGb, disk.Name, size)
+			disk.SizeGb = size
+		}
+	}
+	return disk, nil
+}
+
+// checkDiskName returns an error if name cannot be used for an additional
+// disk.
+func checkDiskName(name string) error {
+	if name == googleRoot.Disk {
+		return fmt.Errorf("the %q disk is configured with --disk-size, --disk-type and --disk-image", name)
+	}
+	if !diskNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid disk name %q (must start with a letter and contain only lowercase letters, digits and dashes)", name)
+	}
+	return nil
+}
+
+// roundLocalSSD rounds size up to a whole number of local SSDs.
+func roundLocalSSD(size int64) int64 {
+	return (size + localSSDSizeGb - 1) / localSSDSizeGb * localSSDSizeGb
+}
+
+// diskPath returns the path at which the named disk is mounted.
+func diskPath(name string) string {
+	return path.Join("/mnt", name)
+}
+
+// diskMounts returns the mounts of the additional disks for an action with
+// the given script options.  Every disk given with --disk is mounted unless
+// the action has a 'disk=' option, which lists the disks that it uses (and
+// may name disks that were not given with --disk, which are then created with
+// the default settings).  A ':ro' suffix mounts a disk read only.
+func diskMounts(options map[string]string) ([]*genomics.Mount, error) {
+	var names []string
+	if value, ok := options["disk"]; ok {
+		for _, name := range strings.Split(value, ",") {
+			if name != "" {
+				names = append(names, name)
+			}
+		}
+	} else {
+		for name := range dataDisks {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+
+	var mounts []*genomics.Mount
+	for _, name := range names {
+		readOnly := strings.HasSuffix(name, ":ro")
+		name = strings.TrimSuffix(name, ":ro")
+		if err := checkDiskName(name); err != nil {
+			return nil, err
+		}
+		mounts = append(mounts, &genomics.Mount{Disk: name, Path: diskPath(name), ReadOnly: readOnly})
+	}
+	return mounts, nil
+}
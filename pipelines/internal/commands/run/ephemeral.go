@@ -0,0 +1,391 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package run
+
+import (
+	"context"
+	cryptorand "crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/common"
+	"golang.org/x/oauth2/google"
+	artifactregistry "google.golang.org/api/artifactregistry/v1beta1"
+	genomics "google.golang.org/api/genomics/v2alpha1"
+	"google.golang.org/api/googleapi"
+	iam "google.golang.org/api/iam/v1"
+	storage "google.golang.org/api/storage/v1"
+)
+
+// Roles granted to an ephemeral service account on the buckets and
+// repositories used by the pipeline, and to the caller on the account.
+const (
+	inputRole    = "roles/storage.objectViewer"
+	outputRole   = "roles/storage.objectAdmin"
+	registryRole = "roles/artifactregistry.reader"
+	actAsRole    = "roles/iam.serviceAccountUser"
+)
+
+// A new service account is not immediately visible to every service, so
+// granting roles to it is retried (with backoff) when it fails with one of
+// these codes.  Concurrent policy changes (412 from GCS and 409 from IAM) are
+// retried in any case.
+var (
+	newAccountErrors = map[int]bool{
+		http.StatusBadRequest:         true,
+		http.StatusForbidden:          true,
+		http.StatusNotFound:           true,
+		http.StatusConflict:           true,
+		http.StatusPreconditionFailed: true,
+	}
+	conflictErrors = map[int]bool{
+		http.StatusConflict:           true,
+		http.StatusPreconditionFailed: true,
+	}
+
+	policyAttempts      uint = 8
+	policyRetryDelay         = time.Second
+	policyRetryMaxDelay      = 16 * time.Second
+)
+
+// ephemeralAccount is a service account that is created for a single run and
+// deleted when the run finishes.
+type ephemeralAccount struct {
+	project string
+	email   string
+
+	// buckets maps the name of each bucket used by the pipeline to the role
+	// that was granted to the account on it.
+	buckets map[string]string
+
+	// repositories lists the Artifact Registry repositories the account was
+	// granted read access to.
+	repositories []string
+
+	iam      *iam.Service
+	storage  *storage.Service
+	registry *artifactregistry.Service
+}
+
+// runBuckets returns the buckets named by the --inputs, --outputs and --output
+// flags, mapped to the role the pipeline needs on each of them.
+func runBuckets() map[string]string {
+	buckets := make(map[string]string)
+	for input := range namedListOf(*inputs, "INPUT") {
+		if bucket, _, err := common.ParseGCSPath(input); err == nil && buckets[bucket] == "" {
+			buckets[bucket] = inputRole
+		}
+	}
+	for _, remote := range staged {
+		if bucket, _, err := common.ParseGCSPath(remote); err == nil && buckets[bucket] == "" {
+			buckets[bucket] = inputRole
+		}
+	}
+	destinations := listOf(*output)
+	for output := range namedListOf(*outputs, "OUTPUT") {
+		destinations = append(destinations, output)
+	}
+	if dirs, err := parseSyncDirs(); err == nil {
+		for _, dir := range dirs {
+			destinations = append(destinations, dir.remote)
+		}
+	}
+	for _, output := range destinations {
+		if bucket, _, err := common.ParseGCSPath(output); err == nil {
+			buckets[bucket] = outputRole
+		}
+	}
+	return buckets
+}
+
+// imageResources returns the Container Registry buckets and the Artifact
+// Registry repositories that hold the images used by actions, which the
+// account must be able to read in order to pull them.  Images in other
+// registries are ignored.
+func imageResources(actions []*genomics.Action) (buckets, repositories []string) {
+	seenBuckets := make(map[string]bool)
+	seenRepositories := make(map[string]bool)
+	for _, action := range actions {
+		parts := strings.Split(parseImageName(action.ImageUri), "/")
+		if len(parts) < 3 {
+			continue
+		}
+		host, project := parts[0], parts[1]
+		switch {
+		case host == "gcr.io" || strings.HasSuffix(host, ".gcr.io"):
+			bucket := "artifacts." + project + ".appspot.com"
+			if len(parts) > 3 && strings.Contains(project, ".") {
+				// Domain scoped projects (gcr.io/example.com/project).
+				bucket = fmt.Sprintf("artifacts.%s.%s.a.appspot.com", parts[2], project)
+			}
+			if host != "gcr.io" {
+				bucket = strings.TrimSuffix(host, ".gcr.io") + "." + bucket
+			}
+			if !seenBuckets[bucket] {
+				seenBuckets[bucket] = true
+				buckets = append(buckets, bucket)
+			}
+		case strings.HasSuffix(host, "-docker.pkg.dev") && len(parts) > 3:
+			location := strings.TrimSuffix(host, "-docker.pkg.dev")
+			repository := fmt.Sprintf("projects/%s/locations/%s/repositories/%s", project, location, parts[2])
+			if !seenRepositories[repository] {
+				seenRepositories[repository] = true
+				repositories = append(repositories, repository)
+			}
+		}
+	}
+	return buckets, repositories
+}
+
+// parseImageName removes the tag or digest from an image name.
+func parseImageName(image string) string {
+	if n := strings.Index(image, "@"); n >= 0 {
+		return image[:n]
+	}
+	if n := strings.LastIndex(image, ":"); n > strings.LastIndex(image, "/") {
+		return image[:n]
+	}
+	return image
+}
+
+// newEphemeralAccount creates a service account in project, grants it the
+// given roles on each bucket and read access to the images used by actions,
+// and grants the caller permission to run pipelines as the account.  If
+// granting a role fails, the account is deleted again.
+func newEphemeralAccount(ctx context.Context, project string, buckets map[string]string, actions []*genomics.Action) (*ephemeralAccount, error) {
+	client, err := google.DefaultClient(ctx, iam.CloudPlatformScope)
+	if err != nil {
+		return nil, fmt.Errorf("creating authenticated client: %v", err)
+	}
+	iamService, err := iam.New(client)
+	if err != nil {
+		return nil, fmt.Errorf("creating IAM service: %v", err)
+	}
+	storageService, err := storage.New(client)
+	if err != nil {
+		return nil, fmt.Errorf("creating storage service: %v", err)
+	}
+	registryService, err := artifactregistry.New(client)
+	if err != nil {
+		return nil, fmt.Errorf("creating Artifact Registry service: %v", err)
+	}
+
+	id := make([]byte, 4)
+	if _, err := cryptorand.Read(id); err != nil {
+		return nil, fmt.Errorf("generating account ID: %v", err)
+	}
+	req := &iam.CreateServiceAccountRequest{
+		AccountId: "pipelines-" + hex.EncodeToString(id),
+		ServiceAccount: &iam.ServiceAccount{
+			DisplayName: "Ephemeral pipelines-tools run account",
+		},
+	}
+	sa, err := iamService.Projects.ServiceAccounts.Create("projects/"+project, req).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("creating service account: %v", err)
+	}
+
+	account := &ephemeralAccount{
+		project:  project,
+		email:    sa.Email,
+		buckets:  make(map[string]string),
+		iam:      iamService,
+		storage:  storageService,
+		registry: registryService,
+	}
+	if err := account.grant(ctx, buckets, actions); err != nil {
+		if err := account.delete(ctx); err != nil {
+			fmt.Printf("Failed to delete service account: %v\n", err)
+		}
+		return nil, err
+	}
+	return account, nil
+}
+
+// grant gives the account the given roles on each bucket and read access to
+// the images used by actions, and allows the caller to act as the account.
+func (a *ephemeralAccount) grant(ctx context.Context, buckets map[string]string, actions []*genomics.Action) error {
+	registryBuckets, repositories := imageResources(actions)
+	for _, bucket := range registryBuckets {
+		if buckets[bucket] == "" {
+			buckets[bucket] = inputRole
+		}
+	}
+
+	for bucket, role := range buckets {
+		role := role
+		if err := a.updateBucketPolicy(ctx, bucket, newAccountErrors, func(policy *storage.Policy) {
+			policy.Bindings = append(policy.Bindings, &storage.PolicyBindings{
+				Role:    role,
+				Members: []string{a.member()},
+			})
+		}); err != nil {
+			return fmt.Errorf("granting %s on bucket %q: %v", role, bucket, err)
+		}
+		a.buckets[bucket] = role
+	}
+
+	for _, repository := range repositories {
+		if err := a.updateRepositoryPolicy(ctx, repository, newAccountErrors, func(policy *artifactregistry.Policy) {
+			policy.Bindings = append(policy.Bindings, &artifactregistry.Binding{
+				Role:    registryRole,
+				Members: []string{a.member()},
+			})
+		}); err != nil {
+			return fmt.Errorf("granting %s on repository %q: %v", registryRole, repository, err)
+		}
+		a.repositories = append(a.repositories, repository)
+	}
+
+	caller := principal(ctx)
+	if caller == "unknown" {
+		fmt.Printf("Not granting %s on %q: the caller's account cannot be determined\n", actAsRole, a.email)
+		return nil
+	}
+	resource := fmt.Sprintf("projects/%s/serviceAccounts/%s", a.project, a.email)
+	err := retryPolicyUpdate(ctx, newAccountErrors, func() error {
+		policy, err := a.iam.Projects.ServiceAccounts.GetIamPolicy(resource).Context(ctx).Do()
+		if err != nil {
+			return err
+		}
+		policy.Bindings = append(policy.Bindings, &iam.Binding{
+			Role:    actAsRole,
+			Members: []string{principalMember(caller)},
+		})
+		req := &iam.SetIamPolicyRequest{Policy: policy}
+		_, err = a.iam.Projects.ServiceAccounts.SetIamPolicy(resource, req).Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("granting %s on %q to %q: %v", actAsRole, a.email, caller, err)
+	}
+	return nil
+}
+
+func (a *ephemeralAccount) member() string {
+	return "serviceAccount:" + a.email
+}
+
+// principalMember returns the IAM member name of the account with the given
+// email address.
+func principalMember(email string) string {
+	if strings.HasSuffix(email, ".gserviceaccount.com") {
+		return "serviceAccount:" + email
+	}
+	return "user:" + email
+}
+
+// delete removes the account from the policy of every bucket and repository
+// it was granted a role on and then deletes the account.
+func (a *ephemeralAccount) delete(ctx context.Context) error {
+	var failed []string
+	for bucket := range a.buckets {
+		if err := a.updateBucketPolicy(ctx, bucket, conflictErrors, func(policy *storage.Policy) {
+			for _, binding := range policy.Bindings {
+				binding.Members = removeString(binding.Members, a.member())
+			}
+		}); err != nil {
+			failed = append(failed, fmt.Sprintf("bucket %q: %v", bucket, err))
+		}
+	}
+	for _, repository := range a.repositories {
+		if err := a.updateRepositoryPolicy(ctx, repository, conflictErrors, func(policy *artifactregistry.Policy) {
+			for _, binding := range policy.Bindings {
+				binding.Members = removeString(binding.Members, a.member())
+			}
+		}); err != nil {
+			failed = append(failed, fmt.Sprintf("repository %q: %v", repository, err))
+		}
+	}
+	name := fmt.Sprintf("projects/%s/serviceAccounts/%s", a.project, a.email)
+	if _, err := a.iam.Projects.ServiceAccounts.Delete(name).Context(ctx).Do(); err != nil {
+		failed = append(failed, fmt.Sprintf("deleting %q: %v", a.email, err))
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("cleaning up service account: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// updateBucketPolicy applies update to the IAM policy of bucket, trying again
+// after errors with the retriable codes.
+func (a *ephemeralAccount) updateBucketPolicy(ctx context.Context, bucket string, retriable map[int]bool, update func(*storage.Policy)) error {
+	err := retryPolicyUpdate(ctx, retriable, func() error {
+		policy, err := a.storage.Buckets.GetIamPolicy(bucket).Context(ctx).Do()
+		if err != nil {
+			return err
+		}
+		update(policy)
+		_, err = a.storage.Buckets.SetIamPolicy(bucket, policy).Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("updating IAM policy: %v", err)
+	}
+	return nil
+}
+
+// updateRepositoryPolicy applies update to the IAM policy of an Artifact
+// Registry repository, trying again after errors with the retriable codes.
+func (a *ephemeralAccount) updateRepositoryPolicy(ctx context.Context, repository string, retriable map[int]bool, update func(*artifactregistry.Policy)) error {
+	err := retryPolicyUpdate(ctx, retriable, func() error {
+		policy, err := a.registry.Projects.Locations.Repositories.GetIamPolicy(repository).Context(ctx).Do()
+		if err != nil {
+			return err
+		}
+		update(policy)
+		req := &artifactregistry.SetIamPolicyRequest{Policy: policy}
+		_, err = a.registry.Projects.Locations.Repositories.SetIamPolicy(repository, req).Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("updating IAM policy: %v", err)
+	}
+	return nil
+}
+
+// retryPolicyUpdate calls update until it succeeds, fails with an error that
+// is not an API error with a retriable code or has been tried policyAttempts
+// times, backing off between attempts.
+func retryPolicyUpdate(ctx context.Context, retriable map[int]bool, update func() error) error {
+	for attempt := uint(1); ; attempt++ {
+		err := update()
+		if err == nil || attempt == policyAttempts {
+			return err
+		}
+		if err, ok := err.(*googleapi.Error); !ok || !retriable[err.Code] {
+			return err
+		}
+		select {
+		case <-time.After(backoff(attempt, policyRetryDelay, policyRetryMaxDelay)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// removeString returns values without any occurrences of value.
+func removeString(values []string, value string) []string {
+	var output []string
+	for _, v := range values {
+		if v != value {
+			output = append(output, v)
+		}
+	}
+	return output
+}
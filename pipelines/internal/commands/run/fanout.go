@@ -0,0 +1,185 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package run
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/commands/watch"
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/common"
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/printer"
+	genomics "google.golang.org/api/genomics/v2alpha1"
+)
+
+// fanOut submits the pipeline to each of the projects and then watches all
+// of them (retrying as usual) at once.
+func fanOut(ctx context.Context, service *genomics.Service, filename string, projects []string) error {
+	if *retryStatePath != "" {
+		return errors.New("--retry-state cannot be used with --projects")
+	}
+
+	var states []*retryState
+	for _, project := range projects {
+		fmt.Printf("=== %s ===\n", project)
+		req, err := prepareRequest(filename, project)
+		if err != nil {
+			return fmt.Errorf("project %q: %v", project, err)
+		}
+		states = append(states, newRetryState(req))
+	}
+
+	if *dryRun || (*attempts == 0 && *pvmAttempts == 0) {
+		return nil
+	}
+	return runFanOut(ctx, service, projects, states)
+}
+
+// runFanOut submits each of the pipelines and (with --wait) watches them until
+// they have all finished.  Failing to submit to a project does not stop the
+// others from being submitted: the failure is reported in the summary
+// instead.
+func runFanOut(ctx context.Context, service *genomics.Service, projects []string, states []*retryState) error {
+	var requests []*genomics.RunPipelineRequest
+	for _, state := range states {
+		requests = append(requests, state.Request)
+	}
+	results, err := skipRequests(ctx, requests)
+	if err != nil {
+		return err
+	}
+
+	for i := range states {
+		if results[i] != nil {
+			fmt.Printf("Skipping project %q: %v\n", projects[i], results[i])
+		}
+	}
+
+	if err := stageInputs(ctx); err != nil {
+		return err
+	}
+	defer removeStagedInputs(ctx)
+
+	for i, state := range states {
+		if results[i] != nil {
+			continue
+		}
+		if err := state.submit(ctx, service, ""); err != nil {
+			results[i] = fmt.Errorf("submitting to project %q: %v", projects[i], err)
+			fmt.Println(results[i])
+		}
+	}
+
+	// Each pipeline is retried by its own goroutine, and each of them
+	// cancels its operation when interrupted.
+	var wg sync.WaitGroup
+	for i, state := range states {
+		if results[i] != nil {
+			continue
+		}
+		if !*wait {
+			fmt.Printf("=== %s ===\n", projects[i])
+			results[i] = runPipeline(ctx, service, state)
+			continue
+		}
+		state.heading = fmt.Sprintf("=== %s ===", projects[i])
+		wg.Add(1)
+		go func(i int, state *retryState) {
+			defer wg.Done()
+			results[i] = runPipeline(ctx, service, state)
+		}(i, state)
+	}
+	wg.Wait()
+
+	return printResults("project", projects, states, results)
+}
+
+// watchMu serializes the use of the watch command, which keeps its state in
+// package variables.
+var watchMu sync.Mutex
+
+// pollInterval is how often a pipeline that is waited for without being
+// watched is checked.
+var pollInterval = 10 * time.Second
+
+// watchPipeline watches the current operation of the pipeline.  If the
+// pipeline has a heading, the operation is first waited for without showing
+// its progress.
+func watchPipeline(ctx context.Context, service *genomics.Service, state *retryState, arguments []string) error {
+	if state.heading != "" {
+		waitForOperation(ctx, service, state.Operation)
+	}
+
+	watchMu.Lock()
+	defer watchMu.Unlock()
+	if state.heading != "" {
+		fmt.Println(state.heading)
+	}
+	return watch.Invoke(ctx, service, state.Request.Pipeline.Resources.ProjectId, arguments)
+}
+
+// waitForOperation returns once the operation has finished.  It also returns
+// if the operation cannot be fetched, leaving the error to be reported by the
+// watch that follows.
+func waitForOperation(ctx context.Context, service *genomics.Service, name string) {
+	for {
+		lro, err := service.Projects.Operations.Get(name).Context(ctx).Do()
+		if err != nil || lro.Done {
+			return
+		}
+		select {
+		case <-time.After(pollInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// printResults shows the operation and result of each pipeline (identified by
+// the names in the named column) and returns an error if any of them failed.
+func printResults(column string, names []string, states []*retryState, results []error) error {
+	var failure error
+	var records []printer.Record
+	for i, state := range states {
+		result := "succeeded"
+		if !*wait {
+			result = "submitted"
+		}
+		if err := results[i]; err == errSkipped {
+			result = "skipped"
+		} else if err != nil {
+			result = "failed"
+			if failure == nil {
+				failure = err
+			}
+		}
+		records = append(records, printer.Record{column: names[i], "operation": state.Operation, "result": result})
+	}
+	if err := out.Print(os.Stdout, []string{column, "operation", "result"}, records); err != nil {
+		return err
+	}
+
+	if failure != nil {
+		return common.ExitError{
+			Code: common.ExitCode(failure),
+			Err:  fmt.Errorf("pipelines failed in some %ss (first failure: %v)", column, failure),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package run
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/plugin"
+	genomics "google.golang.org/api/genomics/v2alpha1"
+)
+
+// runPreHooks runs the pre-submission hooks from the configuration file and
+// the --pre-hook flags with the request on their standard input.  If a hook
+// fails, the pipeline must not be submitted.
+func runPreHooks(req *genomics.RunPipelineRequest) error {
+	for _, hook := range append(append([]string{}, config.PreHooks...), preHooks...) {
+		if err := plugin.Hook(hook, req); err != nil {
+			return fmt.Errorf("pre-submit hook: %v", err)
+		}
+	}
+	return nil
+}
+
+// runPostHooks runs the post-completion hooks from the configuration file and
+// the --post-hook flags with the final state of the named operation on their
+// standard input.  Failures are reported but do not change the outcome of the
+// run.
+func runPostHooks(ctx context.Context, service *genomics.Service, name string) {
+	hooks := append(append([]string{}, config.PostHooks...), postHooks...)
+	if len(hooks) == 0 {
+		return
+	}
+
+	lro, err := service.Projects.Operations.Get(name).Context(ctx).Do()
+	if err != nil {
+		fmt.Printf("Failed to get operation for post-completion hooks: %v\n", err)
+		return
+	}
+	for _, hook := range hooks {
+		if err := plugin.Hook(hook, lro); err != nil {
+			fmt.Printf("Post-completion hook failed: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package run
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/common"
+	genomics "google.golang.org/api/genomics/v2alpha1"
+)
+
+// logsPath is where the API exposes the combined output of the actions.
+const logsPath = "/google/logs"
+
+// localRun holds the state of a pipeline that is run with the local Docker
+// daemon.
+type localRun struct {
+	id   string
+	root string
+
+	// disks maps each disk name to the local directory that replaces it.
+	disks map[string]string
+
+	// paths rewrites the paths of mounted disks (and the logs) in commands
+	// that are run on the host.
+	paths *strings.Replacer
+
+	log        io.Writer
+	background []*exec.Cmd
+	containers []string
+}
+
+// runLocal runs the actions of req in order using the local Docker daemon.
+// Actions that use the cloud SDK image to run bash (such as the localizers
+// and delocalizers) are run on the host instead, so that they use the local
+// gsutil and credentials.
+func runLocal(ctx context.Context, req *genomics.RunPipelineRequest) error {
+	root, err := ioutil.TempDir("", "pipelines-local")
+	if err != nil {
+		return fmt.Errorf("creating local directory: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	run := &localRun{
+		id:    filepath.Base(root),
+		root:  root,
+		disks: make(map[string]string),
+	}
+	if err := os.MkdirAll(filepath.Join(root, "logs"), 0755); err != nil {
+		return fmt.Errorf("creating logs directory: %v", err)
+	}
+	f, err := os.Create(filepath.Join(root, "logs", "output"))
+	if err != nil {
+		return fmt.Errorf("creating log file: %v", err)
+	}
+	defer f.Close()
+	run.log = f
+
+	var replacements []string
+	for _, action := range req.Pipeline.Actions {
+		for _, mount := range action.Mounts {
+			if _, ok := run.disks[mount.Disk]; ok {
+				continue
+			}
+			dir := filepath.Join(root, "disks", mount.Disk)
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return fmt.Errorf("creating disk directory: %v", err)
+			}
+			run.disks[mount.Disk] = dir
+			replacements = append(replacements, mount.Path, dir)
+		}
+	}
+	replacements = append(replacements, logsPath, filepath.Join(root, "logs"))
+	run.paths = strings.NewReplacer(replacements...)
+	defer run.stop()
+
+	fmt.Printf("Running locally in %s\n", root)
+	var failure error
+	for i, action := range req.Pipeline.Actions {
+		if failure != nil && !hasFlag(action, "ALWAYS_RUN") {
+			continue
+		}
+
+		environment := make(map[string]string)
+		for k, v := range req.Pipeline.Environment {
+			environment[k] = v
+		}
+		for k, v := range action.Environment {
+			environment[k] = v
+		}
+		if failure != nil {
+			environment["GOOGLE_PIPELINE_FAILED"] = "1"
+		}
+
+		status, err := run.action(ctx, i+1, action, environment)
+		if err != nil {
+			return err
+		}
+		if status != 0 && !hasFlag(action, "IGNORE_EXIT_STATUS") && failure == nil {
+			failure = common.ExitError{
+				Code: common.ExitActionFailed,
+				Err:  fmt.Errorf("action %d (%s) exited with status %d", i+1, action.ImageUri, status),
+			}
+		}
+	}
+	if failure != nil {
+		return failure
+	}
+	fmt.Println("Pipeline execution completed")
+	return nil
+}
+
+// action runs a single action and returns its exit status.  Background
+// actions are started and left running.
+func (r *localRun) action(ctx context.Context, id int, action *genomics.Action, environment map[string]string) (int, error) {
+	if action.Timeout != "" {
+		timeout, err := time.ParseDuration(action.Timeout)
+		if err != nil {
+			return 0, fmt.Errorf("parsing timeout of action %d: %v", id, err)
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var cmd *exec.Cmd
+	container := fmt.Sprintf("%s-%d", r.id, id)
+	if runsOnHost(action) {
+		fmt.Printf("Running action %d on the host\n", id)
+		cmd = exec.Command("bash", r.rewrite(action.Commands)...)
+		cmd.Env = os.Environ()
+		for k, v := range environment {
+			cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", k, r.paths.Replace(v)))
+		}
+	} else {
+		fmt.Printf("Running action %d (%s) with Docker\n", id, action.ImageUri)
+		cmd = exec.Command("docker", dockerArguments(container, action, environment, r.disks, filepath.Join(r.root, "logs"))...)
+		r.containers = append(r.containers, container)
+	}
+	output := io.MultiWriter(os.Stdout, r.log)
+	cmd.Stdout, cmd.Stderr = output, output
+
+	if err := cmd.Start(); err != nil {
+		return 0, fmt.Errorf("starting action %d: %v", id, err)
+	}
+	if hasFlag(action, "RUN_IN_BACKGROUND") {
+		r.background = append(r.background, cmd)
+		return 0, nil
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		return exitStatus(err)
+	case <-ctx.Done():
+		cmd.Process.Kill()
+		exec.Command("docker", "rm", "-f", container).Run()
+		<-done
+		fmt.Printf("Action %d timed out\n", id)
+		return 1, nil
+	}
+}
+
+// rewrite replaces the paths of the mounted disks in commands with the local
+// directories.
+func (r *localRun) rewrite(commands []string) []string {
+	var result []string
+	for _, command := range commands {
+		result = append(result, r.paths.Replace(command))
+	}
+	return result
+}
+
+// stop stops the background actions.
+func (r *localRun) stop() {
+	for _, cmd := range r.background {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}
+	for _, container := range r.containers {
+		exec.Command("docker", "rm", "-f", container).Run()
+	}
+}
+
+// runsOnHost returns true if action is a bash command line that only needs the
+// cloud SDK, which is available on the host.
+func runsOnHost(action *genomics.Action) bool {
+	return action.ImageUri == *cloudSDKImage && action.Entrypoint == "bash"
+}
+
+// dockerArguments returns the arguments to 'docker' that run action in a
+// container with the given name.  The disks map gives the local directory
+// that replaces each disk, and logs is the directory mounted at /google/logs.
+func dockerArguments(name string, action *genomics.Action, environment, disks map[string]string, logs string) []string {
+	arguments := []string{"run", "--rm", "--name", name, "-v", logs + ":" + logsPath}
+	for _, mount := range action.Mounts {
+		volume := disks[mount.Disk] + ":" + mount.Path
+		if mount.ReadOnly {
+			volume += ":ro"
+		}
+		arguments = append(arguments, "-v", volume)
+	}
+
+	var names []string
+	for k := range environment {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		arguments = append(arguments, "-e", k+"="+environment[k])
+	}
+
+	var ports []string
+	for container, host := range action.PortMappings {
+		ports = append(ports, fmt.Sprintf("%d:%s", host, container))
+	}
+	sort.Strings(ports)
+	for _, port := range ports {
+		arguments = append(arguments, "-p", port)
+	}
+
+	if hasFlag(action, "PUBLISH_EXPOSED_PORTS") {
+		arguments = append(arguments, "-P")
+	}
+	if hasFlag(action, "BLOCK_EXTERNAL_NETWORK") {
+		arguments = append(arguments, "--network", "none")
+	}
+	if hasFlag(action, "ENABLE_FUSE") {
+		arguments = append(arguments, "--cap-add", "SYS_ADMIN", "--device", "/dev/fuse")
+	}
+	if action.Entrypoint != "" {
+		arguments = append(arguments, "--entrypoint", action.Entrypoint)
+	}
+	arguments = append(arguments, action.ImageUri)
+	return append(arguments, action.Commands...)
+}
+
+// exitStatus returns the exit status of a command given the result of
+// waiting for it.
+func exitStatus(err error) (int, error) {
+	if err == nil {
+		return 0, nil
+	}
+	if err, ok := err.(*exec.ExitError); ok {
+		if status, ok := err.Sys().(syscall.WaitStatus); ok {
+			return status.ExitStatus(), nil
+		}
+	}
+	return 0, err
+}
@@ -0,0 +1,119 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package run
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/common"
+	genomics "google.golang.org/api/genomics/v2alpha1"
+)
+
+// monitorInterval is the number of seconds between resource usage samples.
+const monitorInterval = 10
+
+// Shell commands shared by the monitoring and profiling actions.  sample
+// prints the total and idle CPU time, from which cpuPercent computes the CPU
+// usage between the $previous and $current samples.  The memory in use (m)
+// and the space used on the google disk (d) are in KB.
+const (
+	sampleCPU  = "sample() { awk '/^cpu / { print $2+$3+$4+$5+$6+$7+$8+$9, $5+$6 }' /proc/stat; }"
+	cpuPercent = `c=$(echo "$previous $current" | awk '{ t = $3 - $1; print (t > 0) ? int(100 * (t - ($4 - $2)) / t) : 0 }')`
+	memoryKB   = "m=$(awk '/^MemTotal:/ { t = $2 } /^MemAvailable:/ { a = $2 } END { print t - a }' /proc/meminfo)"
+)
+
+func diskKB() string {
+	return fmt.Sprintf("d=$(df -Pk %s | awk 'NR == 2 { print $3 }')", googleRoot.Path)
+}
+
+// monitorActions returns a background action that records the peak CPU,
+// memory and disk usage of the VM, and an action that always runs at the end
+// of the pipeline to write the peaks to standard error (where they are
+// captured by the ContainerStoppedEvent and read by the watch command).
+func monitorActions() (sidecar, report *genomics.Action) {
+	peaks := path.Join(googleRoot.Path, ".google", "monitor")
+	script := strings.Join([]string{
+		sampleCPU,
+		"cpu=0; memory=0; disk=0; previous=$(sample)",
+		fmt.Sprintf("while sleep %d; do", monitorInterval),
+		"current=$(sample)",
+		cpuPercent,
+		"previous=$current",
+		memoryKB,
+		diskKB(),
+		"(( c > cpu )) && cpu=$c; (( m > memory )) && memory=$m; (( d > disk )) && disk=$d",
+		fmt.Sprintf(`echo "cpu_percent=$cpu memory_kb=$memory disk_kb=$disk" > %[1]s.tmp && mv %[1]s.tmp %[1]s`, peaks),
+		"done",
+	}, "\n")
+
+	sidecar = bash(script)
+	sidecar.Name = "monitor"
+	sidecar.Flags = []string{"RUN_IN_BACKGROUND"}
+
+	report = bash(fmt.Sprintf(`if [[ -f %s ]]; then echo "%s $(cat %s)" >&2; fi`, peaks, common.MonitorPrefix, peaks))
+	report.Flags = []string{"ALWAYS_RUN"}
+	return sidecar, report
+}
+
+// profilePath returns the GCS path that the samples recorded by --profile are
+// copied to, next to the output file.
+func profilePath(output string) string {
+	return output + ".profile.csv"
+}
+
+// profileActions returns a background action that appends a sample of the
+// CPU, memory, disk and network usage of the VM to a CSV file every interval,
+// and an action that always runs at the end of the pipeline to copy the file
+// to destination and write a summary of the samples to standard error (the
+// peaks in the same form as the monitoring action, so that the watch command
+// also recommends a machine type).
+func profileActions(interval time.Duration, destination string) (sidecar, report *genomics.Action) {
+	samples := path.Join(googleRoot.Path, ".google", "profile.csv")
+	seconds := int(interval.Seconds())
+	if seconds < 1 {
+		seconds = 1
+	}
+	script := strings.Join([]string{
+		sampleCPU,
+		// network prints the bytes received and sent on every interface
+		// except the loopback interface.
+		`network() { awk 'NR > 2 { sub(/^ */, ""); split($0, a, ":"); if (a[1] != "lo") { split(a[2], f, " "); r += f[1]; t += f[9] } } END { print r + 0, t + 0 }' /proc/net/dev; }`,
+		fmt.Sprintf("echo time,cpu_percent,memory_kb,disk_kb,network_rx_bytes,network_tx_bytes > %s", samples),
+		"previous=$(sample); previous_network=$(network)",
+		fmt.Sprintf("while sleep %d; do", seconds),
+		"current=$(sample); current_network=$(network)",
+		cpuPercent,
+		`n=$(echo "$previous_network $current_network" | awk '{ print $3 - $1 "," $4 - $2 }')`,
+		"previous=$current; previous_network=$current_network",
+		memoryKB,
+		diskKB(),
+		fmt.Sprintf(`echo "$(date -u +%%Y-%%m-%%dT%%H:%%M:%%SZ),$c,$m,$d,$n" >> %s`, samples),
+		"done",
+	}, "\n")
+
+	sidecar = bash(script)
+	sidecar.Name = "profile"
+	sidecar.Flags = []string{"RUN_IN_BACKGROUND"}
+
+	summary := fmt.Sprintf(`awk -F, 'NR > 1 { n++; total += $2; if ($2 > c) c = $2; if ($3 > m) m = $3; if ($4 > d) d = $4; r += $5; t += $6 } `+
+		`END { if (n) { printf "%s cpu_percent=%%.0f memory_kb=%%.0f disk_kb=%%.0f\n", c, m, d; printf "%s samples=%%d cpu_average=%%.1f network_rx_bytes=%%.0f network_tx_bytes=%%.0f path=%s\n", n, total / n, r, t } }' %s >&2`,
+		common.MonitorPrefix, common.ProfilePrefix, destination, samples)
+	report = bash(fmt.Sprintf("if [[ -f %[1]s ]]; then %[2]s; gsutil -q cp %[1]s %[3]s; fi", samples, summary, destination))
+	report.Flags = []string{"ALWAYS_RUN"}
+	return sidecar, report
+}
@@ -0,0 +1,212 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package run
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/common"
+	"golang.org/x/oauth2/google"
+	genomics "google.golang.org/api/genomics/v2alpha1"
+	pubsub "google.golang.org/api/pubsub/v1"
+)
+
+// notificationAction is the name of the action that sends the notification
+// from the VM when the tool is not waiting for the pipeline to finish.
+const notificationAction = "notification"
+
+// notification is the JSON message sent by --notify-topic and --notify-url.
+type notification struct {
+	Operation  string            `json:"operation,omitempty"`
+	Status     string            `json:"status"`
+	ExitStatus *int64            `json:"exitStatus,omitempty"`
+	Attempts   uint              `json:"attempts,omitempty"`
+	Worker     string            `json:"worker,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	Output     string            `json:"output,omitempty"`
+	Error      string            `json:"error,omitempty"`
+}
+
+var topicPattern = regexp.MustCompile("^projects/[^/]+/topics/[^/]+$")
+
+// checkNotifyFlags validates the --notify-topic and --notify-url flags.
+func checkNotifyFlags(topic, webhook string) error {
+	if topic != "" && !topicPattern.MatchString(topic) {
+		return fmt.Errorf("invalid topic %q (expecting projects/PROJECT/topics/TOPIC)", topic)
+	}
+	if webhook != "" {
+		u, err := url.Parse(webhook)
+		if err != nil {
+			return fmt.Errorf("parsing URL: %v", err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("invalid URL %q (expecting an http or https URL)", webhook)
+		}
+	}
+	return nil
+}
+
+// notifyTimeout bounds the time spent sending a notification.
+const notifyTimeout = 30 * time.Second
+
+// notifyOnVM returns true if the request sends its own notification from the
+// VM, in which case the tool must not send another one.
+func notifyOnVM(req *genomics.RunPipelineRequest) bool {
+	for _, action := range req.Pipeline.Actions {
+		if action.Name == notificationAction {
+			return true
+		}
+	}
+	return false
+}
+
+// notifyCompletion publishes a notification that the pipeline finished to
+// --notify-topic and --notify-url (if set).  The error is nil if the pipeline
+// succeeded.  Failures to notify are reported but do not change the outcome of
+// the run.
+//
+// A notification is sent however the run ends (including when the pipeline
+// could not be submitted or the tool was interrupted), so it is sent with its
+// own context: the one used for the run may already have been cancelled.
+func notifyCompletion(state *retryState, err error) {
+	if *notifyTopic == "" && *notifyURL == "" || notifyOnVM(state.Request) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+
+	message := notification{
+		Operation: state.Operation,
+		Status:    "succeeded",
+		Attempts:  state.Attempt,
+		Labels:    state.Request.Labels,
+		Output:    *output,
+	}
+	if err != nil {
+		message.Status = "failed"
+		message.Error = err.Error()
+		if err, ok := err.(common.PipelineExecutionError); ok && err.ActionID > 0 {
+			message.ExitStatus = &err.ExitStatus
+		}
+	} else {
+		var exitStatus int64
+		message.ExitStatus = &exitStatus
+	}
+
+	data, err := json.Marshal(message)
+	if err != nil {
+		fmt.Printf("Failed to encode notification: %v\n", err)
+		return
+	}
+	if *notifyTopic != "" {
+		if err := publish(ctx, *notifyTopic, data); err != nil {
+			fmt.Printf("Failed to publish notification to %q: %v\n", *notifyTopic, err)
+		}
+	}
+	if *notifyURL != "" {
+		if err := post(ctx, *notifyURL, data); err != nil {
+			fmt.Printf("Failed to post notification to %q: %v\n", *notifyURL, err)
+		}
+	}
+}
+
+// publish publishes data as a message to a Pub/Sub topic.
+func publish(ctx context.Context, topic string, data []byte) error {
+	client, err := google.DefaultClient(ctx, pubsub.PubsubScope)
+	if err != nil {
+		return fmt.Errorf("creating authenticated client: %v", err)
+	}
+	service, err := pubsub.New(client)
+	if err != nil {
+		return fmt.Errorf("creating Pub/Sub service: %v", err)
+	}
+	req := &pubsub.PublishRequest{
+		Messages: []*pubsub.PubsubMessage{{Data: base64.StdEncoding.EncodeToString(data)}},
+	}
+	if _, err := service.Projects.Topics.Publish(topic, req).Context(ctx).Do(); err != nil {
+		return fmt.Errorf("publishing message: %v", err)
+	}
+	return nil
+}
+
+// post sends data to a webhook URL as JSON.
+func post(ctx context.Context, webhook string, data []byte) error {
+	req, err := http.NewRequest("POST", webhook, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %q", resp.Status)
+	}
+	return nil
+}
+
+// notificationActions returns the actions that send a notification from the
+// VM when the pipeline finishes: one that records that the preceding actions
+// succeeded and one that always runs to send the message.  The VM cannot see
+// the operation name or the exit status of the failed action, so the message
+// identifies the pipeline by its labels and the name of the worker instead.
+func notificationActions(topic, webhook string, labels map[string]string) ([]*genomics.Action, error) {
+	// The placeholders are replaced by the script; they come before any
+	// user supplied values in the encoded message.
+	data, err := json.Marshal(notification{
+		Status: "@status@",
+		Worker: "@worker@",
+		Labels: labels,
+		Output: *output,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("encoding notification: %v", err)
+	}
+
+	marker := path.Join(googleRoot.Path, ".google", "succeeded")
+	record := bash(fmt.Sprintf("touch %s", marker))
+
+	script := []string{
+		"worker=$(curl -s -H Metadata-Flavor:Google http://metadata.google.internal/computeMetadata/v1/instance/name)",
+		fmt.Sprintf("if [[ -f %s ]]; then status=succeeded; else status=failed; fi", marker),
+		"message=${NOTIFICATION/@status@/$status}",
+		"message=${message/@worker@/$worker}",
+	}
+	if topic != "" {
+		script = append(script, fmt.Sprintf(`gcloud pubsub topics publish %s --message "$message" > /dev/null || echo "Failed to publish notification" >&2`, topic))
+	}
+	if webhook != "" {
+		script = append(script, fmt.Sprintf(`curl -sf -X POST -H 'Content-Type: application/json' -d "$message" %q > /dev/null || echo "Failed to post notification" >&2`, webhook))
+	}
+
+	send := bash(strings.Join(script, "\n"))
+	send.Name = notificationAction
+	send.Environment = map[string]string{"NOTIFICATION": string(data)}
+	send.Flags = []string{"ALWAYS_RUN", "IGNORE_EXIT_STATUS"}
+	return []*genomics.Action{record, send}, nil
+}
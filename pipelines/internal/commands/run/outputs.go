@@ -0,0 +1,161 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package run
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/common"
+	storage "google.golang.org/api/storage/v1"
+)
+
+// defaultMaxOutputSize is the size limit applied to --show-outputs when the
+// flag does not specify one.
+const defaultMaxOutputSize = 1 << 20
+
+// outputFilter selects the output objects that are shown by --show-outputs.
+type outputFilter struct {
+	// patterns are matched against the base name of each object.  If there
+	// are no patterns, every object matches.
+	patterns []string
+
+	// maxSize is the size that objects must be smaller than.
+	maxSize uint64
+}
+
+// parseOutputFilter parses a comma separated list of glob patterns and at most
+// one size limit of the form '<SIZE' (for example, '*.txt,*.json,<1MB').
+func parseOutputFilter(input string) (*outputFilter, error) {
+	filter := &outputFilter{maxSize: defaultMaxOutputSize}
+	for _, term := range listOf(input) {
+		if strings.HasPrefix(term, "<") {
+			size, err := parseSize(term[1:])
+			if err != nil {
+				return nil, fmt.Errorf("parsing size limit %q: %v", term, err)
+			}
+			filter.maxSize = size
+			continue
+		}
+		if _, err := path.Match(term, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", term, err)
+		}
+		filter.patterns = append(filter.patterns, term)
+	}
+	return filter, nil
+}
+
+func (f *outputFilter) matches(object *storage.Object) bool {
+	if object.Size >= f.maxSize {
+		return false
+	}
+	if len(f.patterns) == 0 {
+		return true
+	}
+	for _, pattern := range f.patterns {
+		if ok, _ := path.Match(pattern, path.Base(object.Name)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// parseSize parses a number of bytes with an optional (binary) unit suffix
+// such as KB, MB or GB.
+func parseSize(input string) (uint64, error) {
+	units := []struct {
+		suffix     string
+		multiplier uint64
+	}{
+		{"GB", 1 << 30},
+		{"MB", 1 << 20},
+		{"KB", 1 << 10},
+		{"B", 1},
+	}
+	multiplier := uint64(1)
+	input = strings.ToUpper(strings.TrimSpace(input))
+	for _, unit := range units {
+		if strings.HasSuffix(input, unit.suffix) {
+			input = strings.TrimSpace(strings.TrimSuffix(input, unit.suffix))
+			multiplier = unit.multiplier
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(input, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", input)
+	}
+	return uint64(n * float64(multiplier)), nil
+}
+
+// showOutputs prints the contents of the objects written to the outputs
+// destinations that match filter.
+func showOutputs(ctx context.Context, outputs []string, filter *outputFilter) error {
+	service, err := common.NewStorageService(ctx)
+	if err != nil {
+		return err
+	}
+	for _, output := range outputs {
+		objects, err := common.ListOutput(ctx, service, output)
+		if err != nil {
+			return err
+		}
+		for _, object := range objects {
+			if !filter.matches(object) {
+				continue
+			}
+			name := fmt.Sprintf("gs://%s/%s", object.Bucket, object.Name)
+			data, err := common.ReadObject(ctx, service, name)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("==> %s <==\n%s", name, data)
+			if len(data) > 0 && data[len(data)-1] != '\n' {
+				fmt.Println()
+			}
+		}
+	}
+	return nil
+}
+
+// downloadOutputs downloads the objects written to the outputs destinations
+// into dir.
+func downloadOutputs(ctx context.Context, outputs []string, dir string) error {
+	service, err := common.NewStorageService(ctx)
+	if err != nil {
+		return err
+	}
+	written := make(map[string]string)
+	for _, output := range outputs {
+		objects, err := common.ListOutput(ctx, service, output)
+		if err != nil {
+			return err
+		}
+		for _, object := range objects {
+			filename, err := common.DownloadOutput(ctx, service, output, object, dir, written)
+			if err != nil {
+				return err
+			}
+			if filename == "" {
+				continue
+			}
+			fmt.Printf("Downloaded gs://%s/%s to %s\n", object.Bucket, object.Name, filename)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package run
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	genomics "google.golang.org/api/genomics/v2alpha1"
+)
+
+// applyOverrides sets the fields of req named by the --override flags.  Each
+// override is a path (such as "pipeline.actions[0].imageUri", optionally
+// prefixed with "$.") and a value, which is parsed as JSON if possible and is
+// otherwise used as a string.
+func applyOverrides(req *genomics.RunPipelineRequest, overrides []string) error {
+	if len(overrides) == 0 {
+		return nil
+	}
+
+	encoded, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("encoding request: %v", err)
+	}
+	var root interface{}
+	if err := json.Unmarshal(encoded, &root); err != nil {
+		return fmt.Errorf("decoding request: %v", err)
+	}
+
+	for _, override := range overrides {
+		i := strings.Index(override, "=")
+		if i < 0 {
+			return fmt.Errorf("override %q: missing value", override)
+		}
+		path, err := parseOverridePath(override[:i])
+		if err != nil {
+			return fmt.Errorf("override %q: %v", override, err)
+		}
+		root, err = setPath(root, path, override[i+1:])
+		if err != nil {
+			return fmt.Errorf("override %q: %v", override, err)
+		}
+	}
+
+	if encoded, err = json.Marshal(root); err != nil {
+		return fmt.Errorf("encoding request: %v", err)
+	}
+	var updated genomics.RunPipelineRequest
+	if err := json.Unmarshal(encoded, &updated); err != nil {
+		return fmt.Errorf("applying overrides: %v", err)
+	}
+	*req = updated
+	return nil
+}
+
+// parseOverridePath splits a dotted path into object keys (strings) and array
+// indices (ints).
+func parseOverridePath(input string) ([]interface{}, error) {
+	input = strings.TrimPrefix(input, "$.")
+	if input == "" {
+		return nil, errors.New("empty path")
+	}
+
+	var path []interface{}
+	for _, part := range strings.Split(input, ".") {
+		key := part
+		if i := strings.Index(part, "["); i >= 0 {
+			key = part[:i]
+		}
+		if key == "" {
+			return nil, fmt.Errorf("invalid path element %q", part)
+		}
+		path = append(path, key)
+
+		for rest := part[len(key):]; rest != ""; {
+			end := strings.Index(rest, "]")
+			if rest[0] != '[' || end < 0 {
+				return nil, fmt.Errorf("invalid path element %q", part)
+			}
+			index, err := strconv.Atoi(rest[1:end])
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("invalid index in %q", part)
+			}
+			path = append(path, index)
+			rest = rest[end+1:]
+		}
+	}
+	return path, nil
+}
+
+// setPath returns node with the value at path replaced.  Missing objects are
+// created, and an index one past the end of an array appends to it.
+func setPath(node interface{}, path []interface{}, value string) (interface{}, error) {
+	if len(path) == 0 {
+		var v interface{}
+		if err := json.Unmarshal([]byte(value), &v); err != nil {
+			return value, nil
+		}
+		// The API encodes 64-bit integers as strings, so numbers replacing
+		// strings must stay strings.
+		if _, ok := node.(string); ok {
+			if _, ok := v.(float64); ok {
+				return value, nil
+			}
+		}
+		return v, nil
+	}
+
+	switch key := path[0].(type) {
+	case string:
+		object, ok := node.(map[string]interface{})
+		if node == nil {
+			object = make(map[string]interface{})
+		} else if !ok {
+			return nil, fmt.Errorf("%q is not an object", key)
+		}
+		child, err := setPath(object[key], path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		object[key] = child
+		return object, nil
+	case int:
+		array, ok := node.([]interface{})
+		if node != nil && !ok {
+			return nil, fmt.Errorf("[%d] is not an array index", key)
+		}
+		if key > len(array) {
+			return nil, fmt.Errorf("index %d out of range", key)
+		}
+		if key == len(array) {
+			array = append(array, nil)
+		}
+		child, err := setPath(array[key], path[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		array[key] = child
+		return array, nil
+	}
+	return nil, fmt.Errorf("invalid path element %v", path[0])
+}
@@ -0,0 +1,347 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package run
+
+import (
+	"context"
+	cryptorand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/common"
+	genomics "google.golang.org/api/genomics/v2alpha1"
+	"google.golang.org/api/googleapi"
+)
+
+// retryState is the state of a retry loop.  When --retry-state is specified
+// it is saved to GCS after every attempt is submitted so that the loop can be
+// continued by the resume-retries command (possibly on a different machine).
+//
+// Saved states are updated using GCS generation preconditions, so that two
+// drivers (for example, resume-retries and the retry controller) cannot both
+// submit the same attempt.  These attempts are also labelled with the loop ID
+// and attempt number, so that an attempt submitted by a driver that crashed
+// before saving the state is found again rather than submitted twice.
+type retryState struct {
+	Request *genomics.RunPipelineRequest
+
+	// ID identifies the retry loop.
+	ID string
+
+	// Operation is the name of the most recently submitted operation (or
+	// empty if no attempt has been submitted yet).
+	Operation string
+
+	Attempt, PvmAttempts, Attempts uint
+
+	// RetryUntil and Deadline hold the values computed from the
+	// --retry-deadline and --deadline flags (or the zero time).
+	RetryUntil, Deadline time.Time
+
+	// NotBefore is the earliest time at which the next attempt may be
+	// submitted (used by the retry controller to implement backoff).
+	NotBefore time.Time
+
+	Options retryOptions
+
+	// AuditLog is the --audit-log destination of the run, where attempts
+	// submitted by other drivers (such as the retry controller) are also
+	// recorded.
+	AuditLog string
+
+	// heading, if set, is shown before the progress of the pipeline, which
+	// is then only watched once it has finished so that several pipelines
+	// can be waited for at once (see fanOut).
+	heading string
+
+	// generation is the GCS generation of the saved state, or zero if the
+	// state has not been saved or loaded.
+	generation int64
+}
+
+// attemptLabel is the operation label that holds the retry loop ID and attempt
+// number.
+const attemptLabel = "pipelines-tools-attempt"
+
+// retryOptions holds the run flags that control how failed attempts are
+// retried.
+type retryOptions struct {
+	ExitCodes, Patterns string
+	EscalateMemory      bool
+	EscalateDisk        float64
+	RotateZones         bool
+	Delay, MaxDelay     time.Duration
+}
+
+func optionsFromFlags() retryOptions {
+	return retryOptions{
+		ExitCodes:      *retryExitCodes,
+		Patterns:       *retryPatterns,
+		EscalateMemory: *escalateMemory,
+		EscalateDisk:   *escalateDisk,
+		RotateZones:    *rotateZones,
+		Delay:          *retryDelay,
+		MaxDelay:       *retryMaxDelay,
+	}
+}
+
+// override replaces the options whose flags are named in set (those given
+// explicitly on the command line) with the values in from.
+func (o *retryOptions) override(from retryOptions, set map[string]bool) {
+	if set["retry-exit-codes"] {
+		o.ExitCodes = from.ExitCodes
+	}
+	if set["retry-patterns"] {
+		o.Patterns = from.Patterns
+	}
+	if set["escalate-memory"] {
+		o.EscalateMemory = from.EscalateMemory
+	}
+	if set["escalate-disk"] {
+		o.EscalateDisk = from.EscalateDisk
+	}
+	if set["rotate-zones"] {
+		o.RotateZones = from.RotateZones
+	}
+	if set["retry-delay"] {
+		o.Delay = from.Delay
+	}
+	if set["retry-max-delay"] {
+		o.MaxDelay = from.MaxDelay
+	}
+}
+
+// submit starts the next attempt and saves the updated state to path (if it
+// is not empty).
+func (s *retryState) submit(ctx context.Context, service *genomics.Service, path string) error {
+	// Once the attempt counts are exhausted, attempts made because of the
+	// retry deadline use preemptible VMs only if no standard VM attempts were
+	// requested.
+	req := s.Request
+	vm := req.Pipeline.Resources.VirtualMachine
+	vm.Preemptible = s.Attempt <= s.PvmAttempts || (s.Attempts == 0 && s.PvmAttempts > 0)
+
+	deadline = s.Deadline
+	if err := applyDeadline(req.Pipeline); err != nil {
+		return err
+	}
+
+	// Retries may have changed the machine type, disks and zones, so the
+	// policy is checked before every attempt.
+	if err := checkPolicy(req); err != nil {
+		return fmt.Errorf("attempt %d: %v", s.Attempt, err)
+	}
+
+	if s.ID == "" {
+		id := make([]byte, 6)
+		if _, err := cryptorand.Read(id); err != nil {
+			return fmt.Errorf("generating retry loop ID: %v", err)
+		}
+		s.ID = hex.EncodeToString(id)
+	}
+
+	if path != "" {
+		// Only attempts whose state is saved can be found again, so other
+		// requests are submitted without the label (which keeps them the
+		// same from one run to the next, as --replay requires).
+		labels := map[string]string{attemptLabel: fmt.Sprintf("%s-%d", s.ID, s.Attempt)}
+		for k, v := range req.Labels {
+			if k != attemptLabel {
+				labels[k] = v
+			}
+		}
+		req.Labels = labels
+
+		project := req.Pipeline.Resources.ProjectId
+		if name, err := findAttempt(ctx, service, project, labels[attemptLabel]); err != nil {
+			return err
+		} else if name != "" {
+			fmt.Printf("Found attempt %d already running as %q\n", s.Attempt, name)
+			s.Operation = name
+			return s.save(ctx, path)
+		}
+	}
+
+	// The hooks are given the request exactly as it is submitted, after
+	// any changes made for this attempt.
+	if err := runPreHooks(req); err != nil {
+		return fmt.Errorf("attempt %d: %v", s.Attempt, err)
+	}
+
+	if path != "" {
+		// Claim the attempt, which fails if another driver has updated the
+		// state since it was loaded.
+		if err := s.save(ctx, path); err != nil {
+			return fmt.Errorf("claiming attempt %d: %v", s.Attempt, err)
+		}
+	}
+
+	lro, err := service.Pipelines.Run(req).Context(ctx).Do()
+	if err != nil {
+		if err, ok := err.(*googleapi.Error); ok && err.Message != "" {
+			return fmt.Errorf("starting pipeline: %q: %q", err.Message, err.Body)
+		}
+		return fmt.Errorf("starting pipeline: %v", err)
+	}
+	s.Operation = lro.Name
+	s.NotBefore = time.Time{}
+
+	if s.AuditLog != "" {
+		if err := writeAuditRecord(ctx, s.AuditLog, req.Pipeline.Resources.ProjectId, lro.Name, req); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write audit record: %v\n", err)
+		}
+	}
+
+	// If the state cannot be saved, the next driver to load it finds the
+	// attempt by its label instead.
+	if err := s.save(ctx, path); err != nil {
+		return fmt.Errorf("attempt %d was submitted as %q, but saving the retry state failed: %v", s.Attempt, lro.Name, err)
+	}
+	return nil
+}
+
+// findAttempt returns the name of the operation labelled as the given
+// attempt, or an empty string if there is none.
+func findAttempt(ctx context.Context, service *genomics.Service, project, attempt string) (string, error) {
+	var name string
+	filter := common.LabelFilter(map[string]string{attemptLabel: attempt})
+	err := common.ListOperations(ctx, service, project, filter, func(operation *genomics.Operation, metadata *genomics.Metadata) error {
+		name = operation.Name
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("looking for previous attempts: %v", err)
+	}
+	return name, nil
+}
+
+// retry decides whether the attempt that failed with err should be retried.
+// If so, the state is updated for the next attempt (escalating resources or
+// avoiding the failed zone as configured) and the delay before the next
+// attempt is returned.
+func (s *retryState) retry(err common.PipelineExecutionError, policy *retryPolicy) (time.Duration, bool) {
+	oom := s.Options.EscalateMemory && isOutOfMemory(err)
+	full := s.Options.EscalateDisk > 0 && isOutOfSpace(err)
+	remaining := s.Attempt < s.PvmAttempts+s.Attempts || time.Now().Before(s.RetryUntil)
+	if !s.Deadline.IsZero() && time.Now().After(s.Deadline) {
+		remaining = false
+	}
+	if !(policy.isRetriable(err) || oom || full) || !remaining {
+		return 0, false
+	}
+
+	s.Attempt++
+	s.Operation = ""
+	fmt.Printf("Execution failed: %v\n", err)
+
+	vm := s.Request.Pipeline.Resources.VirtualMachine
+	if oom {
+		vm.MachineType = nextMachineType(vm.MachineType)
+		fmt.Printf("Retrying with machine type %q\n", vm.MachineType)
+	}
+	if full {
+		growDisks(vm, s.Options.EscalateDisk)
+	}
+	if s.Options.RotateZones && (err.Reason == common.ReasonPreempted || err.Reason == common.ReasonResourceExhausted) {
+		resources := s.Request.Pipeline.Resources
+		resources.Zones = avoidZone(resources.Zones, err.Zone)
+	}
+	return backoff(s.Attempt-1, s.Options.Delay, s.Options.MaxDelay), true
+}
+
+func (s *retryState) save(ctx context.Context, path string) error {
+	if path == "" {
+		return nil
+	}
+	storage, err := common.NewStorageService(ctx)
+	if err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("encoding retry state: %v", err)
+	}
+	generation, err := common.WriteObjectIfGeneration(ctx, storage, path, encoded, s.generation)
+	if err != nil {
+		return err
+	}
+	s.generation = generation
+	return nil
+}
+
+func loadRetryState(ctx context.Context, path string) (*retryState, error) {
+	storage, err := common.NewStorageService(ctx)
+	if err != nil {
+		return nil, err
+	}
+	encoded, generation, err := common.ReadObjectGeneration(ctx, storage, path)
+	if err != nil {
+		return nil, err
+	}
+	var s retryState
+	if err := json.Unmarshal(encoded, &s); err != nil {
+		return nil, fmt.Errorf("decoding retry state: %v", err)
+	}
+	s.generation = generation
+	return &s, nil
+}
+
+// remove deletes the saved state at path (if it is not empty).
+func (s *retryState) remove(ctx context.Context, path string) {
+	if path == "" {
+		return
+	}
+	storage, err := common.NewStorageService(ctx)
+	if err == nil {
+		err = common.DeleteObjectIfGeneration(ctx, storage, path, s.generation)
+	}
+	if err != nil {
+		fmt.Printf("Failed to remove retry state: %v\n", err)
+	}
+}
+
+// Resume continues a retry loop from the state saved by a previous run with
+// the --retry-state flag.  The retry policy and --audit-log flags accepted by
+// the run command may also be given, replacing the values saved with the
+// state.
+func Resume(ctx context.Context, service *genomics.Service, project string, arguments []string) error {
+	paths := common.ParseFlags(flags, arguments)
+	if len(paths) != 1 {
+		return errors.New("expecting the GCS path of a single retry state object")
+	}
+	*retryStatePath = paths[0]
+
+	if _, err := parseRetryPolicy(*retryExitCodes, *retryPatterns); err != nil {
+		return fmt.Errorf("parsing retry policy: %v", err)
+	}
+
+	state, err := loadRetryState(ctx, paths[0])
+	if err != nil {
+		return fmt.Errorf("loading retry state: %v", err)
+	}
+	set := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	state.Options.override(optionsFromFlags(), set)
+	if set["audit-log"] {
+		state.AuditLog = *auditLog
+	}
+
+	return runPipeline(ctx, service, state)
+}
@@ -17,9 +17,11 @@ package run
 
 // This tool runs pipelines using the Google Genomics Pipelines API.
 //
-// The tool can execute either a single command line (via the --command flag)
-// or read and execute an input file consisting of:
+// The tool can execute either command lines given with the --command flag
+// (which may be repeated, with each command run in sequence as if it were a
+// line of a script) or read and execute an input file consisting of:
 // - a raw JSON encoded API request
+// - a JSON encoded array of raw API requests (which are all submitted)
 // - a JSON encoded array of action objects
 // - a script file (whose format is described below)
 //
@@ -28,7 +30,15 @@ package run
 // the tool reads from standard input.
 //
 // If a raw request is given as an input the tool does not do any of the
-// additional processing described below.
+// additional processing described below.  In every case, the request is then
+// passed through any request mutators listed in the configuration file (see
+// the plugin package).
+//
+// Environment variables can be set using --set NAME=VALUE, or copied from the
+// local environment using --pass-env, which takes a comma separated list of
+// variable names or patterns (such as "AWS_*").  Variables set with --set take
+// precedence.  Note that the values become part of the request, so they are
+// visible to anyone who can view the operation.
 //
 // The script file format consists of a series of command lines.  Each line is
 // executed as a 'bash' command line in a separate container and must succeed
@@ -42,6 +52,48 @@ package run
 // --image flag or on a per command basis using "# image=...".  The image must
 // contain a 'bash' binary.
 //
+// The "# no-network" option (an alias for the BLOCK_EXTERNAL_NETWORK flag)
+// prevents a command from accessing the network outside the VM, which can be
+// used to ensure that steps handling sensitive data cannot send it elsewhere
+// while the steps that copy inputs and outputs still have network access.
+//
+// The "# fuse" option (an alias for the ENABLE_FUSE flag) gives a command
+// access to /dev/fuse and the capabilities needed to mount FUSE filesystems
+// (such as sshfs or gcsfuse).  Filesystems mounted below /mnt/google are
+// visible to the actions that follow.
+//
+// Actions run in separate PID namespaces unless --share-pids is set.  The
+// "# pidns=NAME" option places an action in the named PID namespace instead,
+// so that (for example) a monitoring command can see the processes of just the
+// command it monitors.
+//
+// Commands that build or launch containers themselves (such as Nextflow or
+// Toil) can use the "# docker" option.  A Docker daemon is then started in the
+// background (using the --docker-image image) and $DOCKER_HOST is set so that
+// the command connects to it once the daemon is ready.  Since the API does not
+// support privileged containers or mounting the host Docker socket, the daemon
+// runs with only the capabilities granted by the ENABLE_FUSE flag: containers
+// it starts have no bridge network (use "--network host" for network access)
+// and some workloads may still need more privileges than that.
+//
+// GPUs can be requested for individual commands using "# gpus=N" and
+// "# gpu-type=TYPE".  Since GPUs are attached to the VM, the VM gets the
+// largest number of GPUs requested by any command (or by --gpus) and a warning
+// is shown if commands request different types of GPU.
+//
+// Besides the "google" disk (sized by --disk-size), additional persistent
+// disks and local SSDs can be attached with --disk (for example,
+// "--disk name=work,size=750,type=local-ssd"), which may be repeated.  Each
+// disk is mounted at /mnt/NAME in every command, unless a command has a
+// "# disk=NAME,..." option listing the disks it uses (with ':ro' to mount a
+// disk read only).  Local SSD sizes are rounded up to multiples of 375GB.
+//
+// Ports in the container can be published on the VM using "# ports=...",
+// which takes a list of CONTAINER:HOST port mappings separated by ';'.  Either
+// side can be a range of ports of the same length (for example,
+// "# ports=4040:4040;8000-8010:8000-8010"), and "publish-all" publishes every
+// port exposed by the image.
+//
 // Files from GCS can be specified as inputs to the pipeline using the --inputs
 // flag.  These files will be copied onto the VM.  The names of the localized
 // files are exposed via the environment variables $INPUT0 to $INPUTN, or, if
@@ -50,16 +102,44 @@ package run
 // In addition to GCS paths, small local files may also be specified as an
 // input.  The files will be packaged as part of the request so there are
 // significant limitations on the size of the file.  This functionality should
-// only be used for inputs such as configuration files or short scripts.
+// only be used for inputs such as configuration files or short scripts, unless
+// --staging-location is set, in which case local files larger than 64KiB are
+// copied to that GCS path before the pipeline is submitted, localized like
+// any other GCS input, and deleted once the pipeline finishes.
 //
 // GCS destinations may be specified with the --outputs flag.  Each output file
 // will be exposed by via the environment variables $OUTPUT0 to $OUTPUTN.
 //
+// The --download-outputs flag names a local directory that the outputs are
+// downloaded to once the pipeline succeeds.  Outputs written to a directory or
+// tree keep their relative paths under the local directory.
+//
+// The --sync-dir flag (LOCAL=gs://bucket/prefix) mirrors a local directory to
+// a GCS prefix before the pipeline is submitted and copies it onto the VM,
+// exposing its path via the environment variables $SYNC0 to $SYNCN.  When the
+// pipeline finishes (even if it fails), the directory on the VM is copied back
+// to GCS and any changed files are downloaded into the local directory, except
+// for local files that were changed while the pipeline ran (which are reported
+// as an error instead of being overwritten).  Files deleted on either side are
+// not deleted from the other.
+//
+// The progress of each copy is written to the pipeline output (see --output and
+// --output-interval) every time it advances by --progress-step percent, which
+// shows how much of a large input has been copied.  Use --progress-step=0 to
+// copy quietly.
+//
 // Entire directories or even subtrees can be localized or delocalized by
 // appending the suffixes '/* or '/**' respectively.  The $OUTPUTN variable
 // will no longer point to a file, but to a directory where files are either
 // copied to (for --inputs) or from (for --outputs).
 //
+// Individual commands can also declare their own GCS inputs and outputs with
+// the "# in=..." and "# out=..." options, which take the same comma separated
+// lists as --inputs and --outputs.  The inputs are copied immediately before
+// the command and the outputs immediately after it, and their local paths are
+// exposed to the command alone via $IN0 to $INN and $OUT0 to $OUTN (or the
+// names given as NAME=gs://...).
+//
 // Since each command is executed in a separate container, disk writes are not
 // typically visible between containers.  To facilitate the sharing of files
 // between commands, the $TMPDIR variable is set to a writeable path on the
@@ -67,16 +147,217 @@ package run
 // delocalized.
 //
 // As a convenience, the tool will automatically use the cloud SDK image
-// whenever the command line starts with gsutil or gcloud, and will
+// whenever the command line runs gsutil or gcloud, and will
 // automatically include the cloud-platform API scope whenever the cloud SDK
-// container is used.
+// container is used.  The bq command is treated in the same way, and the first
+// word of the command is found after skipping any environment variable
+// assignments and wrappers such as 'env' and 'time'.  Other commands can be
+// added using the "cloudCommands" section of the configuration file
+// (~/.pipelines-tools/config.json), or mapped to images in its "images"
+// section, for example:
+//
+//    {"images": {"samtools": "quay.io/biocontainers/samtools:1.19"}}
 //
 // If the --output flag is specified, an action is appended that copies the
 // combined pipeline output to the specified GCS path.
+// With --follow-logs, the output is also copied periodically while the
+// pipeline runs (every 30 seconds unless --output-interval is set) and the
+// new output is shown together with the events of the operation.
+//
+// Failed pipelines are retried (up to the limits set by --pvm-attempts and
+// --attempts) unless the failure is known to be fatal.  Failures that would
+// not normally be retried can be made retriable using --retry-exit-codes (for
+// actions that exit with one of the given statuses) or --retry-patterns (for
+// errors whose message or standard error output match one of the given
+// regular expressions).
+//
+// Instead of counting attempts, --retry-deadline can be used to keep retrying
+// until the given amount of time has passed since the first attempt was
+// submitted.
+//
+// When an attempt is preempted or fails due to a lack of resources, the zone
+// it ran in is removed from the list of zones for the next attempt (unless it
+// is the last one).  Use --rotate-zones=false to disable this.
+//
+// The retry loop normally only runs while the tool is running.  If
+// --retry-state is set to a GCS path, the state of the loop is saved there
+// after every attempt is submitted and the 'resume-retries' command can be
+// used to continue it later (for example, after --wait=false or if the tool
+// was interrupted).
+//
+// The state of each unfinished run is also kept on this machine (in
+// ~/.pipelines-tools/runs), and 'run --resume ID' reattaches to the current
+// attempt of a run or continues its retry loop, for example after the laptop
+// running the tool went to sleep.  The 'runs list' command shows these runs
+// and the status of their latest attempts.  The record of a run is removed
+// once it succeeds or fails for good (including when an attempt cannot be
+// submitted or contact with the operation is lost).  Runs that are not waited
+// for (--wait=false) are not recorded.
+//
+// The --deadline flag sets an absolute time by which the pipeline must be
+// finished: it limits the timeout of each attempt and prevents any retries
+// from starting after the deadline.
+//
+// By default, failed attempts are retried immediately.  The --retry-delay flag
+// adds an exponentially increasing (and randomized) delay between attempts,
+// which avoids wasting attempts during a transient shortage of capacity.
+//
+// If --escalate-memory is set, failures that look like an action ran out of
+// memory are retried using a machine type with more memory (for example,
+// n1-standard-4 is followed by n1-highmem-4 and then n1-highmem-8).
+// Similarly, if --escalate-disk is set, failures caused by the attached disk
+// filling up are retried with the disk size multiplied by the given factor.
+//
+// The --debug-hold flag keeps the VM (and its disk) running for the given
+// duration when an action fails, which can be combined with --ssh to log in
+// and investigate the failure.  Note that the pipeline --timeout still applies.
+// With --debug-notify, a message containing the command needed to connect to
+// the VM is posted to the given webhook URL when the hold starts.
+//
+// The --projects flag submits the same pipeline to each of several projects
+// (for example, to keep each tenant's data in its own project).  All of the
+// pipelines are submitted before any of them are watched, and they are then
+// waited for (and retried) at once, with the progress of each shown when it
+// finishes.  An interrupt cancels all of them.  A project that the pipeline
+// cannot be submitted to is reported in the summary without stopping the
+// others.  Retries are not supported with --retry-state when --projects is
+// used.
+//
+// A batch of raw requests is also submitted before any of them are watched,
+// but the pipelines are watched one at a time.  The --max-parallel flag limits
+// the number of pipelines running at once, so that the next request is only
+// submitted once an earlier pipeline has finished (including its retries).
+// Requests that do not name a project are submitted to --project.
+//
+// The --batch flag runs the script once for each row of a sample sheet (a TSV
+// file, or a CSV file if the name ends with .csv) whose header row names the
+// columns.  References of the form ${COLUMN} in the script (or the --command
+// flags), --inputs and --outputs are replaced by the values from the row, and
+// the pipelines are then run as for a batch of raw requests (so --max-parallel
+// applies) with a summary that names each row by its first column.
+//
+// The --local flag runs the actions on this machine using the local Docker
+// daemon instead of submitting the pipeline, which is useful for testing
+// scripts.  Each disk is replaced by a temporary directory, the actions are
+// run in order (honouring the background, always run and ignore exit status
+// flags) and actions that run bash in the cloud SDK image (such as those that
+// copy inputs and outputs) are run on the host so that they use the local
+// gsutil and credentials.  PID namespaces and VM resources are ignored.
+//
+// The --audit-log flag records every submitted request, together with the
+// operation name, the account used and the command line, either as a new
+// object below a GCS path (use a bucket retention policy to make the log
+// tamper proof) or as a row in a BigQuery table.
+//
+// The --scopes flag adds OAuth scopes to the service account used by the VM.
+// Scopes can be given as full URLs or using short names such as 'bigquery',
+// 'pubsub', 'storage-ro' or 'storage-rw'.
+//
+// With --strict-scopes, the actions are examined to find the scopes they need
+// (for example, storage for gsutil, bigquery for bq and cloud-platform for
+// other gcloud commands or Secret Manager) and the VM is given only those
+// scopes and the ones requested with --scopes.  The resulting set is printed,
+// and a warning is shown if cloud-platform was requested but does not appear
+// to be needed (the scope is still granted, since it was asked for).
+//
+// The --localize-timeout, --run-timeout and --delocalize-timeout flags set the
+// timeout of each action that copies inputs, runs a command or copies outputs
+// respectively, so that a stuck transfer fails quickly without limiting the
+// time available to the commands themselves.  A '# timeout=' option takes
+// precedence over --run-timeout.
+//
+// The --skip-if-outputs-exist flag checks, before submitting, whether every
+// destination named by --outputs already exists in GCS and if so does not run
+// the pipeline, which saves recomputing the rows of a batch that succeeded
+// before a partial failure.  A hash of the actions and environment of the
+// pipeline is recorded in the metadata of the objects it writes, and only
+// outputs recording the same hash count as existing: those written before the
+// script, settings, input paths or staged local inputs changed (or written some
+// other way) do not.  Changes to the contents of GCS inputs are not detected.
+// --force runs the pipeline regardless.
+//
+// The --show-outputs flag prints the contents of small output files once the
+// pipeline succeeds.  It takes a comma separated list of patterns that are
+// matched against the names of the objects written to the --outputs and
+// --output destinations, and an optional size limit (for example,
+// "*.txt,*.json,<1MB").  Objects of 1MB or more are not shown unless a larger
+// limit is given.
+//
+// The --timeline flag writes an HTML timeline of the pipeline once it finishes
+// (whether or not it succeeds), showing when each action pulled its image,
+// transferred files or ran its command.  The timeline can be written to a
+// local file or to GCS (for example, next to the outputs).
+//
+// The --monitor flag adds a background action that samples the CPU, memory and
+// disk usage of the VM every 10 seconds, and an action that always runs at the
+// end of the pipeline to report the peaks.  When the pipeline finishes, the
+// peaks are shown together with the cheapest predefined machine type (and disk
+// size) that would have been large enough.
+//
+// The --profile flag is similar, but records a sample of the CPU, memory, disk
+// and network usage every --profile-interval (10 seconds by default) in a CSV
+// file that is copied next to the --output file (with ".profile.csv" appended
+// to its name) when the pipeline finishes.  The peaks are then shown as with
+// --monitor, together with the average CPU usage and the network traffic.
+//
+// Instead of naming a machine type, --min-cores and --min-ram can be used to
+// specify the CPUs and memory (in GB) that the pipeline needs: the cheapest
+// predefined or custom machine type that provides them is then used.
+// Alternatively, --cpus and --memory select the custom machine type with
+// exactly that many CPUs and GB of memory (by default, 3.75GB per CPU), which
+// must have 1 or an even number of CPUs, between 0.9GB and 6.5GB of memory
+// per CPU and a multiple of 0.25GB of memory.  --min-cpu-platform requests a
+// minimum CPU platform (such as "Intel Skylake") for any machine type.
+//
+// The --policy flag names a policy file (see the policy package) that the
+// request is checked against before it is submitted, so that platform teams
+// can enforce conventions such as allowed images, zones and machine types.
+// The "policy" setting in the configuration file applies a policy to every
+// run.
+//
+// The --override flag sets a field of the request (after any mutators have
+// run) to provide access to API fields that have no flag of their own.  The
+// field is named by a dotted path using the JSON field names, with array
+// elements selected by index (for example, "pipeline.actions[1].imageUri"),
+// and the value is parsed as JSON if possible (so "null" clears a field).
+//
+// The --pre-hook flag runs a local command with the request (as JSON) on its
+// standard input before each attempt is submitted (so it sees the request as
+// changed by retries), and the submission is abandoned if the command fails,
+// which allows custom validation.  Similarly, --post-hook runs a local command
+// with the final state of the operation on its standard input when it stops
+// running, whether or not it succeeded (for example, to register results or
+// update a ticket).  Both flags can be repeated, and hooks can also be listed
+// in the "preHooks" and "postHooks" sections of the configuration file.
+//
+// The --notify-topic and --notify-url flags publish a JSON message to a Pub/Sub
+// topic or post it to a webhook when the pipeline finishes (after any retries),
+// with the operation name, labels, status, exit status and output path.  A
+// failure is also reported if an attempt cannot be submitted, if contact with
+// the operation is lost or if the tool is interrupted.  With --wait=false, the
+// message is sent from the VM by an action that always runs at the end of the
+// pipeline instead, and it names the worker rather than the operation (which
+// the VM does not know).
+//
+// The --ephemeral-service-account flag creates a new service account for the
+// run, grants it read access to the buckets named by --inputs (and to the
+// Container Registry buckets and Artifact Registry repositories holding the
+// images) and write access to the buckets named by --outputs and --output,
+// allows the caller to act as it, runs the pipeline as that account and then
+// removes the grants and deletes the account.  The tool must wait for the
+// pipeline to finish.
 //
 // The --dry-run flag can be used to see what pipeline would be produced
 // without executing it.
 //
+// The --validate flag checks the request before it is submitted: the GCS
+// inputs must exist (and should be readable by the VM's service account), the
+// output buckets must exist, the images must be found in their registries and
+// the GPUs must be available in the selected zones or regions.  A warning is
+// also shown if the inputs are larger than the disk.  All problems are reported
+// together, and the pipeline is not submitted if any check fails.  Combine it
+// with --dry-run to validate without running the pipeline.
+//
 // Example: Simple 'hello world' script
 //
 //    echo "Hello World!"
@@ -115,22 +396,25 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"net/url"
 	"os"
 	"os/signal"
 	"path"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/googlegenomics/pipelines-tools/pipelines/internal/commands/watch"
 	"github.com/googlegenomics/pipelines-tools/pipelines/internal/common"
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/plugin"
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/policy"
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/printer"
 	"golang.org/x/oauth2/google"
 	compute "google.golang.org/api/compute/v1"
 	genomics "google.golang.org/api/genomics/v2alpha1"
-	"google.golang.org/api/googleapi"
 )
 
 var (
@@ -138,18 +422,36 @@ var (
 	environment = make(map[string]string)
 	labels      = make(map[string]string)
 	vmLabels    = make(map[string]string)
+	commands    common.ListFlagValue
+	preHooks    common.ListFlagValue
+	postHooks   common.ListFlagValue
+	syncDirs    common.ListFlagValue
+	overrides   common.ListFlagValue
+
+	// config holds the settings from the configuration file.
+	config = &common.Config{}
+
+	// deadline is the time by which the pipeline must complete (parsed from
+	// the --deadline flag).
+	deadline time.Time
 
 	flags = flag.NewFlagSet("", flag.ExitOnError)
 
 	basePath       = flags.String("base-path", "", "optional API service base path")
 	name           = flags.String("name", "", "optional name applied as a label")
-	scopes         = flags.String("scopes", "", "comma separated list of additional API scopes")
+	scopes         = flags.String("scopes", "", "comma separated list of additional API scopes (URLs or short names such as bigquery, pubsub or storage-rw)")
 	zones          = flags.String("zones", "", "comma separated list of zone names or prefixes (e.g. us-*)")
 	regions        = flags.String("regions", "", "comma separated list of region names or prefixes (e.g. us-*)")
 	output         = flags.String("output", "", "GCS path to write output to")
 	dryRun         = flags.Bool("dry-run", false, "don't run, just show pipeline")
+	validate       = flags.Bool("validate", false, "check that the inputs, output buckets, images and GPUs exist before submitting the pipeline (or with --dry-run, instead of submitting it)")
 	wait           = flags.Bool("wait", true, "wait for the pipeline to finish")
 	machineType    = flags.String("machine-type", "n1-standard-1", "machine type to create")
+	minCores       = flags.Float64("min-cores", 0, "if non-zero, the minimum number of CPUs (the cheapest machine type with enough CPUs and memory is used instead of --machine-type)")
+	minRAM         = flags.Float64("min-ram", 0, "if non-zero, the minimum amount of memory in GB (the cheapest machine type with enough CPUs and memory is used instead of --machine-type)")
+	cpus           = flags.Int("cpus", 0, "if non-zero, the number of CPUs of the custom machine type to use instead of --machine-type")
+	memory         = flags.Float64("memory", 0, "if non-zero, the memory in GB of the custom machine type to use with --cpus (defaults to 3.75GB per CPU)")
+	cpuPlatform    = flags.String("min-cpu-platform", "", "if set, the minimum CPU platform of the VM (e.g. 'Intel Skylake')")
 	inputs         = flags.String("inputs", "", "comma separated list of GCS objects to localize to the VM")
 	outputs        = flags.String("outputs", "", "comma separated list of GCS objects to delocalize from the VM")
 	diskSizeGb     = flags.Int("disk-size", 0, "if non-zero, overrides the default attached disk size (in GB)")
@@ -157,44 +459,288 @@ var (
 	diskImage      = flags.String("disk-image", "", "optional image to pre-load onto the attached disk")
 	bootDiskSizeGb = flags.Int("boot-disk-size", 0, "if non-zero, specifies the boot disk size (in GB)")
 	privateAddress = flags.Bool("private-address", false, "use a private IP address")
+	passEnv        = flags.String("pass-env", "", "comma separated list of local environment variables (or patterns such as AWS_*) to copy into the pipeline environment")
+	downloadDir    = flags.String("download-outputs", "", "if set, a local directory that the outputs are downloaded to after the pipeline succeeds")
+	stagingLoc     = flags.String("staging-location", "", "GCS path that local inputs too large to include in the request are copied to while the pipeline runs")
+	policyFile     = flags.String("policy", "", "optional policy file that the request must satisfy (in addition to the policy in the configuration file)")
 	cloudSDKImage  = flags.String("cloud-sdk-image", "gcr.io/cloud-genomics-pipelines/io", "the cloud SDK image to use")
 	timeout        = flags.Duration("timeout", 0, "how long to wait before the operation is abandoned")
+	deadlineFlag   = flags.String("deadline", "", "if set, the time (RFC3339 or local) by which the pipeline must complete, including retries")
 	defaultImage   = flags.String("image", "bash", "the default image to use when executing commands")
 	attempts       = flags.Uint("attempts", 0, "number of attempts on non-fatal failure, using non-preemptible VM")
 	pvmAttempts    = flags.Uint("pvm-attempts", 1, "number of attempts on non-fatal failure, using preemptible VM")
 	gpus           = flags.Int("gpus", 0, "the number of GPUs to attach")
 	gpuType        = flags.String("gpu-type", "nvidia-tesla-k80", "the GPU type to attach")
-	command        = flags.String("command", "", "a single command line to execute")
 	fuse           = flags.Bool("fuse", false, "if true, use FUSE to localize inputs (see README)")
 	ssh            = flags.Bool("ssh", false, "if true, an ssh server will be started")
+	showOutputsFor = flags.String("show-outputs", "", "if set, a comma separated list of patterns (and optionally a size limit such as '<1MB') selecting outputs to print after the pipeline succeeds")
+	monitor        = flags.Bool("monitor", false, "record the peak CPU, memory and disk usage of the VM and recommend a machine type when the pipeline finishes")
+	profile        = flags.Bool("profile", false, "record the CPU, memory, disk and network usage of the VM every --profile-interval to a CSV file next to --output, and summarize it when the pipeline finishes")
+	profileEvery   = flags.Duration("profile-interval", 10*time.Second, "the time between the samples recorded by --profile")
+	showCost       = flags.Bool("cost", false, "show the estimated cost of the pipeline and of each action")
+	timeline       = flags.String("timeline", "", "if set, a local file or GCS path where an HTML timeline of the actions is written when the pipeline finishes")
+	teeLog         = flags.String("tee-log", "", "if set, a local file that the progress of the pipeline is also appended to")
+	progressStep   = flags.Int("progress-step", 10, "if non-zero, the percentage by which a copy of inputs or outputs must advance before its progress is logged")
+	dockerImage    = flags.String("docker-image", "docker:dind", "the image used to run the Docker daemon for actions with the docker option")
 	network        = flags.String("network", "", "the VPC network to use")
 	subnetwork     = flags.String("subnetwork", "", "the VPC subnetwork to use")
-	sharePIDs      = flags.Bool("share-pids", false, "if true, all actions will share the same PID namespace")
+	debugHold      = flags.Duration("debug-hold", 0, "if non-zero, how long to keep the VM running after an action fails")
+	debugNotify    = flags.String("debug-notify", "", "if set, a webhook URL (e.g. for Slack) that is notified when the VM is held after a failure")
+	strictScopes   = flags.Bool("strict-scopes", false, "if true, only the scopes the actions are found to need are granted to the VM")
+	sharePIDs      = flags.Bool("share-pids", false, "if true, all actions (except those with a '# pidns=' option) will share the same PID namespace")
 	cosChannel     = flags.String("cos-channel", "", "if set, specifies the COS release channel to use")
 	serviceAccount = flags.String("service-account", "", "if set, specifies the service account for the VM")
+	ephemeral      = flags.Bool("ephemeral-service-account", false, "if true, a service account with access to only the input and output buckets is created for the run and deleted afterwards")
 	outputInterval = flags.Duration("output-interval", 0, "if non-zero, specifies the time interval for logging output during runs")
+	followLogs     = flags.Bool("follow-logs", false, "show the output of the actions while the pipeline runs (requires --output, and copies the output every 30s unless --output-interval is set)")
+	retryExitCodes = flags.String("retry-exit-codes", "", "comma separated list of action exit codes that should be retried")
+	retryPatterns  = flags.String("retry-patterns", "", "comma separated list of regular expressions matching errors that should be retried")
+	escalateMemory = flags.Bool("escalate-memory", false, "if true, retry out of memory failures using a machine type with more memory")
+	retryDelay     = flags.Duration("retry-delay", 0, "if non-zero, the initial delay between attempts (doubled after each failure, with jitter)")
+	retryMaxDelay  = flags.Duration("retry-max-delay", 30*time.Minute, "the maximum delay between attempts")
+	retryDeadline  = flags.Duration("retry-deadline", 0, "if non-zero, keep retrying failures until this much time has passed, regardless of the number of attempts")
+	retryStatePath = flags.String("retry-state", "", "if set, the GCS path where the retry state is saved so that it can be resumed with resume-retries")
+	rotateZones    = flags.Bool("rotate-zones", true, "if true, avoid the zone of a preempted or exhausted attempt when retrying")
+	escalateDisk   = flags.Float64("escalate-disk", 0, "if non-zero, the factor by which to grow the attached disk when retrying out of space failures")
+	bqTable        = flags.String("bq-table", "", "if set, a BigQuery table ([PROJECT.]DATASET.TABLE) where a row describing each attempt is written")
+	bqActions      = flags.Bool("bq-actions", false, "if true, include the timing of each action in the --bq-table rows")
+	projects       = flags.String("projects", "", "if set, a comma separated list of projects that the pipeline is submitted to (instead of --project)")
+	local          = flags.Bool("local", false, "if true, run the actions on this machine using the local Docker daemon instead of submitting the pipeline")
+	maxParallel    = flags.Int("max-parallel", 0, "if non-zero, the maximum number of pipelines from a batch (of requests or samples) that run at once")
+	sampleSheet    = flags.String("batch", "", "if set, a TSV or CSV file with a header row: one pipeline is run per row, with ${COLUMN} in the script, --inputs and --outputs replaced by the row's values")
+	out            = printer.New(flags, nil)
+	auditLog       = flags.String("audit-log", "", "if set, a GCS path prefix or BigQuery table (DATASET.TABLE) where a record of every submission is written")
+	skipExisting   = flags.Bool("skip-if-outputs-exist", false, "if true, don't run pipelines whose --outputs all exist already (and were written by the same pipeline)")
+	force          = flags.Bool("force", false, "if true, run pipelines even if --skip-if-outputs-exist would skip them")
+	resume         = flags.String("resume", "", "if set, the ID of an unfinished run (see 'runs list') to reattach to or continue retrying")
+	notifyTopic    = flags.String("notify-topic", "", "if set, a Pub/Sub topic (projects/PROJECT/topics/TOPIC) that a JSON message is published to when the pipeline finishes")
+	notifyURL      = flags.String("notify-url", "", "if set, a webhook URL that a JSON message is posted to when the pipeline finishes")
+)
+
+// Timeouts for the actions in each phase of the pipeline.
+var (
+	localizeTimeout   = flags.Duration("localize-timeout", 0, "if non-zero, the timeout for each action that copies inputs to the VM")
+	runTimeout        = flags.Duration("run-timeout", 0, "if non-zero, the timeout for each action that runs a command (unless set with '# timeout=')")
+	delocalizeTimeout = flags.Duration("delocalize-timeout", 0, "if non-zero, the timeout for each action that copies outputs from the VM")
 )
 
 func init() {
 	flags.Var(&common.MapFlagValue{environment}, "set", "sets an environment variable (e.g. NAME[=VALUE])")
 	flags.Var(&common.MapFlagValue{labels}, "labels", "label names and values to apply to the operation")
 	flags.Var(&common.MapFlagValue{vmLabels}, "vm-labels", "label names and values to apply to the virtual machine")
+	flags.Var(&commands, "command", "a command line to execute (may be repeated to run several commands in sequence)")
+	flags.Var(&syncDirs, "sync-dir", "a local directory and GCS prefix (LOCAL=gs://bucket/prefix) that is uploaded before the run, exposed on the VM and downloaded afterwards (may be repeated)")
+	flags.Var(&preHooks, "pre-hook", "a local command that is given the request (as JSON) before it is submitted and can prevent submission by failing (may be repeated)")
+	flags.Var(&postHooks, "post-hook", "a local command that is given the operation (as JSON) when the pipeline finishes (may be repeated)")
+	flags.Var(&diskSpecs, "disk", "an additional disk to attach, as name=NAME[,size=GB][,type=TYPE][,image=IMAGE] (e.g. name=work,size=750,type=local-ssd), mounted at /mnt/NAME (may be repeated)")
+	flags.Var(&overrides, "override", "a path and value (such as pipeline.resources.virtualMachine.nvidiaDriverVersion=450.51.06) that overrides a field of the request (may be repeated)")
 }
 
 func Invoke(ctx context.Context, service *genomics.Service, project string, arguments []string) error {
-	filenames := common.ParseFlags(flags, arguments)
+	filename, err := parseArguments(arguments)
+	if err != nil {
+		return err
+	}
+
+	if _, err := parseRetryPolicy(*retryExitCodes, *retryPatterns); err != nil {
+		return fmt.Errorf("parsing retry policy: %v", err)
+	}
+
+	if err := out.Validate(); err != nil {
+		return err
+	}
+
+	if *showOutputsFor != "" {
+		if _, err := parseOutputFilter(*showOutputsFor); err != nil {
+			return fmt.Errorf("parsing --show-outputs: %v", err)
+		}
+	}
+
+	if len(syncDirs) > 0 && (!*wait || *projects != "") {
+		return errors.New("--sync-dir requires waiting for the pipeline to finish and cannot be used with --projects")
+	}
+
+	if *followLogs && (*output == "" || !*wait) {
+		return errors.New("--follow-logs requires --output and waiting for the pipeline to finish")
+	}
+
+	if *profile && *output == "" {
+		return errors.New("--profile requires --output (the samples are written next to it)")
+	}
+
+	if err := checkNotifyFlags(*notifyTopic, *notifyURL); err != nil {
+		return fmt.Errorf("parsing notification flags: %v", err)
+	}
+	if *local && (*notifyTopic != "" || *notifyURL != "") {
+		return errors.New("--notify-topic and --notify-url cannot be used with --local")
+	}
+
+	if *downloadDir != "" && !*wait {
+		return errors.New("--download-outputs requires waiting for the pipeline to finish")
+	}
+
+	if *stagingLoc != "" {
+		if _, _, err := common.ParseGCSPath(*stagingLoc); err != nil {
+			return fmt.Errorf("parsing --staging-location: %v", err)
+		}
+	}
+
+	if *deadlineFlag != "" {
+		deadline, err = parseDeadline(*deadlineFlag)
+		if err != nil {
+			return fmt.Errorf("parsing deadline: %v", err)
+		}
+	}
+
+	if *ephemeral {
+		switch {
+		case *serviceAccount != "":
+			return errors.New("--ephemeral-service-account cannot be used with --service-account")
+		case *projects != "" || *retryStatePath != "":
+			return errors.New("--ephemeral-service-account cannot be used with --projects or --retry-state")
+		case !*wait:
+			return errors.New("--ephemeral-service-account requires waiting for the pipeline to finish")
+		}
+	}
+
+	if *local && (*projects != "" || *ephemeral || !*wait) {
+		return errors.New("--local cannot be used with --projects, --ephemeral-service-account or --wait=false")
+	}
+
+	if *validate && (*projects != "" || *sampleSheet != "" || *local || *resume != "") {
+		return errors.New("--validate cannot be used with --projects, --batch, --local or --resume")
+	}
+
+	if *resume != "" {
+		if filename != "" || *projects != "" || *sampleSheet != "" || *local {
+			return errors.New("--resume cannot be used with an input file, --projects, --batch or --local")
+		}
+		return resumeRun(ctx, service, *resume)
+	}
+
+	requests, err := parseBatch(filename)
+	if err != nil {
+		return err
+	}
+	if requests != nil {
+		if *validate {
+			return errors.New("--validate cannot be used with a batch of requests")
+		}
+		if err := checkBatch(); err != nil {
+			return err
+		}
+		names, err := prepareBatch(project, requests)
+		if err != nil {
+			return err
+		}
+		return runBatch(ctx, service, "request", names, requests)
+	}
+
+	if *sampleSheet != "" {
+		if err := checkBatch(); err != nil {
+			return err
+		}
+		column, names, requests, err := prepareSamples(filename, project, *sampleSheet)
+		if err != nil {
+			return err
+		}
+		return runBatch(ctx, service, column, names, requests)
+	}
+
+	if *projects != "" {
+		return fanOut(ctx, service, filename, listOf(*projects))
+	}
+
+	req, err := prepareRequest(filename, project)
+	if err != nil {
+		return err
+	}
+
+	if *validate {
+		if err := validateRequest(ctx, req); err != nil {
+			return err
+		}
+	}
+
+	if *dryRun || (*attempts == 0 && *pvmAttempts == 0) {
+		return nil
+	}
+
+	skipped, err := skipRequests(ctx, []*genomics.RunPipelineRequest{req})
+	if err != nil {
+		return err
+	}
+	if skipped[0] != nil {
+		fmt.Println("Not running the pipeline: all of its outputs already exist (use --force to run it anyway)")
+		return nil
+	}
+
+	if err := stageInputs(ctx); err != nil {
+		return err
+	}
+	defer removeStagedInputs(ctx)
+
+	dirs, err := parseSyncDirs()
+	if err != nil {
+		return err
+	}
+	if err := uploadSyncDirs(ctx, dirs); err != nil {
+		return fmt.Errorf("synchronizing directories: %v", err)
+	}
 
-	var filename string
-	if len(filenames) > 0 {
-		if len(filenames) > 1 {
-			return errors.New("only a single input file may be specified")
+	if *ephemeral {
+		account, err := newEphemeralAccount(ctx, project, runBuckets(), req.Pipeline.Actions)
+		if err != nil {
+			return fmt.Errorf("creating ephemeral service account: %v", err)
 		}
-		filename = filenames[0]
+		defer func() {
+			if err := account.delete(ctx); err != nil {
+				fmt.Printf("Failed to delete ephemeral service account: %v\n", err)
+			}
+		}()
+		fmt.Printf("Running as ephemeral service account %q\n", account.email)
+		req.Pipeline.Resources.VirtualMachine.ServiceAccount.Email = account.email
 	}
+	if *local {
+		if err := runPreHooks(req); err != nil {
+			return err
+		}
+		err = runLocal(ctx, req)
+	} else {
+		err = runPipeline(ctx, service, newRetryState(req))
+	}
+	if syncErr := downloadSyncDirs(ctx, dirs); syncErr != nil {
+		fmt.Printf("Failed to synchronize directories: %v\n", syncErr)
+	}
+	return err
+}
 
+// prepareRequest builds the request for project, applies the deadline and
+// shows the result.
+func prepareRequest(filename, project string) (*genomics.RunPipelineRequest, error) {
 	req, err := buildRequest(filename, project)
 	if err != nil {
-		return fmt.Errorf("building request: %v", err)
+		return nil, fmt.Errorf("building request: %v", err)
+	}
+	if err := finishRequest(req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// finishRequest applies the deadline to req, checks it against the policy and
+// shows the result.
+func finishRequest(req *genomics.RunPipelineRequest) error {
+	if *skipExisting {
+		setHash(req.Pipeline)
+	}
+
+	if err := applyDeadline(req.Pipeline); err != nil {
+		return err
+	}
+
+	if err := checkPolicy(req); err != nil {
+		return err
 	}
 
 	encoded, err := json.MarshalIndent(req, "", "  ")
@@ -202,50 +748,388 @@ func Invoke(ctx context.Context, service *genomics.Service, project string, argu
 		return fmt.Errorf("encoding request: %v", err)
 	}
 	fmt.Printf("%s\n", encoded)
+	return nil
+}
 
-	if *dryRun || (*attempts == 0 && *pvmAttempts == 0) {
+// newRetryState returns the initial state of the retry loop for req.
+func newRetryState(req *genomics.RunPipelineRequest) *retryState {
+	state := &retryState{
+		Request:     req,
+		Attempt:     1,
+		PvmAttempts: *pvmAttempts,
+		Attempts:    *attempts,
+		Deadline:    deadline,
+		Options:     optionsFromFlags(),
+		AuditLog:    *auditLog,
+	}
+	if *retryDeadline > 0 {
+		state.RetryUntil = time.Now().Add(*retryDeadline)
+	}
+	return state
+}
+
+// BuildRequest parses the arguments of the run command and returns the
+// request that it would submit.
+func BuildRequest(project string, arguments []string) (*genomics.RunPipelineRequest, error) {
+	filename, err := parseArguments(arguments)
+	if err != nil {
+		return nil, err
+	}
+	req, err := buildRequest(filename, project)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkPolicy(req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// resetFlags restores every flag to its default value, so that the values (and
+// the environment built from them) of one invocation of the command do not
+// leak into the next when it is invoked more than once (for example, by the
+// listen and schedule commands).
+func resetFlags() {
+	flags.VisitAll(func(f *flag.Flag) {
+		switch f.Value.(type) {
+		case *common.ListFlagValue, *common.MapFlagValue:
+			return
+		}
+		f.Value.Set(f.DefValue)
+	})
+	for _, values := range []map[string]string{environment, labels, vmLabels} {
+		for name := range values {
+			delete(values, name)
+		}
+	}
+	commands, preHooks, postHooks, syncDirs, overrides, diskSpecs = nil, nil, nil, nil, nil, nil
+	deadline = time.Time{}
+
+	// A flag set cannot forget which flags were given, so the flags are
+	// moved to a new set (see isFlagSet).
+	reset := flag.NewFlagSet("", flag.ExitOnError)
+	flags.VisitAll(func(f *flag.Flag) {
+		reset.Var(f.Value, f.Name, f.Usage)
+		reset.Lookup(f.Name).DefValue = f.DefValue
+	})
+	flags = reset
+}
+
+// parseArguments parses the run command flags and returns the name of the
+// input file (if any).
+func parseArguments(arguments []string) (string, error) {
+	resetFlags()
+	staged, stagingID = make(map[string]string), ""
+	stepAccelerators = make(map[*genomics.Action]*genomics.Accelerator)
+	stepTransfers = make(map[*genomics.Action]*stepTransfer)
+
+	filenames := common.ParseFlags(flags, arguments)
+
+	var err error
+	if dataDisks, err = parseDisks(diskSpecs); err != nil {
+		return "", fmt.Errorf("parsing --disk: %v", err)
+	}
+
+	if len(filenames) > 1 {
+		return "", errors.New("only a single input file may be specified")
+	}
+	if len(filenames) == 1 {
+		return filenames[0], nil
+	}
+	return "", nil
+}
+
+// parseDeadline parses an absolute deadline, which is either an RFC3339
+// timestamp or a date and time in the local time zone.
+func parseDeadline(input string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, input); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02 15:04"} {
+		if t, err := time.ParseInLocation(layout, input, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid deadline %q (expected a time such as 2006-01-02T15:04:05Z)", input)
+}
+
+// applyDeadline limits the pipeline timeout so that it cannot run beyond the
+// deadline (if one was specified).
+func applyDeadline(pipeline *genomics.Pipeline) error {
+	if deadline.IsZero() {
 		return nil
 	}
+	remaining := time.Until(deadline)
+	if remaining <= 0 {
+		return fmt.Errorf("the deadline (%s) has already passed", deadline.Format(time.RFC3339))
+	}
+	if current, err := time.ParseDuration(pipeline.Timeout); err == nil && current < remaining {
+		return nil
+	}
+	pipeline.Timeout = apiDuration(remaining)
+	return nil
+}
+
+// retryPolicy extends the set of failures that are considered retriable.
+type retryPolicy struct {
+	exitCodes map[int64]bool
+	patterns  []*regexp.Regexp
+}
+
+func parseRetryPolicy(exitCodes, patterns string) (*retryPolicy, error) {
+	policy := &retryPolicy{exitCodes: make(map[int64]bool)}
+	for _, v := range listOf(exitCodes) {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parsing exit code: %v", err)
+		}
+		policy.exitCodes[n] = true
+	}
+	for _, v := range listOf(patterns) {
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return nil, fmt.Errorf("parsing pattern: %v", err)
+		}
+		policy.patterns = append(policy.patterns, re)
+	}
+	return policy, nil
+}
+
+// isRetriable returns true if err is retriable by default or matches one of
+// the additional conditions in the policy.
+func (p *retryPolicy) isRetriable(err common.PipelineExecutionError) bool {
+	if err.IsRetriable() {
+		return true
+	}
+	if err.Reason == common.ReasonCancelled {
+		return false
+	}
+	if err.ActionID > 0 && p.exitCodes[err.ExitStatus] {
+		return true
+	}
+	for _, re := range p.patterns {
+		if re.MatchString(err.Message) || re.MatchString(err.Stderr) {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns how long to wait before the next attempt after the given
+// number of failures.  The delay grows exponentially and is randomized by up to
+// 50% in either direction so that many pipelines failing at the same time do
+// not all retry at the same time.  The randomized delay never exceeds max.
+func backoff(failures uint, initial, max time.Duration) time.Duration {
+	if initial <= 0 || failures == 0 {
+		return 0
+	}
+	delay := initial
+	for i := uint(1); i < failures && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	jitter := (rand.Float64() - 0.5) * float64(delay)
+	delay = (delay + time.Duration(jitter)).Round(time.Second)
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// avoidZone removes zone from zones, unless it is the only zone remaining.
+func avoidZone(zones []string, zone string) []string {
+	var remaining []string
+	for _, z := range zones {
+		if z != zone {
+			remaining = append(remaining, z)
+		}
+	}
+	if len(remaining) == 0 || len(remaining) == len(zones) {
+		return zones
+	}
+	fmt.Printf("Avoiding zone %q for the next attempt\n", zone)
+	return remaining
+}
+
+// outOfMemoryPattern matches the messages printed when a process runs out of
+// memory or is killed by the OOM killer, as whole words so that (for example)
+// "room" or "bloom" do not match.
+var outOfMemoryPattern = regexp.MustCompile(`(?i)\b(out of memory|oom|oom[- ]?kill(ed|er)?|outofmemoryerror|cannot allocate memory)\b`)
+
+// isOutOfMemory returns true if err looks like an action was killed because
+// the VM ran out of memory.  An exit status of 137 (SIGKILL) is not enough on
+// its own, since actions are also killed by timeouts and cancellation.
+func isOutOfMemory(err common.PipelineExecutionError) bool {
+	for _, text := range []string{err.Message, err.Stderr} {
+		if outOfMemoryPattern.MatchString(text) {
+			return true
+		}
+	}
+	return false
+}
+
+// isOutOfSpace returns true if err looks like an action failed because the
+// attached disk was full.
+func isOutOfSpace(err common.PipelineExecutionError) bool {
+	for _, text := range []string{err.Message, err.Stderr} {
+		if strings.Contains(strings.ToLower(text), "no space left on device") {
+			return true
+		}
+	}
+	return false
+}
+
+// growDisks increases the size of the attached disks by factor.
+func growDisks(vm *genomics.VirtualMachine, factor float64) {
+	for _, disk := range vm.Disks {
+		size := disk.SizeGb
+		if size == 0 {
+			size = defaultDiskSizeGb
+		}
+		disk.SizeGb = int64(float64(size) * factor)
+		if disk.Type == localSSD {
+			disk.SizeGb = roundLocalSSD(disk.SizeGb)
+		}
+		fmt.Printf("Retrying with disk %q of size %dGB\n", disk.Name, disk.SizeGb)
+	}
+}
 
-	return runPipeline(ctx, service, req)
+// nextMachineType returns a machine type with more memory than machineType:
+// standard and high CPU types are replaced by the high memory type with the
+// same number of CPUs, high memory types double the number of CPUs and custom
+// types double their memory.
+func nextMachineType(machineType string) string {
+	parts := strings.Split(machineType, "-")
+	if n := len(parts); n >= 3 && parts[n-3] == "custom" {
+		if mb, err := strconv.Atoi(parts[n-1]); err == nil {
+			parts[n-1] = strconv.Itoa(mb * 2)
+		}
+		return strings.Join(parts, "-")
+	}
+	if len(parts) != 3 {
+		return machineType
+	}
+	cpus, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return machineType
+	}
+	if parts[1] == "highmem" {
+		cpus *= 2
+	}
+	return fmt.Sprintf("%s-highmem-%d", parts[0], cpus)
 }
 
-func runPipeline(ctx context.Context, service *genomics.Service, req *genomics.RunPipelineRequest) error {
+func runPipeline(ctx context.Context, service *genomics.Service, state *retryState) error {
+	policy, err := parseRetryPolicy(state.Options.ExitCodes, state.Options.Patterns)
+	if err != nil {
+		return fmt.Errorf("parsing retry policy: %v", err)
+	}
+
 	abort := make(chan os.Signal, 1)
 	signal.Notify(abort, os.Interrupt)
+	defer signal.Stop(abort)
 
-	attempt := uint(1)
 	for {
-		req.Pipeline.Resources.VirtualMachine.Preemptible = (attempt <= *pvmAttempts)
-
-		lro, err := service.Pipelines.Run(req).Context(ctx).Do()
-		if err != nil {
-			if err, ok := err.(*googleapi.Error); ok && err.Message != "" {
-				return fmt.Errorf("starting pipeline: %q: %q", err.Message, err.Body)
+		if state.Operation == "" {
+			if err := state.submit(ctx, service, *retryStatePath); err != nil {
+				state.forget()
+				notifyCompletion(state, err)
+				return err
 			}
-			return fmt.Errorf("starting pipeline: %v", err)
+		}
+		// Only runs that are being waited for can be resumed.
+		if *wait {
+			state.record()
 		}
 
-		cancelOnInterrupt(ctx, service, lro.Name, abort)
+		stop := cancelOnInterrupt(ctx, service, state.Operation, abort)
 
-		fmt.Printf("Pipeline running as %q (attempt: %d, preemptible: %t)\n", lro.Name, attempt, req.Pipeline.Resources.VirtualMachine.Preemptible)
+		fmt.Printf("Pipeline running as %q (attempt: %d, preemptible: %t)\n", state.Operation, state.Attempt, state.Request.Pipeline.Resources.VirtualMachine.Preemptible)
 		if *output != "" {
 			fmt.Printf("Output will be written to %q\n", *output)
 		}
 
 		if !*wait {
+			if *retryStatePath != "" {
+				fmt.Printf("Use 'resume-retries %s' to continue retrying\n", *retryStatePath)
+			}
 			return nil
 		}
 
-		if err := watch.Invoke(ctx, service, req.Pipeline.Resources.ProjectId, []string{lro.Name}); err != nil {
-			if err, ok := err.(common.PipelineExecutionError); ok && err.IsRetriable() {
-				if attempt < *pvmAttempts+*attempts {
-					attempt++
-					fmt.Printf("Execution failed: %v\n", err)
+		watchArguments := []string{state.Operation}
+		if *bqTable != "" {
+			watchArguments = append([]string{"--bq-table", *bqTable, fmt.Sprintf("--bq-actions=%t", *bqActions)}, watchArguments...)
+		}
+		if *teeLog != "" {
+			watchArguments = append([]string{"--tee-log", *teeLog}, watchArguments...)
+		}
+		if *timeline != "" {
+			watchArguments = append([]string{"--timeline", *timeline}, watchArguments...)
+		}
+		if *showCost {
+			watchArguments = append([]string{"--cost"}, watchArguments...)
+		}
+		if *followLogs {
+			watchArguments = append([]string{"--follow-logs"}, watchArguments...)
+		}
+		// Suggestions are only shown once retries are exhausted.
+		// Watching the run again after an interruption (with --resume) only
+		// shows the events that were missed.
+		watchArguments = append([]string{"--suggest=false", "--resume"}, watchArguments...)
+		watchArguments = append(out.Arguments(), watchArguments...)
+		err := watchPipeline(ctx, service, state, watchArguments)
+		stop()
+		if err != nil {
+			if err, ok := err.(common.PipelineExecutionError); ok {
+				if delay, ok := state.retry(err, policy); ok {
+					state.record()
+					if delay > 0 {
+						fmt.Printf("Waiting %s before the next attempt\n", delay)
+						select {
+						case <-time.After(delay):
+						case <-abort:
+							err := errors.New("interrupted while waiting to retry")
+							notifyCompletion(state, err)
+							return err
+						}
+					}
 					continue
 				}
+				state.remove(ctx, *retryStatePath)
+				state.forget()
+				runPostHooks(ctx, service, state.Operation)
+				notifyCompletion(state, err)
+				common.PrintSuggestions(os.Stderr, err)
+				return common.ExitError{
+					Code: err.ExitCode(),
+					Err:  fmt.Errorf("operation %q failed: %v", state.Operation, err),
+				}
+			}
+			state.forget()
+			runPostHooks(ctx, service, state.Operation)
+			notifyCompletion(state, err)
+			return fmt.Errorf("operation %q failed: %v", state.Operation, err)
+		}
+		state.remove(ctx, *retryStatePath)
+		state.forget()
+		runPostHooks(ctx, service, state.Operation)
+		notifyCompletion(state, nil)
+
+		if *showOutputsFor != "" {
+			filter, err := parseOutputFilter(*showOutputsFor)
+			if err != nil {
+				return fmt.Errorf("parsing --show-outputs: %v", err)
+			}
+			if err := showOutputs(ctx, common.Outputs(state.Request.Pipeline), filter); err != nil {
+				fmt.Printf("Failed to show outputs: %v\n", err)
+			}
+		}
+		if *downloadDir != "" {
+			if err := downloadOutputs(ctx, common.Outputs(state.Request.Pipeline), *downloadDir); err != nil {
+				return fmt.Errorf("downloading outputs: %v", err)
 			}
-			return fmt.Errorf("operation %q failed: %v", lro.Name, err)
 		}
 		return nil
 	}
@@ -261,7 +1145,60 @@ func parseJSON(filename string, v interface{}) error {
 	return json.NewDecoder(f).Decode(v)
 }
 
+// buildRequest creates the request for filename (or the --command flags) and
+// passes it through the request mutators and the --override flags.
 func buildRequest(filename, project string) (*genomics.RunPipelineRequest, error) {
+	var err error
+	if config, err = common.LoadConfig(); err != nil {
+		return nil, err
+	}
+
+	req, err := newRequest(filename, project)
+	if err != nil {
+		return nil, err
+	}
+	if err := applyMutators(req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// applyMutators passes req through the request mutators from the
+// configuration file and then applies the --override flags.
+func applyMutators(req *genomics.RunPipelineRequest) error {
+	for _, mutator := range config.Mutators {
+		if err := plugin.Mutate(mutator, req); err != nil {
+			return fmt.Errorf("applying mutator: %v", err)
+		}
+	}
+	return applyOverrides(req, overrides)
+}
+
+// checkPolicy validates req against the policy in the configuration file and
+// the one named by the --policy flag (a request must satisfy both).
+func checkPolicy(req *genomics.RunPipelineRequest) error {
+	// The configuration is read again since the request may be submitted
+	// without building it (for example, by resume-retries).
+	c, err := common.LoadConfig()
+	if err != nil {
+		return err
+	}
+	for _, filename := range []string{c.Policy, *policyFile} {
+		if filename == "" {
+			continue
+		}
+		p, err := policy.Load(filename)
+		if err != nil {
+			return err
+		}
+		if err := p.Check(req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newRequest(filename, project string) (*genomics.RunPipelineRequest, error) {
 	if filename != "" {
 		var req genomics.RunPipelineRequest
 		if err := parseJSON(filename, &req); err == nil {
@@ -276,6 +1213,16 @@ func buildRequest(filename, project string) (*genomics.RunPipelineRequest, error
 	inputRoot := googlePath("input")
 	outputRoot := googlePath("output")
 
+	passed, err := passEnvironment(listOf(*passEnv), os.Environ())
+	if err != nil {
+		return nil, fmt.Errorf("parsing --pass-env: %v", err)
+	}
+	for name, value := range passed {
+		if _, ok := environment[name]; !ok {
+			environment[name] = value
+		}
+	}
+
 	directories := []string{googlePath("tmp")}
 	environment["TMPDIR"] = directories[0]
 
@@ -291,6 +1238,10 @@ func buildRequest(filename, project string) (*genomics.RunPipelineRequest, error
 				continue
 			}
 			localizers = append(localizers, gcsTransfer(input)(input, filename))
+		} else if remote, err := stagedPath(input); err != nil {
+			return nil, fmt.Errorf("processing %q: %v", input, err)
+		} else if remote != "" {
+			localizers = append(localizers, gcsTransfer(remote)(remote, filename))
 		} else {
 			action, err := upload(input, filename)
 			if err != nil {
@@ -313,7 +1264,7 @@ func buildRequest(filename, project string) (*genomics.RunPipelineRequest, error
 	var delocalizers []*genomics.Action
 	for output, name := range namedListOf(*outputs, "OUTPUT") {
 		filename := gcsJoin(outputRoot, strings.TrimRight(output, "*"))
-		delocalizers = append(delocalizers, gcsTransfer(output)(filename, output))
+		delocalizers = append(delocalizers, gcsTransfer(output, hashOptions()...)(filename, output))
 		environment[name] = filename
 		if strings.HasSuffix(output, "*") {
 			directories = append(directories, filename)
@@ -322,6 +1273,20 @@ func buildRequest(filename, project string) (*genomics.RunPipelineRequest, error
 		}
 	}
 
+	dirs, err := parseSyncDirs()
+	if err != nil {
+		return nil, err
+	}
+	for i, dir := range dirs {
+		filename := gcsJoin(googlePath("sync"), strconv.Itoa(i))
+		environment[fmt.Sprintf("SYNC%d", i)] = filename
+		directories = append(directories, filename)
+		localizers = append(localizers, transfer("-m", "rsync", "-r", dir.remote, filename))
+		action := transfer("-m", "rsync", "-r", filename, dir.remote)
+		action.Flags = []string{"ALWAYS_RUN"}
+		delocalizers = append(delocalizers, action)
+	}
+
 	if *output != "" {
 		action := gsutil("cp", "/google/logs/output", *output)
 		action.Flags = []string{"ALWAYS_RUN"}
@@ -329,28 +1294,65 @@ func buildRequest(filename, project string) (*genomics.RunPipelineRequest, error
 	}
 
 	var actions []*genomics.Action
-	if *outputInterval != 0 && *output != "" {
-		action := bash(fmt.Sprintf("while true; do sleep %.0f; gsutil -q cp /google/logs/output %s; done", (*outputInterval).Seconds(), *output))
+	interval := *outputInterval
+	if interval == 0 && *followLogs {
+		interval = defaultFollowInterval
+	}
+	if interval != 0 && *output != "" {
+		action := bash(fmt.Sprintf("while true; do sleep %.0f; gsutil -q cp /google/logs/output %s; done", interval.Seconds(), *output))
 		action.Flags = []string{"RUN_IN_BACKGROUND"}
 		actions = append(actions, action)
 	}
 
 	if filename != "" {
-		v, err := parseFile(filename)
+		v, script, err := parseFile(filename)
 		if err != nil {
 			return nil, fmt.Errorf("creating pipeline from file: %v", err)
 		}
+		recordScript(v, script)
 		actions = append(actions, v...)
-	} else if *command != "" {
-		action, err := parse(*command)
-		if err != nil {
-			return nil, fmt.Errorf("creating action from command: %v", err)
+	} else if len(commands) > 0 {
+		var v []*genomics.Action
+		for _, command := range commands {
+			action, err := parse(command)
+			if err != nil {
+				return nil, fmt.Errorf("creating action from command %q: %v", command, err)
+			}
+			v = append(v, action)
 		}
-		actions = append(actions, action)
+		recordScript(v, strings.Join(commands, "\n")+"\n")
+		actions = append(actions, v...)
 	} else {
 		return nil, errors.New("no command or input file was specified")
 	}
 
+	actions = addDockerDaemon(actions)
+
+	setTimeouts(localizers, *localizeTimeout)
+	setTimeouts(actions, *runTimeout)
+	setTimeouts(delocalizers, *delocalizeTimeout)
+
+	actions, stepDirectories, stepOutputs := addStepTransfers(actions)
+	directories = append(directories, stepDirectories...)
+
+	var manifest []string
+	for output := range namedListOf(*outputs, "OUTPUT") {
+		manifest = append(manifest, output)
+	}
+	manifest = append(manifest, stepOutputs...)
+	if *output != "" {
+		manifest = append(manifest, *output)
+	}
+	if len(manifest) > 0 {
+		sort.Strings(manifest)
+		environment[common.OutputsVariable] = strings.Join(manifest, ",")
+	}
+
+	serviceScopes, err := expandScopes(listOf(*scopes))
+	if err != nil {
+		return nil, fmt.Errorf("parsing scopes: %v", err)
+	}
+
 	vm := &genomics.VirtualMachine{
 		MachineType: *machineType,
 		Network: &genomics.Network{
@@ -358,7 +1360,7 @@ func buildRequest(filename, project string) (*genomics.RunPipelineRequest, error
 		},
 		ServiceAccount: &genomics.ServiceAccount{
 			Email:  *serviceAccount,
-			Scopes: listOf(*scopes),
+			Scopes: serviceScopes,
 		},
 		Labels: vmLabels,
 	}
@@ -374,11 +1376,35 @@ func buildRequest(filename, project string) (*genomics.RunPipelineRequest, error
 		vm.Network.Subnetwork = *subnetwork
 	}
 
-	if *gpus > 0 {
-		vm.Accelerators = append(vm.Accelerators, &genomics.Accelerator{
-			Type:  *gpuType,
-			Count: int64(*gpus),
-		})
+	vm.Accelerators = vmAccelerators(actions)
+	vm.CpuPlatform = *cpuPlatform
+
+	if *cpus > 0 || *memory > 0 {
+		switch {
+		case isFlagSet("machine-type"):
+			return nil, errors.New("--cpus and --memory cannot be used with --machine-type")
+		case *minCores > 0 || *minRAM > 0:
+			return nil, errors.New("--cpus and --memory cannot be used with --min-cores or --min-ram")
+		case *cpus == 0:
+			return nil, errors.New("--memory requires --cpus")
+		}
+		gb := *memory
+		if gb == 0 {
+			gb = float64(*cpus) * 3.75
+		}
+		if vm.MachineType, err = common.ExactCustomMachineType(*cpus, gb); err != nil {
+			return nil, fmt.Errorf("invalid --cpus or --memory: %v", err)
+		}
+	}
+
+	if *minCores > 0 || *minRAM > 0 {
+		if isFlagSet("machine-type") {
+			return nil, errors.New("--min-cores and --min-ram cannot be used with --machine-type")
+		}
+		vm.MachineType = common.CheapestMachineType(vm, *minCores, *minRAM)
+		if vm.MachineType == "" {
+			return nil, fmt.Errorf("no machine type has at least %g CPUs and %gGB of memory", *minCores, *minRAM)
+		}
 	}
 
 	resources := &genomics.Resources{
@@ -417,43 +1443,88 @@ func buildRequest(filename, project string) (*genomics.RunPipelineRequest, error
 		pipeline.Actions = append(pipeline.Actions, sshDebug(project))
 	}
 
+	// The profile includes the peaks recorded by the monitoring action, so
+	// only one of them is added.
+	var report *genomics.Action
+	if *profile {
+		var sidecar *genomics.Action
+		sidecar, report = profileActions(*profileEvery, profilePath(*output))
+		pipeline.Actions = append(pipeline.Actions, sidecar)
+	} else if *monitor {
+		var sidecar *genomics.Action
+		sidecar, report = monitorActions()
+		pipeline.Actions = append(pipeline.Actions, sidecar)
+	}
+
 	for _, v := range [][]*genomics.Action{localizers, actions, delocalizers} {
 		pipeline.Actions = append(pipeline.Actions, v...)
 	}
+	if report != nil {
+		pipeline.Actions = append(pipeline.Actions, report)
+	}
+
+	if *name != "" {
+		labels["name"] = *name
+	}
+
+	// When waiting, the tool sends the notification itself so that it
+	// includes the operation name and exit status.
+	if !*wait && (*notifyTopic != "" || *notifyURL != "") {
+		notify, err := notificationActions(*notifyTopic, *notifyURL, labels)
+		if err != nil {
+			return nil, err
+		}
+		pipeline.Actions = append(pipeline.Actions, notify...)
+		if *notifyTopic != "" {
+			account := pipeline.Resources.VirtualMachine.ServiceAccount
+			account.Scopes = append(account.Scopes, scopePrefix+"pubsub")
+		}
+	}
+
+	if *debugNotify != "" && *debugHold == 0 {
+		return nil, errors.New("--debug-notify requires --debug-hold")
+	}
+	if *debugHold > 0 {
+		pipeline.Actions = append(pipeline.Actions, holdOnFailure(project, *debugHold, *debugNotify)...)
+	}
 
 	addRequiredDisks(pipeline)
-	addRequiredScopes(pipeline)
+	if *strictScopes {
+		setMinimalScopes(pipeline)
+	} else {
+		addRequiredScopes(pipeline)
+	}
 
 	if *sharePIDs {
 		for _, action := range pipeline.Actions {
-			action.PidNamespace = "shared"
+			if action.PidNamespace == "" {
+				action.PidNamespace = "shared"
+			}
 		}
 	}
 
-	if *name != "" {
-		labels["name"] = *name
-	}
-
 	if *timeout != 0 {
-		pipeline.Timeout = fmt.Sprintf("%.0fs", (*timeout).Seconds())
+		pipeline.Timeout = apiDuration(*timeout)
 	}
 
 	return &genomics.RunPipelineRequest{Pipeline: pipeline, Labels: labels}, nil
 }
 
-func parseFile(filename string) ([]*genomics.Action, error) {
+// parseFile parses a file of actions (in JSON) or a script.  The text of the
+// script is also returned.
+func parseFile(filename string) ([]*genomics.Action, string, error) {
 	var scanner *bufio.Scanner
 	if filename == "-" {
 		scanner = bufio.NewScanner(os.Stdin)
 	} else {
 		var actions []*genomics.Action
 		if parseJSON(filename, &actions) == nil {
-			return actions, nil
+			return actions, "", nil
 		}
 
 		f, err := os.Open(filename)
 		if err != nil {
-			return nil, fmt.Errorf("opening script: %v", err)
+			return nil, "", fmt.Errorf("opening script: %v", err)
 		}
 		defer f.Close()
 
@@ -461,11 +1532,12 @@ func parseFile(filename string) ([]*genomics.Action, error) {
 	}
 
 	var line int
-	var buffer strings.Builder
+	var buffer, script strings.Builder
 	var actions []*genomics.Action
 	for scanner.Scan() {
 		text := scanner.Text()
 		line++
+		script.WriteString(text + "\n")
 
 		if strings.HasSuffix(text, "\\") {
 			buffer.WriteString(text[:len(text)-1])
@@ -476,7 +1548,7 @@ func parseFile(filename string) ([]*genomics.Action, error) {
 
 		action, err := parse(buffer.String())
 		if err != nil {
-			return nil, fmt.Errorf("line %d: %v", line, err)
+			return nil, "", fmt.Errorf("line %d: %v", line, err)
 		}
 		if action != nil {
 			actions = append(actions, action)
@@ -485,21 +1557,24 @@ func parseFile(filename string) ([]*genomics.Action, error) {
 		buffer.Reset()
 	}
 	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("reading script: %v", err)
+		return nil, "", fmt.Errorf("reading script: %v", err)
 	}
-	return actions, nil
+	return actions, script.String(), nil
 }
 
 func parse(line string) (*genomics.Action, error) {
 	var action genomics.Action
 
+	line = substitute(line)
 	options := make(map[string]string)
 	if n := strings.Index(line, "#"); n >= 0 {
 		for _, option := range strings.Fields(strings.TrimSpace(line[n+1:])) {
 			if n := strings.Index(option, "="); n >= 0 {
 				options[option[:n]] = option[n+1:]
+			} else if option == "docker" {
+				action.Environment = map[string]string{"DOCKER_HOST": dockerHost}
 			} else {
-				action.Flags = append(action.Flags, strings.ToUpper(option))
+				action.Flags = append(action.Flags, actionFlag(option))
 			}
 		}
 		line = line[:n]
@@ -520,32 +1595,134 @@ func parse(line string) (*genomics.Action, error) {
 		if err != nil {
 			return nil, fmt.Errorf("parsing action timeout: %v", err)
 		}
-		action.Timeout = fmt.Sprintf("%.0fs", duration.Seconds())
+		action.Timeout = apiDuration(duration)
 	}
 
 	action.ImageUri = detectImage(commands, options)
-	action.Mounts = []*genomics.Mount{googleRoot}
+	mounts, err := diskMounts(options)
+	if err != nil {
+		return nil, err
+	}
+	action.Mounts = append([]*genomics.Mount{googleRoot}, mounts...)
+	action.PidNamespace = options["pidns"]
+
+	accelerator, err := parseAccelerator(options)
+	if err != nil {
+		return nil, err
+	}
+	if accelerator != nil {
+		stepAccelerators[&action] = accelerator
+	}
+
+	if err := parseTransfers(&action, options); err != nil {
+		return nil, err
+	}
 
 	if v, ok := options["ports"]; ok {
-		ports, err := parsePorts(v)
+		ports, publishAll, err := parsePorts(v)
 		if err != nil {
 			return nil, fmt.Errorf("parsing ports: %v", err)
 		}
-		action.PortMappings = ports
+		if len(ports) > 0 {
+			action.PortMappings = ports
+		}
+		if publishAll {
+			action.Flags = append(action.Flags, "PUBLISH_EXPOSED_PORTS")
+		}
 	}
 	return &action, nil
 }
 
+// flagAliases maps short names that can be used in script options to the
+// corresponding action flags.
+var flagAliases = map[string]string{
+	"fuse":       "ENABLE_FUSE",
+	"no-network": "BLOCK_EXTERNAL_NETWORK",
+}
+
+// actionFlag returns the action flag named by a script option.
+func actionFlag(option string) string {
+	if flag, ok := flagAliases[strings.ToLower(option)]; ok {
+		return flag
+	}
+	return strings.ToUpper(option)
+}
+
 func detectImage(command []string, options map[string]string) string {
 	if image, ok := options["image"]; ok {
 		return image
 	}
-	if len(command) > 0 && isCloudCommand(command[0]) {
-		return *cloudSDKImage
+	if name := commandName(command); name != "" {
+		if image, ok := config.Images[name]; ok {
+			return image
+		}
+		if isCloudCommand(name) {
+			return *cloudSDKImage
+		}
 	}
 	return *defaultImage
 }
 
+// commandWrappers are commands that run the command that follows them, mapped
+// to their options that take a value.
+var commandWrappers = map[string][]string{
+	"env":   {"-u", "--unset", "-C", "--chdir"},
+	"exec":  {"-a"},
+	"nohup": nil,
+	"time":  {"-f", "--format", "-o", "--output"},
+}
+
+// commandName returns the name of the program run by a command line,
+// skipping leading environment variable assignments and wrappers such as
+// 'env' or 'time' (with their options) and removing any directory.
+func commandName(command []string) string {
+	if args := commandArgs(command); len(args) > 0 {
+		return path.Base(args[0])
+	}
+	return ""
+}
+
+// commandArgs returns the program and arguments of a command line (see
+// commandName).
+func commandArgs(command []string) []string {
+	for i := 0; i < len(command); i++ {
+		word := command[i]
+		if isAssignment(word) {
+			continue
+		}
+		options, ok := commandWrappers[word]
+		if !ok {
+			return command[i:]
+		}
+		for i+1 < len(command) && strings.HasPrefix(command[i+1], "-") {
+			i++
+			if command[i] == "--" {
+				break
+			}
+			if containsString(options, command[i]) {
+				i++
+			}
+		}
+	}
+	return nil
+}
+
+func isAssignment(word string) bool {
+	n := strings.Index(word, "=")
+	if n <= 0 {
+		return false
+	}
+	for i, c := range word[:n] {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 0 && c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// addRequiredDisks adds a disk to the VM for each disk that is mounted by an
+// action, using the settings from --disk (or the defaults) for each one.  The
+// "google" disk is always first.
 func addRequiredDisks(pipeline *genomics.Pipeline) {
 	disks := make(map[string]bool)
 	for _, action := range pipeline.Actions {
@@ -554,8 +1731,19 @@ func addRequiredDisks(pipeline *genomics.Pipeline) {
 		}
 	}
 
-	vm := pipeline.Resources.VirtualMachine
+	var names []string
 	for name := range disks {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if names[i] == googleRoot.Disk || names[j] == googleRoot.Disk {
+			return names[i] == googleRoot.Disk
+		}
+		return names[i] < names[j]
+	})
+
+	vm := pipeline.Resources.VirtualMachine
+	for _, name := range names {
 		disk := &genomics.Disk{
 			Name:   name,
 			Type:   *diskType,
@@ -564,6 +1752,15 @@ func addRequiredDisks(pipeline *genomics.Pipeline) {
 		if *diskImage != "" && name == googleRoot.Disk {
 			disk.SourceImage = *diskImage
 		}
+		if spec, ok := dataDisks[name]; ok {
+			if spec.Type != "" {
+				disk.Type = spec.Type
+			}
+			if spec.SizeGb != 0 {
+				disk.SizeGb = spec.SizeGb
+			}
+			disk.SourceImage = spec.SourceImage
+		}
 		vm.Disks = append(vm.Disks, disk)
 	}
 	if *bootDiskSizeGb > 0 {
@@ -574,7 +1771,7 @@ func addRequiredDisks(pipeline *genomics.Pipeline) {
 func addRequiredScopes(pipeline *genomics.Pipeline) {
 	scopes := &pipeline.Resources.VirtualMachine.ServiceAccount.Scopes
 	for _, action := range pipeline.Actions {
-		if action.ImageUri == *cloudSDKImage || (len(action.Commands) > 0 && isCloudCommand(action.Commands[0])) {
+		if action.ImageUri == *cloudSDKImage || isCloudCommand(commandName(action.Commands)) {
 			*scopes = append(*scopes, "https://www.googleapis.com/auth/devstorage.read_write")
 			return
 		}
@@ -582,7 +1779,60 @@ func addRequiredScopes(pipeline *genomics.Pipeline) {
 }
 
 func isCloudCommand(command string) bool {
-	return command == "gsutil" || command == "gcloud"
+	switch command {
+	case "gsutil", "gcloud", "bq":
+		return true
+	}
+	for _, name := range config.CloudCommands {
+		if command == name {
+			return true
+		}
+	}
+	return false
+}
+
+// isFlagSet returns true if the named flag was given on the command line.
+func isFlagSet(name string) bool {
+	set := false
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// passEnvironment returns the variables from environ (in the form NAME=VALUE)
+// whose names match one of the patterns.  Patterns without wildcards must
+// name variables that are set.
+func passEnvironment(patterns, environ []string) (map[string]string, error) {
+	values := make(map[string]string)
+	for _, variable := range environ {
+		if i := strings.Index(variable, "="); i > 0 {
+			values[variable[:i]] = variable[i+1:]
+		}
+	}
+
+	passed := make(map[string]string)
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q", pattern)
+		}
+		if !strings.ContainsAny(pattern, "*?[") {
+			value, ok := values[pattern]
+			if !ok {
+				return nil, fmt.Errorf("environment variable %q is not set", pattern)
+			}
+			passed[pattern] = value
+			continue
+		}
+		for name, value := range values {
+			if ok, _ := path.Match(pattern, name); ok {
+				passed[name] = value
+			}
+		}
+	}
+	return passed, nil
 }
 
 func listOf(input string) []string {
@@ -594,7 +1844,7 @@ func listOf(input string) []string {
 
 func namedListOf(input, defaultPrefix string) map[string]string {
 	output := make(map[string]string)
-	for n, input := range strings.Split(input, ",") {
+	for n, input := range strings.Split(substitute(input), ",") {
 		if i := strings.Index(input, "="); i > 0 {
 			output[input[i+1:]] = input[:i]
 		} else if input != "" {
@@ -662,22 +1912,77 @@ func listRegions(project string, service *compute.Service) ([]string, error) {
 	return regions, nil
 }
 
-func parsePorts(input string) (map[string]int64, error) {
+// parsePorts parses a list of port mappings separated by ';'.  Each mapping has
+// the form CONTAINER:HOST where both sides are either a single port or a range
+// of ports of the same length (such as 8000-8010:9000-9010).  The special
+// token 'publish-all' requests that every port exposed by the image is
+// published.
+func parsePorts(input string) (map[string]int64, bool, error) {
 	ports := make(map[string]int64)
+	var publishAll bool
 	for _, pair := range strings.Split(input, ";") {
+		if pair == "publish-all" {
+			publishAll = true
+			continue
+		}
 		i := strings.Index(pair, ":")
 		if i < 1 {
-			return nil, fmt.Errorf("invalid port mapping %q", pair)
+			return nil, false, fmt.Errorf("invalid port mapping %q", pair)
 		}
-		n, err := strconv.ParseInt(pair[i+1:], 10, 64)
+		container, err := parsePortRange(pair[:i])
 		if err != nil {
-			return nil, fmt.Errorf("parsing host port: %v", err)
+			return nil, false, fmt.Errorf("parsing container port: %v", err)
+		}
+		host, err := parsePortRange(pair[i+1:])
+		if err != nil {
+			return nil, false, fmt.Errorf("parsing host port: %v", err)
+		}
+		if len(container) != len(host) {
+			return nil, false, fmt.Errorf("port ranges in %q have different lengths", pair)
 		}
-		ports[pair[:i]] = n
+		for j, port := range container {
+			ports[strconv.FormatInt(port, 10)] = host[j]
+		}
+	}
+	return ports, publishAll, nil
+}
+
+// parsePortRange parses either a single port or a range of ports of the form
+// FIRST-LAST and returns every port in it.
+func parsePortRange(input string) ([]int64, error) {
+	first, last := input, input
+	if i := strings.Index(input, "-"); i >= 0 {
+		first, last = input[:i], input[i+1:]
+	}
+	start, err := parsePort(first)
+	if err != nil {
+		return nil, err
+	}
+	end, err := parsePort(last)
+	if err != nil {
+		return nil, err
+	}
+	if end < start {
+		return nil, fmt.Errorf("invalid port range %q", input)
+	}
+	var ports []int64
+	for port := start; port <= end; port++ {
+		ports = append(ports, port)
 	}
 	return ports, nil
 }
 
+func parsePort(input string) (int64, error) {
+	port, err := strconv.ParseInt(input, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if port < 1 || port > 65535 {
+		return 0, fmt.Errorf("port %d is out of range", port)
+	}
+	return port, nil
+}
+
 func gsutil(arguments ...string) *genomics.Action {
 	return bash("gsutil -q " + strings.Join(arguments, " "))
 }
@@ -694,6 +1999,35 @@ func upload(input, output string) (*genomics.Action, error) {
 	), nil
 }
 
+// setTimeouts sets the timeout of every foreground action that does not
+// already have one.
+func setTimeouts(actions []*genomics.Action, timeout time.Duration) {
+	if timeout == 0 {
+		return
+	}
+	for _, action := range actions {
+		if action.Timeout != "" || hasFlag(action, "RUN_IN_BACKGROUND") {
+			continue
+		}
+		action.Timeout = apiDuration(timeout)
+	}
+}
+
+// apiDuration formats d as a duration for the API (a number of seconds with
+// an "s" suffix), keeping any fraction of a second.
+func apiDuration(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64) + "s"
+}
+
+func hasFlag(action *genomics.Action, flag string) bool {
+	for _, f := range action.Flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
 func bash(commands ...string) *genomics.Action {
 	return &genomics.Action{
 		ImageUri:   *cloudSDKImage,
@@ -721,22 +2055,47 @@ func mkdir(directories []string) *genomics.Action {
 	return bash("mkdir -p " + strings.Join(arguments, " "))
 }
 
-func cancelOnInterrupt(ctx context.Context, service *genomics.Service, name string, abort chan os.Signal) {
+// cancelOnInterrupt cancels the named operation if a signal is received on
+// abort before the returned function is called.
+func cancelOnInterrupt(ctx context.Context, service *genomics.Service, name string, abort chan os.Signal) func() {
+	done := make(chan struct{})
 	go func() {
-		<-abort
+		select {
+		case <-abort:
+		case <-done:
+			return
+		}
 		fmt.Println("Cancelling operation...")
 		req := &genomics.CancelOperationRequest{}
 		if _, err := service.Projects.Operations.Cancel(name, req).Context(ctx).Do(); err != nil {
 			fmt.Printf("Failed to cancel operation: %v\n", err)
 		}
 	}()
+	return func() { close(done) }
+}
+
+// recordScript records the script that the actions were created from in the
+// environment of the first of them (rather than the pipeline, so that the
+// other actions are not passed a copy).
+func recordScript(actions []*genomics.Action, script string) {
+	if script == "" || len(actions) == 0 {
+		return
+	}
+	if actions[0].Environment == nil {
+		actions[0].Environment = make(map[string]string)
+	}
+	actions[0].Environment[common.ScriptVariable] = script
 }
 
 const gcsPrefix = "gs://"
 
+// defaultFollowInterval is how often the output is copied to GCS when
+// --follow-logs is used without --output-interval.
+const defaultFollowInterval = 30 * time.Second
+
 func parseGCSPath(input string) (string, bool) {
 	parsed, err := url.Parse(input)
-	if err != nil {
+	if err != nil || parsed.Scheme != "gs" {
 		return "", false
 	}
 	return parsed.Host, true
@@ -753,20 +2112,35 @@ func gcsJoin(input ...string) string {
 	return path.Join(parts...)
 }
 
-func gcsTransfer(remote string) func(from, to string) *genomics.Action {
+// gcsTransfer returns a function that creates an action copying from one
+// path to another, where remote (the GCS side) determines whether a single
+// object, a directory or a tree is copied.  Any options are passed to gsutil
+// before the command.
+func gcsTransfer(remote string, options ...string) func(from, to string) *genomics.Action {
 	return func(from, to string) *genomics.Action {
 		from = strings.TrimRight(from, "*")
 		to = strings.TrimRight(to, "*")
 		if strings.HasSuffix(remote, "/**") {
-			return gsutil("-m", "cp", "-r", gcsJoin(from, "*"), to)
+			return transfer(append(options, "-m", "cp", "-r", gcsJoin(from, "*"), to)...)
 		}
 		if strings.HasSuffix(remote, "/*") {
-			return gsutil("-m", "cp", gcsJoin(from, "*"), to)
+			return transfer(append(options, "-m", "cp", gcsJoin(from, "*"), to)...)
 		}
-		return gsutil("cp", from, to)
+		return transfer(append(options, "cp", from, to)...)
 	}
 }
 
+// transfer returns an action that runs gsutil to copy files.  If
+// --progress-step is set, the progress reported by gsutil is written to the
+// output every time it advances by that many percent.
+func transfer(arguments ...string) *genomics.Action {
+	if *progressStep <= 0 {
+		return gsutil(arguments...)
+	}
+	const filter = `/%% Done/ { if (match($0, /[0-9]+%% Done/)) { p = substr($0, RSTART, RLENGTH) + 0; if (p == last || (p < last + %d && p != 100)) next; last = p } } { print }`
+	return bash(fmt.Sprintf("set -o pipefail; gsutil %s 2>&1 | tr '\\r' '\\n' | awk -v last=-100 '%s'", strings.Join(arguments, " "), fmt.Sprintf(filter, *progressStep)))
+}
+
 func gcsFuse(buckets map[string]string) []*genomics.Action {
 	var actions []*genomics.Action
 	for bucket, path := range buckets {
@@ -785,10 +2159,113 @@ func gcsFuse(buckets map[string]string) []*genomics.Action {
 	return actions
 }
 
+// holdOnFailure returns actions that keep the VM running for the specified
+// duration if any earlier action failed.  The first action only runs if every
+// earlier action succeeded (and records that fact), while the second always
+// runs and sleeps unless the record exists.
+//
+// If webhook is not empty, a JSON message (in the format used by Slack
+// incoming webhooks) with instructions for connecting to the VM is posted to
+// it before the VM is held.
+func holdOnFailure(project string, duration time.Duration, webhook string) []*genomics.Action {
+	marker := path.Join(googleRoot.Path, ".google", "succeeded")
+	record := bash(fmt.Sprintf("touch %s", marker))
+
+	script := fmt.Sprintf("echo 'Holding VM for %s'", duration)
+	if webhook != "" {
+		const metadata = "curl -s -H Metadata-Flavor:Google http://metadata.google.internal/computeMetadata/v1/instance/"
+		text := fmt.Sprintf("A pipeline action failed: holding the VM for %s. Connect using: gcloud compute ssh ${name} --zone ${zone} --project %s", duration, project)
+		script = strings.Join([]string{
+			fmt.Sprintf("name=$(%sname)", metadata),
+			fmt.Sprintf("zone=$(%szone)", metadata),
+			"zone=${zone##*/}",
+			fmt.Sprintf(`curl -s -X POST -H 'Content-Type: application/json' -d "{\"text\": \"%s\"}" %q`, text, webhook),
+			script,
+		}, "; ")
+	}
+
+	hold := bash(fmt.Sprintf("if [[ ! -f %s ]]; then %s; sleep %.0f; fi", marker, script, duration.Seconds()))
+	hold.Flags = []string{"ALWAYS_RUN"}
+	return []*genomics.Action{record, hold}
+}
+
+// dockerHost is the address of the Docker daemon started by dockerDaemon.
+const dockerHost = "tcp://docker:2375"
+
+// dockerStartTimeout is how long the actions that use the Docker daemon wait
+// for it to start.
+const dockerStartTimeout = 2 * time.Minute
+
+// dockerSocket is the Unix socket the Docker daemon also listens on, which is
+// created in the shared mount so that it is visible to other actions.
+var dockerSocket = path.Join(googleRoot.Path, ".google", "docker.sock")
+
+// addDockerDaemon starts a Docker daemon before the actions if any of them
+// use it, and waits for it to be ready before running them.
+func addDockerDaemon(actions []*genomics.Action) []*genomics.Action {
+	if !usesDocker(actions) {
+		return actions
+	}
+	return append([]*genomics.Action{dockerDaemon(), dockerReady()}, actions...)
+}
+
+// usesDocker returns true if any of the actions connect to the Docker daemon.
+func usesDocker(actions []*genomics.Action) bool {
+	for _, action := range actions {
+		if action.Environment["DOCKER_HOST"] == dockerHost {
+			return true
+		}
+	}
+	return false
+}
+
+// dockerDaemon returns an action that runs a Docker daemon in the background.
+// The API does not allow the host Docker socket to be mounted or containers
+// to run privileged, so the daemon runs with the extra capabilities given by
+// the ENABLE_FUSE flag (CAP_SYS_ADMIN), which the dind script of the image
+// uses to set up the cgroup and security filesystems that runc needs to start
+// containers.  Without CAP_NET_ADMIN the daemon cannot create a bridge
+// network or iptables rules, so it uses neither, and it uses the vfs storage
+// driver since overlay filesystems cannot be nested.  Other actions reach it
+// using the container name as the host name.
+func dockerDaemon() *genomics.Action {
+	return &genomics.Action{
+		Name:       "docker",
+		ImageUri:   *dockerImage,
+		Entrypoint: "dind",
+		Commands: []string{
+			"dockerd",
+			"--host=tcp://0.0.0.0:2375",
+			"--host=unix://" + dockerSocket,
+			"--storage-driver=vfs",
+			"--bridge=none",
+			"--iptables=false",
+			"--data-root=" + path.Join(googleRoot.Path, ".google", "docker"),
+		},
+		Mounts: []*genomics.Mount{googleRoot},
+		Flags:  []string{"ENABLE_FUSE", "RUN_IN_BACKGROUND"},
+	}
+}
+
+// dockerReady returns an action that waits until the Docker daemon has created
+// its socket and answers requests, and fails if it does not start in time.
+func dockerReady() *genomics.Action {
+	seconds := int(dockerStartTimeout.Seconds())
+	script := fmt.Sprintf(`for i in $(seq %d); do if [ -S %[2]s ] && docker -H unix://%[2]s info > /dev/null 2>&1; then exit 0; fi; sleep 1; done; echo "The Docker daemon did not start within %[1]d seconds" >&2; exit 1`, seconds, dockerSocket)
+	return &genomics.Action{
+		Name:       "docker-ready",
+		ImageUri:   *dockerImage,
+		Entrypoint: "sh",
+		Commands:   []string{"-c", script},
+		Mounts:     []*genomics.Mount{googleRoot},
+	}
+}
+
 func sshDebug(project string) *genomics.Action {
 	return &genomics.Action{
 		ImageUri:     "gcr.io/cloud-genomics-pipelines/tools",
 		Entrypoint:   "ssh-server",
+		Mounts:       []*genomics.Mount{googleRoot},
 		PortMappings: map[string]int64{"22": 22},
 		Flags:        []string{"RUN_IN_BACKGROUND"},
 	}
@@ -1,8 +1,25 @@
 package run
 
 import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/common"
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/fake"
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/replay"
+	genomics "google.golang.org/api/genomics/v2alpha1"
+	"google.golang.org/api/googleapi"
+	storage "google.golang.org/api/storage/v1"
+	"google.golang.org/genproto/googleapis/rpc/code"
 )
 
 func TestGCSJoin(t *testing.T) {
@@ -25,3 +42,1992 @@ func TestGCSJoin(t *testing.T) {
 		})
 	}
 }
+
+func TestParseGCSPath(t *testing.T) {
+	testCases := []struct {
+		input      string
+		wantBucket string
+		wantOK     bool
+	}{
+		{"gs://foo/bar", "foo", true},
+		{"gs://foo/bar/*", "foo", true},
+		{"/tmp/config.json", "", false},
+		{"config.json", "", false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.input, func(t *testing.T) {
+			bucket, ok := parseGCSPath(tc.input)
+			if bucket != tc.wantBucket || ok != tc.wantOK {
+				t.Fatalf("Unexpected result: got (%q, %v), want (%q, %v)", bucket, ok, tc.wantBucket, tc.wantOK)
+			}
+		})
+	}
+}
+
+func TestParseSyncDirs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sync")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	testCases := []struct {
+		input   string
+		want    syncDir
+		wantErr bool
+	}{
+		{dir + "=gs://bucket/prefix", syncDir{local: dir, remote: "gs://bucket/prefix"}, false},
+		{dir + "=gs://bucket/prefix/", syncDir{local: dir, remote: "gs://bucket/prefix"}, false},
+		{dir, syncDir{}, true},
+		{dir + "=/tmp/prefix", syncDir{}, true},
+		{dir + "/missing=gs://bucket/prefix", syncDir{}, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.input, func(t *testing.T) {
+			syncDirs = common.ListFlagValue{tc.input}
+			defer func() { syncDirs = nil }()
+
+			got, err := parseSyncDirs()
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("Unexpected success: got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to parse: %v", err)
+			}
+			if len(got) != 1 || !reflect.DeepEqual(got[0], tc.want) {
+				t.Fatalf("Unexpected result: got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPassEnvironment(t *testing.T) {
+	environ := []string{"HOME=/home/user", "AWS_KEY=key", "AWS_REGION=us-east-1", "EMPTY=", "EQUALS=a=b"}
+	testCases := []struct {
+		patterns []string
+		want     map[string]string
+		wantErr  bool
+	}{
+		{nil, map[string]string{}, false},
+		{[]string{"HOME"}, map[string]string{"HOME": "/home/user"}, false},
+		{[]string{"AWS_*"}, map[string]string{"AWS_KEY": "key", "AWS_REGION": "us-east-1"}, false},
+		{[]string{"EMPTY", "EQUALS"}, map[string]string{"EMPTY": "", "EQUALS": "a=b"}, false},
+		{[]string{"GCP_*"}, map[string]string{}, false},
+		{[]string{"MISSING"}, nil, true},
+		{[]string{"[AWS"}, nil, true},
+	}
+	for _, tc := range testCases {
+		t.Run(strings.Join(tc.patterns, ","), func(t *testing.T) {
+			got, err := passEnvironment(tc.patterns, environ)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("Unexpected success: got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to pass environment: %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("Unexpected result: got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "batch")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	testCases := []struct {
+		name     string
+		contents string
+		want     int
+		wantErr  bool
+	}{
+		{"requests", `[{"pipeline": {"actions": []}}, {"pipeline": {}, "labels": {"a": "b"}}]`, 2, false},
+		{"request", `{"pipeline": {"actions": []}}`, 0, false},
+		{"actions", `[{"imageUri": "bash", "commands": ["echo"]}]`, 0, false},
+		{"script", "echo hello", 0, false},
+		{"no pipeline", `[{"pipeline": null}]`, 0, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			filename := filepath.Join(dir, tc.name)
+			if err := ioutil.WriteFile(filename, []byte(tc.contents), 0644); err != nil {
+				t.Fatalf("Failed to write file: %v", err)
+			}
+			got, err := parseBatch(filename)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("Unexpected success: got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to parse batch: %v", err)
+			}
+			if len(got) != tc.want {
+				t.Fatalf("Unexpected number of requests: got %d, want %d", len(got), tc.want)
+			}
+		})
+	}
+}
+
+func TestParseSampleSheet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "samples")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	testCases := []struct {
+		filename string
+		contents string
+		want     []map[string]string
+		wantErr  bool
+	}{
+		{"samples.tsv", "sample\tbam\nNA1\tgs://b/NA1.bam\n# skipped\nNA2\tgs://b/NA2.bam\n", []map[string]string{{"sample": "NA1", "bam": "gs://b/NA1.bam"}, {"sample": "NA2", "bam": "gs://b/NA2.bam"}}, false},
+		{"samples.csv", "sample,note\nNA1,\"a, b\"\n", []map[string]string{{"sample": "NA1", "note": "a, b"}}, false},
+		{"header.tsv", "sample\tbam\n", nil, true},
+		{"columns.tsv", "sample\tbam file\nNA1\tgs://b/NA1.bam\n", nil, true},
+		{"ragged.tsv", "sample\tbam\nNA1\n", nil, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.filename, func(t *testing.T) {
+			filename := filepath.Join(dir, tc.filename)
+			if err := ioutil.WriteFile(filename, []byte(tc.contents), 0644); err != nil {
+				t.Fatalf("Failed to write file: %v", err)
+			}
+			_, got, err := parseSampleSheet(filename)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("Unexpected success: got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to parse sample sheet: %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("Unexpected rows: got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSubstitute(t *testing.T) {
+	sampleVariables = map[string]string{"sample": "NA1", "bam": "gs://b/NA1.bam"}
+	defer func() { sampleVariables = nil }()
+
+	got := substitute("align ${bam} > ${sample}.out  # $sample ${OUTPUT0}")
+	want := "align gs://b/NA1.bam > NA1.out  # $sample ${OUTPUT0}"
+	if got != want {
+		t.Fatalf("Unexpected result: got %q, want %q", got, want)
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	policy, err := parseRetryPolicy("137", "stockout")
+	if err != nil {
+		t.Fatalf("Failed to parse policy: %v", err)
+	}
+
+	failed := func(c code.Code, reason, message string, exitStatus int64) common.PipelineExecutionError {
+		err := common.PipelineExecutionError{
+			Status:     genomics.Status{Code: int64(c), Message: message},
+			ExitStatus: exitStatus,
+			Reason:     reason,
+		}
+		if reason == common.ReasonActionFailed {
+			err.ActionID = 1
+		}
+		return err
+	}
+
+	testCases := []struct {
+		name string
+		err  common.PipelineExecutionError
+		want bool
+	}{
+		{"preempted", failed(code.Code_ABORTED, common.ReasonPreempted, "preempted", 0), true},
+		{"cancelled", failed(code.Code_CANCELLED, common.ReasonCancelled, "cancelled", 0), false},
+		{"exit status", failed(code.Code_FAILED_PRECONDITION, common.ReasonActionFailed, "failed", 137), true},
+		{"other exit status", failed(code.Code_FAILED_PRECONDITION, common.ReasonActionFailed, "failed", 1), false},
+		{"pattern", failed(code.Code_FAILED_PRECONDITION, common.ReasonFatal, "zone stockout", 0), true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := policy.isRetriable(tc.err); got != tc.want {
+				t.Fatalf("Unexpected result: got %t, want %t", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestNextMachineType(t *testing.T) {
+	testCases := []struct {
+		input, want string
+	}{
+		{"n1-standard-4", "n1-highmem-4"},
+		{"n1-highcpu-8", "n1-highmem-8"},
+		{"n1-highmem-4", "n1-highmem-8"},
+		{"custom-2-4096", "custom-2-8192"},
+		{"f1-micro", "f1-micro"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.input, func(t *testing.T) {
+			if got := nextMachineType(tc.input); got != tc.want {
+				t.Fatalf("Unexpected result: got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRunPipelineRetries(t *testing.T) {
+	home, err := ioutil.TempDir("", "pipelines-tools")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(home)
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	os.Setenv("HOME", home)
+
+	testCases := []struct {
+		results        string
+		wantExitCode   int
+		wantOperations int
+	}{
+		{"ok", 0, 1},
+		{"preempted,ok", 0, 2},
+		{"preempted", common.ExitPreempted, 3},
+		{"1", common.ExitActionFailed, 1},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.results, func(t *testing.T) {
+			server := fake.NewServer()
+			defer server.Close()
+
+			service, err := genomics.New(http.DefaultClient)
+			if err != nil {
+				t.Fatalf("Failed to create service: %v", err)
+			}
+			service.BasePath = server.URL
+
+			req := &genomics.RunPipelineRequest{
+				Pipeline: &genomics.Pipeline{
+					Actions:     []*genomics.Action{{ImageUri: "bash"}},
+					Environment: map[string]string{fake.ResultsVariable: tc.results},
+					Resources: &genomics.Resources{
+						ProjectId:      "test",
+						VirtualMachine: &genomics.VirtualMachine{MachineType: "n1-standard-1"},
+					},
+				},
+			}
+			state := &retryState{Request: req, Attempt: 1, PvmAttempts: 1, Attempts: 2}
+
+			err = runPipeline(context.Background(), service, state)
+			if got := common.ExitCode(err); err != nil && got != tc.wantExitCode || err == nil && tc.wantExitCode != 0 {
+				t.Fatalf("Unexpected result: got %v (exit code %d), want exit code %d", err, got, tc.wantExitCode)
+			}
+			if got, want := server.Operations(), tc.wantOperations; got != want {
+				t.Fatalf("Unexpected number of operations: got %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestSubmitChecksPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "policy")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"config.json":     `{"policy": "` + filepath.Join(dir, "configured.json") + `"}`,
+		"configured.json": `{"machineTypes": ["n1-standard-*"]}`,
+		"flag.json":       `{"maxDiskSizeGb": 100}`,
+	}
+	for name, contents := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	defer os.Setenv(common.ConfigVariable, os.Getenv(common.ConfigVariable))
+	os.Setenv(common.ConfigVariable, filepath.Join(dir, "config.json"))
+	defer flags.Set("policy", "")
+	flags.Set("policy", filepath.Join(dir, "flag.json"))
+
+	server := fake.NewServer()
+	defer server.Close()
+	service, err := genomics.New(http.DefaultClient)
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	service.BasePath = server.URL
+
+	testCases := []struct {
+		name        string
+		machineType string
+		bootDiskGb  int64
+		wantErr     bool
+	}{
+		{"allowed", "n1-standard-1", 10, false},
+		{"escalated machine type", "n1-highmem-2", 10, true},
+		{"boot disk", "n1-standard-1", 200, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := &genomics.RunPipelineRequest{
+				Pipeline: &genomics.Pipeline{
+					Actions: []*genomics.Action{{ImageUri: "bash"}},
+					Resources: &genomics.Resources{
+						ProjectId:      "test",
+						VirtualMachine: &genomics.VirtualMachine{MachineType: tc.machineType, BootDiskSizeGb: tc.bootDiskGb},
+					},
+				},
+			}
+			state := &retryState{Request: req, Attempt: 2, Attempts: 2}
+			err := state.submit(context.Background(), service, "")
+			if tc.wantErr && err == nil {
+				t.Fatal("Unexpected success")
+			}
+			if !tc.wantErr && err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestRunRecords(t *testing.T) {
+	home, err := ioutil.TempDir("", "pipelines-tools")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(home)
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	os.Setenv("HOME", home)
+
+	state := &retryState{
+		Request:   &genomics.RunPipelineRequest{Labels: map[string]string{"name": "test"}},
+		ID:        "0123456789ab",
+		Operation: "projects/test/operations/1",
+		Attempt:   2,
+		Attempts:  3,
+	}
+	state.record()
+
+	got, err := loadRecord(state.ID)
+	if err != nil {
+		t.Fatalf("Failed to load record: %v", err)
+	}
+	if !reflect.DeepEqual(got, state) {
+		t.Fatalf("Unexpected record: got %+v, want %+v", got, state)
+	}
+
+	state.forget()
+	if _, err := loadRecord(state.ID); err == nil {
+		t.Fatal("Expected an error loading a forgotten run")
+	}
+}
+
+// isolateConfig points the configuration file at an empty temporary
+// directory, so that the configuration of the user running the tests does not
+// change the requests that are built.  The returned function restores it.
+func isolateConfig(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "pipelines-tools")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	previous := os.Getenv(common.ConfigVariable)
+	os.Setenv(common.ConfigVariable, filepath.Join(dir, "config.json"))
+	return func() {
+		os.Setenv(common.ConfigVariable, previous)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestRepeatedCommands(t *testing.T) {
+	defer func() { commands = nil }()
+	defer isolateConfig(t)()
+
+	filename, err := parseArguments([]string{"--command", "echo one", "--command", "echo two # image=alpine"})
+	if err != nil {
+		t.Fatalf("Failed to parse arguments: %v", err)
+	}
+	req, err := buildRequest(filename, "test")
+	if err != nil {
+		t.Fatalf("Failed to build request: %v", err)
+	}
+
+	var got []string
+	for _, action := range req.Pipeline.Actions[1:] {
+		got = append(got, action.ImageUri+": "+action.Commands[1])
+	}
+	want := []string{"bash: echo one", "alpine: echo two"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Unexpected actions: got %q, want %q", got, want)
+	}
+}
+
+func TestDetectImage(t *testing.T) {
+	defer func(c *common.Config) { config = c }(config)
+	config = &common.Config{
+		Images:        map[string]string{"samtools": "quay.io/biocontainers/samtools:1.19"},
+		CloudCommands: []string{"gcs-sync"},
+	}
+
+	testCases := []struct {
+		line string
+		want string
+	}{
+		{"samtools view in.bam", "quay.io/biocontainers/samtools:1.19"},
+		{"samtools view in.bam # image=other", "other"},
+		{"gsutil ls", *cloudSDKImage},
+		{"bq query 'SELECT 1'", *cloudSDKImage},
+		{"CLOUDSDK_CORE_PROJECT=test gcloud storage ls", *cloudSDKImage},
+		{"env -i time /usr/bin/gsutil ls", *cloudSDKImage},
+		{"gcs-sync in out", *cloudSDKImage},
+		{"A=1 samtools view in.bam", "quay.io/biocontainers/samtools:1.19"},
+		{"echo hello", *defaultImage},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.line, func(t *testing.T) {
+			action, err := parse(tc.line)
+			if err != nil {
+				t.Fatalf("Failed to parse: %v", err)
+			}
+			if got := action.ImageUri; got != tc.want {
+				t.Fatalf("Unexpected image: got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestExpandScopes(t *testing.T) {
+	testCases := []struct {
+		input   string
+		want    []string
+		wantErr bool
+	}{
+		{"bigquery,storage-rw", []string{"https://www.googleapis.com/auth/bigquery", "https://www.googleapis.com/auth/devstorage.read_write"}, false},
+		{"https://www.googleapis.com/auth/pubsub", []string{"https://www.googleapis.com/auth/pubsub"}, false},
+		{"devstorage.read_only", []string{"https://www.googleapis.com/auth/devstorage.read_only"}, false},
+		{"", nil, false},
+		{"storage", nil, true},
+		{"https://example.com/auth/pubsub", nil, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.input, func(t *testing.T) {
+			got, err := expandScopes(listOf(tc.input))
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("Unexpected success: got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to expand scopes: %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("Unexpected result: got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRequiredScopes(t *testing.T) {
+	testCases := []struct {
+		commands []string
+		want     []string
+	}{
+		{[]string{"echo hello"}, nil},
+		{[]string{"gsutil cp a b", "bq load t gs://b/f"}, []string{"https://www.googleapis.com/auth/bigquery", "https://www.googleapis.com/auth/devstorage.read_write"}},
+		{[]string{"echo $(A=1 gcloud storage ls)"}, []string{"https://www.googleapis.com/auth/devstorage.read_write"}},
+		{[]string{"gsutil ls && gcloud secrets versions access latest --secret=key"}, []string{"https://www.googleapis.com/auth/cloud-platform"}},
+	}
+	for _, tc := range testCases {
+		t.Run(strings.Join(tc.commands, ","), func(t *testing.T) {
+			pipeline := &genomics.Pipeline{}
+			for _, command := range tc.commands {
+				pipeline.Actions = append(pipeline.Actions, &genomics.Action{Commands: []string{"-c", command}})
+			}
+			if got := requiredScopes(pipeline); !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("Unexpected result: got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParsePorts(t *testing.T) {
+	testCases := []struct {
+		input          string
+		want           map[string]int64
+		wantPublishAll bool
+		wantErr        bool
+	}{
+		{"1234:22", map[string]int64{"1234": 22}, false, false},
+		{"8000-8002:9000-9002", map[string]int64{"8000": 9000, "8001": 9001, "8002": 9002}, false, false},
+		{"publish-all;80:8080", map[string]int64{"80": 8080}, true, false},
+		{"8000-8002:9000-9001", nil, false, true},
+		{"8002-8000:8002-8000", nil, false, true},
+		{"80:70000", nil, false, true},
+		{"80", nil, false, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.input, func(t *testing.T) {
+			got, publishAll, err := parsePorts(tc.input)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("Unexpected success: got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to parse ports: %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) || publishAll != tc.wantPublishAll {
+				t.Fatalf("Unexpected result: got %v (publish all: %t), want %v (publish all: %t)", got, publishAll, tc.want, tc.wantPublishAll)
+			}
+		})
+	}
+}
+
+func TestActionFlags(t *testing.T) {
+	testCases := []struct {
+		line string
+		want []string
+	}{
+		{"echo hello # no-network", []string{"BLOCK_EXTERNAL_NETWORK"}},
+		{"sshfs host:/data /mnt/google/data # fuse", []string{"ENABLE_FUSE"}},
+		{"echo hello # ignore_exit_status", []string{"IGNORE_EXIT_STATUS"}},
+		{"echo hello &", []string{"RUN_IN_BACKGROUND"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.line, func(t *testing.T) {
+			action, err := parse(tc.line)
+			if err != nil {
+				t.Fatalf("Failed to parse: %v", err)
+			}
+			if got := action.Flags; !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("Unexpected flags: got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPIDNamespaces(t *testing.T) {
+	defer func() { commands = nil }()
+	defer isolateConfig(t)()
+
+	filename, err := parseArguments([]string{"--share-pids", "--command", "run-step # pidns=step", "--command", "monitor & # pidns=step", "--command", "echo done"})
+	if err != nil {
+		t.Fatalf("Failed to parse arguments: %v", err)
+	}
+	defer flags.Set("share-pids", "false")
+	req, err := buildRequest(filename, "test")
+	if err != nil {
+		t.Fatalf("Failed to build request: %v", err)
+	}
+
+	var got []string
+	for _, action := range req.Pipeline.Actions[1:] {
+		got = append(got, action.PidNamespace)
+	}
+	want := []string{"step", "step", "shared"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Unexpected PID namespaces: got %q, want %q", got, want)
+	}
+}
+
+func TestStepAccelerators(t *testing.T) {
+	defer func() { commands = nil }()
+	defer isolateConfig(t)()
+
+	filename, err := parseArguments([]string{"--command", "prepare", "--command", "train # gpus=2 gpu-type=nvidia-tesla-t4", "--command", "evaluate # gpus=1"})
+	if err != nil {
+		t.Fatalf("Failed to parse arguments: %v", err)
+	}
+	req, err := buildRequest(filename, "test")
+	if err != nil {
+		t.Fatalf("Failed to build request: %v", err)
+	}
+
+	got := req.Pipeline.Resources.VirtualMachine.Accelerators
+	want := []*genomics.Accelerator{{Type: "nvidia-tesla-t4", Count: 2}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Unexpected accelerators: got %+v, want %+v", got, want)
+	}
+}
+
+func TestParseDisk(t *testing.T) {
+	testCases := []struct {
+		spec    string
+		want    genomics.Disk
+		wantErr bool
+	}{
+		{"name=work", genomics.Disk{Name: "work"}, false},
+		{"name=ref,size=200,type=pd-ssd,image=ref-image", genomics.Disk{Name: "ref", SizeGb: 200, Type: "pd-ssd", SourceImage: "ref-image"}, false},
+		{"name=scratch,type=local-ssd", genomics.Disk{Name: "scratch", SizeGb: 375, Type: "local-ssd"}, false},
+		{"name=scratch,type=local-ssd,size=500", genomics.Disk{Name: "scratch", SizeGb: 750, Type: "local-ssd"}, false},
+		{"name=scratch,type=local-ssd,image=ref-image", genomics.Disk{}, true},
+		{"name=google", genomics.Disk{}, true},
+		{"name=Work", genomics.Disk{}, true},
+		{"size=10", genomics.Disk{}, true},
+		{"name=work,size=-1", genomics.Disk{}, true},
+		{"name=work,zone=us-east1-b", genomics.Disk{}, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.spec, func(t *testing.T) {
+			got, err := parseDisk(tc.spec)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("Expected an error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to parse disk: %v", err)
+			}
+			if !reflect.DeepEqual(*got, tc.want) {
+				t.Fatalf("Unexpected disk: got %+v, want %+v", *got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDiskMounts(t *testing.T) {
+	dataDisks = map[string]*genomics.Disk{"work": {Name: "work"}, "ref": {Name: "ref"}}
+	defer func() { dataDisks = nil }()
+
+	testCases := []struct {
+		line string
+		want []string
+	}{
+		{"echo hello", []string{"google:/mnt/google", "ref:/mnt/ref", "work:/mnt/work"}},
+		{"echo hello # disk=work", []string{"google:/mnt/google", "work:/mnt/work"}},
+		{"echo hello # disk=ref:ro,extra", []string{"google:/mnt/google", "ref:/mnt/ref:ro", "extra:/mnt/extra"}},
+		{"echo hello # disk=", []string{"google:/mnt/google"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.line, func(t *testing.T) {
+			action, err := parse(tc.line)
+			if err != nil {
+				t.Fatalf("Failed to parse: %v", err)
+			}
+			var got []string
+			for _, mount := range action.Mounts {
+				volume := mount.Disk + ":" + mount.Path
+				if mount.ReadOnly {
+					volume += ":ro"
+				}
+				got = append(got, volume)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("Unexpected mounts: got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestStepTransfers(t *testing.T) {
+	defer func() { stepTransfers = make(map[*genomics.Action]*stepTransfer) }()
+
+	action, err := parse("bwa mem ${REF} ${IN1} > ${OUT0} # in=REF=gs://bucket/ref.fa,gs://bucket/reads.fq out=gs://bucket/out.bam")
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	wantEnvironment := map[string]string{
+		"REF":  "/mnt/google/.google/input/bucket/ref.fa",
+		"IN1":  "/mnt/google/.google/input/bucket/reads.fq",
+		"OUT0": "/mnt/google/.google/output/bucket/out.bam",
+	}
+	if !reflect.DeepEqual(action.Environment, wantEnvironment) {
+		t.Fatalf("Unexpected environment: got %v, want %v", action.Environment, wantEnvironment)
+	}
+
+	other := &genomics.Action{ImageUri: "bash"}
+	actions, directories, outputs := addStepTransfers([]*genomics.Action{other, action})
+	want := []string{
+		"command",
+		"gsutil cp gs://bucket/reads.fq /mnt/google/.google/input/bucket/reads.fq",
+		"gsutil cp gs://bucket/ref.fa /mnt/google/.google/input/bucket/ref.fa",
+		"command",
+		"gsutil cp /mnt/google/.google/output/bucket/out.bam gs://bucket/out.bam",
+	}
+	if len(actions) != len(want) {
+		t.Fatalf("Unexpected number of actions: got %d, want %d", len(actions), len(want))
+	}
+	for i, a := range actions {
+		var got string
+		if a == other || a == action {
+			got = "command"
+		} else {
+			got = a.Commands[len(a.Commands)-1]
+		}
+		if !strings.Contains(got, want[i]) {
+			t.Errorf("Action %d: got %q, want it to contain %q", i, got, want[i])
+		}
+	}
+	if want := []string{"/mnt/google/.google/input/bucket", "/mnt/google/.google/input/bucket", "/mnt/google/.google/output/bucket"}; !reflect.DeepEqual(directories, want) {
+		t.Fatalf("Unexpected directories: got %q, want %q", directories, want)
+	}
+	if want := []string{"gs://bucket/out.bam"}; !reflect.DeepEqual(outputs, want) {
+		t.Fatalf("Unexpected outputs: got %q, want %q", outputs, want)
+	}
+
+	if _, err := parse("cat ${IN0} # in=local.txt"); err == nil {
+		t.Fatal("Expected an error for a local input")
+	}
+}
+
+func TestNotificationActions(t *testing.T) {
+	actions, err := notificationActions("projects/p/topics/t", "https://example.com/hook", map[string]string{"name": "test"})
+	if err != nil {
+		t.Fatalf("Failed to create actions: %v", err)
+	}
+	if len(actions) != 2 {
+		t.Fatalf("Unexpected number of actions: got %d, want 2", len(actions))
+	}
+	send := actions[1]
+	if send.Name != notificationAction || !reflect.DeepEqual(send.Flags, []string{"ALWAYS_RUN", "IGNORE_EXIT_STATUS"}) {
+		t.Errorf("Unexpected action: %+v", send)
+	}
+	if want := `{"status":"@status@","worker":"@worker@","labels":{"name":"test"}}`; send.Environment["NOTIFICATION"] != want {
+		t.Errorf("Unexpected message: got %s, want %s", send.Environment["NOTIFICATION"], want)
+	}
+	script := strings.Join(send.Commands, " ")
+	for _, want := range []string{"gcloud pubsub topics publish projects/p/topics/t", `"https://example.com/hook"`} {
+		if !strings.Contains(script, want) {
+			t.Errorf("Script %q does not contain %q", script, want)
+		}
+	}
+
+	for _, flags := range [][]string{{"projects/p/topics/t", ""}, {"", "https://example.com"}} {
+		if err := checkNotifyFlags(flags[0], flags[1]); err != nil {
+			t.Errorf("checkNotifyFlags(%q): unexpected error: %v", flags, err)
+		}
+	}
+	for _, flags := range [][]string{{"t", ""}, {"projects/p/subscriptions/s", ""}, {"", "example.com"}, {"", "ftp://example.com"}} {
+		if err := checkNotifyFlags(flags[0], flags[1]); err == nil {
+			t.Errorf("checkNotifyFlags(%q): expected an error", flags)
+		}
+	}
+}
+
+func TestAnyZoneAllowed(t *testing.T) {
+	zones := []string{"us-central1-a", "us-east1-c"}
+	testCases := []struct {
+		allowedZones, allowedRegions []string
+		want                         bool
+	}{
+		{nil, nil, true},
+		{[]string{"us-east1-c"}, nil, true},
+		{[]string{"us-east1-b"}, nil, false},
+		{nil, []string{"us-central1"}, true},
+		{nil, []string{"us-central"}, false},
+		{[]string{"europe-west1-b"}, []string{"us-east1"}, true},
+	}
+	for _, tc := range testCases {
+		if got := anyZoneAllowed(zones, tc.allowedZones, tc.allowedRegions); got != tc.want {
+			t.Errorf("anyZoneAllowed(%q, %q): got %t, want %t", tc.allowedZones, tc.allowedRegions, got, tc.want)
+		}
+	}
+	if anyZoneAllowed(nil, nil, nil) {
+		t.Error("Expected no zone to be allowed when the GPU is not available anywhere")
+	}
+}
+
+func TestApplyOverrides(t *testing.T) {
+	testCases := []struct {
+		override string
+		want     string
+		wantErr  bool
+	}{
+		{"pipeline.resources.virtualMachine.nvidiaDriverVersion=450.51.06", `"nvidiaDriverVersion":"450.51.06"`, false},
+		{"$.pipeline.resources.virtualMachine.bootDiskSizeGb=20", `"bootDiskSizeGb":20`, false},
+		{"pipeline.resources.virtualMachine.accelerators[0].count=2", `"count":"2"`, false},
+		{"pipeline.actions[1].imageUri=ubuntu", `"imageUri":"ubuntu"`, false},
+		{"pipeline.actions[0].flags=[\"ALWAYS_RUN\"]", `"flags":["ALWAYS_RUN"]`, false},
+		{"labels.team=genomics", `"labels":{"team":"genomics"}`, false},
+		{"pipeline.actions[3].imageUri=ubuntu", "", true},
+		{"pipeline.actions.imageUri=ubuntu", "", true},
+		{"pipeline.timeout", "", true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.override, func(t *testing.T) {
+			req := &genomics.RunPipelineRequest{
+				Pipeline: &genomics.Pipeline{
+					Actions: []*genomics.Action{{ImageUri: "bash"}},
+					Resources: &genomics.Resources{
+						VirtualMachine: &genomics.VirtualMachine{
+							Accelerators: []*genomics.Accelerator{{Type: "nvidia-tesla-t4", Count: 1}},
+						},
+					},
+				},
+			}
+			err := applyOverrides(req, []string{tc.override})
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("Unexpected success")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to apply override: %v", err)
+			}
+			encoded, err := json.Marshal(req)
+			if err != nil {
+				t.Fatalf("Failed to encode request: %v", err)
+			}
+			if !strings.Contains(string(encoded), tc.want) {
+				t.Fatalf("Unexpected request: got %s, want it to contain %s", encoded, tc.want)
+			}
+		})
+	}
+}
+
+func TestDockerArguments(t *testing.T) {
+	action := &genomics.Action{
+		ImageUri:     "ubuntu",
+		Commands:     []string{"-c", "echo hello"},
+		Entrypoint:   "bash",
+		Mounts:       []*genomics.Mount{{Disk: "google", Path: "/mnt/google"}, {Disk: "reference", Path: "/mnt/reference", ReadOnly: true}},
+		PortMappings: map[string]int64{"80": 8080},
+		Flags:        []string{"BLOCK_EXTERNAL_NETWORK"},
+	}
+	disks := map[string]string{"google": "/tmp/run/google", "reference": "/tmp/run/reference"}
+	got := dockerArguments("run-1", action, map[string]string{"B": "2", "A": "1"}, disks, "/tmp/run/logs")
+	want := []string{
+		"run", "--rm", "--name", "run-1", "-v", "/tmp/run/logs:/google/logs",
+		"-v", "/tmp/run/google:/mnt/google", "-v", "/tmp/run/reference:/mnt/reference:ro",
+		"-e", "A=1", "-e", "B=2", "-p", "8080:80", "--network", "none",
+		"--entrypoint", "bash", "ubuntu", "-c", "echo hello",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Unexpected arguments: got %q, want %q", got, want)
+	}
+}
+
+func TestPipelineHash(t *testing.T) {
+	newPipeline := func(command string) *genomics.Pipeline {
+		return &genomics.Pipeline{
+			Actions:     []*genomics.Action{{ImageUri: "bash", Commands: []string{"-c", command}}},
+			Environment: map[string]string{"INPUT0": "gs://bucket/input"},
+		}
+	}
+
+	original := newPipeline("wc -l ${INPUT0}")
+	setHash(original)
+
+	same := newPipeline("wc -l ${INPUT0}")
+	same.Resources = &genomics.Resources{VirtualMachine: &genomics.VirtualMachine{MachineType: "n1-highmem-8"}}
+	same.Timeout = "3600s"
+	setHash(same)
+	if got, want := same.Environment[hashVariable], original.Environment[hashVariable]; got != want {
+		t.Fatalf("Hash changed with the resources: got %q, want %q", got, want)
+	}
+
+	changed := newPipeline("wc -c ${INPUT0}")
+	setHash(changed)
+	if changed.Environment[hashVariable] == original.Environment[hashVariable] {
+		t.Fatal("Hash did not change with the commands")
+	}
+}
+
+func TestPipelineHashStagedInputs(t *testing.T) {
+	defer func() { staged = make(map[string]string) }()
+
+	f, err := ioutil.TempFile("", "input")
+	if err != nil {
+		t.Fatalf("Failed to create input: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("first version")
+	f.Close()
+
+	// Each run stages the input to a new path.
+	hash := func(remote string) string {
+		staged = map[string]string{f.Name(): remote}
+		return pipelineHash(&genomics.Pipeline{
+			Actions:     []*genomics.Action{{ImageUri: "bash", Commands: []string{"-c", "wc -l ${INPUT0}"}}},
+			Environment: map[string]string{"INPUT0": remote},
+		})
+	}
+	original := hash("gs://staging/20180101-000000-aaaa/0-input")
+	if got := hash("gs://staging/20180102-000000-bbbb/0-input"); got != original {
+		t.Fatalf("Hash changed with the staging ID: got %q, want %q", got, original)
+	}
+
+	if err := ioutil.WriteFile(f.Name(), []byte("second version"), 0644); err != nil {
+		t.Fatalf("Failed to update input: %v", err)
+	}
+	if got := hash("gs://staging/20180103-000000-cccc/0-input"); got == original {
+		t.Fatal("Hash did not change with the contents of the staged input")
+	}
+}
+
+func TestOutputFilter(t *testing.T) {
+	filter, err := parseOutputFilter("*.txt,*.json,<2KB")
+	if err != nil {
+		t.Fatalf("Failed to parse filter: %v", err)
+	}
+
+	testCases := []struct {
+		name string
+		size uint64
+		want bool
+	}{
+		{"out/summary.txt", 100, true},
+		{"out/metrics.json", 2047, true},
+		{"out/metrics.json", 2048, false},
+		{"out/reads.bam", 100, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := filter.matches(&storage.Object{Name: tc.name, Size: tc.size}); got != tc.want {
+				t.Fatalf("Unexpected result for %d bytes: got %t, want %t", tc.size, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSubmitRunsPreHooks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hooks")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	hook := filepath.Join(dir, "hook")
+	saved := filepath.Join(dir, "request.json")
+	if err := ioutil.WriteFile(hook, []byte("#!/bin/sh\ncat > "+saved+"\n"), 0755); err != nil {
+		t.Fatalf("Failed to write hook: %v", err)
+	}
+
+	server := fake.NewServer()
+	defer server.Close()
+	service, err := genomics.New(http.DefaultClient)
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	service.BasePath = server.URL
+
+	defer func() { preHooks = nil }()
+	testCases := []struct {
+		name    string
+		hook    string
+		wantErr bool
+	}{
+		{"succeeds", hook, false},
+		{"fails", "false", true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			os.Remove(saved)
+			preHooks = common.ListFlagValue{tc.hook}
+
+			req := &genomics.RunPipelineRequest{
+				Pipeline: &genomics.Pipeline{
+					Actions: []*genomics.Action{{ImageUri: "bash"}},
+					Resources: &genomics.Resources{
+						ProjectId:      "test",
+						VirtualMachine: &genomics.VirtualMachine{MachineType: "n1-standard-1", Preemptible: true},
+					},
+				},
+			}
+			state := &retryState{Request: req, Attempt: 1, Attempts: 2, Options: retryOptions{EscalateMemory: true}}
+			failure := common.PipelineExecutionError{Status: genomics.Status{Message: "Out of memory"}, Reason: common.ReasonOther}
+			if _, ok := state.retry(failure, &retryPolicy{}); !ok {
+				t.Fatal("Expected the attempt to be retried")
+			}
+
+			err := state.submit(context.Background(), service, "")
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("Unexpected success")
+				}
+				if state.Operation != "" {
+					t.Fatalf("Attempt was submitted as %q", state.Operation)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			var got genomics.RunPipelineRequest
+			if err := parseJSON(saved, &got); err != nil {
+				t.Fatalf("Failed to read request given to the hook: %v", err)
+			}
+			vm := got.Pipeline.Resources.VirtualMachine
+			if vm.MachineType != "n1-highmem-1" || vm.Preemptible {
+				t.Errorf("Hook was given machine type %q (preemptible: %t), want the escalated standard VM", vm.MachineType, vm.Preemptible)
+			}
+		})
+	}
+}
+
+func TestImageResources(t *testing.T) {
+	actions := []*genomics.Action{
+		{ImageUri: "bash"},
+		{ImageUri: "gcr.io/my-project/tool:1.0"},
+		{ImageUri: "gcr.io/my-project/other@sha256:abcd"},
+		{ImageUri: "eu.gcr.io/my-project/tool"},
+		{ImageUri: "gcr.io/example.com/my-project/tool"},
+		{ImageUri: "us-central1-docker.pkg.dev/my-project/repo/tool:latest"},
+		{ImageUri: "us-central1-docker.pkg.dev/my-project/repo/nested/tool"},
+		{ImageUri: "quay.io/biocontainers/samtools:1.9"},
+	}
+	buckets, repositories := imageResources(actions)
+
+	wantBuckets := []string{
+		"artifacts.my-project.appspot.com",
+		"eu.artifacts.my-project.appspot.com",
+		"artifacts.my-project.example.com.a.appspot.com",
+	}
+	if !reflect.DeepEqual(buckets, wantBuckets) {
+		t.Errorf("Unexpected buckets: got %v, want %v", buckets, wantBuckets)
+	}
+	wantRepositories := []string{"projects/my-project/locations/us-central1/repositories/repo"}
+	if !reflect.DeepEqual(repositories, wantRepositories) {
+		t.Errorf("Unexpected repositories: got %v, want %v", repositories, wantRepositories)
+	}
+}
+
+func TestRetryPolicyUpdate(t *testing.T) {
+	defer func(delay time.Duration) { policyRetryDelay = delay }(policyRetryDelay)
+	policyRetryDelay = time.Millisecond
+
+	testCases := []struct {
+		name      string
+		failures  []int
+		retriable map[int]bool
+		wantCalls uint
+		wantErr   bool
+	}{
+		{"succeeds", nil, newAccountErrors, 1, false},
+		{"account not visible yet", []int{http.StatusBadRequest, http.StatusNotFound, http.StatusForbidden}, newAccountErrors, 4, false},
+		{"concurrent update", []int{http.StatusPreconditionFailed}, conflictErrors, 2, false},
+		{"permission denied on cleanup", []int{http.StatusForbidden}, conflictErrors, 1, true},
+		{"gives up", []int{404, 404, 404, 404, 404, 404, 404, 404, 404}, newAccountErrors, policyAttempts, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var calls uint
+			err := retryPolicyUpdate(context.Background(), tc.retriable, func() error {
+				calls++
+				if int(calls) <= len(tc.failures) {
+					return &googleapi.Error{Code: tc.failures[calls-1]}
+				}
+				return nil
+			})
+			if calls != tc.wantCalls {
+				t.Errorf("Unexpected number of calls: got %d, want %d", calls, tc.wantCalls)
+			}
+			if (err != nil) != tc.wantErr {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestAddDockerDaemon(t *testing.T) {
+	plain := &genomics.Action{ImageUri: "bash"}
+	docker := &genomics.Action{ImageUri: "nextflow/nextflow", Environment: map[string]string{"DOCKER_HOST": dockerHost}}
+
+	if got := addDockerDaemon([]*genomics.Action{plain}); len(got) != 1 {
+		t.Fatalf("Unexpected actions added without the docker option: %d actions", len(got))
+	}
+
+	got := addDockerDaemon([]*genomics.Action{plain, docker})
+	if len(got) != 4 {
+		t.Fatalf("Unexpected number of actions: got %d, want 4", len(got))
+	}
+	daemon, ready := got[0], got[1]
+	if !containsString(daemon.Flags, "RUN_IN_BACKGROUND") || !containsString(daemon.Flags, "ENABLE_FUSE") {
+		t.Errorf("Unexpected daemon flags: %v", daemon.Flags)
+	}
+	if !containsString(daemon.Commands, "--bridge=none") || !containsString(daemon.Commands, "--host=unix://"+dockerSocket) {
+		t.Errorf("Unexpected daemon arguments: %v", daemon.Commands)
+	}
+	if containsString(ready.Flags, "RUN_IN_BACKGROUND") {
+		t.Error("The readiness check must block the following actions")
+	}
+	if script := strings.Join(ready.Commands, " "); !strings.Contains(script, dockerSocket) || !strings.Contains(script, "exit 1") {
+		t.Errorf("Unexpected readiness check: %q", script)
+	}
+	if got[2] != plain || got[3] != docker {
+		t.Error("The pipeline actions must follow the readiness check")
+	}
+}
+
+func TestParseArgumentsResetsFlags(t *testing.T) {
+	defer resetFlags()
+
+	first := []string{"--set", "A=1", "--labels", "team=x", "--vm-labels", "cost=y", "--zones", "us-east1-b", "--pvm-attempts", "3", "--command", "echo one"}
+	if _, err := parseArguments(first); err != nil {
+		t.Fatalf("Failed to parse arguments: %v", err)
+	}
+	environment["TMPDIR"] = "/mnt/data"
+
+	if _, err := parseArguments([]string{"--command", "echo two"}); err != nil {
+		t.Fatalf("Failed to parse arguments: %v", err)
+	}
+	if len(environment) > 0 || len(labels) > 0 || len(vmLabels) > 0 {
+		t.Errorf("Maps were not reset: environment %v, labels %v, VM labels %v", environment, labels, vmLabels)
+	}
+	if *zones != "" || *pvmAttempts != 1 {
+		t.Errorf("Flags were not reset: zones %q, PVM attempts %d", *zones, *pvmAttempts)
+	}
+	if want := []string{"echo two"}; !reflect.DeepEqual([]string(commands), want) {
+		t.Errorf("Unexpected commands: got %q, want %q", commands, want)
+	}
+}
+
+func TestInvokeResetsFlags(t *testing.T) {
+	defer resetFlags()
+	defer isolateConfig(t)()
+
+	first := []string{"--dry-run", "--deadline", time.Now().Add(time.Hour).Format(time.RFC3339), "--machine-type", "n1-standard-4", "--command", "echo one"}
+	if err := Invoke(context.Background(), nil, "test", first); err != nil {
+		t.Fatalf("Failed to run the first invocation: %v", err)
+	}
+	if deadline.IsZero() || !isFlagSet("machine-type") {
+		t.Fatalf("The first invocation was not parsed: deadline %v, machine type set %t", deadline, isFlagSet("machine-type"))
+	}
+
+	if err := Invoke(context.Background(), nil, "test", []string{"--dry-run", "--command", "echo two"}); err != nil {
+		t.Fatalf("Failed to run the second invocation: %v", err)
+	}
+	if !deadline.IsZero() {
+		t.Errorf("The deadline of the first invocation was kept: %v", deadline)
+	}
+	for _, name := range []string{"deadline", "machine-type"} {
+		if isFlagSet(name) {
+			t.Errorf("Flag --%s of the first invocation is still set", name)
+		}
+	}
+}
+
+func TestIsOutOfMemory(t *testing.T) {
+	testCases := []struct {
+		message, stderr string
+		exitStatus      int64
+		want            bool
+	}{
+		{"Execution failed: out of memory", "", 0, true},
+		{"", "java.lang.OutOfMemoryError: Java heap space", 1, true},
+		{"", "Memory cgroup out of memory: Killed process 1234 (bwa)", 137, true},
+		{"", "task was OOMKilled", 137, true},
+		{"", "oom-kill:constraint=CONSTRAINT_MEMCG", 137, true},
+		{"", "samtools sort: couldn't allocate memory: Cannot allocate memory", 1, true},
+		{"OOM", "", 0, true},
+		{"", "Killed", 137, false},
+		{"", "no room left for the index", 1, false},
+		{"", "zoom level must be positive", 1, false},
+		{"", "building bloom filter failed", 1, false},
+		{"", "failed to open /data/room/bloom.oom2", 1, false},
+	}
+	for _, tc := range testCases {
+		err := common.PipelineExecutionError{
+			Status:     genomics.Status{Message: tc.message},
+			Stderr:     tc.stderr,
+			ExitStatus: tc.exitStatus,
+			ActionID:   1,
+		}
+		if got := isOutOfMemory(err); got != tc.want {
+			t.Errorf("isOutOfMemory(%q, %q, %d): got %t, want %t", tc.message, tc.stderr, tc.exitStatus, got, tc.want)
+		}
+	}
+}
+
+func TestChangedLocally(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sync")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{"unchanged": "a", "edited": "b", "created": "c"}
+	for name, contents := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	uploaded := make(map[string]string)
+	for _, name := range []string{"unchanged", "edited", "deleted"} {
+		uploaded[filepath.Join(dir, name)] = "hash"
+	}
+	uploaded[filepath.Join(dir, "unchanged")], _ = fileMD5(filepath.Join(dir, "unchanged"))
+
+	testCases := []struct {
+		name string
+		want bool
+	}{
+		{"unchanged", false},
+		{"edited", true},
+		{"created", true},
+		{"deleted", false},
+	}
+	for _, tc := range testCases {
+		got, err := changedLocally(filepath.Join(dir, tc.name), uploaded)
+		if err != nil {
+			t.Fatalf("changedLocally(%q) failed: %v", tc.name, err)
+		}
+		if got != tc.want {
+			t.Errorf("changedLocally(%q): got %t, want %t", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestRetryOptionsOverride(t *testing.T) {
+	saved := retryOptions{ExitCodes: "1", EscalateMemory: true, RotateZones: true, Delay: time.Minute, MaxDelay: time.Hour}
+	given := retryOptions{ExitCodes: "2,3", Patterns: "stockout", RotateZones: true, MaxDelay: 30 * time.Minute}
+
+	got := saved
+	got.override(given, map[string]bool{"retry-exit-codes": true, "retry-max-delay": true, "pvm-attempts": true})
+	want := retryOptions{ExitCodes: "2,3", EscalateMemory: true, RotateZones: true, Delay: time.Minute, MaxDelay: 30 * time.Minute}
+	if got != want {
+		t.Fatalf("Unexpected options: got %+v, want %+v", got, want)
+	}
+
+	got = saved
+	got.override(given, nil)
+	if got != saved {
+		t.Fatalf("Options changed without flags: got %+v, want %+v", got, saved)
+	}
+}
+
+func TestController(t *testing.T) {
+	gcs := fake.NewStorageServer()
+	defer gcs.Close()
+	defer os.Setenv(common.EmulatorVariable, os.Getenv(common.EmulatorVariable))
+	os.Setenv(common.EmulatorVariable, gcs.Host)
+
+	server := fake.NewServer()
+	defer server.Close()
+	service, err := genomics.New(http.DefaultClient)
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	service.BasePath = server.URL
+
+	defer func(prefix string) { *controllerPrefix = prefix }(*controllerPrefix)
+	*controllerPrefix = "gs://bucket/retries/"
+	storageService, err := common.NewStorageService(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to create storage service: %v", err)
+	}
+
+	// The first attempt fails with a retriable exit status and the second
+	// succeeds.
+	path := "gs://bucket/retries/job.json"
+	state := &retryState{
+		Request: &genomics.RunPipelineRequest{
+			Pipeline: &genomics.Pipeline{
+				Actions:     []*genomics.Action{{ImageUri: "bash"}},
+				Environment: map[string]string{fake.ResultsVariable: "1,ok"},
+				Resources: &genomics.Resources{
+					ProjectId:      "test",
+					VirtualMachine: &genomics.VirtualMachine{MachineType: "n1-standard-1"},
+				},
+			},
+		},
+		Attempt:  1,
+		Attempts: 2,
+		Options:  retryOptions{ExitCodes: "1"},
+		AuditLog: "gs://bucket/audit",
+	}
+	if err := state.save(context.Background(), path); err != nil {
+		t.Fatalf("Failed to save retry state: %v", err)
+	}
+
+	for _, want := range []string{
+		"attempt 1 submitted as projects/test/operations/1",
+		"attempt 2 submitted as projects/test/operations/2",
+		"attempt 2 succeeded",
+	} {
+		var b strings.Builder
+		if err := processRetryStates(context.Background(), service, storageService, &b); err != nil {
+			t.Fatalf("Failed to process retry states: %v", err)
+		}
+		if got, want := b.String(), path+": "+want+"\n"; got != want {
+			t.Fatalf("Unexpected status: got %q, want %q", got, want)
+		}
+	}
+
+	if _, ok := gcs.Object("bucket", "retries/job.json"); ok {
+		t.Error("The retry state was not removed after the pipeline succeeded")
+	}
+	objects, err := common.ListOutput(context.Background(), storageService, "gs://bucket/audit/*")
+	if err != nil {
+		t.Fatalf("Failed to list audit records: %v", err)
+	}
+	if len(objects) != 2 {
+		t.Errorf("Unexpected number of audit records: got %d, want 2", len(objects))
+	}
+}
+
+func TestRunFanOut(t *testing.T) {
+	home, err := ioutil.TempDir("", "pipelines-tools")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(home)
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	os.Setenv("HOME", home)
+
+	// Submitting to the second project is rejected by the policy.
+	policyFile := filepath.Join(home, "policy.json")
+	if err := ioutil.WriteFile(policyFile, []byte(`{"machineTypes": ["n1-standard-*"]}`), 0644); err != nil {
+		t.Fatalf("Failed to write policy: %v", err)
+	}
+	defer flags.Set("policy", "")
+	flags.Set("policy", policyFile)
+	defer func(interval time.Duration) { pollInterval = interval }(pollInterval)
+	pollInterval = time.Millisecond
+
+	server := fake.NewServer()
+	defer server.Close()
+	service, err := genomics.New(http.DefaultClient)
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	service.BasePath = server.URL
+
+	// The first attempt in the third project fails and is retried.
+	projects := []string{"a", "b", "c"}
+	var states []*retryState
+	for _, project := range projects {
+		machineType := "n1-standard-1"
+		if project == "b" {
+			machineType = "n1-highmem-2"
+		}
+		req := &genomics.RunPipelineRequest{
+			Pipeline: &genomics.Pipeline{
+				Actions:     []*genomics.Action{{ImageUri: "bash"}},
+				Environment: map[string]string{fake.ResultsVariable: "ok,1,ok"},
+				Resources: &genomics.Resources{
+					ProjectId:      project,
+					VirtualMachine: &genomics.VirtualMachine{MachineType: machineType},
+				},
+			},
+		}
+		states = append(states, &retryState{Request: req, Attempt: 1, Attempts: 2, Options: retryOptions{ExitCodes: "1"}})
+	}
+
+	if err := runFanOut(context.Background(), service, projects, states); err == nil {
+		t.Fatal("Unexpected success with a rejected project")
+	}
+	if got, want := server.Operations(), 3; got != want {
+		t.Fatalf("Unexpected number of operations: got %d, want %d", got, want)
+	}
+	for i, want := range []string{"projects/a/operations/1", "", "projects/c/operations/3"} {
+		if got := states[i].Operation; got != want {
+			t.Errorf("Unexpected operation for project %q: got %q, want %q", projects[i], got, want)
+		}
+	}
+}
+
+func TestNotifySubmitFailure(t *testing.T) {
+	home, err := ioutil.TempDir("", "pipelines-tools")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(home)
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	os.Setenv("HOME", home)
+
+	policyFile := filepath.Join(home, "policy.json")
+	if err := ioutil.WriteFile(policyFile, []byte(`{"machineTypes": ["n1-standard-*"]}`), 0644); err != nil {
+		t.Fatalf("Failed to write policy: %v", err)
+	}
+	defer flags.Set("policy", "")
+	flags.Set("policy", policyFile)
+
+	var messages []notification
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var message notification
+		if err := json.NewDecoder(r.Body).Decode(&message); err != nil {
+			t.Errorf("Failed to decode notification: %v", err)
+		}
+		messages = append(messages, message)
+	}))
+	defer webhook.Close()
+	defer flags.Set("notify-url", "")
+	flags.Set("notify-url", webhook.URL)
+
+	server := fake.NewServer()
+	defer server.Close()
+	service, err := genomics.New(http.DefaultClient)
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	service.BasePath = server.URL
+
+	req := &genomics.RunPipelineRequest{
+		Pipeline: &genomics.Pipeline{
+			Actions: []*genomics.Action{{ImageUri: "bash"}},
+			Resources: &genomics.Resources{
+				ProjectId:      "test",
+				VirtualMachine: &genomics.VirtualMachine{MachineType: "n1-highmem-2"},
+			},
+		},
+		Labels: map[string]string{"name": "rejected"},
+	}
+	state := &retryState{Request: req, Attempt: 1, Attempts: 1}
+	if err := runPipeline(context.Background(), service, state); err == nil {
+		t.Fatal("Unexpected success submitting a rejected pipeline")
+	}
+
+	if len(messages) != 1 {
+		t.Fatalf("Unexpected number of notifications: got %d, want 1", len(messages))
+	}
+	if got := messages[0]; got.Status != "failed" || got.Error == "" || got.Labels["name"] != "rejected" {
+		t.Errorf("Unexpected notification: %+v", got)
+	}
+}
+
+func TestRunsSkipsCorruptRecords(t *testing.T) {
+	home, err := ioutil.TempDir("", "pipelines-tools")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(home)
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	os.Setenv("HOME", home)
+
+	state := &retryState{
+		Request: &genomics.RunPipelineRequest{Labels: map[string]string{"name": "test"}},
+		ID:      "0123456789ab",
+		Attempt: 2,
+	}
+	state.record()
+	directory, err := runsDirectory()
+	if err != nil {
+		t.Fatalf("Failed to find the runs directory: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(directory, "corrupt.json"), []byte("{"), 0600); err != nil {
+		t.Fatalf("Failed to write corrupt record: %v", err)
+	}
+
+	if err := Runs(context.Background(), nil, "test", []string{"list"}); err != nil {
+		t.Fatalf("Failed to list runs: %v", err)
+	}
+}
+
+func TestRunsNotRecordedWithoutWaiting(t *testing.T) {
+	home, err := ioutil.TempDir("", "pipelines-tools")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(home)
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	os.Setenv("HOME", home)
+	defer flags.Set("wait", "true")
+	flags.Set("wait", "false")
+
+	server := fake.NewServer()
+	defer server.Close()
+	service, err := genomics.New(http.DefaultClient)
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	service.BasePath = server.URL
+
+	req := &genomics.RunPipelineRequest{
+		Pipeline: &genomics.Pipeline{
+			Actions: []*genomics.Action{{ImageUri: "bash"}},
+			Resources: &genomics.Resources{
+				ProjectId:      "test",
+				VirtualMachine: &genomics.VirtualMachine{MachineType: "n1-standard-1"},
+			},
+		},
+	}
+	state := &retryState{Request: req, ID: "0123456789ab", Attempt: 1, Attempts: 1}
+	if err := runPipeline(context.Background(), service, state); err != nil {
+		t.Fatalf("Failed to run pipeline: %v", err)
+	}
+	if _, err := loadRecord(state.ID); err == nil {
+		t.Error("A run that is not waited for was recorded")
+	}
+}
+
+func TestRecordScript(t *testing.T) {
+	actions := []*genomics.Action{{ImageUri: "bash"}, {ImageUri: "bash"}}
+	recordScript(actions, "echo hello\n")
+
+	if actions[1].Environment[common.ScriptVariable] != "" {
+		t.Error("The script was passed to every action")
+	}
+	pipeline := &genomics.Pipeline{Actions: append([]*genomics.Action{{ImageUri: "google/cloud-sdk"}}, actions...)}
+	if got, want := common.Script(pipeline), "echo hello\n"; got != want {
+		t.Errorf("Unexpected script: got %q, want %q", got, want)
+	}
+}
+
+func TestCommandName(t *testing.T) {
+	testCases := []struct {
+		command string
+		want    string
+	}{
+		{"gsutil cp a b", "gsutil"},
+		{"/usr/bin/gsutil cp a b", "gsutil"},
+		{"FOO=bar gsutil cp a b", "gsutil"},
+		{"env -u VAR gsutil cp a b", "gsutil"},
+		{"env --unset VAR FOO=bar gsutil cp a b", "gsutil"},
+		{"env -i --unset=VAR gsutil cp a b", "gsutil"},
+		{"time -f %e nohup gcloud info", "gcloud"},
+		{"exec -a name bq ls", "bq"},
+		{"env -- gsutil ls", "gsutil"},
+		{"samtools view -b in.bam", "samtools"},
+		{"env -u VAR", ""},
+	}
+	for _, tc := range testCases {
+		if got := commandName(strings.Fields(tc.command)); got != tc.want {
+			t.Errorf("commandName(%q): got %q, want %q", tc.command, got, tc.want)
+		}
+	}
+}
+
+func TestSetMinimalScopes(t *testing.T) {
+	testCases := []struct {
+		name      string
+		command   string
+		requested []string
+		want      []string
+	}{
+		{"required only", "gsutil cp a b", nil, []string{scopePrefix + "devstorage.read_write"}},
+		{"requested kept", "gsutil cp a b", []string{scopePrefix + "bigquery"}, []string{scopePrefix + "devstorage.read_write", scopePrefix + "bigquery"}},
+		{"unneeded cloud-platform kept", "echo hello", []string{scopePrefix + "cloud-platform"}, []string{scopePrefix + "cloud-platform"}},
+		{"needed cloud-platform", "gcloud compute instances list", []string{scopePrefix + "cloud-platform"}, []string{scopePrefix + "cloud-platform"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pipeline := &genomics.Pipeline{
+				Actions: []*genomics.Action{{Commands: []string{"-c", tc.command}}},
+				Resources: &genomics.Resources{
+					VirtualMachine: &genomics.VirtualMachine{
+						ServiceAccount: &genomics.ServiceAccount{Scopes: tc.requested},
+					},
+				},
+			}
+			setMinimalScopes(pipeline)
+			if got := pipeline.Resources.VirtualMachine.ServiceAccount.Scopes; !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("Unexpected scopes: got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSetTimeouts(t *testing.T) {
+	testCases := []struct {
+		timeout time.Duration
+		want    []string
+	}{
+		{0, []string{"", "10s", ""}},
+		{time.Hour, []string{"3600s", "10s", ""}},
+		{500 * time.Millisecond, []string{"0.5s", "10s", ""}},
+		{90*time.Second + 250*time.Millisecond, []string{"90.25s", "10s", ""}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.timeout.String(), func(t *testing.T) {
+			actions := []*genomics.Action{
+				{ImageUri: "bash"},
+				{ImageUri: "bash", Timeout: "10s"},
+				{ImageUri: "bash", Flags: []string{"RUN_IN_BACKGROUND"}},
+			}
+			setTimeouts(actions, tc.timeout)
+
+			var got []string
+			for _, action := range actions {
+				got = append(got, action.Timeout)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("Unexpected timeouts: got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestAvoidZone(t *testing.T) {
+	testCases := []struct {
+		name  string
+		zones []string
+		zone  string
+		want  []string
+	}{
+		{"failed zone removed", []string{"us-central1-a", "us-central1-b", "us-central1-c"}, "us-central1-b", []string{"us-central1-a", "us-central1-c"}},
+		{"unknown zone", []string{"us-central1-a", "us-central1-b"}, "us-east1-b", []string{"us-central1-a", "us-central1-b"}},
+		{"no zone", []string{"us-central1-a", "us-central1-b"}, "", []string{"us-central1-a", "us-central1-b"}},
+		{"last zone kept", []string{"us-central1-a"}, "us-central1-a", []string{"us-central1-a"}},
+		{"any zone", nil, "us-central1-a", nil},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := avoidZone(tc.zones, tc.zone); !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("Unexpected zones: got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRetryRotatesZones(t *testing.T) {
+	policy, err := parseRetryPolicy("", "")
+	if err != nil {
+		t.Fatalf("Failed to parse retry policy: %v", err)
+	}
+
+	testCases := []struct {
+		name   string
+		reason string
+		status code.Code
+		rotate bool
+		want   []string
+		wantOK bool
+	}{
+		{"preempted", common.ReasonPreempted, code.Code_ABORTED, true, []string{"us-central1-b", "us-central1-c"}, true},
+		{"resources exhausted", common.ReasonResourceExhausted, code.Code_RESOURCE_EXHAUSTED, true, []string{"us-central1-b", "us-central1-c"}, true},
+		{"rotation disabled", common.ReasonPreempted, code.Code_ABORTED, false, []string{"us-central1-a", "us-central1-b", "us-central1-c"}, true},
+		{"action failed", common.ReasonActionFailed, code.Code_FAILED_PRECONDITION, true, []string{"us-central1-a", "us-central1-b", "us-central1-c"}, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			state := &retryState{
+				Request: &genomics.RunPipelineRequest{
+					Pipeline: &genomics.Pipeline{
+						Resources: &genomics.Resources{
+							Zones:          []string{"us-central1-a", "us-central1-b", "us-central1-c"},
+							VirtualMachine: &genomics.VirtualMachine{MachineType: "n1-standard-1"},
+						},
+					},
+				},
+				Attempt:  1,
+				Attempts: 3,
+				Options:  retryOptions{RotateZones: tc.rotate},
+			}
+			failure := common.PipelineExecutionError{
+				Status: genomics.Status{Code: int64(tc.status)},
+				Reason: tc.reason,
+				Zone:   "us-central1-a",
+			}
+			if _, ok := state.retry(failure, policy); ok != tc.wantOK {
+				t.Fatalf("Unexpected retry decision: got %t, want %t", ok, tc.wantOK)
+			}
+			if got := state.Request.Pipeline.Resources.Zones; !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("Unexpected zones: got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMutators(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mutators")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	mutator := filepath.Join(dir, "mutator")
+	files := map[string]string{
+		mutator:        "#!/bin/sh\nsed 's/n1-standard-1/n1-standard-2/'\n",
+		"request.json": `{"pipeline": {"actions": [{"imageUri": "bash"}], "resources": {"virtualMachine": {"machineType": "n1-standard-1"}}}}`,
+		"job.script":   "echo hello\n",
+	}
+	for name, contents := range files {
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(dir, name)
+		}
+		if err := ioutil.WriteFile(name, []byte(contents), 0755); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	testCases := []struct {
+		name     string
+		filename string
+		mutators []string
+		want     string
+		wantErr  bool
+	}{
+		{"raw request", "request.json", []string{mutator}, "n1-standard-2", false},
+		{"script", "job.script", []string{mutator}, "n1-standard-2", false},
+		{"no mutators", "request.json", nil, "n1-standard-1", false},
+		{"failing mutator", "request.json", []string{"false"}, "", true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			encoded, err := json.Marshal(&common.Config{Mutators: tc.mutators})
+			if err != nil {
+				t.Fatalf("Failed to encode configuration: %v", err)
+			}
+			configFile := filepath.Join(dir, "config.json")
+			if err := ioutil.WriteFile(configFile, encoded, 0644); err != nil {
+				t.Fatalf("Failed to write configuration: %v", err)
+			}
+			defer os.Setenv(common.ConfigVariable, os.Getenv(common.ConfigVariable))
+			os.Setenv(common.ConfigVariable, configFile)
+
+			req, err := buildRequest(filepath.Join(dir, tc.filename), "test")
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("Unexpected success")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to build request: %v", err)
+			}
+			if got := req.Pipeline.Resources.VirtualMachine.MachineType; got != tc.want {
+				t.Fatalf("Unexpected machine type: got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestGrowDisks(t *testing.T) {
+	testCases := []struct {
+		name   string
+		disk   genomics.Disk
+		factor float64
+		want   int64
+	}{
+		{"doubled", genomics.Disk{Name: "google", SizeGb: 100}, 2, 200},
+		{"fractional factor", genomics.Disk{Name: "google", SizeGb: 100}, 1.5, 150},
+		{"default size", genomics.Disk{Name: "google"}, 2, 2 * defaultDiskSizeGb},
+		{"local SSD rounded up", genomics.Disk{Name: "scratch", Type: localSSD, SizeGb: 375}, 1.5, 750},
+		{"local SSD doubled", genomics.Disk{Name: "scratch", Type: localSSD, SizeGb: 750}, 2, 1500},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			disk := tc.disk
+			growDisks(&genomics.VirtualMachine{Disks: []*genomics.Disk{&disk}}, tc.factor)
+			if disk.SizeGb != tc.want {
+				t.Fatalf("Unexpected size: got %d, want %d", disk.SizeGb, tc.want)
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	testCases := []struct {
+		name         string
+		failures     uint
+		initial, max time.Duration
+		wantNominal  time.Duration
+	}{
+		{"no failures", 0, time.Minute, time.Hour, 0},
+		{"no delay", 3, 0, time.Hour, 0},
+		{"first failure", 1, time.Minute, time.Hour, time.Minute},
+		{"doubled", 3, time.Minute, time.Hour, 4 * time.Minute},
+		{"capped", 10, time.Minute, 10 * time.Minute, 10 * time.Minute},
+		{"jitter capped", 3, time.Minute, 5 * time.Minute, 4 * time.Minute},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// The jitter is up to half of the delay either way, and the
+			// result is rounded to a second.
+			min, max := tc.wantNominal/2-time.Second, tc.wantNominal*3/2+time.Second
+			for i := 0; i < 100; i++ {
+				got := backoff(tc.failures, tc.initial, tc.max)
+				if tc.wantNominal == 0 && got != 0 || got < min || got > max {
+					t.Fatalf("Unexpected delay: got %s, want %s ± 50%%", got, tc.wantNominal)
+				}
+				if got > tc.max {
+					t.Fatalf("Unexpected delay: got %s, want at most %s", got, tc.max)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	policy, err := parseRetryPolicy("", "")
+	if err != nil {
+		t.Fatalf("Failed to parse retry policy: %v", err)
+	}
+
+	now := time.Now()
+	testCases := []struct {
+		name       string
+		attempt    uint
+		retryUntil time.Time
+		want       bool
+	}{
+		{"attempts remaining", 1, time.Time{}, true},
+		{"attempts exhausted", 2, time.Time{}, false},
+		{"budget remaining", 5, now.Add(time.Hour), true},
+		{"budget exhausted", 5, now.Add(-time.Minute), false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			state := &retryState{
+				Request: &genomics.RunPipelineRequest{
+					Pipeline: &genomics.Pipeline{
+						Resources: &genomics.Resources{VirtualMachine: &genomics.VirtualMachine{MachineType: "n1-standard-1"}},
+					},
+				},
+				Attempt:    tc.attempt,
+				Attempts:   2,
+				RetryUntil: tc.retryUntil,
+			}
+			failure := common.PipelineExecutionError{Status: genomics.Status{Code: int64(code.Code_ABORTED)}, Reason: common.ReasonPreempted}
+			if _, got := state.retry(failure, policy); got != tc.want {
+				t.Fatalf("Unexpected retry decision: got %t, want %t", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestApplyDeadline(t *testing.T) {
+	defer func(saved time.Time) { deadline = saved }(deadline)
+
+	now := time.Now()
+	testCases := []struct {
+		name     string
+		deadline time.Time
+		timeout  string
+		// want is the expected timeout, or empty if the timeout should be
+		// limited to the time remaining until the deadline.
+		want    string
+		wantErr bool
+	}{
+		{"no deadline", time.Time{}, "3600s", "3600s", false},
+		{"deadline passed", now.Add(-time.Minute), "3600s", "", true},
+		{"shorter timeout kept", now.Add(2 * time.Hour), "3600s", "3600s", false},
+		{"timeout limited", now.Add(30 * time.Minute), "3600s", "", false},
+		{"no timeout", now.Add(30 * time.Minute), "", "", false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			deadline = tc.deadline
+			pipeline := &genomics.Pipeline{Timeout: tc.timeout}
+			err := applyDeadline(pipeline)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("Expected an error for a deadline that has passed")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to apply deadline: %v", err)
+			}
+			if tc.want != "" {
+				if pipeline.Timeout != tc.want {
+					t.Fatalf("Unexpected timeout: got %q, want %q", pipeline.Timeout, tc.want)
+				}
+				return
+			}
+			got, err := time.ParseDuration(pipeline.Timeout)
+			if err != nil {
+				t.Fatalf("Failed to parse timeout %q: %v", pipeline.Timeout, err)
+			}
+			if limit := time.Until(tc.deadline); got > limit+time.Second || got < limit-time.Minute {
+				t.Fatalf("Unexpected timeout: got %v, want about %v", got, limit)
+			}
+		})
+	}
+}
+
+func TestRetryDeadline(t *testing.T) {
+	defer func(saved time.Time) { deadline = saved }(deadline)
+
+	policy, err := parseRetryPolicy("", "")
+	if err != nil {
+		t.Fatalf("Failed to parse retry policy: %v", err)
+	}
+
+	now := time.Now()
+	testCases := []struct {
+		name     string
+		deadline time.Time
+		want     bool
+	}{
+		{"no deadline", time.Time{}, true},
+		{"deadline ahead", now.Add(time.Hour), true},
+		{"deadline passed", now.Add(-time.Minute), false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			state := &retryState{
+				Request: &genomics.RunPipelineRequest{
+					Pipeline: &genomics.Pipeline{
+						Resources: &genomics.Resources{VirtualMachine: &genomics.VirtualMachine{MachineType: "n1-standard-1"}},
+					},
+				},
+				Attempt:    1,
+				Attempts:   2,
+				RetryUntil: now.Add(time.Hour),
+				Deadline:   tc.deadline,
+			}
+			failure := common.PipelineExecutionError{Status: genomics.Status{Code: int64(code.Code_ABORTED)}, Reason: common.ReasonPreempted}
+			if _, got := state.retry(failure, policy); got != tc.want {
+				t.Fatalf("Unexpected retry decision: got %t, want %t", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestReplayRun(t *testing.T) {
+	home, err := ioutil.TempDir("", "pipelines-tools")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(home)
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	os.Setenv("HOME", home)
+	defer flags.Set("wait", "true")
+	flags.Set("wait", "false")
+
+	server := fake.NewServer()
+	defer server.Close()
+
+	run := func(transport http.RoundTripper) error {
+		service, err := genomics.New(&http.Client{Transport: transport})
+		if err != nil {
+			t.Fatalf("Failed to create service: %v", err)
+		}
+		service.BasePath = server.URL
+
+		req := &genomics.RunPipelineRequest{
+			Pipeline: &genomics.Pipeline{
+				Actions: []*genomics.Action{{ImageUri: "bash"}},
+				Resources: &genomics.Resources{
+					ProjectId:      "test",
+					VirtualMachine: &genomics.VirtualMachine{MachineType: "n1-standard-1"},
+				},
+			},
+		}
+		state := &retryState{Request: req, Attempt: 1, Attempts: 1}
+		return runPipeline(context.Background(), service, state)
+	}
+
+	filename := filepath.Join(home, "recording")
+	recorder, err := replay.NewRecorder(filename, http.DefaultTransport)
+	if err != nil {
+		t.Fatalf("Failed to create recorder: %v", err)
+	}
+	if err := run(recorder); err != nil {
+		t.Fatalf("Failed to run pipeline: %v", err)
+	}
+	recorder.Close()
+
+	replayer, err := replay.NewReplayer(filename)
+	if err != nil {
+		t.Fatalf("Failed to load recording: %v", err)
+	}
+	if err := run(replayer); err != nil {
+		t.Fatalf("Failed to replay pipeline: %v", err)
+	}
+	if got := replayer.Remaining(); got != 0 {
+		t.Fatalf("Unexpected remaining interactions: got %d, want 0", got)
+	}
+}
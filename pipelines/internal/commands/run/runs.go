@@ -0,0 +1,176 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package run
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/common"
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/printer"
+	genomics "google.golang.org/api/genomics/v2alpha1"
+)
+
+var (
+	runsFlags = flag.NewFlagSet("", flag.ExitOnError)
+	runsOut   = printer.New(runsFlags, nil)
+)
+
+// runsDirectory returns the local directory that holds the state of each
+// unfinished run (one file per run, so that several invocations of the tool
+// can update their runs at the same time), creating it if necessary.
+func runsDirectory() (string, error) {
+	directory, err := common.StatePath("runs")
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return "", fmt.Errorf("creating runs directory: %v", err)
+	}
+	return directory, nil
+}
+
+// record saves the state of the retry loop locally so that the run can be
+// continued with --resume if the tool exits before it finishes.
+func (s *retryState) record() {
+	if err := s.writeRecord(); err != nil {
+		fmt.Printf("Failed to record the state of run %s: %v\n", s.ID, err)
+	}
+}
+
+func (s *retryState) writeRecord() error {
+	directory, err := runsDirectory()
+	if err != nil {
+		return err
+	}
+	encoded, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding run: %v", err)
+	}
+	// The state is written to a temporary file first so that a reader never
+	// sees a partially written record.
+	path := filepath.Join(directory, s.ID+".json")
+	if err := ioutil.WriteFile(path+".tmp", encoded, 0600); err != nil {
+		return fmt.Errorf("writing run: %v", err)
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// forget removes the local record of a finished run.
+func (s *retryState) forget() {
+	directory, err := runsDirectory()
+	if err == nil {
+		err = os.Remove(filepath.Join(directory, s.ID+".json"))
+	}
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Printf("Failed to remove the state of run %s: %v\n", s.ID, err)
+	}
+}
+
+// loadRecord returns the state of the run with the given ID.
+func loadRecord(id string) (*retryState, error) {
+	directory, err := runsDirectory()
+	if err != nil {
+		return nil, err
+	}
+	encoded, err := ioutil.ReadFile(filepath.Join(directory, id+".json"))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no unfinished run with ID %q (see 'runs list')", id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading run: %v", err)
+	}
+	var s retryState
+	if err := json.Unmarshal(encoded, &s); err != nil {
+		return nil, fmt.Errorf("decoding run: %v", err)
+	}
+	return &s, nil
+}
+
+// resumeRun continues the run with the given ID, either by watching its
+// current attempt or by submitting the next one.
+func resumeRun(ctx context.Context, service *genomics.Service, id string) error {
+	state, err := loadRecord(id)
+	if err != nil {
+		return err
+	}
+	return runPipeline(ctx, service, state)
+}
+
+// Runs lists the unfinished runs recorded on this machine (the only
+// subcommand is 'list').  Each run is shown with the current status of its
+// latest attempt.
+func Runs(ctx context.Context, service *genomics.Service, project string, arguments []string) error {
+	arguments = common.ParseFlags(runsFlags, arguments)
+	if len(arguments) != 1 || arguments[0] != "list" {
+		return errors.New("expecting the 'list' subcommand")
+	}
+	if err := runsOut.Validate(); err != nil {
+		return err
+	}
+
+	directory, err := runsDirectory()
+	if err != nil {
+		return err
+	}
+	files, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return fmt.Errorf("listing runs: %v", err)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+
+	var records []printer.Record
+	for _, file := range files {
+		id := strings.TrimSuffix(file.Name(), ".json")
+		if id == file.Name() {
+			continue
+		}
+		state, err := loadRecord(id)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping run %s: %v\n", id, err)
+			continue
+		}
+
+		status := "waiting to retry"
+		if state.Operation != "" {
+			lro, err := service.Projects.Operations.Get(state.Operation).Context(ctx).Do()
+			if err != nil {
+				status = "unknown"
+			} else {
+				status = common.OperationStatus(lro)
+			}
+		}
+		records = append(records, printer.Record{
+			"id":        id,
+			"operation": state.Operation,
+			"attempt":   state.Attempt,
+			"status":    status,
+			"updated":   file.ModTime().Format(time.RFC3339),
+			"labels":    state.Request.Labels,
+		})
+	}
+	return runsOut.Print(os.Stdout, []string{"id", "operation", "attempt", "status", "updated"}, records)
+}
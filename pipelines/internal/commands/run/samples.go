@@ -0,0 +1,145 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package run
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	genomics "google.golang.org/api/genomics/v2alpha1"
+)
+
+var (
+	// sampleVariables holds the values of the sample sheet row that is
+	// being built, or nil if --batch is not used.
+	sampleVariables map[string]string
+
+	columnPattern   = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	variablePattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+)
+
+// parseSampleSheet reads a sample sheet, which is a CSV file (if the name ends
+// with .csv) or a TSV file with a header row naming the variables.  It returns
+// the column names and the values of each row.
+func parseSampleSheet(filename string) ([]string, []map[string]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, fmt.Errorf("opening sample sheet: %v", err)
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	reader.Comment = '#'
+	if !strings.HasSuffix(strings.ToLower(filename), ".csv") {
+		reader.Comma = '\t'
+		reader.LazyQuotes = true
+	}
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing sample sheet: %v", err)
+	}
+	if len(records) < 2 {
+		return nil, nil, errors.New("the sample sheet must have a header row and at least one sample")
+	}
+
+	header := records[0]
+	for _, name := range header {
+		if !columnPattern.MatchString(name) {
+			return nil, nil, fmt.Errorf("invalid column name %q", name)
+		}
+	}
+	var rows []map[string]string
+	for _, record := range records[1:] {
+		row := make(map[string]string)
+		for i, value := range record {
+			row[header[i]] = value
+		}
+		rows = append(rows, row)
+	}
+	return header, rows, nil
+}
+
+// substitute replaces ${NAME} in text with the value of the NAME column of
+// the current sample.  Other references (including those to variables that
+// are not columns) are left for the shell to expand.
+func substitute(text string) string {
+	if sampleVariables == nil {
+		return text
+	}
+	return variablePattern.ReplaceAllStringFunc(text, func(match string) string {
+		if value, ok := sampleVariables[match[2:len(match)-1]]; ok {
+			return value
+		}
+		return match
+	})
+}
+
+// prepareSamples builds a request for each row of the sample sheet.  The rows
+// are named by the values of the first column, which is returned as the name
+// of the summary column.
+func prepareSamples(filename, project, sheet string) (string, []string, []*genomics.RunPipelineRequest, error) {
+	header, rows, err := parseSampleSheet(sheet)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	defer func() { sampleVariables = nil }()
+
+	// Building a request records values (such as the input paths) in the
+	// environment flag values, so each row starts from the original values
+	// and its request is given its own copy.
+	original := copyMap(environment)
+
+	column := header[0]
+	var names []string
+	var requests []*genomics.RunPipelineRequest
+	for _, row := range rows {
+		name := row[column]
+		fmt.Printf("=== %s %s ===\n", column, name)
+
+		for k := range environment {
+			delete(environment, k)
+		}
+		for k, v := range original {
+			environment[k] = v
+		}
+		sampleVariables = row
+
+		req, err := prepareRequest(filename, project)
+		if err != nil {
+			return "", nil, nil, fmt.Errorf("%s %s: %v", column, name, err)
+		}
+		req.Pipeline.Environment = copyMap(req.Pipeline.Environment)
+		req.Labels = copyMap(req.Labels)
+
+		names = append(names, name)
+		requests = append(requests, req)
+	}
+	return column, names, requests, nil
+}
+
+func copyMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	result := make(map[string]string)
+	for k, v := range m {
+		result[k] = v
+	}
+	return result
+}
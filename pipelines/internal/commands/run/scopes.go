@@ -0,0 +1,192 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package run
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	genomics "google.golang.org/api/genomics/v2alpha1"
+)
+
+const scopePrefix = "https://www.googleapis.com/auth/"
+
+// scopeAliases maps the short names accepted by --scopes to the OAuth scopes
+// they stand for.
+var scopeAliases = map[string]string{
+	"bigquery":         "bigquery",
+	"bigquery-ro":      "bigquery.readonly",
+	"cloud-platform":   "cloud-platform",
+	"compute":          "compute",
+	"compute-ro":       "compute.readonly",
+	"datastore":        "datastore",
+	"genomics":         "genomics",
+	"logging-write":    "logging.write",
+	"monitoring-write": "monitoring.write",
+	"pubsub":           "pubsub",
+	"sql":              "sqlservice.admin",
+	"storage-full":     "devstorage.full_control",
+	"storage-ro":       "devstorage.read_only",
+	"storage-rw":       "devstorage.read_write",
+	"userinfo-email":   "userinfo.email",
+}
+
+// expandScopes replaces scope aliases with the corresponding OAuth scope URLs.
+// Full URLs are accepted as-is, as are the names of scopes without the
+// https://www.googleapis.com/auth/ prefix.  An error is returned for any other
+// scope.
+func expandScopes(scopes []string) ([]string, error) {
+	var expanded []string
+	for _, scope := range scopes {
+		scope = strings.TrimSpace(scope)
+		switch {
+		case scope == "":
+			continue
+		case strings.HasPrefix(scope, "https://"):
+			if !strings.HasPrefix(scope, scopePrefix) {
+				return nil, fmt.Errorf("unknown scope %q", scope)
+			}
+		case scopeAliases[scope] != "":
+			scope = scopePrefix + scopeAliases[scope]
+		case isScopeName(scope):
+			scope = scopePrefix + scope
+		default:
+			return nil, fmt.Errorf("unknown scope %q (expecting a URL or one of %s)", scope, strings.Join(scopeAliasNames(), ", "))
+		}
+		expanded = append(expanded, scope)
+	}
+	return expanded, nil
+}
+
+// isScopeName returns true if name is the suffix of one of the scopes that
+// have an alias (for example, 'devstorage.read_only').
+func isScopeName(name string) bool {
+	for _, scope := range scopeAliases {
+		if scope == name {
+			return true
+		}
+	}
+	return false
+}
+
+func scopeAliasNames() []string {
+	var names []string
+	for name := range scopeAliases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// commandSeparators split a shell command line into the individual commands
+// that it runs.
+var commandSeparators = strings.NewReplacer(
+	"&&", "\n", "||", "\n", ";", "\n", "|", "\n", "&", "\n", "$(", "\n", "`", "\n", "(", "\n", ")", "\n")
+
+// requiredScopes examines the commands run by the actions in the pipeline and
+// returns the (sorted) scopes they appear to need.
+func requiredScopes(pipeline *genomics.Pipeline) []string {
+	found := make(map[string]bool)
+	for _, action := range pipeline.Actions {
+		// Options of the shell (such as the '-c' before a script) are
+		// not part of any command.
+		commands := action.Commands
+		for len(commands) > 0 && strings.HasPrefix(commands[0], "-") {
+			commands = commands[1:]
+		}
+		text := strings.Join(commands, " ")
+		if strings.Contains(text, "secretmanager.googleapis.com") {
+			found["cloud-platform"] = true
+		}
+		if strings.HasSuffix(action.ImageUri, "/gcsfuse") {
+			found["devstorage.read_write"] = true
+		}
+		for _, line := range strings.Split(commandSeparators.Replace(text), "\n") {
+			if scope := commandScope(commandArgs(strings.Fields(line))); scope != "" {
+				found[scope] = true
+			}
+		}
+	}
+	if found["cloud-platform"] {
+		return []string{scopePrefix + "cloud-platform"}
+	}
+	var scopes []string
+	for scope := range found {
+		scopes = append(scopes, scopePrefix+scope)
+	}
+	sort.Strings(scopes)
+	return scopes
+}
+
+// commandScope returns the scope (without the prefix) needed to run the given
+// command, or the empty string if it does not need one.
+func commandScope(args []string) string {
+	if len(args) == 0 {
+		return ""
+	}
+	switch name := commandName(args); name {
+	case "gsutil", "gcsfuse":
+		return "devstorage.read_write"
+	case "bq":
+		return "bigquery"
+	case "gcloud":
+		switch commandName(args[1:]) {
+		case "storage":
+			return "devstorage.read_write"
+		case "logging":
+			return "logging.write"
+		case "pubsub":
+			return "pubsub"
+		}
+		return "cloud-platform"
+	default:
+		if isCloudCommand(name) {
+			return "devstorage.read_write"
+		}
+	}
+	return ""
+}
+
+// setMinimalScopes replaces the scopes of the pipeline service account with
+// the ones the actions need together with the ones that were requested
+// explicitly.  A warning is shown if the cloud-platform scope was requested
+// but is not needed, but the scope is kept.
+func setMinimalScopes(pipeline *genomics.Pipeline) {
+	account := pipeline.Resources.VirtualMachine.ServiceAccount
+	scopes := requiredScopes(pipeline)
+
+	cloudPlatform := scopePrefix + "cloud-platform"
+	if containsString(account.Scopes, cloudPlatform) && !containsString(scopes, cloudPlatform) {
+		fmt.Fprintln(os.Stderr, "Warning: the cloud-platform scope was requested but no action appears to need it")
+	}
+	for _, scope := range account.Scopes {
+		if !containsString(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	account.Scopes = scopes
+	fmt.Fprintf(os.Stderr, "Minimal scopes: %s\n", strings.Join(scopes, ", "))
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
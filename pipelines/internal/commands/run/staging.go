@@ -0,0 +1,132 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package run
+
+import (
+	"context"
+	cryptorand "crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/common"
+	storage "google.golang.org/api/storage/v1"
+)
+
+// maxEmbeddedSize is the size (in bytes) above which local inputs are copied
+// to the staging location, when one is given, instead of being included in
+// the request.
+const maxEmbeddedSize = 64 << 10
+
+var (
+	// staged maps each local input that is copied to the staging location
+	// to the GCS path it is copied to.
+	staged = make(map[string]string)
+
+	// stagingID identifies the staged inputs of this run so that concurrent
+	// runs using the same staging location do not interfere.
+	stagingID string
+)
+
+// stagedPath returns the GCS path that the local input will be staged to, or
+// the empty string if the input should be included in the request.
+func stagedPath(input string) (string, error) {
+	if *stagingLoc == "" {
+		return "", nil
+	}
+	info, err := os.Stat(input)
+	if err != nil {
+		return "", fmt.Errorf("reading input file: %v", err)
+	}
+	if info.Size() <= maxEmbeddedSize {
+		return "", nil
+	}
+	if remote, ok := staged[input]; ok {
+		return remote, nil
+	}
+
+	if stagingID == "" {
+		id := make([]byte, 4)
+		if _, err := cryptorand.Read(id); err != nil {
+			return "", fmt.Errorf("generating staging ID: %v", err)
+		}
+		stagingID = time.Now().UTC().Format("20060102-150405") + "-" + hex.EncodeToString(id)
+	}
+	remote := gcsJoin(*stagingLoc, stagingID, fmt.Sprintf("%d-%s", len(staged), filepath.Base(input)))
+	staged[input] = remote
+	return remote, nil
+}
+
+// stageInputs copies the staged local inputs to the staging location.
+func stageInputs(ctx context.Context) error {
+	if len(staged) == 0 {
+		return nil
+	}
+	service, err := common.NewStorageService(ctx)
+	if err != nil {
+		return fmt.Errorf("creating storage service: %v", err)
+	}
+	for local, remote := range staged {
+		fmt.Printf("Staging %q to %q\n", local, remote)
+		if err := stageInput(ctx, service, local, remote); err != nil {
+			return fmt.Errorf("staging %q: %v", local, err)
+		}
+	}
+	return nil
+}
+
+func stageInput(ctx context.Context, service *storage.Service, local, remote string) error {
+	bucket, object, err := common.ParseGCSPath(remote)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	call := service.Objects.Insert(bucket, &storage.Object{Name: object})
+	_, err = call.Media(f).Context(ctx).Do()
+	return err
+}
+
+// removeStagedInputs deletes the staged inputs once the pipeline has
+// finished.  If the tool does not wait for the pipeline (or the run can be
+// resumed from a retry state file), the inputs are left in place since they
+// may still be needed.
+func removeStagedInputs(ctx context.Context) {
+	if len(staged) == 0 {
+		return
+	}
+	location := gcsJoin(*stagingLoc, stagingID)
+	if !*wait || *retryStatePath != "" {
+		fmt.Printf("Leaving staged inputs in %q\n", location)
+		return
+	}
+
+	service, err := common.NewStorageService(ctx)
+	if err != nil {
+		fmt.Printf("Failed to remove staged inputs from %q: %v\n", location, err)
+		return
+	}
+	for _, remote := range staged {
+		if err := common.DeleteObject(ctx, service, remote); err != nil {
+			fmt.Printf("Failed to remove staged input: %v\n", err)
+		}
+	}
+}
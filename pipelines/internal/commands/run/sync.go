@@ -0,0 +1,225 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package run
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/common"
+	storage "google.golang.org/api/storage/v1"
+)
+
+// syncDir is a local directory that is mirrored to a GCS prefix before the
+// pipeline runs and updated from it afterwards.
+type syncDir struct {
+	local, remote string
+
+	// uploaded maps each local file to the (base64 encoded) MD5 hash of its
+	// contents when the directory was uploaded, so that files changed
+	// locally while the pipeline ran are not overwritten.
+	uploaded map[string]string
+}
+
+// parseSyncDirs parses the --sync-dir flags, which have the form
+// LOCAL=gs://bucket/prefix.
+func parseSyncDirs() ([]syncDir, error) {
+	var dirs []syncDir
+	for _, value := range syncDirs {
+		i := strings.Index(value, "="+gcsPrefix)
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid --sync-dir %q (expected LOCAL=gs://bucket/prefix)", value)
+		}
+		dir := syncDir{local: value[:i], remote: strings.TrimRight(value[i+1:], "/")}
+		if _, _, err := common.ParseGCSPath(dir.remote); err != nil {
+			return nil, fmt.Errorf("invalid --sync-dir %q: %v", value, err)
+		}
+		if info, err := os.Stat(dir.local); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("invalid --sync-dir %q: %q is not a directory", value, dir.local)
+		}
+		dirs = append(dirs, dir)
+	}
+	return dirs, nil
+}
+
+// uploadSyncDirs copies the files in each synchronized directory that differ
+// from the objects under its GCS prefix.
+func uploadSyncDirs(ctx context.Context, dirs []syncDir) error {
+	if len(dirs) == 0 {
+		return nil
+	}
+	service, err := common.NewStorageService(ctx)
+	if err != nil {
+		return err
+	}
+	for i := range dirs {
+		dir := &dirs[i]
+		objects, err := syncObjects(ctx, service, *dir)
+		if err != nil {
+			return err
+		}
+		bucket, prefix, _ := common.ParseGCSPath(dir.remote)
+		dir.uploaded = make(map[string]string)
+		err = filepath.Walk(dir.local, func(filename string, info os.FileInfo, err error) error {
+			if err != nil || !info.Mode().IsRegular() {
+				return err
+			}
+			relative, err := filepath.Rel(dir.local, filename)
+			if err != nil {
+				return err
+			}
+			hash, err := fileMD5(filename)
+			if err != nil {
+				return err
+			}
+			dir.uploaded[filename] = hash
+			name := prefix + "/" + filepath.ToSlash(relative)
+			if object := objects[name]; object != nil && object.Md5Hash == hash {
+				return nil
+			}
+
+			fmt.Printf("Uploading %s to gs://%s/%s\n", filename, bucket, name)
+			f, err := os.Open(filename)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = service.Objects.Insert(bucket, &storage.Object{Name: name}).Media(f).Context(ctx).Do()
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("uploading %q: %v", dir.local, err)
+		}
+		// gsutil cannot copy an empty prefix onto the VM.
+		if len(dir.uploaded) == 0 && len(objects) == 0 {
+			return fmt.Errorf("%q is empty", dir.local)
+		}
+	}
+	return nil
+}
+
+// downloadSyncDirs copies the objects under the GCS prefix of each
+// synchronized directory that differ from the local files.  Local files that
+// have changed since the directory was uploaded are not overwritten, and an
+// error listing them is returned once the other objects have been downloaded.
+func downloadSyncDirs(ctx context.Context, dirs []syncDir) error {
+	if len(dirs) == 0 {
+		return nil
+	}
+	service, err := common.NewStorageService(ctx)
+	if err != nil {
+		return err
+	}
+	var conflicts []string
+	for _, dir := range dirs {
+		objects, err := syncObjects(ctx, service, dir)
+		if err != nil {
+			return err
+		}
+		for name, object := range objects {
+			if strings.HasSuffix(name, "/") {
+				continue
+			}
+			filename, err := common.OutputFilename(dir.remote+"/**", name, dir.local)
+			if err != nil {
+				return err
+			}
+			same, err := sameContents(filename, object)
+			if err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("reading %q: %v", filename, err)
+			}
+			if same {
+				continue
+			}
+			if changed, err := changedLocally(filename, dir.uploaded); err != nil {
+				return fmt.Errorf("reading %q: %v", filename, err)
+			} else if changed {
+				fmt.Printf("Not downloading gs://%s/%s: %s has changed locally since it was uploaded\n", object.Bucket, object.Name, filename)
+				conflicts = append(conflicts, filename)
+				continue
+			}
+			if _, err := common.DownloadOutput(ctx, service, dir.remote+"/**", object, dir.local, nil); err != nil {
+				return err
+			}
+			fmt.Printf("Downloaded gs://%s/%s to %s\n", object.Bucket, object.Name, filename)
+		}
+	}
+	if len(conflicts) > 0 {
+		return fmt.Errorf("local changes to %s would have been overwritten", strings.Join(conflicts, ", "))
+	}
+	return nil
+}
+
+// changedLocally returns true if the local file exists and either did not
+// exist or had different contents when it was uploaded (according to the
+// uploaded hashes).
+func changedLocally(filename string, uploaded map[string]string) (bool, error) {
+	hash, err := fileMD5(filename)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return hash != uploaded[filename], nil
+}
+
+// syncObjects returns the objects under the GCS prefix of dir, keyed by name.
+func syncObjects(ctx context.Context, service *storage.Service, dir syncDir) (map[string]*storage.Object, error) {
+	list, err := common.ListOutput(ctx, service, dir.remote+"/**")
+	if err != nil {
+		return nil, err
+	}
+	objects := make(map[string]*storage.Object)
+	for _, object := range list {
+		objects[object.Name] = object
+	}
+	return objects, nil
+}
+
+// sameContents reports whether the local file has the same contents as
+// object (which may be nil).
+func sameContents(filename string, object *storage.Object) (bool, error) {
+	if object == nil || object.Md5Hash == "" {
+		return false, nil
+	}
+	hash, err := fileMD5(filename)
+	if err != nil {
+		return false, err
+	}
+	return hash == object.Md5Hash, nil
+}
+
+// fileMD5 returns the base64 encoded MD5 hash of the contents of the named
+// file, in the form used by GCS.
+func fileMD5(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := md5.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,127 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package run
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	genomics "google.golang.org/api/genomics/v2alpha1"
+)
+
+// stepTransfer holds the GCS inputs and outputs declared by the "# in=" and
+// "# out=" options of a script line, each mapped to the name of the
+// environment variable that holds its local path.
+type stepTransfer struct {
+	inputs, outputs map[string]string
+}
+
+// stepTransfers holds the transfers declared by each script line.
+var stepTransfers = make(map[*genomics.Action]*stepTransfer)
+
+// parseTransfers records the transfers declared by the options of a script
+// line and sets the environment variables of action to their local paths.
+// Like --inputs and --outputs, the options take comma separated lists of GCS
+// paths (optionally prefixed by NAME=), and unnamed paths are given the names
+// IN0, IN1, ... and OUT0, OUT1, ... (which are local to the action).
+func parseTransfers(action *genomics.Action, options map[string]string) error {
+	in, hasIn := options["in"]
+	out, hasOut := options["out"]
+	if !hasIn && !hasOut {
+		return nil
+	}
+
+	transfer := &stepTransfer{
+		inputs:  namedListOf(in, "IN"),
+		outputs: namedListOf(out, "OUT"),
+	}
+	for _, paths := range []map[string]string{transfer.inputs, transfer.outputs} {
+		for remote := range paths {
+			if _, ok := parseGCSPath(remote); !ok {
+				return fmt.Errorf("%q is not a GCS path (only GCS paths can be transferred by a single command)", remote)
+			}
+		}
+	}
+
+	if action.Environment == nil {
+		action.Environment = make(map[string]string)
+	}
+	for remote, name := range transfer.inputs {
+		action.Environment[name] = stepPath("input", remote)
+	}
+	for remote, name := range transfer.outputs {
+		action.Environment[name] = stepPath("output", remote)
+	}
+	stepTransfers[action] = transfer
+	return nil
+}
+
+// stepPath returns the local path on the google disk of a transferred file.
+func stepPath(directory, remote string) string {
+	return gcsJoin(path.Join(googleRoot.Path, ".google", directory), strings.TrimRight(remote, "*"))
+}
+
+// addStepTransfers places the actions that copy the inputs of each command
+// immediately before it and the actions that copy its outputs immediately
+// after it.  The directories that must be created for the transfers and the
+// GCS outputs are also returned.
+func addStepTransfers(actions []*genomics.Action) (result []*genomics.Action, directories, outputs []string) {
+	for _, action := range actions {
+		transfer, ok := stepTransfers[action]
+		if !ok {
+			result = append(result, action)
+			continue
+		}
+
+		var localizers, delocalizers []*genomics.Action
+		for _, remote := range sortedKeys(transfer.inputs) {
+			filename := stepPath("input", remote)
+			localizers = append(localizers, gcsTransfer(remote)(remote, filename))
+			if strings.HasSuffix(remote, "*") {
+				directories = append(directories, filename)
+			} else {
+				directories = append(directories, path.Dir(filename))
+			}
+		}
+		for _, remote := range sortedKeys(transfer.outputs) {
+			filename := stepPath("output", remote)
+			delocalizers = append(delocalizers, gcsTransfer(remote, hashOptions()...)(filename, remote))
+			if strings.HasSuffix(remote, "*") {
+				directories = append(directories, filename)
+			} else {
+				directories = append(directories, path.Dir(filename))
+			}
+			outputs = append(outputs, remote)
+		}
+		setTimeouts(localizers, *localizeTimeout)
+		setTimeouts(delocalizers, *delocalizeTimeout)
+
+		result = append(result, localizers...)
+		result = append(result, action)
+		result = append(result, delocalizers...)
+	}
+	return result, directories, outputs
+}
+
+func sortedKeys(m map[string]string) []string {
+	var keys []string
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,402 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package run
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/common"
+	"golang.org/x/oauth2/google"
+	cloudresourcemanager "google.golang.org/api/cloudresourcemanager/v1"
+	compute "google.golang.org/api/compute/v1"
+	genomics "google.golang.org/api/genomics/v2alpha1"
+	"google.golang.org/api/googleapi"
+	storage "google.golang.org/api/storage/v1"
+)
+
+// defaultDiskSizeGb is the size used by the API when no disk size is
+// specified.
+const defaultDiskSizeGb = 500
+
+// readRoles are the roles that allow the objects in a bucket to be read.
+var readRoles = map[string]bool{
+	"roles/storage.admin":              true,
+	"roles/storage.objectAdmin":        true,
+	"roles/storage.objectViewer":       true,
+	"roles/storage.legacyObjectOwner":  true,
+	"roles/storage.legacyObjectReader": true,
+}
+
+// conveniencePrefixes maps the prefixes of the members that stand for the
+// holders of a basic role on a project (in bucket policies) to that role.
+var conveniencePrefixes = map[string]string{
+	"projectOwner:":  "roles/owner",
+	"projectEditor:": "roles/editor",
+	"projectViewer:": "roles/viewer",
+}
+
+// validation collects the problems found by --validate.
+type validation struct {
+	errors, warnings []string
+}
+
+func (v *validation) errorf(format string, args ...interface{}) {
+	v.errors = append(v.errors, fmt.Sprintf(format, args...))
+}
+
+func (v *validation) warnf(format string, args ...interface{}) {
+	v.warnings = append(v.warnings, fmt.Sprintf(format, args...))
+}
+
+// report writes the problems found to w, and returns an error if any of them
+// should prevent the pipeline from running.
+func (v *validation) report(w io.Writer) error {
+	for _, warning := range v.warnings {
+		fmt.Fprintf(w, "Warning: %s\n", warning)
+	}
+	for _, err := range v.errors {
+		fmt.Fprintf(w, "Error: %s\n", err)
+	}
+	if len(v.errors) > 0 {
+		return fmt.Errorf("validation failed with %d error(s)", len(v.errors))
+	}
+	fmt.Fprintf(w, "Validation passed with %d warning(s)\n", len(v.warnings))
+	return nil
+}
+
+// validateRequest checks that the inputs, output buckets, images and GPUs
+// used by the request exist before it is submitted, so that mistakes are
+// found before the VM starts.  All of the checks are run, and the problems
+// are reported together.
+func validateRequest(ctx context.Context, req *genomics.RunPipelineRequest) error {
+	storageService, err := common.NewStorageService(ctx)
+	if err != nil {
+		return err
+	}
+	computeService, err := common.NewComputeService(ctx)
+	if err != nil {
+		return err
+	}
+
+	var v validation
+	resources := req.Pipeline.Resources
+	account := resources.VirtualMachine.ServiceAccount.Email
+	if account == "" || account == "default" {
+		if project, err := computeService.Projects.Get(resources.ProjectId).Context(ctx).Do(); err != nil {
+			v.warnf("could not find the default service account of project %q: %v", resources.ProjectId, err)
+		} else {
+			account = project.DefaultServiceAccount
+		}
+	}
+
+	var total uint64
+	checked := make(map[string]bool)
+	access := &accessChecker{storage: storageService, account: account}
+	for _, input := range remoteInputs() {
+		size, err := inputSize(ctx, storageService, input)
+		if err != nil {
+			v.errorf("input %q: %v", input, err)
+			continue
+		}
+		total += size
+
+		bucket, _, _ := common.ParseGCSPath(input)
+		if checked[bucket] || *ephemeral || account == "" || account == "default" {
+			continue
+		}
+		checked[bucket] = true
+		if ok, err := access.canRead(ctx, bucket); err != nil {
+			v.warnf("could not check whether %s can read gs://%s: %v", account, bucket, err)
+		} else if !ok {
+			v.warnf("%s does not appear to be able to read gs://%s (grants to groups, folders and organizations are not checked)", account, bucket)
+		}
+	}
+
+	for _, bucket := range outputBuckets(req) {
+		if _, err := storageService.Buckets.Get(bucket).Context(ctx).Do(); err != nil {
+			if isNotFound(err) {
+				v.errorf("output bucket gs://%s does not exist", bucket)
+			} else {
+				v.warnf("could not check output bucket gs://%s: %v", bucket, err)
+			}
+		}
+	}
+
+	images := make(map[string]bool)
+	for _, action := range req.Pipeline.Actions {
+		if images[action.ImageUri] {
+			continue
+		}
+		images[action.ImageUri] = true
+		if _, err := common.ImageDigest(ctx, action.ImageUri); err != nil {
+			v.errorf("image %q cannot be resolved: %v", action.ImageUri, err)
+		}
+	}
+
+	for _, accelerator := range resources.VirtualMachine.Accelerators {
+		zones, err := acceleratorZones(ctx, computeService, resources.ProjectId, accelerator)
+		if err != nil {
+			v.warnf("could not check the availability of %q: %v", accelerator.Type, err)
+			continue
+		}
+		if !anyZoneAllowed(zones, resources.Zones, resources.Regions) {
+			v.errorf("%d %q GPU(s) are not available in the selected zones and regions (available in: %s)", accelerator.Count, accelerator.Type, strings.Join(zones, ", "))
+		}
+	}
+
+	if !*fuse {
+		size := int64(defaultDiskSizeGb)
+		for _, disk := range resources.VirtualMachine.Disks {
+			if disk.Name == googleRoot.Disk && disk.SizeGb != 0 {
+				size = disk.SizeGb
+			}
+		}
+		if gb := float64(total) / (1 << 30); gb > float64(size) {
+			v.warnf("the inputs total %.1fGB, which exceeds the %dGB disk (see --disk-size)", gb, size)
+		}
+	}
+
+	return v.report(os.Stderr)
+}
+
+// remoteInputs returns the GCS inputs localized by the pipeline: those named
+// by --inputs and by the "# in=" options of the commands.
+func remoteInputs() []string {
+	found := make(map[string]bool)
+	for input := range namedListOf(*inputs, "INPUT") {
+		if _, ok := parseGCSPath(input); ok {
+			found[input] = true
+		}
+	}
+	for _, transfer := range stepTransfers {
+		for input := range transfer.inputs {
+			found[input] = true
+		}
+	}
+	return sortedSet(found)
+}
+
+// outputBuckets returns the (sorted) names of the buckets that outputs are
+// written to.
+func outputBuckets(req *genomics.RunPipelineRequest) []string {
+	found := make(map[string]bool)
+	for _, output := range append(common.Outputs(req.Pipeline), listOf(*output)...) {
+		if bucket, _, err := common.ParseGCSPath(output); err == nil {
+			found[bucket] = true
+		}
+	}
+	return sortedSet(found)
+}
+
+// inputSize returns the total size of the objects named by an input, which
+// may end with '/*' or '/**' to name the objects in a directory or subtree.
+// An error is returned if no objects exist.
+func inputSize(ctx context.Context, service *storage.Service, input string) (uint64, error) {
+	var delimiter string
+	switch {
+	case strings.HasSuffix(input, "/**"):
+		input = strings.TrimSuffix(input, "**")
+	case strings.HasSuffix(input, "/*"):
+		input, delimiter = strings.TrimSuffix(input, "*"), "/"
+	default:
+		bucket, name, err := common.ParseGCSPath(input)
+		if err != nil {
+			return 0, err
+		}
+		object, err := service.Objects.Get(bucket, name).Context(ctx).Do()
+		if err != nil {
+			if isNotFound(err) {
+				return 0, fmt.Errorf("object does not exist")
+			}
+			return 0, err
+		}
+		return object.Size, nil
+	}
+
+	bucket, prefix, err := common.ParseGCSPath(input)
+	if err != nil {
+		return 0, err
+	}
+	var size, count uint64
+	call := service.Objects.List(bucket).Prefix(prefix).Delimiter(delimiter)
+	err = call.Pages(ctx, func(objects *storage.Objects) error {
+		for _, object := range objects.Items {
+			size += object.Size
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if count == 0 {
+		return 0, fmt.Errorf("no objects match")
+	}
+	return size, nil
+}
+
+// accessChecker checks whether a service account can read the objects in a
+// bucket, using the bucket's IAM policy and the IAM policy of its project.
+type accessChecker struct {
+	storage *storage.Service
+	account string
+
+	// roles holds the roles that the account has on each project (by ID or
+	// number).
+	roles map[string]map[string]bool
+}
+
+func (c *accessChecker) canRead(ctx context.Context, bucket string) (bool, error) {
+	policy, err := c.storage.Buckets.GetIamPolicy(bucket).Context(ctx).Do()
+	if err != nil {
+		return false, fmt.Errorf("getting bucket policy: %v", err)
+	}
+	for _, binding := range policy.Bindings {
+		if !readRoles[binding.Role] {
+			continue
+		}
+		for _, member := range binding.Members {
+			switch member {
+			case "serviceAccount:" + c.account, "allUsers", "allAuthenticatedUsers":
+				return true, nil
+			}
+			for prefix, role := range conveniencePrefixes {
+				if !strings.HasPrefix(member, prefix) {
+					continue
+				}
+				roles, err := c.projectRoles(ctx, strings.TrimPrefix(member, prefix))
+				if err != nil {
+					return false, err
+				}
+				if roles[role] {
+					return true, nil
+				}
+			}
+		}
+	}
+
+	metadata, err := c.storage.Buckets.Get(bucket).Context(ctx).Do()
+	if err != nil {
+		return false, fmt.Errorf("getting bucket: %v", err)
+	}
+	roles, err := c.projectRoles(ctx, fmt.Sprint(metadata.ProjectNumber))
+	if err != nil {
+		return false, err
+	}
+	for role := range roles {
+		if readRoles[role] || role == "roles/owner" || role == "roles/editor" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// projectRoles returns the roles granted to the account on a project.
+func (c *accessChecker) projectRoles(ctx context.Context, project string) (map[string]bool, error) {
+	if roles, ok := c.roles[project]; ok {
+		return roles, nil
+	}
+
+	client, err := google.DefaultClient(ctx, cloudresourcemanager.CloudPlatformReadOnlyScope)
+	if err != nil {
+		return nil, fmt.Errorf("creating authenticated client: %v", err)
+	}
+	service, err := cloudresourcemanager.New(client)
+	if err != nil {
+		return nil, fmt.Errorf("creating resource manager service: %v", err)
+	}
+	policy, err := service.Projects.GetIamPolicy(project, &cloudresourcemanager.GetIamPolicyRequest{}).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("getting policy of project %q: %v", project, err)
+	}
+
+	roles := make(map[string]bool)
+	for _, binding := range policy.Bindings {
+		for _, member := range binding.Members {
+			if member == "serviceAccount:"+c.account {
+				roles[binding.Role] = true
+			}
+		}
+	}
+	if c.roles == nil {
+		c.roles = make(map[string]map[string]bool)
+	}
+	c.roles[project] = roles
+	return roles, nil
+}
+
+// acceleratorZones returns the (sorted) zones where the accelerator can be
+// attached to a VM in the requested number.
+func acceleratorZones(ctx context.Context, service *compute.Service, project string, accelerator *genomics.Accelerator) ([]string, error) {
+	var zones []string
+	call := service.AcceleratorTypes.AggregatedList(project).Filter(fmt.Sprintf("name = %s", accelerator.Type))
+	err := call.Pages(ctx, func(list *compute.AcceleratorTypeAggregatedList) error {
+		for scope, types := range list.Items {
+			for _, t := range types.AcceleratorTypes {
+				if t.Name == accelerator.Type && t.MaximumCardsPerInstance >= accelerator.Count {
+					zones = append(zones, strings.TrimPrefix(scope, "zones/"))
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing accelerator types: %v", err)
+	}
+	sort.Strings(zones)
+	return zones, nil
+}
+
+// anyZoneAllowed returns true if any of the zones is one of the allowed zones
+// or in one of the allowed regions.  If there are no allowed zones or regions,
+// any zone is allowed.
+func anyZoneAllowed(zones, allowedZones, allowedRegions []string) bool {
+	if len(allowedZones) == 0 && len(allowedRegions) == 0 {
+		return len(zones) > 0
+	}
+	for _, zone := range zones {
+		if containsString(allowedZones, zone) {
+			return true
+		}
+		for _, region := range allowedRegions {
+			if strings.HasPrefix(zone, region+"-") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func sortedSet(set map[string]bool) []string {
+	var values []string
+	for value := range set {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	return values
+}
+
+func isNotFound(err error) bool {
+	if err, ok := err.(*googleapi.Error); ok && err.Code == http.StatusNotFound {
+		return true
+	}
+	return false
+}
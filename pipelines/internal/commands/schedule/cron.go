@@ -0,0 +1,126 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a parsed five field cron expression (minute, hour, day of
+// month, month and day of week).
+type cronSchedule struct {
+	minute, hour, dayOfMonth, month, dayOfWeek map[int]bool
+
+	// Set if the day of month or day of week field is not '*'.  As in cron,
+	// when both are restricted a time matches if either one matches.
+	restrictedDayOfMonth, restrictedDayOfWeek bool
+}
+
+func parseCron(expression string) (*cronSchedule, error) {
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expecting 5 fields, got %d", len(fields))
+	}
+
+	var s cronSchedule
+	var err error
+	ranges := []struct {
+		field    *map[int]bool
+		min, max int
+	}{
+		{&s.minute, 0, 59},
+		{&s.hour, 0, 23},
+		{&s.dayOfMonth, 1, 31},
+		{&s.month, 1, 12},
+		{&s.dayOfWeek, 0, 7},
+	}
+	for i, r := range ranges {
+		if *r.field, err = parseCronField(fields[i], r.min, r.max); err != nil {
+			return nil, fmt.Errorf("field %d (%q): %v", i+1, fields[i], err)
+		}
+	}
+	if s.dayOfWeek[7] {
+		s.dayOfWeek[0] = true
+	}
+	s.restrictedDayOfMonth = fields[2] != "*"
+	s.restrictedDayOfWeek = fields[4] != "*"
+	return &s, nil
+}
+
+func parseCronField(field string, min, max int) (map[int]bool, error) {
+	values := make(map[int]bool)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if n := strings.Index(part, "/"); n >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[n+1:]); err != nil || step < 1 {
+				return nil, fmt.Errorf("invalid step %q", part[n+1:])
+			}
+			part = part[:n]
+		}
+
+		low, high := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if low, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, fmt.Errorf("invalid value %q", bounds[0])
+			}
+			high = low
+			if len(bounds) == 2 {
+				if high, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("invalid value %q", bounds[1])
+				}
+			} else if step > 1 {
+				high = max
+			}
+		}
+		if low < min || high > max || low > high {
+			return nil, fmt.Errorf("%d-%d is out of range (%d-%d)", low, high, min, max)
+		}
+		for v := low; v <= high; v += step {
+			values[v] = true
+		}
+	}
+	return values, nil
+}
+
+func (s *cronSchedule) matches(t time.Time) bool {
+	if !s.minute[t.Minute()] || !s.hour[t.Hour()] || !s.month[int(t.Month())] {
+		return false
+	}
+	dom, dow := s.dayOfMonth[t.Day()], s.dayOfWeek[int(t.Weekday())]
+	if s.restrictedDayOfMonth && s.restrictedDayOfWeek {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+// next returns the first time after t that matches the schedule.
+func (s *cronSchedule) next(t time.Time) (time.Time, error) {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	// Every valid schedule matches at least once within a few years (for
+	// example, February 29th).
+	for limit := t.AddDate(5, 0, 0); t.Before(limit); t = t.Add(time.Minute) {
+		if s.matches(t) {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.New("the schedule never matches")
+}
@@ -0,0 +1,47 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNext(t *testing.T) {
+	start := time.Date(2018, 6, 15, 10, 30, 0, 0, time.UTC) // A Friday.
+
+	testCases := []struct {
+		expression string
+		want       time.Time
+	}{
+		{"* * * * *", time.Date(2018, 6, 15, 10, 31, 0, 0, time.UTC)},
+		{"0 2 * * *", time.Date(2018, 6, 16, 2, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2018, 6, 15, 10, 45, 0, 0, time.UTC)},
+		{"0 9-17 * * 1-5", time.Date(2018, 6, 15, 11, 0, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2018, 7, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 0", time.Date(2018, 6, 17, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 * 0", time.Date(2018, 6, 17, 0, 0, 0, 0, time.UTC)},
+		{"30 4 29 2 *", time.Date(2020, 2, 29, 4, 30, 0, 0, time.UTC)},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.expression, func(t *testing.T) {
+			s, err := parseCron(tc.expression)
+			if err != nil {
+				t.Fatalf("Failed to parse: %v", err)
+			}
+			got, err := s.next(start)
+			if err != nil {
+				t.Fatalf("Failed to find next time: %v", err)
+			}
+			if !got.Equal(tc.want) {
+				t.Fatalf("Unexpected result: got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expression := range []string{"* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		if _, err := parseCron(expression); err == nil {
+			t.Errorf("Expected an error parsing %q", expression)
+		}
+	}
+}
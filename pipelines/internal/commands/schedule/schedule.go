@@ -0,0 +1,200 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package schedule provides a sub-tool for running a pipeline on a recurring
+// schedule.
+//
+// The first argument is a five field cron expression and the remaining
+// arguments are passed to the run command each time the schedule fires:
+//
+//	pipelines schedule "0 2 * * *" nightly.pipeline --name nightly-qc
+//
+// By default, the tool runs in the foreground and submits the pipeline at the
+// scheduled times (in the local time zone).  If a run is still being watched
+// when the next one is due, the next run starts as soon as it finishes (and
+// any other runs that were missed meanwhile are skipped): use --wait=false to
+// submit without waiting.
+//
+// With --generate, the tool instead writes the request and a script that
+// creates a Cloud Scheduler job which submits the request directly to the
+// pipelines API, so that no machine needs to stay running.
+package schedule
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/commands/run"
+	genomics "google.golang.org/api/genomics/v2alpha1"
+)
+
+var (
+	flags = flag.NewFlagSet("", flag.ExitOnError)
+
+	generate       = flags.String("generate", "", "if set, a directory where Cloud Scheduler deployment files are written instead of running locally")
+	jobName        = flags.String("job-name", "pipeline", "the name of the Cloud Scheduler job (with --generate)")
+	location       = flags.String("location", "us-central1", "the Cloud Scheduler location (with --generate)")
+	timeZone       = flags.String("time-zone", "Etc/UTC", "the time zone of the schedule (with --generate)")
+	serviceAccount = flags.String("scheduler-service-account", "", "the service account used by Cloud Scheduler to submit the pipeline (with --generate)")
+)
+
+var deployScript = template.Must(template.New("deploy").Parse(`#!/bin/bash
+# Creates a Cloud Scheduler job that submits request.json to the pipelines API.
+# The service account must be able to run pipelines in {{.Project}} (for
+# example, with the Genomics Pipelines Runner role) and to act as the
+# pipeline's service account.
+set -o errexit -o nounset
+
+cd "$(dirname "$0")"
+gcloud scheduler jobs create http {{.Name}} \
+  --project={{.Project}} \
+  --location={{.Location}} \
+  --schedule='{{.Schedule}}' \
+  --time-zone={{.TimeZone}} \
+  --uri=https://genomics.googleapis.com/v2alpha1/pipelines:run \
+  --http-method=POST \
+  --headers=Content-Type=application/json \
+  --message-body-from-file=request.json \
+  --oauth-service-account-email={{.ServiceAccount}} \
+  --oauth-token-scope=https://www.googleapis.com/auth/cloud-platform
+`))
+
+func Invoke(ctx context.Context, service *genomics.Service, project string, arguments []string) error {
+	flags.Parse(arguments)
+	if flags.NArg() < 1 {
+		return errors.New("missing cron schedule")
+	}
+	expression, runArguments := flags.Arg(0), flags.Args()[1:]
+
+	schedule, err := parseCron(expression)
+	if err != nil {
+		return fmt.Errorf("parsing schedule %q: %v", expression, err)
+	}
+
+	if *generate != "" {
+		return generateJob(project, expression, runArguments)
+	}
+
+	return runSchedule(ctx, schedule, realClock{}, func() error {
+		return run.Invoke(ctx, service, project, runArguments)
+	})
+}
+
+// clock abstracts the passage of time so that the schedule can be tested.
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// runSchedule calls invoke at the times given by schedule until ctx is
+// cancelled.  A run that becomes due while invoke is still running starts as
+// soon as it returns, and earlier runs that were missed meanwhile are skipped.
+func runSchedule(ctx context.Context, schedule *cronSchedule, clock clock, invoke func() error) error {
+	next, err := schedule.next(clock.Now())
+	if err != nil {
+		return err
+	}
+	for {
+		if wait := next.Sub(clock.Now()); wait > 0 {
+			fmt.Printf("Next run at %s\n", next.Format(time.RFC1123))
+			select {
+			case <-clock.After(wait):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		} else {
+			fmt.Printf("Starting the run due at %s now\n", next.Format(time.RFC1123))
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if err := invoke(); err != nil {
+			fmt.Fprintf(os.Stderr, "Scheduled run failed: %v\n", err)
+		}
+
+		// Find the next run, skipping all but the last of the runs that
+		// became due while this one was running.
+		if next, err = schedule.next(next); err != nil {
+			return err
+		}
+		now := clock.Now()
+		for {
+			after, err := schedule.next(next)
+			if err != nil {
+				return err
+			}
+			if after.After(now) {
+				break
+			}
+			next = after
+		}
+	}
+}
+
+func generateJob(project, expression string, runArguments []string) error {
+	if *serviceAccount == "" {
+		return errors.New("--scheduler-service-account is required with --generate")
+	}
+
+	req, err := run.BuildRequest(project, runArguments)
+	if err != nil {
+		return fmt.Errorf("building request: %v", err)
+	}
+	encoded, err := json.MarshalIndent(req, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding request: %v", err)
+	}
+
+	if err := os.MkdirAll(*generate, 0755); err != nil {
+		return fmt.Errorf("creating directory: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(*generate, "request.json"), encoded, 0644); err != nil {
+		return fmt.Errorf("writing request: %v", err)
+	}
+
+	var script strings.Builder
+	err = deployScript.Execute(&script, map[string]string{
+		"Name":           *jobName,
+		"Project":        project,
+		"Location":       *location,
+		"Schedule":       expression,
+		"TimeZone":       *timeZone,
+		"ServiceAccount": *serviceAccount,
+	})
+	if err != nil {
+		return fmt.Errorf("generating script: %v", err)
+	}
+	filename := filepath.Join(*generate, "deploy.sh")
+	if err := ioutil.WriteFile(filename, []byte(script.String()), 0755); err != nil {
+		return fmt.Errorf("writing script: %v", err)
+	}
+
+	fmt.Printf("Run %q to create the Cloud Scheduler job\n", filename)
+	return nil
+}
@@ -0,0 +1,78 @@
+package schedule
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock whose time only advances when it is waited on (or
+// explicitly advanced).
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.now = c.now.Add(d)
+	ch := make(chan time.Time, 1)
+	ch <- c.now
+	return ch
+}
+
+func TestRunSchedule(t *testing.T) {
+	at := func(hour, minute int) time.Time {
+		return time.Date(2018, 6, 15, hour, minute, 0, 0, time.UTC)
+	}
+
+	testCases := []struct {
+		name      string
+		durations []time.Duration
+		want      []time.Time
+	}{
+		{
+			name:      "on time",
+			durations: []time.Duration{10 * time.Minute, 10 * time.Minute, 10 * time.Minute},
+			want:      []time.Time{at(1, 0), at(2, 0), at(3, 0)},
+		},
+		{
+			name:      "overdue",
+			durations: []time.Duration{90 * time.Minute, 10 * time.Minute, 10 * time.Minute},
+			want:      []time.Time{at(1, 0), at(2, 30), at(3, 0)},
+		},
+		{
+			name:      "several missed",
+			durations: []time.Duration{150 * time.Minute, 10 * time.Minute, 10 * time.Minute},
+			want:      []time.Time{at(1, 0), at(3, 30), at(4, 0)},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			schedule, err := parseCron("0 * * * *")
+			if err != nil {
+				t.Fatalf("Failed to parse schedule: %v", err)
+			}
+			clock := &fakeClock{now: at(0, 30)}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			var got []time.Time
+			err = runSchedule(ctx, schedule, clock, func() error {
+				got = append(got, clock.Now())
+				clock.now = clock.now.Add(tc.durations[len(got)-1])
+				if len(got) == len(tc.durations) {
+					cancel()
+				}
+				return nil
+			})
+			if err != context.Canceled {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("Unexpected run times: got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
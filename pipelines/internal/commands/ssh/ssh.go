@@ -0,0 +1,221 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ssh provides a sub-tool for logging in to the VM running a pipeline.
+package ssh
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/common"
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/selector"
+	genomics "google.golang.org/api/genomics/v2alpha1"
+)
+
+var (
+	flags  = flag.NewFlagSet("", flag.ExitOnError)
+	target = selector.New(flags)
+
+	iap     = flags.Bool("iap", false, "connect using an IAP tunnel (for VMs without a public address)")
+	recurse = flags.Bool("recurse", false, "copy directories recursively (scp only)")
+)
+
+// Invoke runs 'gcloud compute ssh' against the VM running the named operation.
+// Any arguments after a '--' separator are passed through to gcloud.
+func Invoke(ctx context.Context, service *genomics.Service, project string, arguments []string) error {
+	arguments, extra := common.SplitArguments(arguments)
+	name, _, err := target.Take(ctx, service, project, common.ParseFlags(flags, arguments))
+	if err != nil {
+		return err
+	}
+	worker, err := common.ResolveWorker(ctx, service, name)
+	if err != nil {
+		return fmt.Errorf("finding VM: %v", err)
+	}
+
+	fmt.Printf("Connecting to %s in %s\n", worker.Instance, worker.Zone)
+	return Gcloud(project, worker, *iap, []string{"ssh", worker.Instance}, extra)
+}
+
+// Copy runs 'gcloud compute scp' to copy files to or from the VM running the
+// named operation.  Paths on the VM are given using a 'remote:' prefix, for
+// example:
+//
+//	scp <operation> remote:/mnt/google/.google/tmp/sample.bam .
+//
+// When the VM was started with --ssh, the data disk is mounted at /mnt/google.
+func Copy(ctx context.Context, service *genomics.Service, project string, arguments []string) error {
+	arguments, extra := common.SplitArguments(arguments)
+	name, paths, err := target.Take(ctx, service, project, common.ParseFlags(flags, arguments))
+	if err != nil {
+		return err
+	}
+	if len(paths) < 2 {
+		return errors.New("expecting an operation name, one or more sources and a destination")
+	}
+	worker, err := common.ResolveWorker(ctx, service, name)
+	if err != nil {
+		return fmt.Errorf("finding VM: %v", err)
+	}
+
+	args := []string{"scp"}
+	if *recurse {
+		args = append(args, "--recurse")
+	}
+	for _, path := range paths {
+		if strings.HasPrefix(path, remotePrefix) {
+			path = worker.Instance + ":" + strings.TrimPrefix(path, remotePrefix)
+		}
+		args = append(args, path)
+	}
+	return Gcloud(project, worker, *iap, args, extra)
+}
+
+const remotePrefix = "remote:"
+
+// Exec runs a single command inside the ssh-server action of the named
+// operation (which requires the pipeline to have been started with --ssh) and
+// streams its output back.  The command follows a '--' separator, for example:
+//
+//	exec <operation> -- df -h /mnt/google
+//
+// The command can only see the processes of other actions if the pipeline was
+// started with --share-pids.
+func Exec(ctx context.Context, service *genomics.Service, project string, arguments []string) error {
+	arguments, command := common.SplitArguments(arguments)
+	if len(command) == 0 {
+		return errors.New("missing command (expected after '--')")
+	}
+
+	name, _, err := target.Take(ctx, service, project, common.ParseFlags(flags, arguments))
+	if err != nil {
+		return err
+	}
+	worker, err := common.ResolveWorker(ctx, service, name)
+	if err != nil {
+		return fmt.Errorf("finding VM: %v", err)
+	}
+
+	return Gcloud(project, worker, *iap, []string{"ssh", worker.Instance, "--command", shellJoin(command)}, nil)
+}
+
+// shellJoin quotes each of the arguments for the remote shell (so that they
+// reach the command unchanged) and joins them with spaces.
+func shellJoin(arguments []string) string {
+	var quoted []string
+	for _, argument := range arguments {
+		if argument != "" && strings.Trim(argument, safeCharacters) == "" {
+			quoted = append(quoted, argument)
+			continue
+		}
+		quoted = append(quoted, "'"+strings.Replace(argument, "'", `'\''`, -1)+"'")
+	}
+	return strings.Join(quoted, " ")
+}
+
+// safeCharacters are the characters that need no quoting in a shell word.
+const safeCharacters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789@%_-+=:,./"
+
+// PortForward opens an IAP tunnel from a local port to a port on the VM running
+// the named operation.  The ports are given as LOCAL:REMOTE, where REMOTE is a
+// host port published by one of the actions (using "# ports=...").
+func PortForward(ctx context.Context, service *genomics.Service, project string, arguments []string) error {
+	arguments, extra := common.SplitArguments(arguments)
+	name, positional, err := target.Take(ctx, service, project, common.ParseFlags(flags, arguments))
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return errors.New("expecting an operation name and a LOCAL:REMOTE port pair")
+	}
+
+	local, remote, err := parsePortPair(positional[0])
+	if err != nil {
+		return err
+	}
+	_, metadata, err := common.GetOperation(ctx, service, name)
+	if err != nil {
+		return err
+	}
+	if !isPublished(metadata.Pipeline, remote) {
+		fmt.Printf("Warning: port %d is not published by any action\n", remote)
+	}
+
+	worker, err := common.ResolveWorker(ctx, service, name)
+	if err != nil {
+		return fmt.Errorf("finding VM: %v", err)
+	}
+
+	fmt.Printf("Forwarding localhost:%d to port %d on %s\n", local, remote, worker.Instance)
+	args := []string{"start-iap-tunnel", worker.Instance, strconv.Itoa(remote), fmt.Sprintf("--local-host-port=localhost:%d", local)}
+	return Gcloud(project, worker, false, args, extra)
+}
+
+func parsePortPair(input string) (local, remote int, err error) {
+	parts := strings.Split(input, ":")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid port pair %q (expected LOCAL:REMOTE)", input)
+	}
+	if local, err = strconv.Atoi(parts[0]); err != nil {
+		return 0, 0, fmt.Errorf("parsing local port: %v", err)
+	}
+	if remote, err = strconv.Atoi(parts[1]); err != nil {
+		return 0, 0, fmt.Errorf("parsing remote port: %v", err)
+	}
+	return local, remote, nil
+}
+
+func isPublished(pipeline *genomics.Pipeline, port int) bool {
+	if pipeline == nil {
+		return false
+	}
+	for _, action := range pipeline.Actions {
+		for _, hostPort := range action.PortMappings {
+			if hostPort == int64(port) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Gcloud runs a 'gcloud compute' sub-command targeting worker, connected to
+// the standard input and outputs of the tool.  The extra arguments (if any)
+// are passed after a '--' separator.
+func Gcloud(project string, worker *common.Worker, iap bool, arguments, extra []string) error {
+	arguments = append([]string{"compute"}, arguments...)
+	arguments = append(arguments, "--zone", worker.Zone, "--project", project)
+	if iap {
+		arguments = append(arguments, "--tunnel-through-iap")
+	}
+	if len(extra) > 0 {
+		arguments = append(append(arguments, "--"), extra...)
+	}
+
+	cmd := exec.Command("gcloud", arguments...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("running gcloud: %v", err)
+	}
+	return nil
+}
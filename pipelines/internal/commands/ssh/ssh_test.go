@@ -0,0 +1,21 @@
+package ssh
+
+import "testing"
+
+func TestShellJoin(t *testing.T) {
+	testCases := []struct {
+		arguments []string
+		want      string
+	}{
+		{[]string{"df", "-h", "/mnt/google"}, "df -h /mnt/google"},
+		{[]string{"echo", "a b"}, "echo 'a b'"},
+		{[]string{"echo", ""}, "echo ''"},
+		{[]string{"echo", "it's"}, `echo 'it'\''s'`},
+		{[]string{"sh", "-c", "ls $HOME; rm *"}, "sh -c 'ls $HOME; rm *'"},
+	}
+	for _, tc := range testCases {
+		if got := shellJoin(tc.arguments); got != tc.want {
+			t.Errorf("shellJoin(%q): got %q, want %q", tc.arguments, got, tc.want)
+		}
+	}
+}
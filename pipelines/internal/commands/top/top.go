@@ -0,0 +1,381 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package top provides an interactive dashboard of running pipelines.
+//
+// The dashboard lists the running operations in the project (optionally only
+// those with the labels given by --label) together with the action that each
+// is currently running and how long ago it was created, and refreshes the list
+// every --interval.  The up and down arrow keys (or k and j) select an
+// operation, which can then be watched with w (until Ctrl-C is pressed),
+// described with d or cancelled with c (after confirmation).  The r key
+// refreshes the list immediately and q quits.
+package top
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/googlegenomics/pipelines-tools/pipelines/events"
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/commands/watch"
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/common"
+	"golang.org/x/crypto/ssh/terminal"
+	genomics "google.golang.org/api/genomics/v2alpha1"
+)
+
+var (
+	labels = make(map[string]string)
+
+	flags = flag.NewFlagSet("", flag.ExitOnError)
+
+	interval = flags.Duration("interval", 5*time.Second, "how often the list of operations is refreshed")
+)
+
+func init() {
+	flags.Var(&common.MapFlagValue{Values: labels}, "label", "only show operations with this label (may be repeated)")
+}
+
+// row describes a running operation.
+type row struct {
+	name    string
+	current string
+	elapsed time.Duration
+	labels  map[string]string
+}
+
+func Invoke(ctx context.Context, service *genomics.Service, project string, arguments []string) error {
+	common.ParseFlags(flags, arguments)
+	if *interval <= 0 {
+		return errors.New("--interval must be positive")
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		return errors.New("top requires an interactive terminal")
+	}
+	state, err := terminal.MakeRaw(fd)
+	if err != nil {
+		return fmt.Errorf("configuring terminal: %v", err)
+	}
+	defer terminal.Restore(fd, state)
+
+	keys := make(chan string)
+	go readKeys(os.Stdin, keys)
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+
+	var rows []row
+	var selected int
+	var status string
+	refresh := func() {
+		var name string
+		if selected < len(rows) {
+			name = rows[selected].name
+		}
+		var err error
+		if rows, err = list(ctx, service, project, time.Now()); err != nil {
+			status = err.Error()
+		}
+		selected = 0
+		for i, row := range rows {
+			if row.name == name {
+				selected = i
+			}
+		}
+	}
+
+	refresh()
+	for {
+		width, height, err := terminal.GetSize(fd)
+		if err != nil || width <= 0 || height <= 0 {
+			width, height = 80, 24
+		}
+		render(os.Stdout, project, rows, selected, status, width, height)
+		status = ""
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			refresh()
+		case key, ok := <-keys:
+			if !ok {
+				return nil
+			}
+			switch key {
+			case "q":
+				return nil
+			case "up":
+				if selected > 0 {
+					selected--
+				}
+			case "down":
+				if selected < len(rows)-1 {
+					selected++
+				}
+			case "r":
+				refresh()
+			case "w", "d", "c":
+				if len(rows) == 0 {
+					continue
+				}
+				name := rows[selected].name
+				switch key {
+				case "w":
+					terminal.Restore(fd, state)
+					watchOperation(ctx, service, project, name)
+					if _, err := terminal.MakeRaw(fd); err != nil {
+						return fmt.Errorf("configuring terminal: %v", err)
+					}
+					pause(keys)
+				case "d":
+					describe(ctx, service, name)
+					pause(keys)
+				case "c":
+					render(os.Stdout, project, rows, selected, fmt.Sprintf("Cancel %s? (y/n)", name), width, height)
+					if <-keys != "y" {
+						continue
+					}
+					status = fmt.Sprintf("Cancelled %s", name)
+					if err := cancel(ctx, service, name); err != nil {
+						status = fmt.Sprintf("Failed to cancel %s: %v", name, err)
+					}
+				}
+				refresh()
+			}
+		}
+	}
+}
+
+// list returns the running operations in project that have the labels given
+// by the --label flags.
+func list(ctx context.Context, service *genomics.Service, project string, now time.Time) ([]row, error) {
+	filter := common.AndFilters(common.LabelFilter(labels), "done = false")
+
+	var rows []row
+	err := common.ListOperations(ctx, service, project, filter, func(operation *genomics.Operation, metadata *genomics.Metadata) error {
+		rows = append(rows, newRow(operation.Name, metadata, now))
+		return nil
+	})
+	return rows, err
+}
+
+// newRow summarizes a running operation: the current activity is the most
+// recently started foreground action that is still running or, if there is
+// none, the most recent event.
+func newRow(name string, metadata *genomics.Metadata, now time.Time) row {
+	r := row{name: name, current: "waiting", labels: metadata.Labels}
+	if created, err := time.Parse(time.RFC3339Nano, metadata.CreateTime); err == nil {
+		r.elapsed = now.Sub(created).Truncate(time.Second)
+	}
+
+	var actions []*genomics.Action
+	if metadata.Pipeline != nil {
+		actions = metadata.Pipeline.Actions
+	}
+	running := make(map[int64]bool)
+	var last string
+	for _, e := range events.ParseAll(metadata.Events) {
+		last = e.Description
+		switch e.Details.(type) {
+		case *genomics.ContainerStartedEvent:
+			running[e.ActionID()] = true
+		case *genomics.ContainerStoppedEvent, *genomics.ContainerKilledEvent:
+			delete(running, e.ActionID())
+		}
+	}
+	if last != "" {
+		r.current = last
+	}
+
+	var latest int64
+	for id := range running {
+		if id > latest && id <= int64(len(actions)) && !isBackground(actions[id-1]) {
+			latest = id
+		}
+	}
+	if latest > 0 {
+		action := actions[latest-1]
+		label := action.Name
+		if label == "" {
+			label = action.ImageUri
+		}
+		r.current = fmt.Sprintf("action %d: %s", latest, label)
+	}
+	return r
+}
+
+func isBackground(action *genomics.Action) bool {
+	for _, flag := range action.Flags {
+		if flag == "RUN_IN_BACKGROUND" {
+			return true
+		}
+	}
+	return false
+}
+
+// render draws the dashboard.  The terminal is in raw mode, so lines must end
+// with a carriage return as well as a newline.
+func render(w io.Writer, project string, rows []row, selected int, status string, width, height int) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%d running operations in %s (updated %s)\n\n", len(rows), project, time.Now().Format("15:04:05"))
+
+	// Scroll so that the selected operation is visible below the header and
+	// above the help and status lines.
+	visible := height - 6
+	if visible < 1 {
+		visible = 1
+	}
+	first := 0
+	if selected >= visible {
+		first = selected - visible + 1
+	}
+
+	tw := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "  NAME\tELAPSED\tCURRENT\tLABELS")
+	for i := first; i < len(rows) && i < first+visible; i++ {
+		marker := " "
+		if i == selected {
+			marker = ">"
+		}
+		r := rows[i]
+		fmt.Fprintf(tw, "%s %s\t%s\t%s\t%s\n", marker, r.name, r.elapsed, r.current, formatLabels(r.labels))
+	}
+	tw.Flush()
+
+	fmt.Fprintf(&b, "\n%s\n", status)
+	fmt.Fprint(&b, "[up/down] select  [w]atch  [d]escribe  [c]ancel  [r]efresh  [q]uit")
+
+	lines := strings.Split(b.String(), "\n")
+	for i, line := range lines {
+		if len(line) > width {
+			lines[i] = line[:width]
+		}
+	}
+	fmt.Fprint(w, "\x1b[H\x1b[2J"+strings.Join(lines, "\r\n"))
+}
+
+func formatLabels(labels map[string]string) string {
+	var pairs []string
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// readKeys sends the keys read from r to keys, translating arrow keys to "up"
+// and "down" and Ctrl-C to "q".  The channel is closed when r is exhausted.
+func readKeys(r io.Reader, keys chan<- string) {
+	defer close(keys)
+	buffer := make([]byte, 16)
+	for {
+		n, err := r.Read(buffer)
+		for _, key := range parseKeys(buffer[:n]) {
+			keys <- key
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func parseKeys(input []byte) []string {
+	var keys []string
+	for len(input) > 0 {
+		switch {
+		case bytes.HasPrefix(input, []byte("\x1b[A")):
+			keys, input = append(keys, "up"), input[3:]
+			continue
+		case bytes.HasPrefix(input, []byte("\x1b[B")):
+			keys, input = append(keys, "down"), input[3:]
+			continue
+		}
+		switch input[0] {
+		case 'k':
+			keys = append(keys, "up")
+		case 'j':
+			keys = append(keys, "down")
+		case 3:
+			keys = append(keys, "q")
+		default:
+			keys = append(keys, strings.ToLower(string(input[0])))
+		}
+		input = input[1:]
+	}
+	return keys
+}
+
+// pause waits for a key to be pressed before the dashboard is redrawn.
+func pause(keys <-chan string) {
+	fmt.Print("\r\nPress any key to return to the dashboard")
+	<-keys
+}
+
+// watchOperation watches the named operation until it finishes or Ctrl-C is
+// pressed.  It must be called with the terminal in its normal mode.
+func watchOperation(ctx context.Context, service *genomics.Service, project, name string) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	go func() {
+		select {
+		case <-interrupt:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	fmt.Print("\x1b[H\x1b[2J")
+	if err := watch.Invoke(ctx, service, project, []string{name}); err != nil && ctx.Err() == nil {
+		fmt.Println(err)
+	}
+}
+
+// describe shows the full metadata of the named operation.
+func describe(ctx context.Context, service *genomics.Service, name string) {
+	fmt.Print("\x1b[H\x1b[2J")
+	_, metadata, err := common.GetOperation(ctx, service, name)
+	if err != nil {
+		fmt.Printf("%v\r\n", err)
+		return
+	}
+	encoded, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		fmt.Printf("Failed to encode metadata: %v\r\n", err)
+		return
+	}
+	fmt.Print(strings.Replace(string(encoded), "\n", "\r\n", -1) + "\r\n")
+}
+
+func cancel(ctx context.Context, service *genomics.Service, name string) error {
+	req := &genomics.CancelOperationRequest{}
+	_, err := service.Projects.Operations.Cancel(name, req).Context(ctx).Do()
+	return err
+}
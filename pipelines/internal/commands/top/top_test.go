@@ -0,0 +1,66 @@
+package top
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	genomics "google.golang.org/api/genomics/v2alpha1"
+)
+
+func TestParseKeys(t *testing.T) {
+	got := parseKeys([]byte("\x1b[Aj\x1b[BkW\x03"))
+	want := []string{"up", "down", "down", "up", "w", "q"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Unexpected keys: got %q, want %q", got, want)
+	}
+}
+
+func TestNewRow(t *testing.T) {
+	pipeline := &genomics.Pipeline{
+		Actions: []*genomics.Action{
+			{ImageUri: "gcr.io/cloud-genomics-pipelines/io"},
+			{ImageUri: "bash", Flags: []string{"RUN_IN_BACKGROUND"}},
+			{ImageUri: "gcr.io/my-project/aligner", Name: "align"},
+		},
+	}
+	event := func(timestamp, description, kind string, actionID int) *genomics.Event {
+		details := fmt.Sprintf(`{"@type": "type.googleapis.com/google.genomics.v2alpha1.%s", "actionId": %d}`, kind, actionID)
+		return &genomics.Event{Timestamp: timestamp, Description: description, Details: []byte(details)}
+	}
+
+	testCases := []struct {
+		name   string
+		events []*genomics.Event
+		want   string
+	}{
+		{"queued", nil, "waiting"},
+		{"worker", []*genomics.Event{
+			{Timestamp: "2020-01-01T00:00:01Z", Description: "Worker assigned"},
+		}, "Worker assigned"},
+		{"running", []*genomics.Event{
+			event("2020-01-01T00:00:05Z", "Started running align", "ContainerStartedEvent", 3),
+			event("2020-01-01T00:00:04Z", "Started running bash", "ContainerStartedEvent", 2),
+			event("2020-01-01T00:00:03Z", "Stopped running io", "ContainerStoppedEvent", 1),
+			event("2020-01-01T00:00:02Z", "Started running io", "ContainerStartedEvent", 1),
+		}, "action 3: align"},
+		{"background", []*genomics.Event{
+			event("2020-01-01T00:00:04Z", "Started running bash", "ContainerStartedEvent", 2),
+			event("2020-01-01T00:00:03Z", "Stopped running io", "ContainerStoppedEvent", 1),
+		}, "Started running bash"},
+	}
+	now := time.Date(2020, 1, 1, 0, 1, 30, 0, time.UTC)
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			metadata := &genomics.Metadata{CreateTime: "2020-01-01T00:00:00Z", Pipeline: pipeline, Events: tc.events}
+			got := newRow("operations/1", metadata, now)
+			if got.current != tc.want {
+				t.Fatalf("Unexpected current activity: got %q, want %q", got.current, tc.want)
+			}
+			if got.elapsed != 90*time.Second {
+				t.Fatalf("Unexpected elapsed time: got %s, want 1m30s", got.elapsed)
+			}
+		})
+	}
+}
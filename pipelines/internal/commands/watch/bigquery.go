@@ -0,0 +1,165 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package watch
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/googlegenomics/pipelines-tools/pipelines/events"
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/common"
+	genomics "google.golang.org/api/genomics/v2alpha1"
+)
+
+// historyRow is the row written to the --bq-table for each operation.
+type historyRow struct {
+	Operation string
+	Done      bool
+	Code      int64
+	Message   string
+	Reason    string
+
+	CreateTime, StartTime, EndTime bigquery.NullTimestamp
+	DurationSeconds                float64
+
+	MachineType   string
+	Preemptible   bool
+	Zone          string
+	Labels        []historyLabel
+	EstimatedCost float64
+
+	// Actions is only populated when --bq-actions is set.
+	Actions []historyAction
+}
+
+type historyLabel struct {
+	Key, Value string
+}
+
+type historyAction struct {
+	ID              int64
+	Name            string
+	Image           string
+	StartTime       bigquery.NullTimestamp
+	EndTime         bigquery.NullTimestamp
+	DurationSeconds float64
+	ExitStatus      bigquery.NullInt64
+}
+
+// writeHistory streams a row describing the operation to the table named by
+// the --bq-table flag, which is of the form [PROJECT.]DATASET.TABLE.  The
+// table is created if it does not exist.
+func writeHistory(ctx context.Context, project string, lro *genomics.Operation, metadata *genomics.Metadata) error {
+	parts := strings.Split(*bqTable, ".")
+	switch len(parts) {
+	case 2:
+		parts = append([]string{project}, parts...)
+	case 3:
+	default:
+		return fmt.Errorf("invalid table %q: expecting [PROJECT.]DATASET.TABLE", *bqTable)
+	}
+
+	bq, err := bigquery.NewClient(ctx, parts[0])
+	if err != nil {
+		return fmt.Errorf("creating BigQuery client: %v", err)
+	}
+	defer bq.Close()
+
+	schema, err := bigquery.InferSchema(historyRow{})
+	if err != nil {
+		return fmt.Errorf("inferring schema: %v", err)
+	}
+	table := bq.Dataset(parts[1]).Table(parts[2])
+	if _, err := table.Metadata(ctx); err != nil {
+		if err := table.Create(ctx, &bigquery.TableMetadata{Schema: schema}); err != nil {
+			return fmt.Errorf("creating table: %v", err)
+		}
+	}
+
+	row := newHistoryRow(lro, metadata)
+	saver := &bigquery.StructSaver{Struct: row, InsertID: lro.Name, Schema: schema}
+	if err := table.Uploader().Put(ctx, saver); err != nil {
+		return fmt.Errorf("inserting row: %v", err)
+	}
+	return nil
+}
+
+func newHistoryRow(lro *genomics.Operation, metadata *genomics.Metadata) historyRow {
+	row := historyRow{
+		Operation:  lro.Name,
+		Done:       lro.Done,
+		CreateTime: nullTimestamp(metadata.CreateTime),
+		StartTime:  nullTimestamp(metadata.StartTime),
+		EndTime:    nullTimestamp(metadata.EndTime),
+	}
+	if row.StartTime.Valid && row.EndTime.Valid {
+		row.DurationSeconds = row.EndTime.Timestamp.Sub(row.StartTime.Timestamp).Seconds()
+	}
+
+	if lro.Error != nil {
+		err := common.NewPipelineExecutionError(lro.Error, metadata)
+		row.Code = lro.Error.Code
+		row.Message = lro.Error.Message
+		row.Reason = err.Reason
+	}
+
+	if pipeline := metadata.Pipeline; pipeline != nil && pipeline.Resources != nil && pipeline.Resources.VirtualMachine != nil {
+		row.MachineType = pipeline.Resources.VirtualMachine.MachineType
+		row.Preemptible = pipeline.Resources.VirtualMachine.Preemptible
+		row.EstimatedCost = estimateCost(metadata)
+	}
+
+	for k, v := range metadata.Labels {
+		row.Labels = append(row.Labels, historyLabel{Key: k, Value: v})
+	}
+
+	parsed := events.ParseAll(metadata.Events)
+	for _, event := range parsed {
+		if details, ok := event.Details.(*genomics.WorkerAssignedEvent); ok {
+			row.Zone = details.Zone
+		}
+	}
+
+	if *bqActions {
+		for _, timing := range actionTimings(parsed) {
+			action := historyAction{
+				ID:        timing.id,
+				Name:      actionName(metadata.Pipeline, timing.id),
+				StartTime: bigquery.NullTimestamp{Timestamp: timing.start, Valid: true},
+			}
+			if a := pipelineAction(metadata.Pipeline, timing.id); a != nil {
+				action.Image = a.ImageUri
+			}
+			if timing.stopped {
+				action.EndTime = bigquery.NullTimestamp{Timestamp: timing.end, Valid: true}
+				action.DurationSeconds = timing.end.Sub(timing.start).Seconds()
+				action.ExitStatus = bigquery.NullInt64{Int64: timing.exitStatus, Valid: true}
+			}
+			row.Actions = append(row.Actions, action)
+		}
+	}
+	return row
+}
+
+func nullTimestamp(value string) bigquery.NullTimestamp {
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return bigquery.NullTimestamp{}
+	}
+	return bigquery.NullTimestamp{Timestamp: t, Valid: true}
+}
@@ -0,0 +1,99 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package watch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/common"
+	genomics "google.golang.org/api/genomics/v2alpha1"
+	"google.golang.org/api/googleapi"
+	storage "google.golang.org/api/storage/v1"
+)
+
+// logCopyPattern matches the command that copies the combined output of the
+// actions to GCS (see the --output flag of the run command).
+var logCopyPattern = regexp.MustCompile(`cp /google/logs/output (gs://[^\s;]+)`)
+
+// logPath returns the GCS path that the pipeline copies its output to, or the
+// empty string if it does not copy its output.
+func logPath(pipeline *genomics.Pipeline) string {
+	if pipeline == nil {
+		return ""
+	}
+	for _, action := range pipeline.Actions {
+		for _, command := range action.Commands {
+			if m := logCopyPattern.FindStringSubmatch(command); m != nil {
+				return m[1]
+			}
+		}
+	}
+	return ""
+}
+
+// logFollower shows the output of a pipeline as it is copied to GCS.  The
+// output only grows, so each read starts where the previous one ended.
+type logFollower struct {
+	service        *storage.Service
+	bucket, object string
+	offset         int64
+}
+
+// startFollowing returns a follower for the output of pipeline.
+func startFollowing(ctx context.Context, pipeline *genomics.Pipeline) (*logFollower, error) {
+	path := logPath(pipeline)
+	if path == "" {
+		return nil, errors.New("the pipeline does not copy its output to GCS (see the --output flag of run)")
+	}
+	return newLogFollower(ctx, path)
+}
+
+func newLogFollower(ctx context.Context, path string) (*logFollower, error) {
+	bucket, object, err := common.ParseGCSPath(path)
+	if err != nil {
+		return nil, err
+	}
+	service, err := common.NewStorageService(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &logFollower{service: service, bucket: bucket, object: object}, nil
+}
+
+// follow writes the output added since the previous call to w.
+func (f *logFollower) follow(ctx context.Context, w io.Writer) error {
+	call := f.service.Objects.Get(f.bucket, f.object).Context(ctx)
+	call.Header().Set("Range", fmt.Sprintf("bytes=%d-", f.offset))
+	resp, err := call.Download()
+	if err != nil {
+		// The object does not exist until the first copy, and a range
+		// that starts at the end of the object means there is no new
+		// output.
+		if err, ok := err.(*googleapi.Error); ok && (err.Code == http.StatusNotFound || err.Code == http.StatusRequestedRangeNotSatisfiable) {
+			return nil
+		}
+		return fmt.Errorf("reading output: %v", err)
+	}
+	defer resp.Body.Close()
+
+	n, err := io.Copy(w, resp.Body)
+	f.offset += n
+	return err
+}
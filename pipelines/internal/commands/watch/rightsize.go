@@ -0,0 +1,136 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package watch
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/googlegenomics/pipelines-tools/pipelines/events"
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/common"
+	genomics "google.golang.org/api/genomics/v2alpha1"
+)
+
+// headroom is the factor applied to the peak usage when recommending a
+// machine type.
+const headroom = 1.2
+
+// resourcePeaks holds the peak resource usage of a VM, as recorded by the
+// monitoring action (see the --monitor flag of the run command).
+type resourcePeaks struct {
+	cpuPercent       float64
+	memoryKB, diskKB float64
+}
+
+// monitorPeaks returns the peak resource usage reported by the monitoring
+// (or profiling) action, if the pipeline has one.
+func monitorPeaks(parsed []*events.Event) (resourcePeaks, bool) {
+	fields, ok := reportedFields(parsed, common.MonitorPrefix)
+	if !ok {
+		return resourcePeaks{}, false
+	}
+	var peaks resourcePeaks
+	peaks.cpuPercent, _ = strconv.ParseFloat(fields["cpu_percent"], 64)
+	peaks.memoryKB, _ = strconv.ParseFloat(fields["memory_kb"], 64)
+	peaks.diskKB, _ = strconv.ParseFloat(fields["disk_kb"], 64)
+	return peaks, true
+}
+
+// profileSummary describes the average CPU usage and the network traffic
+// reported by the profiling action, if the pipeline has one.
+func profileSummary(parsed []*events.Event) (string, bool) {
+	fields, ok := reportedFields(parsed, common.ProfilePrefix)
+	if !ok {
+		return "", false
+	}
+	const bytesPerGB = 1 << 30
+	received, _ := strconv.ParseFloat(fields["network_rx_bytes"], 64)
+	sent, _ := strconv.ParseFloat(fields["network_tx_bytes"], 64)
+	return fmt.Sprintf("Average CPU usage: %s%%; network: %.2f GB received and %.2f GB sent; %s samples written to %s",
+		fields["cpu_average"], received/bytesPerGB, sent/bytesPerGB, fields["samples"], fields["path"]), true
+}
+
+// reportedFields returns the NAME=VALUE fields of the first line starting
+// with prefix in the standard error of an action.
+func reportedFields(parsed []*events.Event, prefix string) (map[string]string, bool) {
+	for _, event := range parsed {
+		details, ok := event.Details.(*genomics.ContainerStoppedEvent)
+		if !ok {
+			continue
+		}
+		for _, line := range strings.Split(details.Stderr, "\n") {
+			if !strings.HasPrefix(line, prefix) {
+				continue
+			}
+			fields := make(map[string]string)
+			for _, field := range strings.Fields(strings.TrimPrefix(line, prefix)) {
+				if parts := strings.SplitN(field, "=", 2); len(parts) == 2 {
+					fields[parts[0]] = parts[1]
+				}
+			}
+			return fields, true
+		}
+	}
+	return nil, false
+}
+
+// recommendation describes the peak usage of vm and suggests the machine type
+// (and disk size) that would have sufficed.
+func recommendation(vm *genomics.VirtualMachine, peaks resourcePeaks) string {
+	const kbPerGB = 1 << 20
+	cpus, memory := common.MachineShape(vm.MachineType)
+	usedCPUs := peaks.cpuPercent / 100 * float64(cpus)
+	usedMemory := peaks.memoryKB / kbPerGB
+	usedDisk := peaks.diskKB / kbPerGB
+
+	diskSize := int64(common.DefaultDiskSizeGb)
+	if len(vm.Disks) > 0 && vm.Disks[0].SizeGb > 0 {
+		diskSize = vm.Disks[0].SizeGb
+	}
+	text := fmt.Sprintf("Peak usage: %.1f of %d CPUs, %.1f of %.1f GB memory and %.1f of %d GB disk on %s", usedCPUs, cpus, usedMemory, memory, usedDisk, diskSize, vm.MachineType)
+	if cpus == 0 {
+		return text
+	}
+
+	var suggestions []string
+	recommended := common.RecommendMachineType(vm, usedCPUs*headroom, usedMemory*headroom)
+	switch {
+	case peaks.cpuPercent >= 95:
+		suggestions = append(suggestions, "the CPUs were saturated, so a larger machine type may be faster")
+	case recommended == "":
+	case recommended == vm.MachineType:
+		suggestions = append(suggestions, vm.MachineType+" is a good fit")
+	default:
+		candidate := *vm
+		candidate.MachineType = recommended
+		if saving := 1 - common.HourlyCost(&candidate)/common.HourlyCost(vm); saving > 0 {
+			suggestions = append(suggestions, fmt.Sprintf("%s would suffice (about %.0f%% cheaper)", recommended, 100*saving))
+		} else {
+			suggestions = append(suggestions, recommended+" would leave more headroom")
+		}
+	}
+
+	if needed := int64(usedDisk*headroom) + 1; needed*2 < diskSize {
+		if needed < 10 {
+			needed = 10
+		}
+		suggestions = append(suggestions, fmt.Sprintf("--disk-size %d would be enough", needed))
+	}
+	if len(suggestions) == 0 {
+		return text
+	}
+	return text + "; " + strings.Join(suggestions, "; ")
+}
@@ -0,0 +1,196 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package watch
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/googlegenomics/pipelines-tools/pipelines/events"
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/common"
+	genomics "google.golang.org/api/genomics/v2alpha1"
+)
+
+// transferPattern matches the commands of actions that copy inputs and
+// outputs, which are shown as transfers rather than as running commands.
+var transferPattern = regexp.MustCompile(`gsutil(?: -\w+)* (?:cp|rsync) `)
+
+// phase is a period of time spent on part of an action.
+type phase struct {
+	Kind       string
+	Start, End time.Time
+
+	// Left and Width position the phase on the timeline (as percentages).
+	Left, Width float64
+}
+
+// timelineRow holds the phases of a single action.
+type timelineRow struct {
+	ID     int64
+	Name   string
+	Status string
+	Phases []*phase
+}
+
+// timeline describes the execution of an operation over time.
+type timeline struct {
+	Operation  string
+	Start, End time.Time
+	Rows       []*timelineRow
+}
+
+// newTimeline builds the timeline of an operation from its events.  Image
+// pulls are attributed to the next action that uses the image.
+func newTimeline(name string, metadata *genomics.Metadata) *timeline {
+	parsed := events.ParseAll(metadata.Events)
+	t := &timeline{Operation: name}
+	if len(parsed) == 0 {
+		return t
+	}
+	t.Start, t.End = parsed[0].Timestamp, parsed[len(parsed)-1].Timestamp
+	if end, err := time.Parse(time.RFC3339Nano, metadata.EndTime); err == nil && end.After(t.End) {
+		t.End = end
+	}
+
+	var actions []*genomics.Action
+	if metadata.Pipeline != nil {
+		actions = metadata.Pipeline.Actions
+	}
+	rows := make(map[int64]*timelineRow)
+	row := func(id int64) *timelineRow {
+		r, ok := rows[id]
+		if !ok {
+			r = &timelineRow{ID: id, Name: actionName(metadata.Pipeline, id), Status: "running"}
+			rows[id] = r
+			t.Rows = append(t.Rows, r)
+		}
+		return r
+	}
+
+	// pulls holds the image pulls that have not yet been attributed to an
+	// action, keyed by image.
+	pulls := make(map[string]*phase)
+	for _, event := range parsed {
+		switch details := event.Details.(type) {
+		case *genomics.PullStartedEvent:
+			pulls[details.ImageUri] = &phase{Kind: "pull", Start: event.Timestamp, End: event.Timestamp}
+		case *genomics.PullStoppedEvent:
+			if p, ok := pulls[details.ImageUri]; ok {
+				p.End = event.Timestamp
+			}
+		case *genomics.ContainerStartedEvent:
+			r := row(details.ActionId)
+			kind := "run"
+			if id := details.ActionId; id >= 1 && int(id) <= len(actions) {
+				action := actions[id-1]
+				if transferPattern.MatchString(strings.Join(action.Commands, " ")) {
+					kind = "transfer"
+				}
+				if p, ok := pulls[action.ImageUri]; ok {
+					r.Phases = append(r.Phases, p)
+					delete(pulls, action.ImageUri)
+				}
+			}
+			r.Phases = append(r.Phases, &phase{Kind: kind, Start: event.Timestamp, End: t.End})
+		case *genomics.ContainerStoppedEvent:
+			r := row(details.ActionId)
+			if len(r.Phases) > 0 {
+				r.Phases[len(r.Phases)-1].End = event.Timestamp
+			}
+			r.Status = fmt.Sprintf("exit status %d", details.ExitStatus)
+		}
+	}
+
+	total := t.End.Sub(t.Start).Seconds()
+	for _, r := range t.Rows {
+		for _, p := range r.Phases {
+			if total > 0 {
+				p.Left = 100 * p.Start.Sub(t.Start).Seconds() / total
+				p.Width = 100 * p.End.Sub(p.Start).Seconds() / total
+			}
+		}
+	}
+	return t
+}
+
+var timelineTemplate = template.Must(template.New("timeline").Funcs(template.FuncMap{
+	"time": func(t time.Time) string { return t.Format("15:04:05") },
+	"duration": func(p *phase) string {
+		return p.End.Sub(p.Start).Round(time.Second).String()
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Timeline of {{.Operation}}</title>
+<style>
+body { font-family: sans-serif; font-size: 13px; }
+table { border-collapse: collapse; width: 100%; }
+td { padding: 2px 6px; white-space: nowrap; }
+td.bars { position: relative; width: 70%; }
+div.phase { position: absolute; top: 3px; height: 14px; min-width: 1px; }
+.pull { background: #bbbbbb; }
+.transfer { background: #4a90d9; }
+.run { background: #5cb85c; }
+span.key { display: inline-block; width: 12px; height: 12px; margin: 0 4px 0 12px; }
+</style>
+</head>
+<body>
+<h1>{{.Operation}}</h1>
+<p>{{.Start.Format "2006-01-02 15:04:05 MST"}} to {{.End.Format "2006-01-02 15:04:05 MST"}} ({{.End.Sub .Start}})
+<span class="key pull"></span>image pull
+<span class="key transfer"></span>transfer
+<span class="key run"></span>run</p>
+<table>
+{{- range .Rows}}
+<tr>
+<td>{{.ID}}</td>
+<td>{{.Name}}</td>
+<td>{{.Status}}</td>
+<td class="bars">
+{{- range .Phases}}
+<div class="phase {{.Kind}}" style="left: {{printf "%.3f" .Left}}%; width: {{printf "%.3f" .Width}}%" title="{{.Kind}}: {{time .Start}} to {{time .End}} ({{duration .}})"></div>
+{{- end}}
+</td>
+</tr>
+{{- end}}
+</table>
+</body>
+</html>
+`))
+
+// writeTimeline writes an HTML timeline of the operation to path, which is
+// either a local file or a GCS path.
+func writeTimeline(ctx context.Context, name string, metadata *genomics.Metadata, path string) error {
+	var buf bytes.Buffer
+	if err := timelineTemplate.Execute(&buf, newTimeline(name, metadata)); err != nil {
+		return fmt.Errorf("generating timeline: %v", err)
+	}
+
+	if !strings.HasPrefix(path, "gs://") {
+		return ioutil.WriteFile(path, buf.Bytes(), 0644)
+	}
+	service, err := common.NewStorageService(ctx)
+	if err != nil {
+		return err
+	}
+	return common.WriteObject(ctx, service, path, buf.Bytes())
+}
@@ -0,0 +1,67 @@
+package watch
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	genomics "google.golang.org/api/genomics/v2alpha1"
+	"google.golang.org/api/googleapi"
+)
+
+func TestNewTimeline(t *testing.T) {
+	start := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	var events []*genomics.Event
+	add := func(seconds int, details string) {
+		// The API returns events from newest to oldest.
+		events = append([]*genomics.Event{{
+			Timestamp: start.Add(time.Duration(seconds) * time.Second).Format(time.RFC3339Nano),
+			Details:   googleapi.RawMessage(details),
+		}}, events...)
+	}
+	event := func(kind, fields string) string {
+		return fmt.Sprintf(`{"@type": "type.googleapis.com/google.genomics.v2alpha1.%s", %s}`, kind, fields)
+	}
+	add(0, event("PullStartedEvent", `"imageUri": "io"`))
+	add(10, event("PullStoppedEvent", `"imageUri": "io"`))
+	add(10, event("ContainerStartedEvent", `"actionId": 1`))
+	add(30, event("ContainerStoppedEvent", `"actionId": 1, "exitStatus": 0`))
+	add(30, event("PullStartedEvent", `"imageUri": "bash"`))
+	add(40, event("PullStoppedEvent", `"imageUri": "bash"`))
+	add(40, event("ContainerStartedEvent", `"actionId": 2`))
+	add(100, event("ContainerStoppedEvent", `"actionId": 2, "exitStatus": 1`))
+
+	metadata := &genomics.Metadata{
+		Events: events,
+		Pipeline: &genomics.Pipeline{
+			Actions: []*genomics.Action{
+				{ImageUri: "io", Commands: []string{"-c", "gsutil cp gs://bucket/input /mnt/input"}},
+				{ImageUri: "bash", Commands: []string{"-c", "sort /mnt/input"}},
+			},
+		},
+	}
+
+	timeline := newTimeline("operation", metadata)
+	type summary struct {
+		status string
+		kinds  []string
+		widths []float64
+	}
+	var got []summary
+	for _, row := range timeline.Rows {
+		s := summary{status: row.Status}
+		for _, p := range row.Phases {
+			s.kinds = append(s.kinds, p.Kind)
+			s.widths = append(s.widths, p.Width)
+		}
+		got = append(got, s)
+	}
+	want := []summary{
+		{"exit status 0", []string{"pull", "transfer"}, []float64{10, 20}},
+		{"exit status 1", []string{"pull", "run"}, []float64{10, 60}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Unexpected timeline: got %+v, want %+v", got, want)
+	}
+}
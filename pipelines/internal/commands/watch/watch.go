@@ -18,90 +18,490 @@ package watch
 import (
 	"context"
 	"encoding/json"
-	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"strings"
 	"time"
 
+	"github.com/googlegenomics/pipelines-tools/pipelines/events"
 	"github.com/googlegenomics/pipelines-tools/pipelines/internal/common"
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/printer"
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/selector"
 	genomics "google.golang.org/api/genomics/v2alpha1"
+	"google.golang.org/api/googleapi"
 )
 
 var (
-	flags = flag.NewFlagSet("", flag.ExitOnError)
+	flags  = flag.NewFlagSet("", flag.ExitOnError)
+	target = selector.New(flags)
 
 	actions = flags.Bool("actions", false, "show action details")
 	details = flags.Bool("details", false, "show event details")
+	summary = flags.Bool("summary", true, "show a summary of action durations on completion")
+	cost    = flags.Bool("cost", false, "show a running estimate of the pipeline cost")
+	quiet   = flags.Bool("quiet", false, "only show warnings, failures and the final status")
+	suggest = flags.Bool("suggest", true, "show suggestions for fixing a failed pipeline")
+	logs    = flags.Bool("follow-logs", false, "show the output of the actions as it is copied to GCS (requires the pipeline to have been run with --output)")
+
+	timestamps = flags.String("timestamps", "utc", "how event timestamps are shown (utc, local or relative)")
+	resume     = flags.Bool("resume", false, "only show events that were not shown by a previous watch (recording the last event shown in ~/.pipelines-tools)")
+
+	bqTable   = flags.String("bq-table", "", "if set, a BigQuery table ([PROJECT.]DATASET.TABLE) where a row describing the finished operation is written")
+	bqActions = flags.Bool("bq-actions", false, "if true, include the timing of each action in the --bq-table row")
+
+	out = printer.New(flags, quiet)
+
+	timelinePath = flags.String("timeline", "", "if set, a local file or GCS path where an HTML timeline of the actions is written when the operation finishes")
+
+	teeLog = flags.String("tee-log", "", "if set, a local file that everything shown is also appended to")
+
+	// stdout is where the progress of the operation is written.
+	stdout io.Writer = os.Stdout
 )
 
 func Invoke(ctx context.Context, service *genomics.Service, project string, arguments []string) error {
-	names := common.ParseFlags(flags, arguments)
-	if len(names) < 1 {
-		return errors.New("missing operation name")
+	targets := common.ParseFlags(flags, arguments)
+
+	switch *timestamps {
+	case "utc", "local", "relative":
+	default:
+		return fmt.Errorf("unknown timestamp format %q", *timestamps)
+	}
+	if err := out.Validate(); err != nil {
+		return err
 	}
 
-	name := common.ExpandOperationName(project, names[0])
-	result, err := watch(ctx, service, name)
+	name, _, err := target.Take(ctx, service, project, targets)
+	if err != nil {
+		return err
+	}
+	var logFile io.Writer = ioutil.Discard
+	if *teeLog != "" {
+		f, err := os.OpenFile(*teeLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return fmt.Errorf("opening log file: %v", err)
+		}
+		defer f.Close()
+		fmt.Fprintf(f, "=== %s (watched at %s) ===\n", name, time.Now().Format(time.RFC3339))
+
+		logFile = f
+	}
+
+	// When the output is JSON or YAML, only the summary is written to
+	// standard output.
+	stdout = io.MultiWriter(os.Stdout, logFile)
+	if out.Structured() {
+		stdout = logFile
+	}
+	defer func() { stdout = os.Stdout }()
+
+	lro, metadata, err := watch(ctx, service, name)
 	if err != nil {
 		return fmt.Errorf("watching pipeline: %v", err)
 	}
 
-	if status, ok := result.(*genomics.Status); ok {
-		return common.PipelineExecutionError(*status)
+	if *timelinePath != "" {
+		if err := writeTimeline(ctx, name, metadata, *timelinePath); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write timeline: %v\n", err)
+		} else {
+			fmt.Fprintf(stdout, "Timeline written to %s\n", *timelinePath)
+		}
+	}
+
+	if *bqTable != "" {
+		if err := writeHistory(ctx, project, lro, metadata); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write to BigQuery: %v\n", err)
+		}
+	}
+
+	if out.Structured() && *summary && !*quiet {
+		if err := out.Print(os.Stdout, summaryDefaults(), summaryRecords(metadata)); err != nil {
+			return err
+		}
 	}
 
-	fmt.Println("Pipeline execution completed")
+	if lro.Error != nil {
+		err := common.NewPipelineExecutionError(lro.Error, metadata)
+		fmt.Fprintln(logFile, err)
+		if *suggest {
+			common.PrintSuggestions(os.Stderr, err)
+		}
+		return err
+	}
+
+	fmt.Fprintln(stdout, "Pipeline execution completed")
 	return nil
 }
 
-func watch(ctx context.Context, service *genomics.Service, name string) (interface{}, error) {
-	var events []*genomics.Event
-	const initialDelay = 5 * time.Second
+// The operation is polled after initialDelay, and then less often (up to
+// maxDelay) while nothing changes.  The same delays are used to back off while
+// the service cannot be reached, for up to maxOutage.
+var (
+	initialDelay = 5 * time.Second
+	maxDelay     = time.Minute
+	maxOutage    = 30 * time.Minute
+)
+
+// isTransient returns true if err (from getting the operation) may succeed
+// when retried: a server error, a rate limit or a network error.
+func isTransient(err error) bool {
+	if err, ok := err.(*googleapi.Error); ok {
+		return err.Code >= http.StatusInternalServerError || err.Code == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// sleep waits for the duration d, returning early with an error if ctx is
+// cancelled.
+func sleep(ctx context.Context, d time.Duration) error {
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// watch polls the named operation until it completes, returning the final
+// operation and its decoded metadata.
+func watch(ctx context.Context, service *genomics.Service, name string) (*genomics.Operation, *genomics.Metadata, error) {
+	var seen []*genomics.Event
+	started := make(map[int64]time.Time)
+
+	var checkpoint time.Time
+	if *resume {
+		checkpoint = loadCheckpoint(name)
+	}
+
 	delay := initialDelay
+	outageDelay := initialDelay
+	var outage time.Time
+	var follower *logFollower
+	followLogs := *logs
 	for {
 		lro, err := service.Projects.Operations.Get(name).Context(ctx).Do()
 		if err != nil {
-			return nil, fmt.Errorf("getting operation status: %v", err)
+			// Keep trying through transient failures (such as the network
+			// dropping while a laptop sleeps, or the request quota being
+			// exhausted) for a reasonable amount of time.
+			if ctx.Err() != nil {
+				return nil, nil, ctx.Err()
+			}
+			if !isTransient(err) {
+				return nil, nil, fmt.Errorf("getting operation status: %v", err)
+			}
+			if outage.IsZero() {
+				outage = time.Now()
+				fmt.Fprintf(stdout, "Lost contact with the service (%v), retrying...\n", err)
+			} else if time.Since(outage) > maxOutage {
+				return nil, nil, fmt.Errorf("getting operation status: %v", err)
+			}
+			if err := sleep(ctx, outageDelay); err != nil {
+				return nil, nil, err
+			}
+			outageDelay *= 2
+			if outageDelay > maxDelay {
+				outageDelay = maxDelay
+			}
+			continue
 		}
+		outage, outageDelay = time.Time{}, initialDelay
 
 		var metadata genomics.Metadata
 		if err := json.Unmarshal(lro.Metadata, &metadata); err != nil {
-			return nil, fmt.Errorf("parsing metadata: %v", err)
+			return nil, nil, fmt.Errorf("parsing metadata: %v", err)
+		}
+
+		if followLogs && follower == nil {
+			if follower, err = startFollowing(ctx, metadata.Pipeline); err != nil {
+				fmt.Fprintf(os.Stderr, "Not following logs: %v\n", err)
+				followLogs = false
+			}
 		}
 
 		if *actions {
 			*actions = false
 			encoded, err := json.MarshalIndent(metadata.Pipeline.Actions, "", "  ")
 			if err != nil {
-				return nil, fmt.Errorf("encoding actions: %v", err)
+				return nil, nil, fmt.Errorf("encoding actions: %v", err)
 			}
-			fmt.Printf("%s\n", encoded)
+			fmt.Fprintf(stdout, "%s\n", encoded)
 		}
 
-		if len(events) != len(metadata.Events) {
-			for i := len(metadata.Events) - len(events) - 1; i >= 0; i-- {
-				timestamp, _ := time.Parse(time.RFC3339Nano, metadata.Events[i].Timestamp)
-				fmt.Println(timestamp.Format("15:04:05"), metadata.Events[i].Description)
+		if len(seen) != len(metadata.Events) {
+			for _, event := range events.ParseAll(metadata.Events[:len(metadata.Events)-len(seen)]) {
+				description := event.Description
+				switch details := event.Details.(type) {
+				case *genomics.ContainerStartedEvent:
+					started[details.ActionId] = event.Timestamp
+				case *genomics.ContainerStoppedEvent:
+					if start, ok := started[details.ActionId]; ok {
+						description += fmt.Sprintf(" (after %s)", event.Timestamp.Sub(start).Round(time.Second))
+					}
+				}
+				if !event.Timestamp.After(checkpoint) || (*quiet && !event.IsFailure()) {
+					continue
+				}
+				fmt.Fprintln(stdout, formatTimestamp(event.Timestamp, metadata.CreateTime), description)
 
 				if *details {
-					fmt.Println(string(metadata.Events[i].Details))
+					fmt.Fprintln(stdout, string(event.Raw))
 				}
 			}
-			events = metadata.Events
+			seen = metadata.Events
 			delay = initialDelay
+
+			if *resume && len(seen) > 0 {
+				saveCheckpoint(name, seen[0].Timestamp)
+			}
+
+			if *cost && !*quiet && !lro.Done {
+				fmt.Fprintf(stdout, "Estimated cost so far: $%.2f\n", estimateCost(&metadata))
+			}
+		}
+
+		if follower != nil {
+			if err := follower.follow(ctx, stdout); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to follow logs: %v\n", err)
+			}
 		}
 
 		if lro.Done {
-			if lro.Error != nil {
-				return lro.Error, nil
+			if *summary && !*quiet {
+				printSummary(&metadata)
+			}
+			// The total is part of the summary, and --cost adds the
+			// actions that cost the most.
+			if *cost || *summary && !*quiet {
+				total := estimateCost(&metadata)
+				fmt.Fprintf(stdout, "Estimated total cost: $%.2f\n", total)
+				if *cost {
+					printMostExpensive(&metadata, total)
+				}
+			}
+			if peaks, ok := monitorPeaks(events.ParseAll(metadata.Events)); ok && !*quiet {
+				if p := metadata.Pipeline; p != nil && p.Resources != nil && p.Resources.VirtualMachine != nil {
+					fmt.Fprintln(stdout, recommendation(p.Resources.VirtualMachine, peaks))
+				}
+			}
+			if summary, ok := profileSummary(events.ParseAll(metadata.Events)); ok && !*quiet {
+				fmt.Fprintln(stdout, summary)
+			}
+			if *resume {
+				removeCheckpoint(name)
 			}
-			return lro.Response, nil
+			return lro, &metadata, nil
 		}
 
-		time.Sleep(delay)
+		if err := sleep(ctx, delay); err != nil {
+			return nil, nil, err
+		}
 		delay = time.Duration(float64(delay) * 1.5)
-		if limit := time.Minute; delay > limit {
+		limit := maxDelay
+		if follower != nil {
+			limit = 15 * time.Second
+		}
+		if delay > limit {
 			delay = limit
 		}
 	}
 }
+
+// checkpointPath returns the path of the file used to record the last event
+// shown for the named operation.
+func checkpointPath(name string) (string, error) {
+	return common.StatePath("watch-" + strings.Replace(name, "/", "_", -1))
+}
+
+// loadCheckpoint returns the timestamp of the most recent event shown by a
+// previous watch of the named operation (or the zero time if there is none).
+func loadCheckpoint(name string) time.Time {
+	path, err := checkpointPath(name)
+	if err != nil {
+		return time.Time{}
+	}
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return time.Time{}
+	}
+	timestamp, _ := time.Parse(time.RFC3339Nano, strings.TrimSpace(string(raw)))
+	return timestamp
+}
+
+func saveCheckpoint(name, timestamp string) {
+	path, err := checkpointPath(name)
+	if err != nil {
+		fmt.Fprintf(stdout, "Failed to save watch checkpoint: %v\n", err)
+		return
+	}
+	if err := ioutil.WriteFile(path, []byte(timestamp), 0600); err != nil {
+		fmt.Fprintf(stdout, "Failed to save watch checkpoint: %v\n", err)
+	}
+}
+
+func removeCheckpoint(name string) {
+	if path, err := checkpointPath(name); err == nil {
+		os.Remove(path)
+	}
+}
+
+// formatTimestamp formats an event timestamp according to the --timestamps
+// flag.  Relative timestamps are measured from the operation creation time.
+func formatTimestamp(timestamp time.Time, createTime string) string {
+	switch *timestamps {
+	case "local":
+		return timestamp.Local().Format("15:04:05")
+	case "relative":
+		origin, err := time.Parse(time.RFC3339Nano, createTime)
+		if err != nil {
+			return timestamp.Format("15:04:05")
+		}
+		return "+" + timestamp.Sub(origin).Round(time.Second).String()
+	}
+	return timestamp.Format("15:04:05")
+}
+
+// estimateCost returns the approximate cost of the pipeline so far, based on
+// the time elapsed since the worker started.
+func estimateCost(metadata *genomics.Metadata) float64 {
+	start, err := time.Parse(time.RFC3339Nano, metadata.StartTime)
+	if err != nil || metadata.Pipeline == nil || metadata.Pipeline.Resources == nil {
+		return 0
+	}
+	end := time.Now()
+	if t, err := time.Parse(time.RFC3339Nano, metadata.EndTime); err == nil {
+		end = t
+	}
+	return common.EstimateCost(metadata.Pipeline.Resources.VirtualMachine, end.Sub(start))
+}
+
+// actionTiming records when an action started and stopped executing.
+type actionTiming struct {
+	id         int64
+	start, end time.Time
+	exitStatus int64
+	stopped    bool
+}
+
+func actionTimings(parsed []*events.Event) []*actionTiming {
+	var timings []*actionTiming
+	byID := make(map[int64]*actionTiming)
+	for _, event := range parsed {
+		switch details := event.Details.(type) {
+		case *genomics.ContainerStartedEvent:
+			timing := &actionTiming{id: details.ActionId, start: event.Timestamp}
+			byID[details.ActionId] = timing
+			timings = append(timings, timing)
+		case *genomics.ContainerStoppedEvent:
+			if timing, ok := byID[details.ActionId]; ok {
+				timing.end = event.Timestamp
+				timing.exitStatus = details.ExitStatus
+				timing.stopped = true
+			}
+		}
+	}
+	return timings
+}
+
+// pipelineAction returns the action of pipeline with the given ID, or nil if
+// there is no such action.
+func pipelineAction(pipeline *genomics.Pipeline, id int64) *genomics.Action {
+	if pipeline == nil || id < 1 || int(id) > len(pipeline.Actions) {
+		return nil
+	}
+	return pipeline.Actions[id-1]
+}
+
+func actionName(pipeline *genomics.Pipeline, id int64) string {
+	action := pipelineAction(pipeline, id)
+	if action == nil {
+		return ""
+	}
+	if action.Name != "" {
+		return action.Name
+	}
+	return action.ImageUri
+}
+
+// summaryFields are the fields of the action summary shown by default.
+var summaryFields = []string{"action", "name", "start", "end", "duration", "exit_status"}
+
+// summaryDefaults returns the fields of the action summary that are shown
+// unless --fields is given, which include the cost of each action with --cost.
+func summaryDefaults() []string {
+	if *cost {
+		return append(append([]string{}, summaryFields...), "cost_usd")
+	}
+	return summaryFields
+}
+
+func printSummary(metadata *genomics.Metadata) {
+	records := summaryRecords(metadata)
+	if len(records) == 0 {
+		return
+	}
+	out.Print(stdout, summaryDefaults(), records)
+}
+
+// summaryRecords returns a record describing the timing, exit status and
+// estimated cost of each action that has started.
+func summaryRecords(metadata *genomics.Metadata) []printer.Record {
+	var records []printer.Record
+	for _, timing := range actionTimings(events.ParseAll(metadata.Events)) {
+		end, duration, status := "-", "-", "running"
+		if timing.stopped {
+			end = timing.end.Format("15:04:05")
+			duration = timing.end.Sub(timing.start).Round(time.Second).String()
+			status = fmt.Sprintf("%d", timing.exitStatus)
+		}
+		records = append(records, printer.Record{
+			"action":      timing.id,
+			"name":        actionName(metadata.Pipeline, timing.id),
+			"start":       timing.start.Format("15:04:05"),
+			"end":         end,
+			"duration":    duration,
+			"exit_status": status,
+			"cost_usd":    math.Round(actionCost(metadata, timing)*10000) / 10000,
+		})
+	}
+	return records
+}
+
+// actionCost returns the approximate cost of the VM while the action was
+// running.  Since background actions run alongside other actions, the costs of
+// the actions do not add up to the cost of the pipeline, which also includes
+// the time spent starting the VM and pulling images.
+func actionCost(metadata *genomics.Metadata, timing *actionTiming) float64 {
+	if metadata.Pipeline == nil || metadata.Pipeline.Resources == nil {
+		return 0
+	}
+	end := timing.end
+	if !timing.stopped {
+		end = time.Now()
+		if t, err := time.Parse(time.RFC3339Nano, metadata.EndTime); err == nil {
+			end = t
+		}
+	}
+	return common.EstimateCost(metadata.Pipeline.Resources.VirtualMachine, end.Sub(timing.start))
+}
+
+// printMostExpensive shows which action accounted for the largest part of the
+// total cost.
+func printMostExpensive(metadata *genomics.Metadata, total float64) {
+	var most *actionTiming
+	var mostCost float64
+	for _, timing := range actionTimings(events.ParseAll(metadata.Events)) {
+		if c := actionCost(metadata, timing); most == nil || c > mostCost {
+			most, mostCost = timing, c
+		}
+	}
+	if most == nil || total <= 0 || mostCost > total {
+		return
+	}
+	fmt.Fprintf(stdout, "Most expensive action: %d (%s) at $%.2f (%.0f%% of the total)\n", most.id, actionName(metadata.Pipeline, most.id), mostCost, 100*mostCost/total)
+}
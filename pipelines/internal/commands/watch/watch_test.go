@@ -0,0 +1,272 @@
+package watch
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/googlegenomics/pipelines-tools/pipelines/events"
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/common"
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/fake"
+	genomics "google.golang.org/api/genomics/v2alpha1"
+)
+
+func TestActionCost(t *testing.T) {
+	start := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	vm := &genomics.VirtualMachine{MachineType: "n1-standard-4"}
+	metadata := &genomics.Metadata{
+		Pipeline: &genomics.Pipeline{Resources: &genomics.Resources{VirtualMachine: vm}},
+		EndTime:  start.Add(2 * time.Hour).Format(time.RFC3339Nano),
+	}
+
+	stopped := &actionTiming{start: start, end: start.Add(time.Hour), stopped: true}
+	if got, want := actionCost(metadata, stopped), common.HourlyCost(vm); math.Abs(got-want) > 1e-9 {
+		t.Errorf("Unexpected cost of stopped action: got %f, want %f", got, want)
+	}
+	running := &actionTiming{start: start}
+	if got, want := actionCost(metadata, running), 2*common.HourlyCost(vm); math.Abs(got-want) > 1e-9 {
+		t.Errorf("Unexpected cost of running action: got %f, want %f", got, want)
+	}
+}
+
+func TestRecommendation(t *testing.T) {
+	const kbPerGB = 1 << 20
+	testCases := []struct {
+		machineType string
+		peaks       resourcePeaks
+		want        string
+	}{
+		{
+			"n1-highmem-8",
+			resourcePeaks{cpuPercent: 40, memoryKB: 6.2 * kbPerGB, diskKB: 300 * kbPerGB},
+			"Peak usage: 3.2 of 8 CPUs, 6.2 of 52.0 GB memory and 300.0 of 500 GB disk on n1-highmem-8; n1-standard-4 would suffice (about 60% cheaper)",
+		},
+		{
+			"n1-standard-4",
+			resourcePeaks{cpuPercent: 60, memoryKB: 10 * kbPerGB, diskKB: 20 * kbPerGB},
+			"Peak usage: 2.4 of 4 CPUs, 10.0 of 15.0 GB memory and 20.0 of 500 GB disk on n1-standard-4; n1-standard-4 is a good fit; --disk-size 25 would be enough",
+		},
+		{
+			"n1-standard-2",
+			resourcePeaks{cpuPercent: 100, memoryKB: 1 * kbPerGB, diskKB: 300 * kbPerGB},
+			"Peak usage: 2.0 of 2 CPUs, 1.0 of 7.5 GB memory and 300.0 of 500 GB disk on n1-standard-2; the CPUs were saturated, so a larger machine type may be faster",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.machineType, func(t *testing.T) {
+			vm := &genomics.VirtualMachine{MachineType: tc.machineType}
+			if got := recommendation(vm, tc.peaks); got != tc.want {
+				t.Fatalf("Unexpected recommendation:\ngot  %q\nwant %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestProfileSummary(t *testing.T) {
+	stderr := "pipelines-monitor: cpu_percent=97 memory_kb=3145728 disk_kb=1048576\n" +
+		"pipelines-profile: samples=360 cpu_average=42.5 network_rx_bytes=2147483648 network_tx_bytes=536870912 path=gs://bucket/run.log.profile.csv\n"
+	parsed := []*events.Event{{Details: &genomics.ContainerStoppedEvent{ActionId: 5, Stderr: stderr}}}
+
+	peaks, ok := monitorPeaks(parsed)
+	if !ok {
+		t.Fatal("Failed to find the peaks")
+	}
+	if want := (resourcePeaks{cpuPercent: 97, memoryKB: 3145728, diskKB: 1048576}); peaks != want {
+		t.Fatalf("Unexpected peaks: got %+v, want %+v", peaks, want)
+	}
+
+	summary, ok := profileSummary(parsed)
+	if !ok {
+		t.Fatal("Failed to find the profile summary")
+	}
+	if want := "Average CPU usage: 42.5%; network: 2.00 GB received and 0.50 GB sent; 360 samples written to gs://bucket/run.log.profile.csv"; summary != want {
+		t.Fatalf("Unexpected summary:\ngot  %q\nwant %q", summary, want)
+	}
+}
+
+func TestLogPath(t *testing.T) {
+	testCases := []struct {
+		commands []string
+		want     string
+	}{
+		{[]string{"-c", "while true; do sleep 30; gsutil -q cp /google/logs/output gs://bucket/logs/output; done"}, "gs://bucket/logs/output"},
+		{[]string{"-c", "gsutil -q cp /google/logs/output gs://bucket/run.log"}, "gs://bucket/run.log"},
+		{[]string{"-c", "echo hello"}, ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.want, func(t *testing.T) {
+			pipeline := &genomics.Pipeline{Actions: []*genomics.Action{{ImageUri: "bash", Commands: tc.commands}}}
+			if got := logPath(pipeline); got != tc.want {
+				t.Fatalf("Unexpected path: got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func startOperation(t *testing.T) (*fake.Server, *genomics.Service, string) {
+	server := fake.NewServer()
+	service, err := genomics.New(http.DefaultClient)
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	service.BasePath = server.URL
+
+	req := &genomics.RunPipelineRequest{
+		Pipeline: &genomics.Pipeline{
+			Actions:   []*genomics.Action{{ImageUri: "bash", Commands: []string{"true"}}},
+			Resources: &genomics.Resources{ProjectId: "test"},
+		},
+	}
+	lro, err := service.Pipelines.Run(req).Do()
+	if err != nil {
+		t.Fatalf("Failed to start pipeline: %v", err)
+	}
+	return server, service, lro.Name
+}
+
+func TestWatchSurvivesInterruptions(t *testing.T) {
+	defer func(delay time.Duration) { initialDelay = delay }(initialDelay)
+	initialDelay = time.Millisecond
+
+	testCases := []struct {
+		name     string
+		failures []int
+		wantErr  bool
+	}{
+		{"no failures", nil, false},
+		{"outage", []int{http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusInternalServerError}, false},
+		{"rate limited", []int{http.StatusTooManyRequests, http.StatusTooManyRequests}, false},
+		{"permission denied", []int{http.StatusForbidden}, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server, service, name := startOperation(t)
+			defer server.Close()
+			server.FailGets(tc.failures...)
+
+			err := Invoke(context.Background(), service, "test", []string{"--summary=false", name})
+			if tc.wantErr && err == nil {
+				t.Fatal("Unexpected success")
+			}
+			if !tc.wantErr && err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestWatchStopsWhenCancelled(t *testing.T) {
+	defer func(delay time.Duration) { initialDelay = delay }(initialDelay)
+	initialDelay = time.Hour
+
+	server, service, name := startOperation(t)
+	defer server.Close()
+	server.FailGets(http.StatusServiceUnavailable)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, _, err := watch(ctx, service, name); err != context.DeadlineExceeded {
+		t.Fatalf("Unexpected error: got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("Waited %s after the context was cancelled", elapsed)
+	}
+}
+
+func TestPipelineAction(t *testing.T) {
+	pipeline := &genomics.Pipeline{Actions: []*genomics.Action{{ImageUri: "first"}, {ImageUri: "second"}}}
+	testCases := []struct {
+		pipeline *genomics.Pipeline
+		id       int64
+		want     string
+	}{
+		{pipeline, 1, "first"},
+		{pipeline, 2, "second"},
+		{pipeline, 0, ""},
+		{pipeline, -1, ""},
+		{pipeline, 3, ""},
+		{nil, 1, ""},
+	}
+	for _, tc := range testCases {
+		var got string
+		if action := pipelineAction(tc.pipeline, tc.id); action != nil {
+			got = action.ImageUri
+		}
+		if got != tc.want {
+			t.Errorf("pipelineAction(%d): got %q, want %q", tc.id, got, tc.want)
+		}
+	}
+}
+
+func TestSummaryRecords(t *testing.T) {
+	server := fake.NewServer()
+	defer server.Close()
+	service, err := genomics.New(http.DefaultClient)
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	service.BasePath = server.URL
+
+	type row struct {
+		action                     int64
+		name, duration, exitStatus string
+	}
+	testCases := []struct {
+		name    string
+		actions []*genomics.Action
+		result  string
+		want    []row
+	}{
+		{
+			name:    "succeeded",
+			actions: []*genomics.Action{{Name: "align", ImageUri: "bwa"}, {ImageUri: "samtools"}},
+			result:  "ok",
+			want:    []row{{1, "align", "1s", "0"}, {2, "samtools", "1s", "0"}},
+		},
+		{
+			name:    "failed",
+			actions: []*genomics.Action{{ImageUri: "bwa"}, {ImageUri: "samtools"}},
+			result:  "3",
+			want:    []row{{1, "bwa", "1s", "0"}, {2, "samtools", "1s", "3"}},
+		},
+		{
+			name:    "background",
+			actions: []*genomics.Action{{ImageUri: "monitor", Flags: []string{"RUN_IN_BACKGROUND"}}, {ImageUri: "bwa"}},
+			result:  "ok",
+			want:    []row{{1, "monitor", "-", "running"}, {2, "bwa", "1s", "0"}},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := &genomics.RunPipelineRequest{
+				Pipeline: &genomics.Pipeline{
+					Actions:     tc.actions,
+					Environment: map[string]string{fake.ResultsVariable: tc.result},
+					Resources:   &genomics.Resources{ProjectId: "test"},
+				},
+			}
+			lro, err := service.Pipelines.Run(req).Do()
+			if err != nil {
+				t.Fatalf("Failed to start pipeline: %v", err)
+			}
+			_, metadata, err := common.GetOperation(context.Background(), service, lro.Name)
+			if err != nil {
+				t.Fatalf("Failed to get operation: %v", err)
+			}
+
+			records := summaryRecords(metadata)
+			if len(records) != len(tc.want) {
+				t.Fatalf("Unexpected number of records: got %d, want %d", len(records), len(tc.want))
+			}
+			for i, want := range tc.want {
+				got := records[i]
+				if got["action"] != want.action || got["name"] != want.name || got["duration"] != want.duration || got["exit_status"] != want.exitStatus {
+					t.Errorf("Unexpected record %d: got %v, want %+v", i, got, want)
+				}
+			}
+		})
+	}
+}
@@ -4,16 +4,27 @@ package common
 import (
 	"flag"
 	"fmt"
+	"os"
+	"os/user"
 	"path"
+	"path/filepath"
 	"strings"
 
+	"github.com/googlegenomics/pipelines-tools/pipelines/events"
 	genomics "google.golang.org/api/genomics/v2alpha1"
 	"google.golang.org/genproto/googleapis/rpc/code"
 )
 
 // ExpandOperationName adds the project and operations prefixes to name (if
-// they are not already present).
+// they are not already present).  This allows operations to be named using
+// just their ID.  Quotes and surrounding space are removed, as is anything
+// before the 'projects/' prefix, so that names can be copied from log messages
+// or API URLs.
 func ExpandOperationName(project, name string) string {
+	name = strings.Trim(strings.TrimSpace(name), `"'`)
+	if i := strings.Index(name, "projects/"); i > 0 {
+		name = name[i:]
+	}
 	if !strings.HasPrefix(name, "projects/") {
 		if !strings.HasPrefix(name, "operations/") {
 			name = path.Join("operations/", name)
@@ -23,6 +34,25 @@ func ExpandOperationName(project, name string) string {
 	return name
 }
 
+// StatePath returns the path of the named file in the directory used to store
+// local state between invocations of the tool, creating the directory if
+// necessary.
+func StatePath(name string) (string, error) {
+	home := os.Getenv("HOME")
+	if home == "" {
+		u, err := user.Current()
+		if err != nil {
+			return "", fmt.Errorf("finding home directory: %v", err)
+		}
+		home = u.HomeDir
+	}
+	directory := filepath.Join(home, ".pipelines-tools")
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return "", fmt.Errorf("creating state directory: %v", err)
+	}
+	return filepath.Join(directory, name), nil
+}
+
 // ParseFlags calls parse on flags and collects non-flag arguments until there
 // are no non-flag arguments remaining.  This makes it possible to handle mixed
 // flag and non-flag arguments.
@@ -55,16 +85,150 @@ func (m *MapFlagValue) Set(input string) error {
 	return nil
 }
 
+// ListFlagValue is a flag value that collects every occurrence of a
+// repeatable flag.
+type ListFlagValue []string
+
+func (l *ListFlagValue) String() string {
+	return fmt.Sprintf("%v", []string(*l))
+}
+
+func (l *ListFlagValue) Set(input string) error {
+	*l = append(*l, input)
+	return nil
+}
+
+// Machine readable reasons for a pipeline execution failure.
+const (
+	ReasonActionFailed      = "ACTION_FAILED"
+	ReasonPreempted         = "PREEMPTED"
+	ReasonCancelled         = "CANCELLED"
+	ReasonTimeout           = "TIMEOUT"
+	ReasonResourceExhausted = "RESOURCE_EXHAUSTED"
+	ReasonFatal             = "FATAL"
+	ReasonOther             = "OTHER"
+)
+
 // PipelineExecutionError is an error returned by the Genomics API
 // during a pipeline execution
-type PipelineExecutionError genomics.Status
+type PipelineExecutionError struct {
+	genomics.Status
+
+	// ActionID is the (1-based) index of the action that failed, or zero if
+	// the failure could not be attributed to an action.
+	ActionID   int64
+	ActionName string
+
+	// ExitStatus and Stderr are taken from the failing container.
+	ExitStatus int64
+	Stderr     string
+
+	// Zone is the zone of the worker that ran the pipeline (if one was
+	// assigned).
+	Zone string
+
+	// Reason classifies the failure (one of the Reason constants).
+	Reason string
+
+	// Suggestions describe changes that might fix the failure.
+	Suggestions []string
+}
+
+// NewPipelineExecutionError creates an error from the final status of an
+// operation, using the operation metadata to find the action that failed and to
+// suggest possible fixes.
+func NewPipelineExecutionError(status *genomics.Status, metadata *genomics.Metadata) PipelineExecutionError {
+	err := PipelineExecutionError{Status: *status}
+
+	// Actions that run after the failure (such as cleanup actions and
+	// background actions that are killed) can also stop with a nonzero
+	// status, so the failed action is the one named by the unexpected exit
+	// status event, or else the first to stop with a nonzero status.
+	var (
+		unexpected *genomics.UnexpectedExitStatusEvent
+		stopped    = make(map[int64]*genomics.ContainerStoppedEvent)
+		firstStop  *genomics.ContainerStoppedEvent
+	)
+	for _, event := range events.ParseAll(metadata.Events) {
+		switch details := event.Details.(type) {
+		case *genomics.WorkerAssignedEvent:
+			err.Zone = details.Zone
+		case *genomics.UnexpectedExitStatusEvent:
+			if unexpected == nil {
+				unexpected = details
+			}
+		case *genomics.ContainerStoppedEvent:
+			if _, ok := stopped[details.ActionId]; !ok {
+				stopped[details.ActionId] = details
+			}
+			if details.ExitStatus != 0 && firstStop == nil {
+				firstStop = details
+			}
+		}
+	}
+	if unexpected != nil {
+		err.ActionID = unexpected.ActionId
+		err.ExitStatus = unexpected.ExitStatus
+	} else if firstStop != nil {
+		err.ActionID = firstStop.ActionId
+		err.ExitStatus = firstStop.ExitStatus
+	}
+	if stop, ok := stopped[err.ActionID]; ok && err.ActionID > 0 {
+		err.Stderr = stop.Stderr
+	}
+	if pipeline := metadata.Pipeline; pipeline != nil && err.ActionID > 0 && int(err.ActionID) <= len(pipeline.Actions) {
+		action := pipeline.Actions[err.ActionID-1]
+		err.ActionName = action.Name
+		if err.ActionName == "" {
+			err.ActionName = action.ImageUri
+		}
+	}
+	err.Reason = classify(err)
+	err.Suggestions = diagnose(err, metadata)
+	return err
+}
+
+func classify(err PipelineExecutionError) string {
+	switch code.Code(err.Code) {
+	case code.Code_CANCELLED:
+		return ReasonCancelled
+	case code.Code_DEADLINE_EXCEEDED:
+		return ReasonTimeout
+	case code.Code_RESOURCE_EXHAUSTED:
+		return ReasonResourceExhausted
+	case code.Code_ABORTED:
+		return ReasonPreempted
+	}
+	if err.ActionID > 0 {
+		return ReasonActionFailed
+	}
+	if fatalErrorCodes[code.Code(err.Code)] {
+		return ReasonFatal
+	}
+	return ReasonOther
+}
+
+// maxStderrLines is the number of trailing lines of standard error output
+// included in the error message.
+const maxStderrLines = 10
 
 func (err PipelineExecutionError) Error() string {
 	reason := code.Code_name[int32(err.Code)]
 	if reason == "" {
 		reason = fmt.Sprintf("unknown error code %d", err.Code)
 	}
-	return fmt.Sprintf("executing pipeline: %s (reason: %s)", err.Message, reason)
+	message := fmt.Sprintf("executing pipeline: %s (reason: %s)", err.Message, reason)
+	if err.ActionID > 0 {
+		message += fmt.Sprintf("\naction %d (%s) exited with status %d", err.ActionID, err.ActionName, err.ExitStatus)
+	}
+	if stderr := strings.TrimSpace(err.Stderr); stderr != "" {
+		lines := strings.Split(stderr, "\n")
+		if len(lines) > maxStderrLines {
+			lines = lines[len(lines)-maxStderrLines:]
+		}
+		message += "\n" + strings.Join(lines, "\n")
+	}
+	return message
 }
 
 var fatalErrorCodes = map[code.Code]bool{
@@ -78,8 +242,59 @@ var fatalErrorCodes = map[code.Code]bool{
 	code.Code_UNIMPLEMENTED:       true,
 }
 
+// Exit codes used by the pipelines tool to distinguish between classes of
+// failures.  Any other failure results in an exit code of 1.
+const (
+	ExitActionFailed      = 2
+	ExitPreempted         = 3
+	ExitCancelled         = 4
+	ExitTimeout           = 5
+	ExitResourceExhausted = 6
+)
+
+// ExitCode returns the exit code that should be used when the pipeline fails
+// with the current error.
+func (err PipelineExecutionError) ExitCode() int {
+	switch err.Reason {
+	case ReasonCancelled:
+		return ExitCancelled
+	case ReasonTimeout:
+		return ExitTimeout
+	case ReasonResourceExhausted:
+		return ExitResourceExhausted
+	case ReasonPreempted:
+		return ExitPreempted
+	case ReasonActionFailed:
+		return ExitActionFailed
+	}
+	return 1
+}
+
+// ExitError is an error that should cause the tool to exit with a specific
+// exit code.
+type ExitError struct {
+	Code int
+	Err  error
+}
+
+func (err ExitError) Error() string {
+	return err.Err.Error()
+}
+
+// ExitCode returns the exit code the tool should use when exiting because of
+// err.
+func ExitCode(err error) int {
+	switch err := err.(type) {
+	case ExitError:
+		return err.Code
+	case PipelineExecutionError:
+		return err.ExitCode()
+	}
+	return 1
+}
+
 // IsRetriable indicates if the user should retry the operation after receiving
 // the current error.
 func (err PipelineExecutionError) IsRetriable() bool {
-	return !fatalErrorCodes[code.Code(err.Code)]
+	return !fatalErrorCodes[code.Code(err.Code)] && err.Reason != ReasonCancelled
 }
@@ -0,0 +1,150 @@
+package common
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	genomics "google.golang.org/api/genomics/v2alpha1"
+)
+
+func TestExpandOperationName(t *testing.T) {
+	testCases := []struct {
+		input, want string
+	}{
+		{"1234", "projects/p/operations/1234"},
+		{"operations/1234", "projects/p/operations/1234"},
+		{"projects/other/operations/1234", "projects/other/operations/1234"},
+		{`"projects/p/operations/1234"`, "projects/p/operations/1234"},
+		{" 1234\n", "projects/p/operations/1234"},
+		{"https://genomics.googleapis.com/v2alpha1/projects/p/operations/1234", "projects/p/operations/1234"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.input, func(t *testing.T) {
+			if got := ExpandOperationName("p", tc.input); got != tc.want {
+				t.Fatalf("Unexpected result: got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	now := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		input string
+		want  time.Time
+	}{
+		{"2018-05-01T00:00:00Z", time.Date(2018, 5, 1, 0, 0, 0, 0, time.UTC)},
+		{"12h", time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)},
+		{"2d", time.Date(2018, 5, 30, 12, 0, 0, 0, time.UTC)},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.input, func(t *testing.T) {
+			got, err := ParseTime(tc.input, now)
+			if err != nil {
+				t.Fatalf("Failed to parse: %v", err)
+			}
+			if !got.Equal(tc.want) {
+				t.Fatalf("Unexpected time: got %v, want %v", got, tc.want)
+			}
+		})
+	}
+
+	if _, err := ParseTime("yesterday", now); err == nil {
+		t.Fatal("Expected an error for an invalid time")
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	testCases := []struct {
+		reason string
+		want   int
+	}{
+		{ReasonActionFailed, ExitActionFailed},
+		{ReasonPreempted, ExitPreempted},
+		{ReasonCancelled, ExitCancelled},
+		{ReasonTimeout, ExitTimeout},
+		{ReasonResourceExhausted, ExitResourceExhausted},
+		{ReasonFatal, 1},
+		{ReasonOther, 1},
+	}
+	for _, tc := range testCases {
+		if got := (PipelineExecutionError{Reason: tc.reason}).ExitCode(); got != tc.want {
+			t.Errorf("ExitCode(%s): got %d, want %d", tc.reason, got, tc.want)
+		}
+	}
+}
+
+func TestNewPipelineExecutionError(t *testing.T) {
+	stopped := func(action, status int64, stderr string) string {
+		return fmt.Sprintf(`{"@type": "type.googleapis.com/google.genomics.v2alpha1.ContainerStoppedEvent", "actionId": %d, "exitStatus": %d, "stderr": %q}`, action, status, stderr)
+	}
+	unexpected := func(action, status int64) string {
+		return fmt.Sprintf(`{"@type": "type.googleapis.com/google.genomics.v2alpha1.UnexpectedExitStatusEvent", "actionId": %d, "exitStatus": %d}`, action, status)
+	}
+
+	testCases := []struct {
+		name string
+		// details are the event details, from oldest to newest.
+		details        []string
+		wantAction     int64
+		wantExitStatus int64
+		wantStderr     string
+	}{
+		{
+			name:           "single failure",
+			details:        []string{stopped(1, 0, ""), stopped(2, 3, "oops"), unexpected(2, 3)},
+			wantAction:     2,
+			wantExitStatus: 3,
+			wantStderr:     "oops",
+		},
+		{
+			name:           "later always run action fails",
+			details:        []string{stopped(1, 3, "oops"), unexpected(1, 3), stopped(2, 1, "cleanup failed")},
+			wantAction:     1,
+			wantExitStatus: 3,
+			wantStderr:     "oops",
+		},
+		{
+			name:           "background action killed",
+			details:        []string{stopped(2, 137, "killed"), unexpected(1, 3), stopped(1, 3, "oops")},
+			wantAction:     1,
+			wantExitStatus: 3,
+			wantStderr:     "oops",
+		},
+		{
+			name:           "no unexpected exit status",
+			details:        []string{stopped(1, 3, "oops"), stopped(2, 1, "cleanup failed")},
+			wantAction:     1,
+			wantExitStatus: 3,
+			wantStderr:     "oops",
+		},
+		{
+			name:    "no failed action",
+			details: []string{stopped(1, 0, "")},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			metadata := &genomics.Metadata{
+				Pipeline: &genomics.Pipeline{
+					Actions: []*genomics.Action{{ImageUri: "first"}, {ImageUri: "second"}},
+				},
+			}
+			// The API returns events from newest to oldest.
+			for i := len(tc.details) - 1; i >= 0; i-- {
+				metadata.Events = append(metadata.Events, &genomics.Event{
+					Timestamp: time.Date(2018, 6, 1, 12, 0, i, 0, time.UTC).Format(time.RFC3339Nano),
+					Details:   []byte(tc.details[i]),
+				})
+			}
+
+			err := NewPipelineExecutionError(&genomics.Status{Code: 9, Message: "failed"}, metadata)
+			if err.ActionID != tc.wantAction || err.ExitStatus != tc.wantExitStatus || err.Stderr != tc.wantStderr {
+				t.Fatalf("Unexpected failure: got action %d (exit status %d, stderr %q), want action %d (exit status %d, stderr %q)",
+					err.ActionID, err.ExitStatus, err.Stderr, tc.wantAction, tc.wantExitStatus, tc.wantStderr)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// ConfigVariable is the name of the environment variable that overrides the
+// location of the configuration file.
+const ConfigVariable = "PIPELINES_TOOLS_CONFIG"
+
+// Config holds user settings read from the configuration file, which is a
+// JSON object stored in ~/.pipelines-tools/config.json (or the file named by
+// the PIPELINES_TOOLS_CONFIG environment variable).  For example:
+//
+//	{
+//	  "images": {
+//	    "samtools": "quay.io/biocontainers/samtools:1.19"
+//	  },
+//	  "cloudCommands": ["gcs-sync"],
+//	  "mutators": ["pipelines-site-defaults --team genomics"],
+//	  "policy": "/etc/pipelines/policy.json"
+//	}
+type Config struct {
+	// Images maps command names to the image used to run them when a script
+	// line (or --command) does not specify an image.
+	Images map[string]string `json:"images,omitempty"`
+
+	// CloudCommands lists additional commands (besides gsutil, gcloud and
+	// bq) that are run using the cloud SDK image.
+	CloudCommands []string `json:"cloudCommands,omitempty"`
+
+	// Mutators lists command lines that every run request is passed through
+	// before it is submitted (see the plugin package).
+	Mutators []string `json:"mutators,omitempty"`
+
+	// PreHooks and PostHooks list command lines that are run before a
+	// pipeline is submitted and after it finishes (in addition to the
+	// --pre-hook and --post-hook flags of the run command).
+	PreHooks  []string `json:"preHooks,omitempty"`
+	PostHooks []string `json:"postHooks,omitempty"`
+
+	// Policy is the path of a policy file that every run request is checked
+	// against before it is submitted (see the policy package).
+	Policy string `json:"policy,omitempty"`
+}
+
+// LoadConfig reads the configuration file.  A missing file results in an
+// empty configuration.
+func LoadConfig() (*Config, error) {
+	path := os.Getenv(ConfigVariable)
+	if path == "" {
+		var err error
+		if path, err = StatePath("config.json"); err != nil {
+			return nil, err
+		}
+	}
+
+	var config Config
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &config, nil
+		}
+		return nil, fmt.Errorf("reading configuration: %v", err)
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("parsing configuration %q: %v", path, err)
+	}
+	return &config, nil
+}
@@ -0,0 +1,265 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	genomics "google.golang.org/api/genomics/v2alpha1"
+)
+
+// The prices below are approximate on-demand list prices (in USD) for the
+// us-central1 region.  They are only intended to give users a rough idea of
+// how much a pipeline is costing and will drift from the real prices over
+// time.
+const (
+	cpuHourly           = 0.031611
+	memoryGBHourly      = 0.004237
+	preemptibleCPU      = 0.006655
+	preemptibleMemoryGB = 0.000892
+
+	hoursPerMonth = 730
+
+	// customPremium is the extra cost of the CPUs and memory of custom
+	// machine types compared to predefined ones.
+	customPremium = 1.05
+
+	defaultBootDiskSizeGb = 10
+)
+
+// DefaultDiskSizeGb is the size of disks that do not specify one.
+const DefaultDiskSizeGb = 500
+
+var (
+	gpuHourly = map[string]float64{
+		"nvidia-tesla-k80":  0.45,
+		"nvidia-tesla-p4":   0.60,
+		"nvidia-tesla-t4":   0.35,
+		"nvidia-tesla-p100": 1.46,
+		"nvidia-tesla-v100": 2.48,
+	}
+	preemptibleGPUHourly = map[string]float64{
+		"nvidia-tesla-k80":  0.135,
+		"nvidia-tesla-p4":   0.216,
+		"nvidia-tesla-t4":   0.11,
+		"nvidia-tesla-p100": 0.43,
+		"nvidia-tesla-v100": 0.74,
+	}
+	diskMonthlyGB = map[string]float64{
+		"":            0.04,
+		"pd-standard": 0.04,
+		"pd-ssd":      0.17,
+		"local-ssd":   0.08,
+	}
+
+	// memoryPerCPU maps each machine family and the class of its predefined
+	// machine types to the amount of memory (in GB) allocated per virtual
+	// CPU.
+	memoryPerCPU = map[string]map[string]float64{
+		"n1":  {"standard": 3.75, "highmem": 6.5, "highcpu": 0.9},
+		"n2":  {"standard": 4, "highmem": 8, "highcpu": 1},
+		"n2d": {"standard": 4, "highmem": 8, "highcpu": 1},
+		"e2":  {"standard": 4, "highmem": 8, "highcpu": 1},
+		"c2":  {"standard": 4},
+		"c2d": {"standard": 4, "highmem": 8, "highcpu": 2},
+		"t2d": {"standard": 4},
+	}
+
+	// sharedCoreShapes holds the shapes of the shared-core machine types,
+	// which do not follow the naming of the other predefined types.
+	sharedCoreShapes = map[string]struct {
+		cpus     int
+		memoryGB float64
+	}{
+		"f1-micro":  {1, 0.6},
+		"g1-small":  {1, 1.7},
+		"e2-micro":  {2, 1},
+		"e2-small":  {2, 2},
+		"e2-medium": {2, 4},
+	}
+)
+
+// predefinedCPUs lists the CPU counts of the predefined N1 machine types.
+var predefinedCPUs = []int{1, 2, 4, 8, 16, 32, 64, 96}
+
+// MachineShape returns the number of virtual CPUs and the amount of memory (in
+// GB) for the named machine type.  Predefined machine types of the families in
+// memoryPerCPU (e.g. n1-standard-4 or n2-highmem-8), shared-core machine
+// types and custom machine types (e.g. custom-2-8192, n2-custom-4-16384 or
+// custom-2-15360-ext) are supported.  The returned values are zero if the
+// machine type is not recognized.
+func MachineShape(machineType string) (cpus int, memoryGB float64) {
+	if shape, ok := sharedCoreShapes[machineType]; ok {
+		return shape.cpus, shape.memoryGB
+	}
+
+	parts := strings.Split(strings.TrimSuffix(machineType, "-ext"), "-")
+	if n := len(parts); n >= 3 && parts[n-3] == "custom" {
+		cpus, _ = strconv.Atoi(parts[n-2])
+		mb, _ := strconv.Atoi(parts[n-1])
+		return cpus, float64(mb) / 1024
+	}
+	if len(parts) != 3 {
+		return 0, 0
+	}
+	perCPU, ok := memoryPerCPU[parts[0]][parts[1]]
+	if !ok {
+		return 0, 0
+	}
+	cpus, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return 0, 0
+	}
+	return cpus, float64(cpus) * perCPU
+}
+
+// HourlyCost returns the estimated cost per hour of running the virtual
+// machine described by vm, including accelerators and attached disks.
+func HourlyCost(vm *genomics.VirtualMachine) float64 {
+	if vm == nil {
+		return 0
+	}
+
+	cpus, memory := MachineShape(vm.MachineType)
+	cost := float64(cpus)*cpuHourly + memory*memoryGBHourly
+	gpus := gpuHourly
+	if vm.Preemptible {
+		cost = float64(cpus)*preemptibleCPU + memory*preemptibleMemoryGB
+		gpus = preemptibleGPUHourly
+	}
+
+	if strings.Contains(vm.MachineType, "custom-") {
+		cost *= customPremium
+	}
+
+	for _, accelerator := range vm.Accelerators {
+		cost += float64(accelerator.Count) * gpus[accelerator.Type]
+	}
+
+	bootDiskSizeGb := vm.BootDiskSizeGb
+	if bootDiskSizeGb == 0 {
+		bootDiskSizeGb = defaultBootDiskSizeGb
+	}
+	cost += float64(bootDiskSizeGb) * diskMonthlyGB[""] / hoursPerMonth
+	for _, disk := range vm.Disks {
+		size := disk.SizeGb
+		if size == 0 {
+			size = DefaultDiskSizeGb
+		}
+		cost += float64(size) * diskMonthlyGB[disk.Type] / hoursPerMonth
+	}
+	return cost
+}
+
+// EstimateCost returns the estimated cost of running the virtual machine
+// described by vm for the given duration.
+func EstimateCost(vm *genomics.VirtualMachine, elapsed time.Duration) float64 {
+	return HourlyCost(vm) * elapsed.Hours()
+}
+
+// RecommendMachineType returns the predefined N1 machine type with at least
+// the given number of CPUs and amount of memory (in GB) that is the cheapest
+// to run with the other settings of vm.  It returns the empty string if no
+// machine type is large enough.
+func RecommendMachineType(vm *genomics.VirtualMachine, cpus float64, memoryGB float64) string {
+	var best string
+	var bestCost float64
+	for class := range memoryPerCPU["n1"] {
+		for _, n := range predefinedCPUs {
+			if n == 1 && class != "standard" {
+				continue
+			}
+			machineType := fmt.Sprintf("n1-%s-%d", class, n)
+			if _, memory := MachineShape(machineType); float64(n) < cpus || memory < memoryGB {
+				continue
+			}
+			candidate := *vm
+			candidate.MachineType = machineType
+			if cost := HourlyCost(&candidate); best == "" || cost < bestCost {
+				best, bestCost = machineType, cost
+			}
+		}
+	}
+	return best
+}
+
+// CustomMachineType returns the smallest custom N1 machine type with at least
+// the given number of CPUs and amount of memory (in GB), or the empty string if
+// there is no such machine type.  Custom machine types have one or an even
+// number of CPUs (up to 96) and between 0.9 and 6.5GB of memory per CPU, in
+// multiples of 256MB.
+func CustomMachineType(cpus, memoryGB float64) string {
+	n := int(math.Ceil(math.Max(cpus, memoryGB/memoryPerCPU["n1"]["highmem"])))
+	if n < 1 {
+		n = 1
+	}
+	if n > 1 && n%2 == 1 {
+		n++
+	}
+	if n > predefinedCPUs[len(predefinedCPUs)-1] {
+		return ""
+	}
+
+	mb := math.Max(memoryGB, float64(n)*memoryPerCPU["n1"]["highcpu"]) * 1024
+	return fmt.Sprintf("custom-%d-%d", n, int(math.Ceil(mb/256))*256)
+}
+
+// ExactCustomMachineType returns the custom N1 machine type with exactly the
+// given number of CPUs and amount of memory (in GB), or an error describing
+// the constraint on custom machine types (see CustomMachineType) that they
+// violate.
+func ExactCustomMachineType(cpus int, memoryGB float64) (string, error) {
+	maxCPUs := predefinedCPUs[len(predefinedCPUs)-1]
+	switch {
+	case cpus < 1 || cpus > maxCPUs:
+		return "", fmt.Errorf("custom machine types have between 1 and %d CPUs, not %d", maxCPUs, cpus)
+	case cpus > 1 && cpus%2 == 1:
+		return "", fmt.Errorf("custom machine types have 1 or an even number of CPUs, not %d", cpus)
+	}
+
+	mb := memoryGB * 1024
+	if mb != math.Trunc(mb) || int(mb)%256 != 0 {
+		return "", fmt.Errorf("the memory of custom machine types must be a multiple of 0.25GB, not %gGB", memoryGB)
+	}
+	min, max := float64(cpus)*memoryPerCPU["n1"]["highcpu"], float64(cpus)*memoryPerCPU["n1"]["highmem"]
+	if memoryGB < min || memoryGB > max {
+		return "", fmt.Errorf("custom machine types with %d CPUs have between %gGB and %gGB of memory, not %gGB", cpus, min, max, memoryGB)
+	}
+	return fmt.Sprintf("custom-%d-%d", cpus, int(mb)), nil
+}
+
+// CheapestMachineType returns the predefined or custom N1 machine type with at
+// least the given number of CPUs and amount of memory (in GB) that is the
+// cheapest to run with the other settings of vm, or the empty string if there
+// is no such machine type.
+func CheapestMachineType(vm *genomics.VirtualMachine, cpus, memoryGB float64) string {
+	var best string
+	var bestCost float64
+	for _, machineType := range []string{RecommendMachineType(vm, cpus, memoryGB), CustomMachineType(cpus, memoryGB)} {
+		if machineType == "" {
+			continue
+		}
+		candidate := *vm
+		candidate.MachineType = machineType
+		if cost := HourlyCost(&candidate); best == "" || cost < bestCost {
+			best, bestCost = machineType, cost
+		}
+	}
+	return best
+}
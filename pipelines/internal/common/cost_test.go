@@ -0,0 +1,136 @@
+package common
+
+import (
+	"fmt"
+	"testing"
+
+	genomics "google.golang.org/api/genomics/v2alpha1"
+)
+
+func TestMachineShape(t *testing.T) {
+	testCases := []struct {
+		machineType string
+		cpus        int
+		memoryGB    float64
+	}{
+		{"n1-standard-4", 4, 15},
+		{"n1-highmem-2", 2, 13},
+		{"n1-highcpu-8", 8, 7.2},
+		{"custom-2-8192", 2, 8},
+		{"n1-custom-6-23040", 6, 22.5},
+		{"n2-standard-4", 4, 16},
+		{"n2d-highcpu-16", 16, 16},
+		{"e2-highmem-2", 2, 16},
+		{"c2-standard-8", 8, 32},
+		{"e2-medium", 2, 4},
+		{"f1-micro", 1, 0.6},
+		{"n2-custom-4-16384", 4, 16},
+		{"custom-2-15360-ext", 2, 15},
+		{"m1-ultramem-40", 0, 0},
+		{"n1-megamem-4", 0, 0},
+		{"unknown", 0, 0},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.machineType, func(t *testing.T) {
+			cpus, memory := MachineShape(tc.machineType)
+			if cpus != tc.cpus || memory != tc.memoryGB {
+				t.Fatalf("Unexpected result: got (%d, %v), want (%d, %v)", cpus, memory, tc.cpus, tc.memoryGB)
+			}
+		})
+	}
+}
+
+func TestRecommendMachineType(t *testing.T) {
+	testCases := []struct {
+		cpus, memoryGB float64
+		want           string
+	}{
+		{0.5, 1, "n1-standard-1"},
+		{1.5, 1, "n1-highcpu-2"},
+		{2, 7, "n1-standard-2"},
+		{2, 12, "n1-highmem-2"},
+		{3, 20, "n1-highmem-4"},
+		{100, 1, ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.want, func(t *testing.T) {
+			vm := &genomics.VirtualMachine{MachineType: "n1-standard-8"}
+			if got := RecommendMachineType(vm, tc.cpus, tc.memoryGB); got != tc.want {
+				t.Fatalf("Unexpected result: got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCustomMachineType(t *testing.T) {
+	testCases := []struct {
+		cpus, memoryGB float64
+		want           string
+	}{
+		{1, 1, "custom-1-1024"},
+		{1, 0.5, "custom-1-1024"},
+		{3, 4, "custom-4-4096"},
+		{2, 10.1, "custom-2-10496"},
+		{1, 13, "custom-2-13312"},
+		{1, 14, "custom-4-14336"},
+		{97, 1, ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.want, func(t *testing.T) {
+			if got := CustomMachineType(tc.cpus, tc.memoryGB); got != tc.want {
+				t.Fatalf("Unexpected result: got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestExactCustomMachineType(t *testing.T) {
+	testCases := []struct {
+		cpus     int
+		memoryGB float64
+		want     string
+		wantErr  bool
+	}{
+		{1, 1, "custom-1-1024", false},
+		{4, 15, "custom-4-15360", false},
+		{6, 5.5, "custom-6-5632", false},
+		{96, 624, "custom-96-638976", false},
+		{0, 1, "", true},
+		{3, 8, "", true},
+		{98, 100, "", true},
+		{2, 10.1, "", true},
+		{2, 1.5, "", true},
+		{2, 13.5, "", true},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%d-%g", tc.cpus, tc.memoryGB), func(t *testing.T) {
+			got, err := ExactCustomMachineType(tc.cpus, tc.memoryGB)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Unexpected error: got %v, want error %t", err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Fatalf("Unexpected result: got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCheapestMachineType(t *testing.T) {
+	testCases := []struct {
+		cpus, memoryGB float64
+		want           string
+	}{
+		{4, 15, "n1-standard-4"},
+		{4, 3.6, "n1-highcpu-4"},
+		{4, 4, "custom-4-4096"},
+		{2, 20, "custom-4-20480"},
+		{16, 10, "n1-highcpu-16"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.want, func(t *testing.T) {
+			if got := CheapestMachineType(&genomics.VirtualMachine{}, tc.cpus, tc.memoryGB); got != tc.want {
+				t.Fatalf("Unexpected result: got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
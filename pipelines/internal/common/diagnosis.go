@@ -0,0 +1,158 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	"github.com/googlegenomics/pipelines-tools/pipelines/events"
+	genomics "google.golang.org/api/genomics/v2alpha1"
+)
+
+var (
+	bucketPattern = regexp.MustCompile(`gs://([a-z0-9][a-z0-9._-]*)`)
+	quotaPattern  = regexp.MustCompile(`[Qq]uota '?"?([A-Z0-9_]+)'?"? exceeded`)
+)
+
+// diagnose returns suggestions for fixing the failure described by err, using
+// the pipeline in metadata for details such as the service account and the
+// machine type.
+func diagnose(err PipelineExecutionError, metadata *genomics.Metadata) []string {
+	// The failure details can appear in the operation error, the standard
+	// error of the failed action or the description of a failure event.
+	texts := []string{err.Message, err.Stderr}
+	for _, event := range events.ParseAll(metadata.Events) {
+		if event.IsFailure() {
+			texts = append(texts, event.Description)
+		}
+	}
+	text := strings.Join(texts, "\n")
+	lower := strings.ToLower(text)
+
+	vm := &genomics.VirtualMachine{}
+	if pipeline := metadata.Pipeline; pipeline != nil && pipeline.Resources != nil && pipeline.Resources.VirtualMachine != nil {
+		vm = pipeline.Resources.VirtualMachine
+	}
+
+	var suggestions []string
+	switch {
+	case strings.Contains(lower, "quota"):
+		quota := "A quota"
+		if m := quotaPattern.FindStringSubmatch(text); m != nil {
+			quota = fmt.Sprintf("The %s quota", m[1])
+		}
+		where := ""
+		if err.Zone != "" {
+			where = fmt.Sprintf(" in %s", err.Zone)
+		}
+		suggestions = append(suggestions, fmt.Sprintf("%s was exceeded%s: request more at https://console.cloud.google.com/iam-admin/quotas or run in other regions with --regions", quota, where))
+	case err.Reason == ReasonResourceExhausted:
+		suggestions = append(suggestions, "The zone ran out of resources: retry in more zones with --zones or --regions")
+	}
+
+	if isPermissionDenied(lower) {
+		account := "the Compute Engine default service account"
+		if vm.ServiceAccount != nil && vm.ServiceAccount.Email != "" && vm.ServiceAccount.Email != "default" {
+			account = vm.ServiceAccount.Email
+		}
+		buckets := make(map[string]bool)
+		for _, m := range bucketPattern.FindAllStringSubmatch(text, -1) {
+			if !buckets[m[1]] {
+				buckets[m[1]] = true
+				suggestions = append(suggestions, fmt.Sprintf("Grant roles/storage.objectAdmin on gs://%s to %s", m[1], account))
+			}
+		}
+		if len(buckets) == 0 {
+			suggestions = append(suggestions, fmt.Sprintf("Check that %s has access to the inputs and outputs (and the storage scopes with --scopes)", account))
+		}
+	}
+
+	if isPullFailure(lower) {
+		image := "the image"
+		if pipeline := metadata.Pipeline; pipeline != nil && err.ActionID > 0 && int(err.ActionID) <= len(pipeline.Actions) {
+			image = fmt.Sprintf("%q", pipeline.Actions[err.ActionID-1].ImageUri)
+		}
+		suggestions = append(suggestions, fmt.Sprintf("Check that %s exists and can be read by the VM service account (private images need roles/storage.objectViewer on the registry bucket)", image))
+	}
+
+	if (err.ActionID > 0 && err.ExitStatus == 137) || isOutOfMemory(lower) {
+		cpus, memory := MachineShape(vm.MachineType)
+		if machineType := CheapestMachineType(vm, float64(cpus), memory*2); machineType != "" && cpus > 0 {
+			suggestions = append(suggestions, fmt.Sprintf("The action may have run out of memory: retry with --machine-type %s (or use --escalate-memory)", machineType))
+		} else {
+			suggestions = append(suggestions, "The action may have run out of memory: retry with a larger --machine-type (or use --escalate-memory)")
+		}
+	}
+
+	if strings.Contains(lower, "no space left on device") {
+		size := int64(DefaultDiskSizeGb)
+		for _, disk := range vm.Disks {
+			if disk.SizeGb > 0 {
+				size = disk.SizeGb
+			}
+		}
+		suggestions = append(suggestions, fmt.Sprintf("The disk was full: retry with --disk-size %d (or use --escalate-disk)", size*2))
+	}
+
+	switch err.Reason {
+	case ReasonPreempted:
+		suggestions = append(suggestions, "The VM was preempted: allow more attempts with --pvm-attempts, or use a standard VM with --attempts")
+	case ReasonTimeout:
+		suggestions = append(suggestions, "The pipeline timed out: increase --timeout (or the per-action timeouts)")
+	}
+	return suggestions
+}
+
+func isPermissionDenied(text string) bool {
+	for _, s := range []string{"permission denied", "permission_denied", "accessdenied", "forbidden", "does not have storage."} {
+		if strings.Contains(text, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func isOutOfMemory(text string) bool {
+	for _, s := range []string{"out of memory", "oomkilled", "oom-kill", "oom killer"} {
+		if strings.Contains(text, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func isPullFailure(text string) bool {
+	for _, s := range []string{"failed to pull", "pull access denied", "manifest unknown", "image not found", "error pulling image"} {
+		if strings.Contains(text, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// PrintSuggestions writes the suggestions for fixing err (if there are any)
+// to w.
+func PrintSuggestions(w io.Writer, err PipelineExecutionError) {
+	if len(err.Suggestions) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "Suggestions:")
+	for _, suggestion := range err.Suggestions {
+		fmt.Fprintf(w, "- %s\n", suggestion)
+	}
+}
@@ -0,0 +1,72 @@
+package common
+
+import (
+	"reflect"
+	"testing"
+
+	genomics "google.golang.org/api/genomics/v2alpha1"
+	"google.golang.org/genproto/googleapis/rpc/code"
+)
+
+func TestDiagnose(t *testing.T) {
+	metadata := &genomics.Metadata{
+		Pipeline: &genomics.Pipeline{
+			Actions: []*genomics.Action{{ImageUri: "gcr.io/my-project/tool"}},
+			Resources: &genomics.Resources{
+				VirtualMachine: &genomics.VirtualMachine{
+					MachineType:    "n1-standard-2",
+					ServiceAccount: &genomics.ServiceAccount{Email: "runner@my-project.iam.gserviceaccount.com"},
+				},
+			},
+		},
+	}
+
+	testCases := []struct {
+		name string
+		err  PipelineExecutionError
+		want []string
+	}{
+		{
+			"quota",
+			PipelineExecutionError{Status: genomics.Status{Code: int64(code.Code_RESOURCE_EXHAUSTED), Message: "Quota 'CPUS' exceeded.  Limit: 24.0 in region us-central1."}, Zone: "us-central1-f", Reason: ReasonResourceExhausted},
+			[]string{"The CPUS quota was exceeded in us-central1-f: request more at https://console.cloud.google.com/iam-admin/quotas or run in other regions with --regions"},
+		},
+		{
+			"bucket",
+			PipelineExecutionError{ActionID: 1, ExitStatus: 1, Stderr: "AccessDeniedException: 403 runner@my-project.iam.gserviceaccount.com does not have storage.objects.get access to gs://inputs/sample.bam.", Reason: ReasonActionFailed},
+			[]string{"Grant roles/storage.objectAdmin on gs://inputs to runner@my-project.iam.gserviceaccount.com"},
+		},
+		{
+			"image",
+			PipelineExecutionError{Status: genomics.Status{Message: `Failed to pull image "gcr.io/my-project/tool": manifest unknown`}, ActionID: 1, Reason: ReasonActionFailed},
+			[]string{`Check that "gcr.io/my-project/tool" exists and can be read by the VM service account (private images need roles/storage.objectViewer on the registry bucket)`},
+		},
+		{
+			"memory",
+			PipelineExecutionError{ActionID: 1, ExitStatus: 137, Reason: ReasonActionFailed},
+			[]string{"The action may have run out of memory: retry with --machine-type n1-standard-4 (or use --escalate-memory)"},
+		},
+		{
+			"disk",
+			PipelineExecutionError{ActionID: 1, ExitStatus: 1, Stderr: "cp: write error: No space left on device", Reason: ReasonActionFailed},
+			[]string{"The disk was full: retry with --disk-size 1000 (or use --escalate-disk)"},
+		},
+		{
+			"preempted",
+			PipelineExecutionError{Status: genomics.Status{Code: int64(code.Code_ABORTED)}, Reason: ReasonPreempted},
+			[]string{"The VM was preempted: allow more attempts with --pvm-attempts, or use a standard VM with --attempts"},
+		},
+		{
+			"unknown",
+			PipelineExecutionError{ActionID: 1, ExitStatus: 2, Stderr: "usage: tool [options]", Reason: ReasonActionFailed},
+			nil,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := diagnose(tc.err, metadata); !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("Unexpected suggestions: got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,292 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/googleapi"
+	storage "google.golang.org/api/storage/v1"
+)
+
+// ErrConflict is returned by the conditional object functions when the object
+// has been modified (or deleted) by someone else.
+var ErrConflict = errors.New("the object was modified concurrently")
+
+// EmulatorVariable is the environment variable that, when set, holds the
+// address (host:port) of a GCS emulator to use instead of the real service, as
+// with the Cloud client libraries.
+const EmulatorVariable = "STORAGE_EMULATOR_HOST"
+
+// NewStorageService returns an authenticated client for the GCS JSON API.
+func NewStorageService(ctx context.Context) (*storage.Service, error) {
+	if host := os.Getenv(EmulatorVariable); host != "" {
+		service, err := storage.New(http.DefaultClient)
+		if err != nil {
+			return nil, fmt.Errorf("creating storage service: %v", err)
+		}
+		if !strings.Contains(host, "://") {
+			host = "http://" + host
+		}
+		service.BasePath = strings.TrimRight(host, "/") + "/storage/v1/"
+		return service, nil
+	}
+
+	client, err := google.DefaultClient(ctx, storage.DevstorageReadWriteScope)
+	if err != nil {
+		return nil, fmt.Errorf("creating storage client: %v", err)
+	}
+	service, err := storage.New(client)
+	if err != nil {
+		return nil, fmt.Errorf("creating storage service: %v", err)
+	}
+	return service, nil
+}
+
+// ParseGCSPath splits a path of the form gs://bucket/object into the bucket
+// and object names.
+func ParseGCSPath(path string) (bucket, object string, err error) {
+	parsed, err := url.Parse(path)
+	if err != nil {
+		return "", "", fmt.Errorf("parsing %q: %v", path, err)
+	}
+	if parsed.Scheme != "gs" || parsed.Host == "" {
+		return "", "", fmt.Errorf("%q is not a GCS path", path)
+	}
+	return parsed.Host, strings.TrimPrefix(parsed.Path, "/"), nil
+}
+
+// ReadObject returns the contents of the GCS object at path.
+func ReadObject(ctx context.Context, service *storage.Service, path string) ([]byte, error) {
+	bucket, object, err := ParseGCSPath(path)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := service.Objects.Get(bucket, object).Context(ctx).Download()
+	if err != nil {
+		return nil, fmt.Errorf("reading %q: %v", path, err)
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+// WriteObject replaces the contents of the GCS object at path with data.
+func WriteObject(ctx context.Context, service *storage.Service, path string, data []byte) error {
+	bucket, object, err := ParseGCSPath(path)
+	if err != nil {
+		return err
+	}
+	call := service.Objects.Insert(bucket, &storage.Object{Name: object})
+	if _, err := call.Media(bytes.NewReader(data)).Context(ctx).Do(); err != nil {
+		return fmt.Errorf("writing %q: %v", path, err)
+	}
+	return nil
+}
+
+// DeleteObject deletes the GCS object at path.
+func DeleteObject(ctx context.Context, service *storage.Service, path string) error {
+	bucket, object, err := ParseGCSPath(path)
+	if err != nil {
+		return err
+	}
+	if err := service.Objects.Delete(bucket, object).Context(ctx).Do(); err != nil {
+		return fmt.Errorf("deleting %q: %v", path, err)
+	}
+	return nil
+}
+
+// ReadObjectGeneration returns the contents of the GCS object at path along
+// with its generation number.
+func ReadObjectGeneration(ctx context.Context, service *storage.Service, path string) ([]byte, int64, error) {
+	bucket, object, err := ParseGCSPath(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := service.Objects.Get(bucket, object).Context(ctx).Download()
+	if err != nil {
+		return nil, 0, fmt.Errorf("reading %q: %v", path, err)
+	}
+	defer resp.Body.Close()
+	generation, err := strconv.ParseInt(resp.Header.Get("X-Goog-Generation"), 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("reading %q: invalid generation: %v", path, err)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, fmt.Errorf("reading %q: %v", path, err)
+	}
+	return data, generation, nil
+}
+
+// WriteObjectIfGeneration replaces the contents of the GCS object at path with
+// data, provided that the object has not been modified since it had the given
+// generation.  If generation is zero, the object is written unconditionally.
+// The generation of the new contents is returned.
+func WriteObjectIfGeneration(ctx context.Context, service *storage.Service, path string, data []byte, generation int64) (int64, error) {
+	bucket, object, err := ParseGCSPath(path)
+	if err != nil {
+		return 0, err
+	}
+	call := service.Objects.Insert(bucket, &storage.Object{Name: object})
+	if generation != 0 {
+		call.IfGenerationMatch(generation)
+	}
+	written, err := call.Media(bytes.NewReader(data)).Context(ctx).Do()
+	if err != nil {
+		if err, ok := err.(*googleapi.Error); ok && err.Code == http.StatusPreconditionFailed {
+			return 0, ErrConflict
+		}
+		return 0, fmt.Errorf("writing %q: %v", path, err)
+	}
+	return written.Generation, nil
+}
+
+// DeleteObjectIfGeneration deletes the GCS object at path, provided that it
+// still has the given generation (or unconditionally if generation is zero).
+func DeleteObjectIfGeneration(ctx context.Context, service *storage.Service, path string, generation int64) error {
+	bucket, object, err := ParseGCSPath(path)
+	if err != nil {
+		return err
+	}
+	call := service.Objects.Delete(bucket, object)
+	if generation != 0 {
+		call.IfGenerationMatch(generation)
+	}
+	if err := call.Context(ctx).Do(); err != nil {
+		if err, ok := err.(*googleapi.Error); ok && (err.Code == http.StatusPreconditionFailed || err.Code == http.StatusNotFound) {
+			return ErrConflict
+		}
+		return fmt.Errorf("deleting %q: %v", path, err)
+	}
+	return nil
+}
+
+// ListOutput returns the objects written to a single output destination, which
+// may be a directory ('/*') or a tree ('/**').
+func ListOutput(ctx context.Context, service *storage.Service, output string) ([]*storage.Object, error) {
+	bucket, name, err := ParseGCSPath(strings.TrimRight(output, "*"))
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.HasSuffix(output, "*") {
+		object, err := service.Objects.Get(bucket, name).Context(ctx).Do()
+		if err, ok := err.(*googleapi.Error); ok && err.Code == http.StatusNotFound {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("getting %q: %v", output, err)
+		}
+		return []*storage.Object{object}, nil
+	}
+
+	var objects []*storage.Object
+	call := service.Objects.List(bucket).Prefix(name)
+	if !strings.HasSuffix(output, "**") {
+		call = call.Delimiter("/")
+	}
+	err = call.Pages(ctx, func(resp *storage.Objects) error {
+		objects = append(objects, resp.Items...)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing %q: %v", output, err)
+	}
+	return objects, nil
+}
+
+// DownloadOutput downloads an object written to the output destination into
+// dir.  Objects written to a directory or tree are downloaded to the same
+// relative path under dir.  It returns the name of the downloaded file, or the
+// empty string if the object is a directory placeholder (a name ending in
+// '/'), which is skipped.
+//
+// The written map records the files downloaded so far (and the objects they
+// came from): an error is returned instead of overwriting one of them with a
+// different object.  It may be nil if the caller downloads a single object.
+func DownloadOutput(ctx context.Context, service *storage.Service, output string, object *storage.Object, dir string, written map[string]string) (string, error) {
+	if strings.HasSuffix(object.Name, "/") {
+		return "", nil
+	}
+	filename, err := OutputFilename(output, object.Name, dir)
+	if err != nil {
+		return "", err
+	}
+	source := fmt.Sprintf("gs://%s/%s", object.Bucket, object.Name)
+	if previous, ok := written[filename]; ok && previous != source {
+		return "", fmt.Errorf("both %q and %q would be downloaded to %q", previous, source, filename)
+	}
+	if written != nil {
+		written[filename] = source
+	}
+
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return "", fmt.Errorf("creating directory: %v", err)
+	}
+
+	resp, err := service.Objects.Get(object.Bucket, object.Name).Context(ctx).Download()
+	if err != nil {
+		return "", fmt.Errorf("downloading %q: %v", object.Name, err)
+	}
+	defer resp.Body.Close()
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return "", fmt.Errorf("creating file: %v", err)
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		return "", fmt.Errorf("writing %q: %v", filename, err)
+	}
+	return filename, f.Close()
+}
+
+// OutputFilename returns the name of the file under dir that the named object,
+// written to the output destination, is downloaded to.  An error is returned if
+// the file would be outside dir (for example, because the object name contains
+// '..').
+func OutputFilename(output, name, dir string) (string, error) {
+	filename := filepath.Join(dir, filepath.FromSlash(relativeName(output, name)))
+	rel, err := filepath.Rel(dir, filename)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("object %q cannot be downloaded into %q", name, dir)
+	}
+	return filename, nil
+}
+
+// relativeName returns the name of an object relative to the output
+// destination it was written to.
+func relativeName(output, name string) string {
+	if strings.HasSuffix(output, "*") {
+		_, prefix, err := ParseGCSPath(strings.TrimRight(output, "*"))
+		if err == nil && strings.HasPrefix(name, prefix) {
+			return strings.TrimPrefix(name, prefix)
+		}
+	}
+	return path.Base(name)
+}
@@ -0,0 +1,41 @@
+package common
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestOutputFilename(t *testing.T) {
+	dir := filepath.FromSlash("/tmp/outputs")
+	testCases := []struct {
+		output, name string
+		want         string
+		wantErr      bool
+	}{
+		{"gs://bucket/out.txt", "out.txt", "/tmp/outputs/out.txt", false},
+		{"gs://bucket/a/b/out.txt", "a/b/out.txt", "/tmp/outputs/out.txt", false},
+		{"gs://bucket/dir/*", "dir/file.txt", "/tmp/outputs/file.txt", false},
+		{"gs://bucket/dir/**", "dir/sub/file.txt", "/tmp/outputs/sub/file.txt", false},
+		{"gs://bucket/dir/**", "dir/sub/../file.txt", "/tmp/outputs/file.txt", false},
+		{"gs://bucket/dir/**", "dir/../../etc/passwd", "", true},
+		{"gs://bucket/dir/**", "dir/..", "", true},
+		{"gs://bucket/dir/**", "dir/", "", true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := OutputFilename(tc.output, tc.name, dir)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("Expected an error, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if want := filepath.FromSlash(tc.want); got != want {
+				t.Fatalf("Unexpected filename: got %q, want %q", got, want)
+			}
+		})
+	}
+}
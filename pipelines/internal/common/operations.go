@@ -0,0 +1,274 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	genomics "google.golang.org/api/genomics/v2alpha1"
+	"google.golang.org/genproto/googleapis/rpc/code"
+)
+
+// GetOperation fetches the named operation and decodes its metadata.
+func GetOperation(ctx context.Context, service *genomics.Service, name string) (*genomics.Operation, *genomics.Metadata, error) {
+	lro, err := service.Projects.Operations.Get(name).Context(ctx).Do()
+	if err != nil {
+		return nil, nil, fmt.Errorf("getting operation: %v", err)
+	}
+	var metadata genomics.Metadata
+	if err := json.Unmarshal(lro.Metadata, &metadata); err != nil {
+		return nil, nil, fmt.Errorf("parsing metadata: %v", err)
+	}
+	return lro, &metadata, nil
+}
+
+// OperationStatus returns a short description of the state of an operation:
+// one of running, succeeded, cancelled or failed.
+func OperationStatus(lro *genomics.Operation) string {
+	switch {
+	case !lro.Done:
+		return "running"
+	case lro.Error == nil:
+		return "succeeded"
+	case code.Code(lro.Error.Code) == code.Code_CANCELLED:
+		return "cancelled"
+	}
+	return "failed"
+}
+
+// ResolveOperation returns the full name of the operation identified by
+// target, which is either an operation name or ID (see ExpandOperationName) or
+// a label selector such as 'name=nightly' (or 'name=nightly,stage=align'),
+// which identifies the most recently created operation with the labels.
+func ResolveOperation(ctx context.Context, service *genomics.Service, project, target string) (string, error) {
+	if !IsLabelSelector(target) {
+		return ExpandOperationName(project, target), nil
+	}
+	labels, err := parseLabelSelector(target)
+	if err != nil {
+		return "", err
+	}
+	name, err := LatestOperation(ctx, service, project, LabelFilter(labels))
+	if err != nil {
+		return "", fmt.Errorf("resolving %q: %v", target, err)
+	}
+	return name, nil
+}
+
+// IsLabelSelector returns true if target is a label selector rather than the
+// name or ID of an operation.
+func IsLabelSelector(target string) bool {
+	return strings.Contains(target, "=") && !strings.Contains(target, "/")
+}
+
+func parseLabelSelector(selector string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, term := range strings.Split(selector, ",") {
+		parts := strings.SplitN(term, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid label selector %q", selector)
+		}
+		labels[parts[0]] = parts[1]
+	}
+	return labels, nil
+}
+
+// maxLatestPages bounds the number of pages of operations that
+// LatestOperation fetches while looking for a match.
+const maxLatestPages = 10
+
+// LatestOperation returns the name of the most recently created operation in
+// project that matches filter.  Operations are listed newest first, so only
+// the first page that contains a matching operation is examined.
+func LatestOperation(ctx context.Context, service *genomics.Service, project, filter string) (string, error) {
+	call := service.Projects.Operations.List(fmt.Sprintf("projects/%s/operations", project)).Context(ctx)
+	if filter != "" {
+		call = call.Filter(filter)
+	}
+
+	var pageToken string
+	for page := 0; page < maxLatestPages; page++ {
+		resp, err := call.PageToken(pageToken).Do()
+		if err != nil {
+			return "", fmt.Errorf("listing operations: %v", err)
+		}
+
+		var (
+			name    string
+			created time.Time
+		)
+		for _, operation := range resp.Operations {
+			var metadata genomics.Metadata
+			if err := json.Unmarshal(operation.Metadata, &metadata); err != nil {
+				return "", fmt.Errorf("parsing metadata for %q: %v", operation.Name, err)
+			}
+			t, err := time.Parse(time.RFC3339Nano, metadata.CreateTime)
+			if err != nil {
+				return "", fmt.Errorf("parsing creation time of %q: %v", operation.Name, err)
+			}
+			if name == "" || t.After(created) {
+				name, created = operation.Name, t
+			}
+		}
+		if name != "" {
+			return name, nil
+		}
+
+		if resp.NextPageToken == "" {
+			break
+		}
+		pageToken = resp.NextPageToken
+	}
+	return "", errors.New("no matching operation found")
+}
+
+// OutputsVariable is the name of the pipeline environment variable used to
+// record the GCS destinations written by a pipeline (its output manifest).
+const OutputsVariable = "PIPELINES_TOOLS_OUTPUTS"
+
+// ScriptVariable is the name of the action environment variable used to
+// record the script (or command) that the pipeline was created from.  It is
+// set on the first action created from the script.
+const ScriptVariable = "PIPELINES_TOOLS_SCRIPT"
+
+// MonitorPrefix starts the line that the monitoring action (see the --monitor
+// flag of the run command) writes to standard error with the peak resource
+// usage of the VM.
+const MonitorPrefix = "pipelines-monitor:"
+
+// ProfilePrefix starts the line that the profiling action (see the --profile
+// flag of the run command) writes to standard error with a summary of the
+// samples it recorded.
+const ProfilePrefix = "pipelines-profile:"
+
+// Outputs returns the GCS destinations recorded in the output manifest of
+// pipeline.
+func Outputs(pipeline *genomics.Pipeline) []string {
+	if pipeline == nil || pipeline.Environment[OutputsVariable] == "" {
+		return nil
+	}
+	return strings.Split(pipeline.Environment[OutputsVariable], ",")
+}
+
+// Script returns the script recorded in pipeline (see ScriptVariable), or
+// the empty string if there is none.
+func Script(pipeline *genomics.Pipeline) string {
+	if pipeline == nil {
+		return ""
+	}
+	for _, action := range pipeline.Actions {
+		if script := action.Environment[ScriptVariable]; script != "" {
+			return script
+		}
+	}
+	return ""
+}
+
+// ListOperations calls fn for each operation in project that matches filter,
+// following pagination until all operations have been visited or fn returns
+// an error.
+func ListOperations(ctx context.Context, service *genomics.Service, project, filter string, fn func(*genomics.Operation, *genomics.Metadata) error) error {
+	path := fmt.Sprintf("projects/%s/operations", project)
+	call := service.Projects.Operations.List(path).Context(ctx)
+	if filter != "" {
+		call = call.Filter(filter)
+	}
+
+	var pageToken string
+	for {
+		resp, err := call.PageToken(pageToken).Do()
+		if err != nil {
+			return fmt.Errorf("listing operations: %v", err)
+		}
+
+		for _, operation := range resp.Operations {
+			var metadata genomics.Metadata
+			if err := json.Unmarshal(operation.Metadata, &metadata); err != nil {
+				return fmt.Errorf("parsing metadata for %q: %v", operation.Name, err)
+			}
+			if err := fn(operation, &metadata); err != nil {
+				return err
+			}
+		}
+
+		if resp.NextPageToken == "" {
+			return nil
+		}
+		pageToken = resp.NextPageToken
+	}
+}
+
+// LabelFilter returns an operation filter expression that matches operations
+// with all of the given labels.
+func LabelFilter(labels map[string]string) string {
+	var keys []string
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var terms []string
+	for _, key := range keys {
+		terms = append(terms, fmt.Sprintf("metadata.labels.%s = %q", key, labels[key]))
+	}
+	return strings.Join(terms, " AND ")
+}
+
+// AndFilters combines operation filter expressions, ignoring empty ones.
+func AndFilters(filters ...string) string {
+	var terms []string
+	for _, filter := range filters {
+		if filter != "" {
+			terms = append(terms, filter)
+		}
+	}
+	if len(terms) < 2 {
+		return strings.Join(terms, "")
+	}
+	return "(" + strings.Join(terms, ") AND (") + ")"
+}
+
+// ParseDuration extends time.ParseDuration with support for a 'd' (day)
+// suffix, e.g. "30d".
+func ParseDuration(input string) (time.Duration, error) {
+	if strings.HasSuffix(input, "d") {
+		days, err := strconv.ParseFloat(strings.TrimSuffix(input, "d"), 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", input)
+		}
+		return time.Duration(days * float64(24*time.Hour)), nil
+	}
+	return time.ParseDuration(input)
+}
+
+// ParseTime parses input as either an RFC3339 timestamp or a duration (as
+// accepted by ParseDuration) before now.
+func ParseTime(input string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, input); err == nil {
+		return t, nil
+	}
+	age, err := ParseDuration(input)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q (must be an RFC3339 timestamp or a duration)", input)
+	}
+	return now.Add(-age), nil
+}
@@ -0,0 +1,90 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	genomics "google.golang.org/api/genomics/v2alpha1"
+)
+
+func TestParseLabelSelector(t *testing.T) {
+	testCases := []struct {
+		input   string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"name=nightly", map[string]string{"name": "nightly"}, false},
+		{"name=nightly,stage=align", map[string]string{"name": "nightly", "stage": "align"}, false},
+		{"name=", map[string]string{"name": ""}, false},
+		{"=nightly", nil, true},
+		{"name=nightly,stage", nil, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.input, func(t *testing.T) {
+			got, err := parseLabelSelector(tc.input)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("Unexpected success: got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to parse: %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("Unexpected result: got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestLatestOperationPaging(t *testing.T) {
+	// Every page claims that more operations follow, and only the second
+	// page contains any.
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		resp := genomics.ListOperationsResponse{NextPageToken: fmt.Sprintf("page-%d", requests)}
+		if requests == 2 {
+			for i, created := range []time.Time{time.Unix(100, 0), time.Unix(300, 0), time.Unix(200, 0)} {
+				metadata, _ := json.Marshal(&genomics.Metadata{CreateTime: created.UTC().Format(time.RFC3339Nano)})
+				resp.Operations = append(resp.Operations, &genomics.Operation{
+					Name:     fmt.Sprintf("projects/test/operations/%d", i+1),
+					Metadata: metadata,
+				})
+			}
+		}
+		json.NewEncoder(w).Encode(&resp)
+	}))
+	defer server.Close()
+	service, err := genomics.New(http.DefaultClient)
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	service.BasePath = server.URL + "/"
+
+	got, err := LatestOperation(context.Background(), service, "test", "")
+	if err != nil {
+		t.Fatalf("Failed to find the latest operation: %v", err)
+	}
+	if want := "projects/test/operations/2"; got != want {
+		t.Errorf("Unexpected operation: got %q, want %q", got, want)
+	}
+	if requests != 2 {
+		t.Errorf("Unexpected number of requests: got %d, want 2", requests)
+	}
+
+	requests = 2
+	if got, err := LatestOperation(context.Background(), service, "test", ""); err == nil {
+		t.Errorf("Unexpected success with no matching operations: got %q", got)
+	}
+	if want := 2 + maxLatestPages; requests != want {
+		t.Errorf("Unexpected number of requests: got %d, want %d", requests, want)
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/oauth2/google"
+)
+
+// manifestTypes are the manifest media types accepted when resolving a tag.
+var manifestTypes = []string{
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.oci.image.manifest.v1+json",
+}
+
+// imageReference is a parsed container image name.
+type imageReference struct {
+	// name is the image name as given (without the tag or digest).
+	name string
+
+	registry, repository, tag, digest string
+}
+
+func parseImage(image string) imageReference {
+	ref := imageReference{name: image, tag: "latest"}
+	if n := strings.Index(image, "@"); n >= 0 {
+		ref.name, ref.digest = image[:n], image[n+1:]
+	} else if n := strings.LastIndex(image, ":"); n > strings.LastIndex(image, "/") {
+		ref.name, ref.tag = image[:n], image[n+1:]
+	}
+
+	parts := strings.SplitN(ref.name, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		ref.registry, ref.repository = parts[0], parts[1]
+	} else {
+		ref.registry, ref.repository = "registry-1.docker.io", ref.name
+		if len(parts) == 1 {
+			ref.repository = "library/" + ref.name
+		}
+	}
+	return ref
+}
+
+// PinImage returns the image name with its tag replaced by the digest of the
+// image that the tag currently refers to.
+func PinImage(ctx context.Context, image string) (string, error) {
+	ref := parseImage(image)
+	if ref.digest != "" {
+		return image, nil
+	}
+	digest, err := ImageDigest(ctx, image)
+	if err != nil {
+		return "", err
+	}
+	return ref.name + "@" + digest, nil
+}
+
+// ImageDigest looks up the manifest of an image (by tag or digest) in its
+// registry and returns its digest.  An error is returned if the image does not
+// exist or cannot be pulled with the application default credentials.
+func ImageDigest(ctx context.Context, image string) (string, error) {
+	ref := parseImage(image)
+	reference := ref.tag
+	if ref.digest != "" {
+		reference = ref.digest
+	}
+
+	manifest := fmt.Sprintf("https://%s/v2/%s/manifests/%s", ref.registry, ref.repository, reference)
+	resp, err := headManifest(ctx, manifest, "")
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		token, err := registryToken(ctx, ref, resp.Header.Get("WWW-Authenticate"))
+		if err != nil {
+			return "", fmt.Errorf("authenticating: %v", err)
+		}
+		if resp, err = headManifest(ctx, manifest, token); err != nil {
+			return "", err
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("looking up %q: %s", image, resp.Status)
+	}
+
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		return "", fmt.Errorf("looking up %q: no digest returned", image)
+	}
+	return digest, nil
+}
+
+func headManifest(ctx context.Context, manifest, token string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodHead, manifest, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", strings.Join(manifestTypes, ", "))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("requesting manifest: %v", err)
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+// registryToken obtains a bearer token for pulling the image, following the
+// challenge returned by the registry.  Google registries are authenticated
+// using the application default credentials.
+func registryToken(ctx context.Context, ref imageReference, challenge string) (string, error) {
+	if !strings.HasPrefix(challenge, "Bearer ") {
+		return "", fmt.Errorf("unsupported challenge %q", challenge)
+	}
+	parameters := make(map[string]string)
+	for _, field := range strings.Split(strings.TrimPrefix(challenge, "Bearer "), ",") {
+		if n := strings.Index(field, "="); n >= 0 {
+			parameters[strings.TrimSpace(field[:n])] = strings.Trim(field[n+1:], `"`)
+		}
+	}
+	if parameters["realm"] == "" {
+		return "", fmt.Errorf("missing realm in challenge %q", challenge)
+	}
+
+	query := url.Values{}
+	query.Set("service", parameters["service"])
+	query.Set("scope", fmt.Sprintf("repository:%s:pull", ref.repository))
+	req, err := http.NewRequest(http.MethodGet, parameters["realm"]+"?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+
+	if strings.HasSuffix(ref.registry, "gcr.io") || strings.HasSuffix(ref.registry, "pkg.dev") {
+		source, err := google.DefaultTokenSource(ctx, "https://www.googleapis.com/auth/cloud-platform")
+		if err != nil {
+			return "", fmt.Errorf("getting credentials: %v", err)
+		}
+		token, err := source.Token()
+		if err != nil {
+			return "", fmt.Errorf("getting access token: %v", err)
+		}
+		req.SetBasicAuth("oauth2accesstoken", token.AccessToken)
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", fmt.Errorf("requesting token: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("requesting token: %s", resp.Status)
+	}
+
+	var result struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("decoding token: %v", err)
+	}
+	if result.Token != "" {
+		return result.Token, nil
+	}
+	return result.AccessToken, nil
+}
@@ -0,0 +1,26 @@
+package common
+
+import "testing"
+
+func TestParseImage(t *testing.T) {
+	testCases := []struct {
+		image                                   string
+		name, registry, repository, tag, digest string
+	}{
+		{"bash", "bash", "registry-1.docker.io", "library/bash", "latest", ""},
+		{"bash:4.4", "bash", "registry-1.docker.io", "library/bash", "4.4", ""},
+		{"user/image", "user/image", "registry-1.docker.io", "user/image", "latest", ""},
+		{"gcr.io/project/image:v1", "gcr.io/project/image", "gcr.io", "project/image", "v1", ""},
+		{"localhost:5000/image", "localhost:5000/image", "localhost:5000", "image", "latest", ""},
+		{"bash@sha256:abc", "bash", "registry-1.docker.io", "library/bash", "latest", "sha256:abc"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.image, func(t *testing.T) {
+			got := parseImage(tc.image)
+			want := imageReference{tc.name, tc.registry, tc.repository, tc.tag, tc.digest}
+			if got != want {
+				t.Fatalf("Unexpected result: got %+v, want %+v", got, want)
+			}
+		})
+	}
+}
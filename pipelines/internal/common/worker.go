@@ -0,0 +1,81 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"golang.org/x/oauth2/google"
+	compute "google.golang.org/api/compute/v1"
+
+	"github.com/googlegenomics/pipelines-tools/pipelines/events"
+	genomics "google.golang.org/api/genomics/v2alpha1"
+)
+
+// Worker identifies the VM that is running a pipeline.
+type Worker struct {
+	Instance, Zone string
+}
+
+// ResolveWorker returns the VM that is currently running the named operation.
+// An error is returned if no VM has been assigned yet or if the VM has already
+// been released.
+func ResolveWorker(ctx context.Context, service *genomics.Service, name string) (*Worker, error) {
+	_, metadata, err := GetOperation(ctx, service, name)
+	if err != nil {
+		return nil, err
+	}
+
+	var worker *Worker
+	for _, event := range events.ParseAll(metadata.Events) {
+		switch details := event.Details.(type) {
+		case *genomics.WorkerAssignedEvent:
+			worker = &Worker{Instance: details.Instance, Zone: details.Zone}
+		case *genomics.WorkerReleasedEvent:
+			worker = nil
+		}
+	}
+	if worker == nil {
+		return nil, errors.New("the operation is not running on a VM")
+	}
+	return worker, nil
+}
+
+// NewComputeService returns an authenticated client for the Compute Engine
+// API.
+func NewComputeService(ctx context.Context) (*compute.Service, error) {
+	client, err := google.DefaultClient(ctx, compute.ComputeScope)
+	if err != nil {
+		return nil, fmt.Errorf("creating compute client: %v", err)
+	}
+	service, err := compute.New(client)
+	if err != nil {
+		return nil, fmt.Errorf("creating compute service: %v", err)
+	}
+	return service, nil
+}
+
+// SplitArguments splits arguments at the first "--" separator, returning the
+// arguments before and after it.
+func SplitArguments(arguments []string) (before, after []string) {
+	for i, argument := range arguments {
+		if argument == "--" {
+			return arguments[:i], arguments[i+1:]
+		}
+	}
+	return arguments, nil
+}
@@ -0,0 +1,350 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fake provides an in-process fake of the pipelines API.
+//
+// Pipelines submitted to the fake are not executed.  Instead, each operation
+// completes the first time it is fetched, with events that simulate the
+// actions running in order.  The outcome of each attempt is controlled by the
+// MOCK_RESULTS pipeline environment variable, which holds a comma separated
+// list of results (one per submitted operation, with the last result repeated
+// as necessary).  Each result is one of:
+//
+//	ok          all actions exit with status zero
+//	preempted   the VM is preempted before any action runs
+//	<status>    the last action that is not ALWAYS_RUN exits with this status
+//
+// For example, MOCK_RESULTS=preempted,137,ok simulates a preemption followed by
+// an out of memory failure and then a successful attempt.
+package fake
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	genomics "google.golang.org/api/genomics/v2alpha1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/genproto/googleapis/rpc/code"
+)
+
+// ResultsVariable is the name of the pipeline environment variable that
+// controls the outcome of each operation.
+const ResultsVariable = "MOCK_RESULTS"
+
+// Server is a fake pipelines API server.
+type Server struct {
+	// URL is the base path to use for the genomics service.
+	URL string
+
+	server *httptest.Server
+
+	mu         sync.Mutex
+	operations []*operation
+
+	// failures holds the HTTP status codes returned by the next requests to
+	// get an operation (see FailGets).
+	failures []int
+}
+
+type operation struct {
+	lro      *genomics.Operation
+	metadata *genomics.Metadata
+	result   string
+}
+
+// NewServer starts a new fake server.  It must be closed by the caller.
+func NewServer() *Server {
+	s := &Server{}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	s.URL = s.server.URL + "/"
+	return s
+}
+
+// Close shuts down the server.
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// FailGets makes the next requests to get an operation fail with the given
+// HTTP status codes (one per request), to simulate outages and rate limits.
+func (s *Server) FailGets(codes ...int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = append(s.failures, codes...)
+}
+
+// Operations returns the number of operations submitted to the server.
+func (s *Server) Operations() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.operations)
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/v2alpha1/")
+	switch {
+	case r.Method == http.MethodPost && path == "pipelines:run":
+		var req genomics.RunPipelineRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("decoding request: %v", err))
+			return
+		}
+		writeJSON(w, s.submit(&req))
+	case r.Method == http.MethodPost && strings.HasSuffix(path, ":cancel"):
+		op := s.find(strings.TrimSuffix(path, ":cancel"))
+		if op == nil {
+			writeError(w, http.StatusNotFound, "operation not found")
+			return
+		}
+		if op.lro.Done {
+			writeError(w, http.StatusBadRequest, "operation is already done")
+			return
+		}
+		s.finish(op, &genomics.Status{Code: int64(code.Code_CANCELLED), Message: "operation was cancelled"}, nil)
+		writeJSON(w, &genomics.Empty{})
+	case r.Method == http.MethodGet && strings.HasSuffix(path, "/operations"):
+		var resp genomics.ListOperationsResponse
+		labels := labelFilter(r.URL.Query().Get("filter"))
+		for i := len(s.operations) - 1; i >= 0; i-- {
+			if hasLabels(s.operations[i].metadata, labels) {
+				resp.Operations = append(resp.Operations, s.operations[i].lro)
+			}
+		}
+		writeJSON(w, &resp)
+	case r.Method == http.MethodGet && len(s.failures) > 0:
+		status := s.failures[0]
+		s.failures = s.failures[1:]
+		writeError(w, status, "simulated failure")
+	case r.Method == http.MethodGet:
+		op := s.find(path)
+		if op == nil {
+			writeError(w, http.StatusNotFound, "operation not found")
+			return
+		}
+		if !op.lro.Done {
+			s.execute(op)
+		}
+		writeJSON(w, op.lro)
+	default:
+		writeError(w, http.StatusNotFound, fmt.Sprintf("unsupported request: %s %s", r.Method, r.URL.Path))
+	}
+}
+
+func (s *Server) submit(req *genomics.RunPipelineRequest) *genomics.Operation {
+	project := "fake"
+	if resources := req.Pipeline.Resources; resources != nil && resources.ProjectId != "" {
+		project = resources.ProjectId
+	}
+
+	results := strings.Split(req.Pipeline.Environment[ResultsVariable], ",")
+	result := results[len(results)-1]
+	if n := len(s.operations); n < len(results) {
+		result = results[n]
+	}
+
+	op := &operation{
+		lro: &genomics.Operation{
+			Name: fmt.Sprintf("projects/%s/operations/%d", project, len(s.operations)+1),
+		},
+		metadata: &genomics.Metadata{
+			Pipeline:   req.Pipeline,
+			Labels:     req.Labels,
+			CreateTime: time.Now().UTC().Format(time.RFC3339Nano),
+		},
+		result: strings.TrimSpace(result),
+	}
+	s.operations = append(s.operations, op)
+	s.update(op)
+	return op.lro
+}
+
+func (s *Server) find(name string) *operation {
+	for _, op := range s.operations {
+		if op.lro.Name == name {
+			return op
+		}
+	}
+	return nil
+}
+
+// execute simulates running the pipeline to completion.
+func (s *Server) execute(op *operation) {
+	now := time.Now()
+	op.metadata.StartTime = now.UTC().Format(time.RFC3339Nano)
+
+	instance := fmt.Sprintf("google-pipelines-worker-%d", len(s.operations))
+	const zone = "fake-zone-a"
+	op.addEvent(now, "Worker %q assigned in %q", "WorkerAssignedEvent", &genomics.WorkerAssignedEvent{Instance: instance, Zone: zone}, instance, zone)
+
+	if op.result == "preempted" {
+		status := &genomics.Status{Code: int64(code.Code_ABORTED), Message: "The assigned worker was preempted"}
+		op.addEvent(now, "Worker released", "WorkerReleasedEvent", &genomics.WorkerReleasedEvent{Instance: instance, Zone: zone})
+		s.finish(op, status, nil)
+		return
+	}
+
+	exitStatus, _ := strconv.ParseInt(op.result, 10, 64)
+	actions := op.metadata.Pipeline.Actions
+	last := len(actions)
+	for i := len(actions) - 1; i >= 0; i-- {
+		if !hasFlag(actions[i], "ALWAYS_RUN") {
+			last = i + 1
+			break
+		}
+	}
+
+	var status *genomics.Status
+	for i, action := range actions {
+		id := int64(i + 1)
+		if status != nil && !hasFlag(action, "ALWAYS_RUN") {
+			continue
+		}
+		op.addEvent(now, "Started running %q", "ContainerStartedEvent", &genomics.ContainerStartedEvent{ActionId: id}, actionName(action))
+		if hasFlag(action, "RUN_IN_BACKGROUND") {
+			continue
+		}
+
+		var stopped genomics.ContainerStoppedEvent
+		stopped.ActionId = id
+		if id == int64(last) {
+			stopped.ExitStatus = exitStatus
+		}
+		if stopped.ExitStatus != 0 {
+			stopped.Stderr = fmt.Sprintf("simulated failure with exit status %d\n", stopped.ExitStatus)
+		}
+		op.addEvent(now, "Stopped running %q", "ContainerStoppedEvent", &stopped, actionName(action))
+
+		if stopped.ExitStatus != 0 && status == nil && !hasFlag(action, "IGNORE_EXIT_STATUS") {
+			op.addEvent(now, "Unexpected exit status %d while running %q", "UnexpectedExitStatusEvent", &genomics.UnexpectedExitStatusEvent{ActionId: id, ExitStatus: stopped.ExitStatus}, stopped.ExitStatus, actionName(action))
+			status = &genomics.Status{
+				Code:    int64(code.Code_FAILED_PRECONDITION),
+				Message: fmt.Sprintf("Execution failed: action %d: unexpected exit status %d was not ignored", id, stopped.ExitStatus),
+			}
+		}
+	}
+
+	op.addEvent(now, "Worker released", "WorkerReleasedEvent", &genomics.WorkerReleasedEvent{Instance: instance, Zone: zone})
+	if status == nil {
+		s.finish(op, nil, googleapi.RawMessage(`{}`))
+	} else {
+		s.finish(op, status, nil)
+	}
+}
+
+func (s *Server) finish(op *operation, status *genomics.Status, response googleapi.RawMessage) {
+	now := time.Now()
+	if status != nil {
+		op.addEvent(now, "%s", "FailedEvent", &genomics.FailedEvent{Code: code.Code(status.Code).String(), Cause: status.Message}, status.Message)
+	}
+	op.metadata.EndTime = now.UTC().Format(time.RFC3339Nano)
+	op.lro.Done = true
+	op.lro.Error = status
+	op.lro.Response = response
+	s.update(op)
+}
+
+func (s *Server) update(op *operation) {
+	encoded, err := json.Marshal(op.metadata)
+	if err != nil {
+		panic(fmt.Sprintf("encoding metadata: %v", err))
+	}
+	op.lro.Metadata = encoded
+}
+
+// addEvent records an event.  Events are kept in reverse chronological order
+// (as returned by the real API) and are spaced one second apart.
+func (op *operation) addEvent(base time.Time, format, kind string, details interface{}, arguments ...interface{}) {
+	encoded, err := json.Marshal(details)
+	if err != nil {
+		panic(fmt.Sprintf("encoding event: %v", err))
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(encoded, &fields); err != nil {
+		panic(fmt.Sprintf("decoding event: %v", err))
+	}
+	fields["@type"] = "type.googleapis.com/google.genomics.v2alpha1." + kind
+	encoded, err = json.Marshal(fields)
+	if err != nil {
+		panic(fmt.Sprintf("encoding event: %v", err))
+	}
+
+	timestamp := base.Add(time.Duration(len(op.metadata.Events)) * time.Second)
+	event := &genomics.Event{
+		Timestamp:   timestamp.UTC().Format(time.RFC3339Nano),
+		Description: fmt.Sprintf(format, arguments...),
+		Details:     googleapi.RawMessage(encoded),
+	}
+	op.metadata.Events = append([]*genomics.Event{event}, op.metadata.Events...)
+}
+
+// labelTerm matches the label terms of an operation filter.
+var labelTerm = regexp.MustCompile(`metadata\.labels\.([\w-]+) = "([^"]*)"`)
+
+// labelFilter returns the labels required by an operation filter.  Other terms
+// of the filter are ignored.
+func labelFilter(filter string) map[string]string {
+	labels := make(map[string]string)
+	for _, match := range labelTerm.FindAllStringSubmatch(filter, -1) {
+		labels[match[1]] = match[2]
+	}
+	return labels
+}
+
+func hasLabels(metadata *genomics.Metadata, labels map[string]string) bool {
+	for key, value := range labels {
+		if metadata.Labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+func actionName(action *genomics.Action) string {
+	if action.Name != "" {
+		return action.Name
+	}
+	return action.ImageUri
+}
+
+func hasFlag(action *genomics.Action, flag string) bool {
+	for _, f := range action.Flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{"code": status, "message": message},
+	})
+}
@@ -0,0 +1,214 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fake
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	storage "google.golang.org/api/storage/v1"
+)
+
+// StorageServer is a fake GCS JSON API server that supports the requests used
+// by the tools: getting, downloading, listing, uploading (with a multipart
+// request) and deleting objects, with generation preconditions.  Set the
+// STORAGE_EMULATOR_HOST environment variable to its Host to use it.
+type StorageServer struct {
+	// Host is the address of the server.
+	Host string
+
+	server *httptest.Server
+
+	mu         sync.Mutex
+	objects    map[string]*storedObject
+	generation int64
+}
+
+type storedObject struct {
+	metadata *storage.Object
+	data     []byte
+}
+
+// NewStorageServer starts a new fake storage server.  It must be closed by the
+// caller.
+func NewStorageServer() *StorageServer {
+	s := &StorageServer{objects: make(map[string]*storedObject)}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	s.Host = strings.TrimPrefix(s.server.URL, "http://")
+	return s
+}
+
+// Close shuts down the server.
+func (s *StorageServer) Close() {
+	s.server.Close()
+}
+
+// Object returns the contents of the named object, and false if it does not
+// exist.
+func (s *StorageServer) Object(bucket, name string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	object, ok := s.objects[bucket+"/"+name]
+	if !ok {
+		return nil, false
+	}
+	return object.data, true
+}
+
+// Put creates or replaces the named object.
+func (s *StorageServer) Put(bucket, name string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.put(bucket, name, data)
+}
+
+func (s *StorageServer) put(bucket, name string, data []byte) *storage.Object {
+	s.generation++
+	metadata := &storage.Object{
+		Bucket:     bucket,
+		Name:       name,
+		Generation: s.generation,
+		Size:       uint64(len(data)),
+	}
+	s.objects[bucket+"/"+name] = &storedObject{metadata: metadata, data: data}
+	return metadata
+}
+
+func (s *StorageServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := r.URL.EscapedPath()
+	query := r.URL.Query()
+	switch {
+	case r.Method == http.MethodPost && strings.HasPrefix(path, "/upload/storage/v1/b/"):
+		bucket := strings.TrimSuffix(strings.TrimPrefix(path, "/upload/storage/v1/b/"), "/o")
+		name, data, err := readUpload(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if !s.generationMatches(bucket+"/"+name, query) {
+			writeError(w, http.StatusPreconditionFailed, "precondition failed")
+			return
+		}
+		writeJSON(w, s.put(bucket, name, data))
+	case strings.HasPrefix(path, "/storage/v1/b/"):
+		parts := strings.SplitN(strings.TrimPrefix(path, "/storage/v1/b/"), "/o", 2)
+		bucket := parts[0]
+		if len(parts) < 2 || parts[1] == "" {
+			s.list(w, bucket, query.Get("prefix"))
+			return
+		}
+		name, err := url.PathUnescape(strings.TrimPrefix(parts[1], "/"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		key := bucket + "/" + name
+		object, ok := s.objects[key]
+		if !ok {
+			writeError(w, http.StatusNotFound, "object not found")
+			return
+		}
+		switch {
+		case r.Method == http.MethodDelete:
+			if !s.generationMatches(key, query) {
+				writeError(w, http.StatusPreconditionFailed, "precondition failed")
+				return
+			}
+			delete(s.objects, key)
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodGet && query.Get("alt") == "media":
+			w.Header().Set("X-Goog-Generation", strconv.FormatInt(object.metadata.Generation, 10))
+			w.Write(object.data)
+		case r.Method == http.MethodGet:
+			writeJSON(w, object.metadata)
+		default:
+			writeError(w, http.StatusNotFound, fmt.Sprintf("unsupported request: %s %s", r.Method, r.URL.Path))
+		}
+	default:
+		writeError(w, http.StatusNotFound, fmt.Sprintf("unsupported request: %s %s", r.Method, r.URL.Path))
+	}
+}
+
+// generationMatches checks the ifGenerationMatch precondition of a request
+// against the current generation of the object (zero if it does not exist).
+func (s *StorageServer) generationMatches(key string, query url.Values) bool {
+	want := query.Get("ifGenerationMatch")
+	if want == "" {
+		return true
+	}
+	var generation int64
+	if object, ok := s.objects[key]; ok {
+		generation = object.metadata.Generation
+	}
+	return want == strconv.FormatInt(generation, 10)
+}
+
+func (s *StorageServer) list(w http.ResponseWriter, bucket, prefix string) {
+	var keys []string
+	for key := range s.objects {
+		if strings.HasPrefix(key, bucket+"/"+prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var resp storage.Objects
+	for _, key := range keys {
+		resp.Items = append(resp.Items, s.objects[key].metadata)
+	}
+	writeJSON(w, &resp)
+}
+
+// readUpload returns the name and contents of an object from a multipart
+// upload request.
+func readUpload(r *http.Request) (string, []byte, error) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return "", nil, fmt.Errorf("parsing content type: %v", err)
+	}
+	reader := multipart.NewReader(r.Body, params["boundary"])
+
+	part, err := reader.NextPart()
+	if err != nil {
+		return "", nil, fmt.Errorf("reading metadata: %v", err)
+	}
+	var metadata storage.Object
+	if err := json.NewDecoder(part).Decode(&metadata); err != nil {
+		return "", nil, fmt.Errorf("decoding metadata: %v", err)
+	}
+
+	part, err = reader.NextPart()
+	if err != nil {
+		return "", nil, fmt.Errorf("reading media: %v", err)
+	}
+	data, err := ioutil.ReadAll(part)
+	if err != nil {
+		return "", nil, fmt.Errorf("reading media: %v", err)
+	}
+	return metadata.Name, data, nil
+}
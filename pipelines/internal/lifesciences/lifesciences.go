@@ -0,0 +1,280 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package lifesciences provides an HTTP transport that translates calls to
+// the Genomics v2alpha1 API into calls to the Cloud Life Sciences v2beta API,
+// so that every command can use either backend without change.
+//
+// The two APIs use the same resources with a few differences: Life Sciences
+// operations (and the pipelines:run method) are named by location, action
+// flags are boolean fields, the action name is called containerName and event
+// details are stored in a field named after the event type.  Operation names
+// without a location (for example, those built from a bare operation ID) are
+// given the location of the transport.
+package lifesciences
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+const (
+	// BasePath is the default Cloud Life Sciences endpoint.
+	BasePath = "https://lifesciences.googleapis.com/"
+
+	// Scope is the OAuth scope needed to use the Cloud Life Sciences API.
+	Scope = "https://www.googleapis.com/auth/cloud-platform"
+
+	alphaPrefix = "/v2alpha1/"
+	betaPrefix  = "/v2beta/"
+	typePrefix  = "type.googleapis.com/google.genomics.v2alpha1."
+)
+
+// actionFlags lists the v2alpha1 action flags, each of which corresponds to a
+// boolean v2beta action field.
+var actionFlags = []string{
+	"IGNORE_EXIT_STATUS",
+	"RUN_IN_BACKGROUND",
+	"ALWAYS_RUN",
+	"ENABLE_FUSE",
+	"PUBLISH_EXPOSED_PORTS",
+	"DISABLE_IMAGE_PREFETCH",
+	"DISABLE_STANDARD_ERROR_CAPTURE",
+	"BLOCK_EXTERNAL_NETWORK",
+}
+
+// IsLifeSciences returns true if the --api flag selects the Cloud Life
+// Sciences API, either by name or by URL.
+func IsLifeSciences(api string) bool {
+	return api == "lifesciences" || strings.Contains(api, "lifesciences.")
+}
+
+// Transport translates Genomics v2alpha1 requests into Cloud Life Sciences
+// v2beta requests (and the responses back again).
+type Transport struct {
+	Base http.RoundTripper
+
+	// Location is used for new pipelines and for operation names that do
+	// not include a location.
+	Location string
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !strings.HasPrefix(req.URL.Path, alphaPrefix) {
+		return nil, fmt.Errorf("unexpected API path %q", req.URL.Path)
+	}
+	path := strings.TrimPrefix(req.URL.Path, alphaPrefix)
+
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, fmt.Errorf("reading request body: %v", err)
+		}
+		req.Body.Close()
+	}
+
+	if path == "pipelines:run" {
+		var project string
+		var err error
+		if body, project, err = translateRequest(body); err != nil {
+			return nil, err
+		}
+		path = fmt.Sprintf("projects/%s/locations/%s/pipelines:run", project, t.Location)
+	} else {
+		path = t.locate(path)
+	}
+
+	// Requests must not be modified by a transport, so a copy is sent.
+	out := req.WithContext(req.Context())
+	u := *req.URL
+	u.Path, u.RawPath = betaPrefix+path, ""
+	out.URL = &u
+	out.Body = ioutil.NopCloser(bytes.NewReader(body))
+	out.ContentLength = int64(len(body))
+
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	resp, err := base.RoundTrip(out)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+
+	body, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("reading response body: %v", err)
+	}
+	if body, err = translateResponse(body); err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Del("Content-Length")
+	return resp, nil
+}
+
+// locate adds the location to an operation name (or the name of the list of
+// operations) that does not have one.
+func (t *Transport) locate(path string) string {
+	parts := strings.SplitN(path, "/", 3)
+	if len(parts) == 3 && parts[0] == "projects" && strings.HasPrefix(parts[2], "operations") {
+		return fmt.Sprintf("projects/%s/locations/%s/%s", parts[1], t.Location, parts[2])
+	}
+	return path
+}
+
+// translateRequest converts a v2alpha1 RunPipelineRequest into a v2beta one
+// and returns the project that it names.
+func translateRequest(body []byte) ([]byte, string, error) {
+	var req map[string]interface{}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, "", fmt.Errorf("decoding request: %v", err)
+	}
+
+	pipeline := object(req["pipeline"])
+	for _, action := range array(pipeline["actions"]) {
+		action := object(action)
+		rename(action, "name", "containerName")
+		for _, flag := range array(action["flags"]) {
+			if flag, ok := flag.(string); ok {
+				action[fieldName(flag)] = true
+			}
+		}
+		delete(action, "flags")
+	}
+
+	resources := object(pipeline["resources"])
+	project, _ := resources["projectId"].(string)
+	if project == "" {
+		return nil, "", fmt.Errorf("the request does not name a project")
+	}
+	delete(resources, "projectId")
+	rename(object(object(resources["virtualMachine"])["network"]), "name", "network")
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("encoding request: %v", err)
+	}
+	return body, project, nil
+}
+
+// translateResponse converts a v2beta operation (or list of operations) into
+// the v2alpha1 form.
+func translateResponse(body []byte) ([]byte, error) {
+	var resp map[string]interface{}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, fmt.Errorf("decoding response: %v", err)
+	}
+
+	if operations, ok := resp["operations"]; ok {
+		for _, operation := range array(operations) {
+			translateOperation(object(operation))
+		}
+	} else {
+		translateOperation(resp)
+	}
+
+	body, err := json.Marshal(resp)
+	if err != nil {
+		return nil, fmt.Errorf("encoding response: %v", err)
+	}
+	return body, nil
+}
+
+func translateOperation(operation map[string]interface{}) {
+	metadata := object(operation["metadata"])
+	if metadata == nil {
+		return
+	}
+	metadata["@type"] = typePrefix + "Metadata"
+
+	pipeline := object(metadata["pipeline"])
+	for _, action := range array(pipeline["actions"]) {
+		action := object(action)
+		rename(action, "containerName", "name")
+		var flags []interface{}
+		for _, flag := range actionFlags {
+			if enabled, _ := action[fieldName(flag)].(bool); enabled {
+				flags = append(flags, flag)
+			}
+			delete(action, fieldName(flag))
+		}
+		if len(flags) > 0 {
+			action["flags"] = flags
+		}
+	}
+
+	if resources := object(pipeline["resources"]); resources != nil {
+		// Operation names have the form projects/PROJECT/locations/...
+		if parts := strings.Split(stringValue(operation["name"]), "/"); len(parts) > 1 {
+			resources["projectId"] = parts[1]
+		}
+		rename(object(object(resources["virtualMachine"])["network"]), "network", "name")
+	}
+
+	for _, event := range array(metadata["events"]) {
+		event := object(event)
+		var kind string
+		for key := range event {
+			if key != "timestamp" && key != "description" {
+				kind = key
+			}
+		}
+		if details := object(event[kind]); details != nil {
+			details["@type"] = typePrefix + strings.ToUpper(kind[:1]) + kind[1:] + "Event"
+			event["details"] = details
+			delete(event, kind)
+		}
+	}
+}
+
+// fieldName converts an action flag (such as RUN_IN_BACKGROUND) into the name
+// of the corresponding v2beta field (such as runInBackground).
+func fieldName(flag string) string {
+	words := strings.Split(strings.ToLower(flag), "_")
+	for i := 1; i < len(words); i++ {
+		words[i] = strings.Title(words[i])
+	}
+	return strings.Join(words, "")
+}
+
+func rename(v map[string]interface{}, from, to string) {
+	if value, ok := v[from]; ok {
+		v[to] = value
+		delete(v, from)
+	}
+}
+
+func object(v interface{}) map[string]interface{} {
+	m, _ := v.(map[string]interface{})
+	return m
+}
+
+func array(v interface{}) []interface{} {
+	a, _ := v.([]interface{})
+	return a
+}
+
+func stringValue(v interface{}) string {
+	s, _ := v.(string)
+	return s
+}
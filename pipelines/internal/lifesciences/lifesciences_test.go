@@ -0,0 +1,110 @@
+package lifesciences
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	genomics "google.golang.org/api/genomics/v2alpha1"
+)
+
+const operation = `{
+  "name": "projects/p/locations/us-east1/operations/1",
+  "metadata": {
+    "@type": "type.googleapis.com/google.cloud.lifesciences.v2beta.Metadata",
+    "pipeline": {
+      "actions": [{"containerName": "main", "imageUri": "bash", "alwaysRun": true, "enableFuse": true}],
+      "resources": {"virtualMachine": {"machineType": "n1-standard-1", "network": {"network": "default"}}}
+    },
+    "events": [{
+      "timestamp": "2020-01-01T00:00:00Z",
+      "description": "Stopped running \"bash\"",
+      "containerStopped": {"actionId": 1, "exitStatus": 1, "stderr": "failed"}
+    }]
+  }
+}`
+
+func TestTransport(t *testing.T) {
+	var requests []string
+	var body map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		if r.Method == http.MethodPost {
+			data, _ := ioutil.ReadAll(r.Body)
+			if err := json.Unmarshal(data, &body); err != nil {
+				t.Errorf("Failed to decode request: %v", err)
+			}
+		}
+		fmt.Fprint(w, operation)
+	}))
+	defer server.Close()
+
+	service, err := genomics.New(&http.Client{Transport: &Transport{Location: "us-east1"}})
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	service.BasePath = server.URL + "/"
+
+	req := &genomics.RunPipelineRequest{
+		Pipeline: &genomics.Pipeline{
+			Actions: []*genomics.Action{{Name: "main", ImageUri: "bash", Flags: []string{"ALWAYS_RUN", "ENABLE_FUSE"}}},
+			Resources: &genomics.Resources{
+				ProjectId:      "p",
+				VirtualMachine: &genomics.VirtualMachine{MachineType: "n1-standard-1", Network: &genomics.Network{Name: "default"}},
+			},
+		},
+	}
+	lro, err := service.Pipelines.Run(req).Do()
+	if err != nil {
+		t.Fatalf("Failed to run pipeline: %v", err)
+	}
+
+	want := map[string]interface{}{
+		"pipeline": map[string]interface{}{
+			"actions": []interface{}{map[string]interface{}{"containerName": "main", "imageUri": "bash", "alwaysRun": true, "enableFuse": true}},
+			"resources": map[string]interface{}{
+				"virtualMachine": map[string]interface{}{"machineType": "n1-standard-1", "network": map[string]interface{}{"network": "default"}},
+			},
+		},
+	}
+	if !reflect.DeepEqual(body, want) {
+		t.Errorf("Unexpected request: got %v, want %v", body, want)
+	}
+
+	if _, err := service.Projects.Operations.Get("projects/p/operations/1").Do(); err != nil {
+		t.Fatalf("Failed to get operation: %v", err)
+	}
+	wantRequests := []string{
+		"POST /v2beta/projects/p/locations/us-east1/pipelines:run",
+		"GET /v2beta/projects/p/locations/us-east1/operations/1",
+	}
+	if !reflect.DeepEqual(requests, wantRequests) {
+		t.Errorf("Unexpected requests: got %q, want %q", requests, wantRequests)
+	}
+
+	var metadata genomics.Metadata
+	if err := json.Unmarshal(lro.Metadata, &metadata); err != nil {
+		t.Fatalf("Failed to decode metadata: %v", err)
+	}
+	action := metadata.Pipeline.Actions[0]
+	if action.Name != "main" || !reflect.DeepEqual(action.Flags, []string{"ALWAYS_RUN", "ENABLE_FUSE"}) {
+		t.Errorf("Unexpected action: got %+v", action)
+	}
+	if resources := metadata.Pipeline.Resources; resources.ProjectId != "p" || resources.VirtualMachine.Network.Name != "default" {
+		t.Errorf("Unexpected resources: got %+v", resources)
+	}
+	var details struct {
+		Type     string `json:"@type"`
+		ActionID int64  `json:"actionId"`
+	}
+	if err := json.Unmarshal(metadata.Events[0].Details, &details); err != nil {
+		t.Fatalf("Failed to decode event details: %v", err)
+	}
+	if details.Type != typePrefix+"ContainerStoppedEvent" || details.ActionID != 1 {
+		t.Errorf("Unexpected event details: got %+v", details)
+	}
+}
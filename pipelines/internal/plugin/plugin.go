@@ -0,0 +1,158 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package plugin provides support for extending the tool with external
+// executables.
+//
+// An executable named 'pipelines-NAME' found on the PATH provides the NAME
+// command (unless a built-in command has the same name).  It is run with the
+// remaining arguments, and the project is passed in the PIPELINES_PROJECT
+// environment variable.
+//
+// Request mutators are executables listed in the "mutators" section of the
+// configuration file.  Each receives the JSON encoded run request on standard
+// input and must write the (possibly modified) request to standard output,
+// which allows site-specific defaults (such as labels, networks or service
+// accounts) to be applied to every pipeline.
+//
+// Hooks are executables that are run with a JSON document on standard input
+// (see Hook): the run command uses them to validate requests before they are
+// submitted and to act on operations once they finish.
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/common"
+)
+
+// Prefix is the prefix of the names of executables that provide commands.
+const Prefix = "pipelines-"
+
+// ProjectVariable is the name of the environment variable used to pass the
+// project to a command.
+const ProjectVariable = "PIPELINES_PROJECT"
+
+// Find returns the path of the executable that provides the named command, or
+// the empty string if there is none.
+func Find(name string) string {
+	path, err := exec.LookPath(Prefix + name)
+	if err != nil {
+		return ""
+	}
+	return path
+}
+
+// List returns the names of the commands provided by executables on the PATH.
+func List() []string {
+	seen := make(map[string]bool)
+	for _, directory := range filepath.SplitList(os.Getenv("PATH")) {
+		matches, _ := filepath.Glob(filepath.Join(directory, Prefix+"*"))
+		for _, match := range matches {
+			if info, err := os.Stat(match); err == nil && !info.IsDir() && info.Mode()&0111 != 0 {
+				seen[strings.TrimPrefix(filepath.Base(match), Prefix)] = true
+			}
+		}
+	}
+	var names []string
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Run runs the executable at path with the given arguments, connected to the
+// standard input and output of the tool.  If the executable fails, the error
+// carries its exit code.
+func Run(path, project string, arguments []string) error {
+	cmd := exec.Command(path, arguments...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), ProjectVariable+"="+project)
+	return exitError(filepath.Base(path), cmd.Run())
+}
+
+// Mutate passes v (encoded as JSON) through the mutator command line and
+// decodes the result back into v.
+func Mutate(command string, v interface{}) error {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil
+	}
+
+	input, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("encoding request: %v", err)
+	}
+
+	var output bytes.Buffer
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &output
+	cmd.Stderr = os.Stderr
+	if err := exitError(args[0], cmd.Run()); err != nil {
+		return err
+	}
+	// Clear v first so that fields removed by the mutator are not kept.
+	value := reflect.ValueOf(v).Elem()
+	value.Set(reflect.Zero(value.Type()))
+	if err := json.Unmarshal(output.Bytes(), v); err != nil {
+		return fmt.Errorf("parsing output of %q: %v", command, err)
+	}
+	return nil
+}
+
+// Hook runs the hook command line with v (encoded as JSON) on its standard
+// input.  The output of the hook is shown to the user.
+func Hook(command string, v interface{}) error {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil
+	}
+
+	input, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("encoding hook input: %v", err)
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return exitError(args[0], cmd.Run())
+}
+
+func exitError(name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if exit, ok := err.(*exec.ExitError); ok {
+		code := 1
+		if status, ok := exit.Sys().(interface{ ExitStatus() int }); ok {
+			code = status.ExitStatus()
+		}
+		return common.ExitError{Code: code, Err: fmt.Errorf("running %q: %v", name, err)}
+	}
+	return fmt.Errorf("running %q: %v", name, err)
+}
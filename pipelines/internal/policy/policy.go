@@ -0,0 +1,195 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package policy validates run requests against the conventions of an
+// organization before they are submitted.
+//
+// A policy is a JSON file such as:
+//
+//	{
+//	  "images": ["gcr.io/my-org/*", "google/cloud-sdk:*"],
+//	  "registries": ["us-docker.pkg.dev"],
+//	  "requiredLabels": ["team", "cost-center"],
+//	  "zones": ["us-central1*"],
+//	  "machineTypes": ["n1-standard-*", "n1-highmem-*"],
+//	  "maxDiskSizeGb": 1000,
+//	  "forbidPublicIp": true
+//	}
+//
+// Patterns use the syntax of path.Match.  Every section is optional, and an
+// empty (or missing) section places no restriction on the request.
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	genomics "google.golang.org/api/genomics/v2alpha1"
+)
+
+// Policy describes the requests that are allowed to be submitted.
+type Policy struct {
+	// Images and Registries restrict the images used by actions.  An image
+	// is allowed if it matches one of the image patterns or is hosted in one
+	// of the registries (images without a registry are hosted in
+	// docker.io).
+	Images     []string `json:"images,omitempty"`
+	Registries []string `json:"registries,omitempty"`
+
+	// RequiredLabels lists labels that must be applied to every pipeline.
+	RequiredLabels []string `json:"requiredLabels,omitempty"`
+
+	// Zones lists patterns that every zone and region in the request must
+	// match (so 'us-central1*' allows the region and all of its zones).
+	Zones []string `json:"zones,omitempty"`
+
+	// MachineTypes lists patterns that the machine type must match.
+	MachineTypes []string `json:"machineTypes,omitempty"`
+
+	// MaxDiskSizeGb is the largest disk (in GB) that may be attached to the
+	// VM, including the boot disk.
+	MaxDiskSizeGb int64 `json:"maxDiskSizeGb,omitempty"`
+
+	// ForbidPublicIP requires the VM to use a private address.
+	ForbidPublicIP bool `json:"forbidPublicIp,omitempty"`
+}
+
+// Load reads a policy from the named file.
+func Load(filename string) (*Policy, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("reading policy: %v", err)
+	}
+	var p Policy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("parsing policy %q: %v", filename, err)
+	}
+	for _, patterns := range [][]string{p.Images, p.Zones, p.MachineTypes} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("parsing policy %q: invalid pattern %q", filename, pattern)
+			}
+		}
+	}
+	return &p, nil
+}
+
+// Check returns an error describing every way in which req violates the
+// policy, or nil if the request is allowed.
+func (p *Policy) Check(req *genomics.RunPipelineRequest) error {
+	var violations []string
+	report := func(format string, args ...interface{}) {
+		violations = append(violations, fmt.Sprintf(format, args...))
+	}
+
+	pipeline := req.Pipeline
+	if pipeline == nil {
+		pipeline = &genomics.Pipeline{}
+	}
+
+	for i, action := range pipeline.Actions {
+		if !p.allowsImage(action.ImageUri) {
+			report("action %d uses image %q, which is not allowed", i+1, action.ImageUri)
+		}
+	}
+
+	for _, label := range p.RequiredLabels {
+		if _, ok := req.Labels[label]; !ok {
+			report("missing required label %q", label)
+		}
+	}
+
+	resources := pipeline.Resources
+	if resources == nil {
+		resources = &genomics.Resources{}
+	}
+	vm := resources.VirtualMachine
+	if vm == nil {
+		vm = &genomics.VirtualMachine{}
+	}
+
+	if len(p.Zones) > 0 {
+		if len(resources.Zones)+len(resources.Regions) == 0 {
+			report("no zones or regions specified")
+		}
+		for _, location := range append(append([]string{}, resources.Zones...), resources.Regions...) {
+			if !matchesAny(p.Zones, location) {
+				report("location %q is not allowed", location)
+			}
+		}
+	}
+
+	if len(p.MachineTypes) > 0 && !matchesAny(p.MachineTypes, vm.MachineType) {
+		report("machine type %q is not allowed", vm.MachineType)
+	}
+
+	if p.MaxDiskSizeGb > 0 {
+		for _, disk := range vm.Disks {
+			if disk.SizeGb > p.MaxDiskSizeGb {
+				report("disk %q is %dGB, which exceeds the maximum of %dGB", disk.Name, disk.SizeGb, p.MaxDiskSizeGb)
+			}
+		}
+		if vm.BootDiskSizeGb > p.MaxDiskSizeGb {
+			report("the boot disk is %dGB, which exceeds the maximum of %dGB", vm.BootDiskSizeGb, p.MaxDiskSizeGb)
+		}
+	}
+
+	if p.ForbidPublicIP && (vm.Network == nil || !vm.Network.UsePrivateAddress) {
+		report("public IP addresses are not allowed (use --private-address)")
+	}
+
+	if len(violations) > 0 {
+		return fmt.Errorf("request violates policy:\n  %s", strings.Join(violations, "\n  "))
+	}
+	return nil
+}
+
+func (p *Policy) allowsImage(image string) bool {
+	if len(p.Images) == 0 && len(p.Registries) == 0 {
+		return true
+	}
+	if matchesAny(p.Images, image) {
+		return true
+	}
+	registry := registryOf(image)
+	for _, r := range p.Registries {
+		if r == registry {
+			return true
+		}
+	}
+	return false
+}
+
+// registryOf returns the host name of the registry that hosts image.
+func registryOf(image string) string {
+	if i := strings.Index(image, "/"); i > 0 {
+		host := image[:i]
+		if strings.ContainsAny(host, ".:") || host == "localhost" {
+			return host
+		}
+	}
+	return "docker.io"
+}
+
+func matchesAny(patterns []string, s string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, s); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,92 @@
+package policy
+
+import (
+	"testing"
+
+	genomics "google.golang.org/api/genomics/v2alpha1"
+)
+
+func TestCheck(t *testing.T) {
+	p := &Policy{
+		Images:         []string{"gcr.io/my-org/*"},
+		Registries:     []string{"us-docker.pkg.dev"},
+		RequiredLabels: []string{"team"},
+		Zones:          []string{"us-central1*"},
+		MachineTypes:   []string{"n1-standard-*"},
+		MaxDiskSizeGb:  500,
+		ForbidPublicIP: true,
+	}
+
+	newRequest := func() *genomics.RunPipelineRequest {
+		return &genomics.RunPipelineRequest{
+			Labels: map[string]string{"team": "genomics"},
+			Pipeline: &genomics.Pipeline{
+				Actions: []*genomics.Action{
+					{ImageUri: "gcr.io/my-org/tool:1.0"},
+					{ImageUri: "us-docker.pkg.dev/project/repository/image"},
+				},
+				Resources: &genomics.Resources{
+					Zones: []string{"us-central1-a", "us-central1-b"},
+					VirtualMachine: &genomics.VirtualMachine{
+						MachineType: "n1-standard-4",
+						Disks:       []*genomics.Disk{{Name: "google", SizeGb: 500}},
+						Network:     &genomics.Network{UsePrivateAddress: true},
+					},
+				},
+			},
+		}
+	}
+
+	testCases := []struct {
+		name    string
+		modify  func(*genomics.RunPipelineRequest)
+		wantErr bool
+	}{
+		{"allowed", func(*genomics.RunPipelineRequest) {}, false},
+		{"image", func(req *genomics.RunPipelineRequest) { req.Pipeline.Actions[0].ImageUri = "bash" }, true},
+		{"registry", func(req *genomics.RunPipelineRequest) { req.Pipeline.Actions[1].ImageUri = "quay.io/tool" }, true},
+		{"label", func(req *genomics.RunPipelineRequest) { req.Labels = nil }, true},
+		{"zone", func(req *genomics.RunPipelineRequest) { req.Pipeline.Resources.Zones = []string{"europe-west1-b"} }, true},
+		{"region", func(req *genomics.RunPipelineRequest) {
+			req.Pipeline.Resources.Zones = nil
+			req.Pipeline.Resources.Regions = []string{"us-central1"}
+		}, false},
+		{"no location", func(req *genomics.RunPipelineRequest) { req.Pipeline.Resources.Zones = nil }, true},
+		{"machine type", func(req *genomics.RunPipelineRequest) {
+			req.Pipeline.Resources.VirtualMachine.MachineType = "n1-highmem-96"
+		}, true},
+		{"disk size", func(req *genomics.RunPipelineRequest) { req.Pipeline.Resources.VirtualMachine.Disks[0].SizeGb = 501 }, true},
+		{"boot disk size", func(req *genomics.RunPipelineRequest) { req.Pipeline.Resources.VirtualMachine.BootDiskSizeGb = 1000 }, true},
+		{"public IP", func(req *genomics.RunPipelineRequest) { req.Pipeline.Resources.VirtualMachine.Network = nil }, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := newRequest()
+			tc.modify(req)
+			err := p.Check(req)
+			if tc.wantErr && err == nil {
+				t.Fatal("Unexpected success")
+			}
+			if !tc.wantErr && err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestRegistryOf(t *testing.T) {
+	testCases := []struct {
+		image, want string
+	}{
+		{"bash", "docker.io"},
+		{"google/cloud-sdk:alpine", "docker.io"},
+		{"gcr.io/project/image", "gcr.io"},
+		{"localhost/image", "localhost"},
+		{"registry:5000/image", "registry:5000"},
+	}
+	for _, tc := range testCases {
+		if got := registryOf(tc.image); got != tc.want {
+			t.Errorf("registryOf(%q): got %q, want %q", tc.image, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package printer provides the output formats shared by the commands.
+//
+// Commands describe their output as a list of records, each of which maps
+// field names to values, together with the fields that are shown by default.
+// The --format flag selects a table (the default), JSON, YAML or CSV, --fields
+// selects and orders the fields that are shown and --quiet prints just the
+// first field of each record (typically the operation name) for use in
+// scripts.
+package printer
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// Record is a single item of output, mapping field names to values.
+type Record map[string]interface{}
+
+// Printer holds the formatting flags of a command.
+type Printer struct {
+	format *string
+	fields *string
+	quiet  *bool
+}
+
+// New adds the formatting flags to flags.  If quiet is not nil, it is used
+// instead of registering a --quiet flag (for commands that already have one).
+func New(flags *flag.FlagSet, quiet *bool) *Printer {
+	if quiet == nil {
+		quiet = flags.Bool("quiet", false, "only print the first field of each item")
+	}
+	return &Printer{
+		format: flags.String("format", "table", "the output format (table, json, yaml or csv)"),
+		fields: flags.String("fields", "", "if set, a comma separated list of the fields to show (e.g. name,status)"),
+		quiet:  quiet,
+	}
+}
+
+// Validate checks the values of the formatting flags.
+func (p *Printer) Validate() error {
+	switch *p.format {
+	case "table", "json", "yaml", "csv":
+		return nil
+	}
+	return fmt.Errorf("unknown output format %q", *p.format)
+}
+
+// Quiet returns true if --quiet was given.
+func (p *Printer) Quiet() bool {
+	return *p.quiet
+}
+
+// Default returns true if none of the formatting flags were given, in which
+// case commands keep the plain output that scripts written for earlier
+// versions expect.
+func (p *Printer) Default() bool {
+	return *p.format == "table" && *p.fields == "" && !*p.quiet
+}
+
+// Structured returns true if the output is JSON, YAML or CSV (in which case
+// commands should not print anything else to standard output).
+func (p *Printer) Structured() bool {
+	return *p.format != "table"
+}
+
+// Arguments returns the command line arguments that pass the formatting flags
+// on to another command.
+func (p *Printer) Arguments() []string {
+	arguments := []string{"--format", *p.format}
+	if *p.fields != "" {
+		arguments = append(arguments, "--fields", *p.fields)
+	}
+	if *p.quiet {
+		arguments = append(arguments, "--quiet")
+	}
+	return arguments
+}
+
+// Print writes records to w using the selected format.  The defaults are the
+// fields shown when --fields is not given.
+func (p *Printer) Print(w io.Writer, defaults []string, records []Record) error {
+	fields := defaults
+	if *p.fields != "" {
+		fields = strings.Split(*p.fields, ",")
+	}
+
+	if *p.quiet {
+		for _, record := range records {
+			fmt.Fprintln(w, formatValue(record[fields[0]]))
+		}
+		return nil
+	}
+
+	selected := make([]Record, len(records))
+	for i, record := range records {
+		selected[i] = make(Record)
+		for _, field := range fields {
+			if value, ok := record[field]; ok {
+				selected[i][field] = value
+			}
+		}
+	}
+
+	switch *p.format {
+	case "json":
+		encoded, err := json.MarshalIndent(selected, "", "  ")
+		if err != nil {
+			return fmt.Errorf("encoding output: %v", err)
+		}
+		fmt.Fprintf(w, "%s\n", encoded)
+		return nil
+	case "yaml":
+		return printYAML(w, fields, selected)
+	case "csv":
+		return printCSV(w, fields, selected)
+	}
+	return printTable(w, fields, selected)
+}
+
+func printTable(w io.Writer, fields []string, records []Record) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	var headings []string
+	for _, field := range fields {
+		headings = append(headings, strings.ToUpper(strings.Replace(field, "_", " ", -1)))
+	}
+	fmt.Fprintln(tw, strings.Join(headings, "\t"))
+	for _, record := range records {
+		var values []string
+		for _, field := range fields {
+			value := "-"
+			if v, ok := record[field]; ok {
+				value = formatValue(v)
+			}
+			values = append(values, value)
+		}
+		fmt.Fprintln(tw, strings.Join(values, "\t"))
+	}
+	return tw.Flush()
+}
+
+// printYAML writes records as a YAML sequence of mappings.  Values are written
+// as JSON, which is also valid YAML.
+func printYAML(w io.Writer, fields []string, records []Record) error {
+	if len(records) == 0 {
+		fmt.Fprintln(w, "[]")
+		return nil
+	}
+	for _, record := range records {
+		prefix := "- "
+		for _, field := range fields {
+			value, ok := record[field]
+			if !ok {
+				continue
+			}
+			encoded, err := json.Marshal(value)
+			if err != nil {
+				return fmt.Errorf("encoding %q: %v", field, err)
+			}
+			fmt.Fprintf(w, "%s%s: %s\n", prefix, field, encoded)
+			prefix = "  "
+		}
+		if prefix == "- " {
+			fmt.Fprintln(w, "- {}")
+		}
+	}
+	return nil
+}
+
+// printCSV writes records as comma separated values with a header row.  Missing
+// and empty values are left blank.
+func printCSV(w io.Writer, fields []string, records []Record) error {
+	cw := csv.NewWriter(w)
+	cw.Write(fields)
+	for _, record := range records {
+		var values []string
+		for _, field := range fields {
+			value := formatValue(record[field])
+			if value == "-" {
+				value = ""
+			}
+			values = append(values, value)
+		}
+		cw.Write(values)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// formatValue returns the text used for a value in a table.
+func formatValue(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return "-"
+	case string:
+		if value == "" {
+			return "-"
+		}
+		return value
+	case map[string]string:
+		var pairs []string
+		for k, v := range value {
+			pairs = append(pairs, k+"="+v)
+		}
+		sort.Strings(pairs)
+		return strings.Join(pairs, ",")
+	case []string:
+		return strings.Join(value, ",")
+	}
+	return fmt.Sprintf("%v", value)
+}
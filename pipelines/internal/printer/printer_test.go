@@ -0,0 +1,69 @@
+package printer
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"testing"
+)
+
+func TestPrint(t *testing.T) {
+	records := []Record{
+		{"name": "operations/1", "status": "done", "labels": map[string]string{"b": "2", "a": "1"}},
+		{"name": "operations/2", "status": "running"},
+	}
+
+	testCases := []struct {
+		arguments []string
+		want      string
+	}{
+		{nil, "NAME          STATUS\noperations/1  done\noperations/2  running\n"},
+		{[]string{"--fields", "status,labels"}, "STATUS   LABELS\ndone     a=1,b=2\nrunning  -\n"},
+		{[]string{"--quiet"}, "operations/1\noperations/2\n"},
+		{[]string{"--format", "yaml", "--fields", "name"}, "- name: \"operations/1\"\n- name: \"operations/2\"\n"},
+		{[]string{"--format", "csv", "--fields", "name,labels,status"}, "name,labels,status\noperations/1,\"a=1,b=2\",done\noperations/2,,running\n"},
+		{[]string{"--format", "json", "--fields", "status"}, "[\n  {\n    \"status\": \"done\"\n  },\n  {\n    \"status\": \"running\"\n  }\n]\n"},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprint(tc.arguments), func(t *testing.T) {
+			flags := flag.NewFlagSet("", flag.ContinueOnError)
+			p := New(flags, nil)
+			if err := flags.Parse(tc.arguments); err != nil {
+				t.Fatalf("Failed to parse flags: %v", err)
+			}
+
+			var b bytes.Buffer
+			if err := p.Print(&b, []string{"name", "status"}, records); err != nil {
+				t.Fatalf("Failed to print: %v", err)
+			}
+			if got := b.String(); got != tc.want {
+				t.Fatalf("Unexpected output: got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDefault(t *testing.T) {
+	testCases := []struct {
+		arguments []string
+		want      bool
+	}{
+		{nil, true},
+		{[]string{"--format", "table"}, true},
+		{[]string{"--fields", "name,status"}, false},
+		{[]string{"--format", "json"}, false},
+		{[]string{"--quiet"}, false},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprint(tc.arguments), func(t *testing.T) {
+			flags := flag.NewFlagSet("", flag.ContinueOnError)
+			p := New(flags, nil)
+			if err := flags.Parse(tc.arguments); err != nil {
+				t.Fatalf("Failed to parse flags: %v", err)
+			}
+			if got := p.Default(); got != tc.want {
+				t.Fatalf("Unexpected result: got %t, want %t", got, tc.want)
+			}
+		})
+	}
+}
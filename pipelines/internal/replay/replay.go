@@ -0,0 +1,208 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package replay provides HTTP transports that record API interactions to a
+// file and replay them later, which allows the tool to be tested without
+// access to the cloud.
+//
+// Interactions are stored as a sequence of JSON objects (one per line).  Only
+// the method, path, query and body of each request are recorded: headers
+// (including credentials) are not.
+package replay
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// Interaction is a single recorded request and its response.
+type Interaction struct {
+	Method      string          `json:"method"`
+	URL         string          `json:"url"`
+	RequestBody json.RawMessage `json:"requestBody,omitempty"`
+	StatusCode  int             `json:"statusCode"`
+	Body        json.RawMessage `json:"body,omitempty"`
+}
+
+// Recorder is a transport that appends every interaction to a file.
+type Recorder struct {
+	Base http.RoundTripper
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewRecorder creates a recorder that writes to filename (replacing any
+// existing file) and uses base to make requests.
+func NewRecorder(filename string, base http.RoundTripper) (*Recorder, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, fmt.Errorf("creating recording: %v", err)
+	}
+	return &Recorder{Base: base, file: f}, nil
+}
+
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	var requestBody []byte
+	if req.Body != nil {
+		var err error
+		requestBody, err = ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, fmt.Errorf("reading request body: %v", err)
+		}
+		req.Body.Close()
+		req.Body = ioutil.NopCloser(bytes.NewReader(requestBody))
+	}
+
+	resp, err := r.Base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("reading response body: %v", err)
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	interaction := Interaction{
+		Method:      req.Method,
+		URL:         req.URL.RequestURI(),
+		RequestBody: asJSON(requestBody),
+		StatusCode:  resp.StatusCode,
+		Body:        asJSON(body),
+	}
+	encoded, err := json.Marshal(interaction)
+	if err != nil {
+		return nil, fmt.Errorf("encoding interaction: %v", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, err := r.file.Write(append(encoded, '\n')); err != nil {
+		return nil, fmt.Errorf("writing recording: %v", err)
+	}
+	return resp, nil
+}
+
+// Close closes the recording file.
+func (r *Recorder) Close() error {
+	return r.file.Close()
+}
+
+// Replayer is a transport that answers requests from a recording.  Requests
+// must be made in the same order as they were recorded and must match the
+// recorded method, URL and body.
+type Replayer struct {
+	mu           sync.Mutex
+	interactions []*Interaction
+}
+
+// NewReplayer loads the recording in filename.
+func NewReplayer(filename string) (*Replayer, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("opening recording: %v", err)
+	}
+	defer f.Close()
+
+	var r Replayer
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64*1024*1024)
+	for scanner.Scan() {
+		var interaction Interaction
+		if err := json.Unmarshal(scanner.Bytes(), &interaction); err != nil {
+			return nil, fmt.Errorf("parsing recording: %v", err)
+		}
+		r.interactions = append(r.interactions, &interaction)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading recording: %v", err)
+	}
+	return &r, nil
+}
+
+func (r *Replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	var requestBody []byte
+	if req.Body != nil {
+		var err error
+		requestBody, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("reading request body: %v", err)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.interactions) == 0 {
+		return nil, fmt.Errorf("unexpected request %s %s: the recording is exhausted", req.Method, req.URL.RequestURI())
+	}
+	next := r.interactions[0]
+	if req.Method != next.Method || req.URL.RequestURI() != next.URL {
+		return nil, fmt.Errorf("unexpected request %s %s: expecting %s %s", req.Method, req.URL.RequestURI(), next.Method, next.URL)
+	}
+	if !equalJSON(asJSON(requestBody), next.RequestBody) {
+		return nil, fmt.Errorf("request body for %s %s differs from the recording:\ngot:  %s\nwant: %s", req.Method, next.URL, bytes.TrimSpace(requestBody), next.RequestBody)
+	}
+	r.interactions = r.interactions[1:]
+
+	return &http.Response{
+		Status:     fmt.Sprintf("%d %s", next.StatusCode, http.StatusText(next.StatusCode)),
+		StatusCode: next.StatusCode,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(bytes.NewReader(next.Body)),
+		Request:    req,
+	}, nil
+}
+
+// Remaining returns the number of recorded interactions that have not been
+// replayed.
+func (r *Replayer) Remaining() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.interactions)
+}
+
+// asJSON returns data as raw JSON, quoting it if it is not valid JSON.
+func asJSON(data []byte) json.RawMessage {
+	if len(data) == 0 {
+		return nil
+	}
+	if json.Valid(data) {
+		return json.RawMessage(data)
+	}
+	quoted, _ := json.Marshal(string(data))
+	return json.RawMessage(quoted)
+}
+
+func equalJSON(a, b json.RawMessage) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return len(a) == len(b)
+	}
+	var x, y interface{}
+	if json.Unmarshal(a, &x) != nil || json.Unmarshal(b, &y) != nil {
+		return bytes.Equal(a, b)
+	}
+	encodedX, _ := json.Marshal(x)
+	encodedY, _ := json.Marshal(y)
+	return bytes.Equal(encodedX, encodedY)
+}
@@ -0,0 +1,56 @@
+package replay
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecordReplay(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write([]byte(`{"echo":` + string(body) + `}`))
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "recording")
+
+	recorder, err := NewRecorder(filename, http.DefaultTransport)
+	if err != nil {
+		t.Fatalf("Failed to create recorder: %v", err)
+	}
+	client := &http.Client{Transport: recorder}
+	if _, err := client.Post(server.URL+"/run?x=1", "application/json", strings.NewReader(`{"a": 1}`)); err != nil {
+		t.Fatalf("Failed to make request: %v", err)
+	}
+	recorder.Close()
+
+	replayer, err := NewReplayer(filename)
+	if err != nil {
+		t.Fatalf("Failed to load recording: %v", err)
+	}
+	client = &http.Client{Transport: replayer}
+	if _, err := client.Post("https://example.com/run?x=1", "application/json", strings.NewReader(`{"a":2}`)); err == nil {
+		t.Fatal("Expected an error for a mismatched request body")
+	}
+	resp, err := client.Post("https://example.com/run?x=1", "application/json", strings.NewReader(`{"a":1}`))
+	if err != nil {
+		t.Fatalf("Failed to replay request: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if got, want := string(body), `{"echo":{"a":1}}`; got != want {
+		t.Fatalf("Unexpected response: got %q, want %q", got, want)
+	}
+	if got := replayer.Remaining(); got != 0 {
+		t.Fatalf("Unexpected remaining interactions: got %d, want 0", got)
+	}
+}
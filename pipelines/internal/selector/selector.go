@@ -0,0 +1,94 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package selector provides the syntax used by every command to identify the
+// operations it acts on.
+//
+// An operation can be identified by its full name, by its ID (in which case
+// the project is taken from --project) or by a label selector such as
+// 'name=nightly' (or 'name=nightly,stage=align'), which identifies the most
+// recently created operation with all of the labels.  Commands that register
+// the selector flags also accept --latest, which targets the most recently
+// created operation in the project without naming it.
+package selector
+
+import (
+	"context"
+	"errors"
+	"flag"
+
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/common"
+	genomics "google.golang.org/api/genomics/v2alpha1"
+)
+
+// Selector holds the targeting flags of a command.
+type Selector struct {
+	latest *bool
+}
+
+// New adds the targeting flags to flags.
+func New(flags *flag.FlagSet) *Selector {
+	return &Selector{
+		latest: flags.Bool("latest", false, "target the most recently created operation instead of naming one"),
+	}
+}
+
+// Take resolves the operation targeted by a command and returns its name
+// together with the remaining arguments.  With --latest, the most recently
+// created operation is used and no arguments are consumed; otherwise the first
+// argument identifies the operation.
+func (s *Selector) Take(ctx context.Context, service *genomics.Service, project string, arguments []string) (string, []string, error) {
+	if *s.latest {
+		name, err := common.LatestOperation(ctx, service, project, "")
+		return name, arguments, err
+	}
+	if len(arguments) < 1 {
+		return "", nil, errors.New("missing operation name (or --latest)")
+	}
+	name, err := Resolve(ctx, service, project, arguments[0])
+	return name, arguments[1:], err
+}
+
+// All resolves every argument to an operation name (or, with --latest, returns
+// just the most recently created operation).
+func (s *Selector) All(ctx context.Context, service *genomics.Service, project string, arguments []string) ([]string, error) {
+	if *s.latest {
+		if len(arguments) > 0 {
+			return nil, errors.New("operation names cannot be combined with --latest")
+		}
+		name, err := common.LatestOperation(ctx, service, project, "")
+		if err != nil {
+			return nil, err
+		}
+		return []string{name}, nil
+	}
+	if len(arguments) < 1 {
+		return nil, errors.New("missing operation name (or --latest)")
+	}
+	var names []string
+	for _, target := range arguments {
+		name, err := Resolve(ctx, service, project, target)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// Resolve returns the full name of the operation identified by target, which
+// is an operation name, ID or label selector (see common.ResolveOperation).
+func Resolve(ctx context.Context, service *genomics.Service, project, target string) (string, error) {
+	return common.ResolveOperation(ctx, service, project, target)
+}
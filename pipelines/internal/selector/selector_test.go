@@ -0,0 +1,67 @@
+package selector
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/fake"
+	genomics "google.golang.org/api/genomics/v2alpha1"
+)
+
+func TestResolve(t *testing.T) {
+	server := fake.NewServer()
+	defer server.Close()
+	service, err := genomics.New(http.DefaultClient)
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	service.BasePath = server.URL
+
+	for _, labels := range []map[string]string{
+		{"name": "nightly", "stage": "align"},
+		{"name": "nightly", "stage": "call"},
+		{"name": "weekly"},
+	} {
+		req := &genomics.RunPipelineRequest{
+			Pipeline: &genomics.Pipeline{
+				Actions:   []*genomics.Action{{ImageUri: "bash"}},
+				Resources: &genomics.Resources{ProjectId: "test"},
+			},
+			Labels: labels,
+		}
+		if _, err := service.Pipelines.Run(req).Do(); err != nil {
+			t.Fatalf("Failed to start pipeline: %v", err)
+		}
+	}
+
+	testCases := []struct {
+		target  string
+		want    string
+		wantErr bool
+	}{
+		{"7", "projects/test/operations/7", false},
+		{"projects/other/operations/1", "projects/other/operations/1", false},
+		{"name=nightly", "projects/test/operations/2", false},
+		{"name=nightly,stage=align", "projects/test/operations/1", false},
+		{"name=weekly", "projects/test/operations/3", false},
+		{"name=monthly", "", true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.target, func(t *testing.T) {
+			got, err := Resolve(context.Background(), service, "test", tc.target)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("Unexpected success: got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to resolve: %v", err)
+			}
+			if got != tc.want {
+				t.Fatalf("Unexpected result: got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
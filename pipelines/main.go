@@ -25,11 +25,25 @@ import (
 	"strings"
 	"time"
 
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/commands/bundle"
 	"github.com/googlegenomics/pipelines-tools/pipelines/internal/commands/cancel"
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/commands/cleanup"
 	"github.com/googlegenomics/pipelines-tools/pipelines/internal/commands/export"
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/commands/gc"
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/commands/graph"
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/commands/listen"
 	"github.com/googlegenomics/pipelines-tools/pipelines/internal/commands/query"
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/commands/results"
 	"github.com/googlegenomics/pipelines-tools/pipelines/internal/commands/run"
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/commands/schedule"
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/commands/ssh"
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/commands/top"
 	"github.com/googlegenomics/pipelines-tools/pipelines/internal/commands/watch"
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/common"
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/fake"
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/lifesciences"
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/plugin"
+	"github.com/googlegenomics/pipelines-tools/pipelines/internal/replay"
 
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
@@ -38,14 +52,34 @@ import (
 
 var (
 	project  = flag.String("project", defaultProject(), "the cloud project name")
-	basePath = flag.String("api", "", "the API base to use")
+	basePath = flag.String("api", "", "the API base to use (or 'lifesciences' to use the Cloud Life Sciences API)")
+	location = flag.String("location", "us-central1", "the Cloud Life Sciences location to run pipelines in")
+	mock     = flag.Bool("mock", false, "use an in-process fake of the API (see the fake package for details)")
+
+	recordFile = flag.String("record", "", "if set, the file to record API interactions to")
+	replayFile = flag.String("replay", "", "if set, a file of recorded API interactions to replay instead of calling the API")
 
 	commands = map[string]func(context.Context, *genomics.Service, string, []string) error{
-		"run":    run.Invoke,
-		"cancel": cancel.Invoke,
-		"query":  query.Invoke,
-		"watch":  watch.Invoke,
-		"export": export.Invoke,
+		"run":              run.Invoke,
+		"cancel":           cancel.Invoke,
+		"query":            query.Invoke,
+		"watch":            watch.Invoke,
+		"export":           export.Invoke,
+		"ssh":              ssh.Invoke,
+		"scp":              ssh.Copy,
+		"exec":             ssh.Exec,
+		"port-forward":     ssh.PortForward,
+		"resume-retries":   run.Resume,
+		"retry-controller": run.Controller,
+		"cleanup":          cleanup.Invoke,
+		"gc":               gc.Invoke,
+		"bundle":           bundle.Invoke,
+		"schedule":         schedule.Invoke,
+		"listen":           listen.Invoke,
+		"results":          results.Invoke,
+		"graph":            graph.Invoke,
+		"top":              top.Invoke,
+		"runs":             run.Runs,
 	}
 )
 
@@ -57,6 +91,7 @@ func main() {
 		for name := range commands {
 			names = append(names, name)
 		}
+		names = append(names, plugin.List()...)
 		exitf("Missing command name: expecting one of %s", names)
 	}
 
@@ -67,17 +102,81 @@ func main() {
 	command := flag.Arg(0)
 	invoke := commands[command]
 	if invoke == nil {
-		exitf("Unknown command %q", command)
+		path := plugin.Find(command)
+		if path == "" {
+			exitf("Unknown command %q", command)
+		}
+		if err := plugin.Run(path, *project, flag.Args()[1:]); err != nil {
+			// The plugin reports its own errors, so only failures to
+			// start it are shown.
+			if _, ok := err.(common.ExitError); !ok {
+				fmt.Fprintf(os.Stderr, "%q: %v\n", command, err)
+			}
+			os.Exit(common.ExitCode(err))
+		}
+		return
+	}
+
+	// The Cloud Life Sciences API is used through a transport that
+	// translates the requests made by the Genomics client.
+	useLifeSciences := lifesciences.IsLifeSciences(*basePath)
+	if *basePath == "lifesciences" {
+		*basePath = lifesciences.BasePath
 	}
 
 	ctx := context.Background()
-	service, err := newService(ctx, *basePath)
+	var (
+		client *http.Client
+		err    error
+	)
+	switch {
+	case *replayFile != "":
+		replayer, err := replay.NewReplayer(*replayFile)
+		if err != nil {
+			exitf("Failed to load recording: %v", err)
+		}
+		client = &http.Client{Transport: replayer}
+	case *mock:
+		server := fake.NewServer()
+		defer server.Close()
+
+		client = &http.Client{}
+		*basePath = server.URL
+	default:
+		client, err = newClient(ctx, *basePath, useLifeSciences)
+		if err != nil {
+			exitf("Failed to create client: %v", err)
+		}
+	}
+
+	if *recordFile != "" {
+		transport := client.Transport
+		if transport == nil {
+			transport = http.DefaultTransport
+		}
+		recorder, err := replay.NewRecorder(*recordFile, transport)
+		if err != nil {
+			exitf("Failed to start recording: %v", err)
+		}
+		defer recorder.Close()
+		client = &http.Client{Transport: recorder}
+	}
+
+	if useLifeSciences && !*mock {
+		client = &http.Client{Transport: &lifesciences.Transport{Base: client.Transport, Location: *location}}
+	}
+
+	service, err := genomics.New(client)
 	if err != nil {
 		exitf("Failed to create service: %v", err)
 	}
+	if *basePath != "" {
+		service.BasePath = *basePath
+	}
 
 	if err := invoke(ctx, service, *project, flag.Args()[1:]); err != nil {
-		exitf("%q: %v", command, err)
+		fmt.Fprintf(os.Stderr, "%q: %v\n", command, err)
+		os.Exit(common.ExitCode(err))
 	}
 }
 
@@ -87,7 +186,7 @@ func exitf(format string, arguments ...interface{}) {
 	os.Exit(1)
 }
 
-func newService(ctx context.Context, basePath string) (*genomics.Service, error) {
+func newClient(ctx context.Context, basePath string, useLifeSciences bool) (*http.Client, error) {
 	var transport robustTransport
 
 	// When connecting to a local server (for Google developers only) disable SSL
@@ -98,19 +197,15 @@ func newService(ctx context.Context, basePath string) (*genomics.Service, error)
 
 	ctx = context.WithValue(ctx, oauth2.HTTPClient, &http.Client{Transport: &transport})
 
-	client, err := google.DefaultClient(ctx, genomics.GenomicsScope)
-	if err != nil {
-		return nil, fmt.Errorf("creating authenticated client: %v", err)
+	scope := genomics.GenomicsScope
+	if useLifeSciences {
+		scope = lifesciences.Scope
 	}
-
-	service, err := genomics.New(client)
+	client, err := google.DefaultClient(ctx, scope)
 	if err != nil {
-		return nil, fmt.Errorf("creating service object: %v", err)
-	}
-	if basePath != "" {
-		service.BasePath = basePath
+		return nil, fmt.Errorf("creating authenticated client: %v", err)
 	}
-	return service, nil
+	return client, nil
 }
 
 func defaultProject() string {
@@ -154,7 +154,11 @@ func serviceChannel(newChannel ssh.NewChannel) error {
 				}
 
 				go func() {
-					done <- exec.Command("bash", "-c", command).Run()
+					cmd := exec.Command("bash", "-c", command)
+					cmd.Stdin = channel
+					cmd.Stdout = channel
+					cmd.Stderr = channel.Stderr()
+					done <- cmd.Run()
 				}()
 			case "pty-req":
 				r := bytes.NewReader(req.Payload)